@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+)
+
+// parseTargetDomains - comma separated domains of --target-domains, lowercase, sorted and without duplicates
+func parseTargetDomains(input string) ([]string, error) {
+	var domains []string
+	for _, domain := range strings.Split(input, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			continue
+		}
+		if strings.ContainsAny(domain, "/:?# ") || !strings.Contains(domain, ".") {
+			return nil, fmt.Errorf("invalid domain %q", domain)
+		}
+		domains = append(domains, domain)
+	}
+	slices.Sort(domains)
+
+	return slices.Compact(domains), nil
+}
+
+// parseTargetDomainsFile - read domains from file, one or more comma separated domains per line, text after # is a comment
+func parseTargetDomainsFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var results []string
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+
+		domains, err := parseTargetDomains(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		results = append(results, domains...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(results)
+
+	return slices.Compact(results), nil
+}
+
+// setIndexURL - Common Crawl URL index server queried for WAT files of target domains
+func setIndexURL() string {
+	indexURL := os.Getenv("GLOBALLINKS_CC_INDEX_URL")
+	if indexURL == "" {
+		return commoncrawl.DefaultIndexURL
+	}
+
+	return indexURL
+}
+
+// filterTargetWatFiles - keep only WAT files with pages of target domains found in URL index of archive, segments without such files are removed
+func filterTargetWatFiles(segmentList []commoncrawl.WatSegment, archiveName string, domains []string) ([]commoncrawl.WatSegment, error) {
+	watPaths, err := commoncrawl.IndexWatFiles(setIndexURL(), archiveName, domains)
+	if err != nil {
+		return nil, fmt.Errorf("could not query URL index: %w", err)
+	}
+
+	filtered := commoncrawl.FilterWatFiles(segmentList, watPaths)
+	files := 0
+	for _, segment := range filtered {
+		files += len(segment.WatFiles)
+	}
+	log.Printf("Pages of %d target domains found in %d WAT files of %d segments\n", len(domains), files, len(filtered))
+
+	return filtered, nil
+}
+
+// targetDataDirectory - data directory of import of target domains, every set of domains has its own directory in target directory.
+// Segments compacted from WAT files of target domains only are kept apart from full import, otherwise it would count them as imported
+func targetDataDirectory(dataDir string, domains []string) string {
+	hash := sha256.Sum256([]byte(strings.Join(domains, ",")))
+
+	return filepath.Join(dataDir, "target", hex.EncodeToString(hash[:6]))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+)
+
+func TestParseTargetDomains(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{"single domain", "example.com", []string{"example.com"}, false},
+		{"sorted without duplicates", " Example.com,blog.net,,example.com ", []string{"blog.net", "example.com"}, false},
+		{"empty", "", nil, false},
+		{"url", "https://example.com/", nil, true},
+		{"no dot", "localhost", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTargetDomains(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTargetDomains() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseTargetDomains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTargetDomainsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "domains.txt")
+	if err := os.WriteFile(path, []byte("# clients\nexample.com\n\nblog.net, news.org # partners\nexample.com\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write domains file: %v", err)
+	}
+
+	got, err := parseTargetDomainsFile(path)
+	if err != nil {
+		t.Fatalf("parseTargetDomainsFile() error = %v", err)
+	}
+	if want := []string{"blog.net", "example.com", "news.org"}; !slices.Equal(got, want) {
+		t.Errorf("parseTargetDomainsFile() = %v, want %v", got, want)
+	}
+
+	if err = os.WriteFile(path, []byte("example.com\nhttp://blog.net\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write domains file: %v", err)
+	}
+	if _, err = parseTargetDomainsFile(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("parseTargetDomainsFile() error = %v, want error of line 2", err)
+	}
+	if _, err = parseTargetDomainsFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("parseTargetDomainsFile() of missing file returned no error")
+	}
+}
+
+// TestImportSegmentTargetDomains - only WAT files with pages of target domains listed by URL index are downloaded and imported
+func TestImportSegmentTargetDomains(t *testing.T) {
+	downloads := serveTestWatFile(t)
+	defaultSort := sortFiles
+	t.Cleanup(func() { sortFiles = defaultSort })
+	sortFiles = func(sortedFile string, dirPath string) error {
+		sortLinkFiles(t, dirPath, sortedFile)
+		return nil
+	}
+
+	var segmentList []commoncrawl.WatSegment
+	for i := 0; i < 2; i++ {
+		segment := "1610703495901." + strconv.Itoa(i)
+		var watFiles []commoncrawl.WatFile
+		for number := 3 * i; number < 3*i+3; number++ {
+			watFiles = append(watFiles, commoncrawl.WatFile{Number: fmt.Sprintf("%05d", number), Path: "crawl-data/CC-MAIN-2021-04/segments/" + segment + "/wat/" + watFileName(number)})
+		}
+		segmentList = append(segmentList, commoncrawl.WatSegment{Archive: "CC-MAIN-2021-04", Segment: segment, SegmentID: i, WatFiles: watFiles})
+	}
+
+	// index lists two WARC files of the first segment and robots.txt capture of the second one
+	index := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("showNumPages") == "true" {
+			fmt.Fprint(w, `{"pages": 1}`)
+			return
+		}
+		for _, filename := range []string{
+			"crawl-data/CC-MAIN-2021-04/segments/1610703495901.0/warc/CC-MAIN-20210115134101-20210115164101-00000.warc.gz",
+			"crawl-data/CC-MAIN-2021-04/segments/1610703495901.0/warc/CC-MAIN-20210115134101-20210115164101-00002.warc.gz",
+			"crawl-data/CC-MAIN-2021-04/segments/1610703495901.1/robotstxt/CC-MAIN-20210115134101-20210115164101-00004.warc.gz",
+		} {
+			fmt.Fprintf(w, "{\"filename\": \"%s\"}\n", filename)
+		}
+	}))
+	t.Cleanup(index.Close)
+	t.Setenv("GLOBALLINKS_CC_INDEX_URL", index.URL)
+
+	segmentList, err := filterTargetWatFiles(segmentList, "CC-MAIN-2021-04", []string{"blog.net"})
+	if err != nil {
+		t.Fatalf("filterTargetWatFiles() error = %v", err)
+	}
+	if len(segmentList) != 1 || len(segmentList[0].WatFiles) != 2 {
+		t.Fatalf("filterTargetWatFiles() = %+v, want 2 WAT files of the first segment", segmentList)
+	}
+
+	defaultDir := t.TempDir()
+	dataDir, err := commoncrawl.CreateDataDir(targetDataDirectory(defaultDir, []string{"blog.net"}))
+	if err != nil {
+		t.Fatalf("CreateDataDir() error = %v", err)
+	}
+	maxWatFiles := 10
+	importSegment(segmentList[0], dataDir, &segmentList, 1, &maxWatFiles, nil, nil, nil)
+
+	if len(downloads) != 2 || downloads[watFileName(0)] != 1 || downloads[watFileName(2)] != 1 {
+		t.Errorf("downloads = %v, want only WAT files 00000 and 00002", downloads)
+	}
+	if !fileutils.FileExists(dataDir.CompactedLinksFile(segmentList[0])) {
+		t.Error("segment with all WAT files of target domains imported is not compacted")
+	}
+
+	// full import of the same data directory does not see segment compacted from WAT files of target domains or its WAT files
+	fullDir, err := commoncrawl.CreateDataDir(defaultDir)
+	if err != nil {
+		t.Fatalf("CreateDataDir() error = %v", err)
+	}
+	fullList := []commoncrawl.WatSegment{{Archive: "CC-MAIN-2021-04", Segment: segmentList[0].Segment, SegmentID: segmentList[0].SegmentID, WatFiles: segmentList[0].WatFiles}}
+	if fileutils.FileExists(fullDir.CompactedLinksFile(fullList[0])) || fileutils.FileExists(fullDir.ImportedWatFilesFile()) {
+		t.Error("segment imported for target domains is saved in data directory of full import")
+	}
+}
+
+func TestTargetDataDirectory(t *testing.T) {
+	got := targetDataDirectory("data", []string{"blog.net", "example.com"})
+	if filepath.Dir(got) != filepath.Join("data", "target") {
+		t.Errorf("targetDataDirectory() = %q, want directory in data/target", got)
+	}
+	if again := targetDataDirectory("data", []string{"blog.net", "example.com"}); again != got {
+		t.Errorf("targetDataDirectory() of the same domains = %q, want %q", again, got)
+	}
+	if other := targetDataDirectory("data", []string{"blog.net"}); other == got {
+		t.Errorf("targetDataDirectory() of other domains = %q, want other directory", other)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+)
+
+const (
+	defaultCompactWorkers  = 4
+	maxCompactWorkers      = 64
+	defaultCompactMemoryMB = 4096
+	minSortBufferMB        = 64 // smaller sort buffer makes sort write too many temporary files
+)
+
+// sortBufferMB - memory of one sort or merge of sorted files in MB, compact-archive splits its memory budget between workers
+var sortBufferMB = 1024
+
+// compactJob - sorted file or segment directory with link files parsed from WAT files, compacted by compact-archive
+type compactJob struct {
+	name string
+	run  func() error
+}
+
+// runCompactArchive - compact all sorted files and segment directories of archive data in parallel. Returns exit code
+func runCompactArchive(args []string) int {
+	flags := flag.NewFlagSet("compact-archive", flag.ContinueOnError)
+	workers := flags.Int("workers", defaultCompactWorkers, "number of segments compacted at once")
+	memoryMB := flags.Int("memory-mb", defaultCompactMemoryMB, "memory of all sort processes in MB, split between workers")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return 1
+	}
+	if *workers < 1 || *workers > maxCompactWorkers {
+		fmt.Printf("Number of workers must be between 1 and %d\n", maxCompactWorkers)
+		return 1
+	}
+	if *memoryMB/(*workers) < minSortBufferMB {
+		fmt.Printf("Memory budget %dMB is too small for %d workers, every worker needs at least %dMB\n", *memoryMB, *workers, minSortBufferMB)
+		return 1
+	}
+
+	dataDir := commoncrawl.NewDataDir(setDataDirectory())
+	dataDir.Naming = setFileNaming()
+	jobs, err := findCompactJobs(args[0], dataDir)
+	if err != nil {
+		fmt.Println("Could not find files to compact: " + err.Error())
+		return 1
+	}
+	if len(jobs) == 0 {
+		fmt.Println("No sorted files or segment directories to compact in " + args[0])
+		return 0
+	}
+
+	sortBufferMB = *memoryMB / *workers
+	fmt.Printf("Compacting %d segments with %d workers, %dMB of sort memory each\n", len(jobs), *workers, sortBufferMB)
+
+	err = compactArchive(jobs, *workers)
+	if err != nil {
+		fmt.Println("Compacting failed: " + err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// findCompactJobs - sorted files (sort_*.txt.gz) compacted to compact_*.txt.gz next to them and segment directories with link files
+// parsed from WAT files or sorted file left by interrupted compaction. Segment directory in tmp directory of dataDir is compacted
+// like at the end of import to compacted file of segment in links directory, other directories like recompact to compact.txt.gz in them
+func findCompactJobs(dir string, dataDir commoncrawl.DataDir) ([]compactJob, error) {
+	var jobs []compactJob
+
+	sortedFiles, err := filepath.Glob(filepath.Join(dir, "sort_*"+extensionTxtGz))
+	if err != nil {
+		return nil, err
+	}
+	for _, sortedFile := range sortedFiles {
+		sortedFile := sortedFile
+		compactedFile := filepath.Join(dir, "compact_"+strings.TrimPrefix(filepath.Base(sortedFile), "sort_"))
+		jobs = append(jobs, compactJob{name: sortedFile, run: func() error {
+			return compactSortedLinks(sortedFile, compactedFile)
+		}})
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		segmentDir := filepath.Join(dir, entry.Name())
+		sortedFile := filepath.Join(segmentDir, "sort_compact"+extensionTxtGz)
+		compactedFile := filepath.Join(segmentDir, "compact"+extensionTxtGz)
+		segment, inTmpDir := tmpDirSegment(dataDir, segmentDir)
+		if inTmpDir {
+			sortedFile = dataDir.SortedLinksFile(segment)
+			compactedFile = dataDir.CompactedLinksFile(segment)
+		}
+		inputFiles, err := watPreProcessedFiles(segmentDir + linkDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(inputFiles) == 0 && !fileutils.FileExists(sortedFile) {
+			continue
+		}
+		jobs = append(jobs, compactJob{name: segmentDir, run: func() error {
+			// compacted file of earlier run is never replaced, the same as at the end of import
+			if inTmpDir && fileutils.FileExists(compactedFile) {
+				return fmt.Errorf("compacted file %s exists, link files in %s are not compacted into it", compactedFile, segmentDir+linkDir)
+			}
+			err := fileutils.CreateDataDirectory(filepath.Dir(compactedFile))
+			if err != nil {
+				return err
+			}
+			return recompactSegmentDir(segmentDir, sortedFile, compactedFile)
+		}})
+	}
+
+	return jobs, nil
+}
+
+// tmpDirSegment - segment of directory named by segment tmp dir template in tmp directory of dataDir, false for other directories
+func tmpDirSegment(dataDir commoncrawl.DataDir, segmentDir string) (commoncrawl.WatSegment, bool) {
+	tmpDir, err := filepath.Abs(dataDir.TmpDir)
+	if err != nil {
+		return commoncrawl.WatSegment{}, false
+	}
+	segmentDir, err = filepath.Abs(segmentDir)
+	if err != nil {
+		return commoncrawl.WatSegment{}, false
+	}
+	relDir, err := filepath.Rel(tmpDir, segmentDir)
+	if err != nil || relDir == "." || strings.HasPrefix(relDir, "..") {
+		return commoncrawl.WatSegment{}, false
+	}
+
+	// segment 1610703495901.0 has segment id 0, archive is parent directory when template has one
+	name := filepath.Base(relDir)
+	_, id, found := strings.Cut(name, ".")
+	segmentID, err := strconv.Atoi(id)
+	if !found || err != nil {
+		return commoncrawl.WatSegment{}, false
+	}
+	segment := commoncrawl.WatSegment{Segment: name, SegmentID: segmentID}
+	if archive := filepath.Dir(relDir); archive != "." {
+		segment.Archive = archive
+	}
+	if filepath.FromSlash(dataDir.Naming.Name(dataDir.Naming.SegmentTmpDir, segment)) != relDir {
+		return commoncrawl.WatSegment{}, false
+	}
+
+	return segment, true
+}
+
+// compactArchive - run jobs with up to workers jobs at once, failed job does not stop the others. Errors of all failed jobs are returned
+func compactArchive(jobs []compactJob, workers int) error {
+	guard := make(chan struct{}, workers) // limits the number of jobs running at once
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+
+	for _, job := range jobs {
+		guard <- struct{}{}
+		wg.Add(1)
+		go func(job compactJob) {
+			defer func() {
+				<-guard
+				wg.Done()
+			}()
+
+			err := job.run()
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				fmt.Printf("Compacting %s failed: %v\n", job.name, err)
+				errs = append(errs, fmt.Errorf("%s: %w", job.name, err))
+				return
+			}
+			fmt.Printf("Compacted %s\n", job.name)
+		}(job)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
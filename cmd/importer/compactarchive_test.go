@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+)
+
+func TestRunCompactArchive(t *testing.T) {
+	defaultSort := sortFiles
+	defer func() { sortFiles = defaultSort }()
+	sortFiles = func(sortedFile string, dirPath string) error {
+		sortLinkFiles(t, dirPath, sortedFile)
+		return nil
+	}
+	defaultBuffer := sortBufferMB
+	defer func() { sortBufferMB = defaultBuffer }()
+
+	// three sorted segments and one segment directory with link files parsed from WAT files
+	archiveDir := t.TempDir()
+	segmentLines := make(map[int][]string)
+	for segment := 0; segment < 3; segment++ {
+		lines := make([]string, 0, 3)
+		for page := 0; page < 3; page++ {
+			lines = append(lines, fmt.Sprintf("example%d.com||/a||2|source.com|/page%d||2|Anchor|0|0|2023-02-0%d|1.2.3.4|", segment, page, page+1))
+		}
+		segmentLines[segment] = lines
+		writeTestGzFile(t, filepath.Join(archiveDir, fmt.Sprintf("sort_%d%s", segment, extensionTxtGz)), lines)
+	}
+	linkFilesDir, _ := writeMergeLinkFiles(t)
+	segmentDir := filepath.Join(archiveDir, "1610703495901.0")
+	if err := os.Rename(filepath.Dir(linkFilesDir), segmentDir); err != nil {
+		t.Fatalf("Failed to move segment directory: %v", err)
+	}
+	// directory without link files is not a segment
+	if err := os.Mkdir(filepath.Join(archiveDir, "empty"), 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	if code := runCompactArchive([]string{archiveDir, "--workers", "2", "--memory-mb", "512"}); code != 0 {
+		t.Fatalf("runCompactArchive() = %d, want 0", code)
+	}
+	if sortBufferMB != 256 {
+		t.Errorf("sortBufferMB = %d, want memory budget split between 2 workers", sortBufferMB)
+	}
+
+	for segment := range segmentLines {
+		rows := readLinkRows(t, filepath.Join(archiveDir, fmt.Sprintf("compact_%d%s", segment, extensionTxtGz)))
+		if len(rows) != 1 || rows[0].LinkDomain != fmt.Sprintf("example%d.com", segment) || rows[0].Qty != 3 {
+			t.Errorf("compacted segment %d = %+v, want one link found on 3 pages", segment, rows)
+		}
+		if fileutils.FileExists(filepath.Join(archiveDir, fmt.Sprintf("sort_%d%s", segment, extensionTxtGz))) {
+			t.Errorf("sorted file of segment %d is not deleted", segment)
+		}
+	}
+	if lines, err := fileutils.ReadGZFileByLine(filepath.Join(segmentDir, "compact"+extensionTxtGz)); err != nil || len(lines) == 0 {
+		t.Errorf("compacted segment directory = %d lines, %v, want links", len(lines), err)
+	}
+	if fileutils.FileExists(filepath.Join(archiveDir, "empty", "compact"+extensionTxtGz)) {
+		t.Error("directory without link files is compacted")
+	}
+}
+
+func TestRunCompactArchiveTmpDir(t *testing.T) {
+	defaultSort := sortFiles
+	defer func() { sortFiles = defaultSort }()
+	sortFiles = func(sortedFile string, dirPath string) error {
+		sortLinkFiles(t, dirPath, sortedFile)
+		return nil
+	}
+	defaultBuffer := sortBufferMB
+	defer func() { sortBufferMB = defaultBuffer }()
+
+	tests := []struct {
+		name          string
+		archiveNaming string
+		segmentsDir   string
+		compactedFile string
+	}{
+		{"default naming", "", "tmp", "links/compact_3.txt.gz"},
+		{"archive in file names", "true", "tmp/CC-MAIN-2021-04", "links/compact_CC-MAIN-2021-04_3.txt.gz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataPath := t.TempDir()
+			t.Setenv("GLOBALLINKS_DATAPATH", dataPath)
+			t.Setenv("GLOBALLINKS_ARCHIVEINFILENAME", tt.archiveNaming)
+
+			// segment directory left by interrupted import is compacted to compacted file of segment like at the end of import
+			linkFilesDir, _ := writeMergeLinkFiles(t)
+			segmentsDir := filepath.Join(dataPath, tt.segmentsDir)
+			if err := os.MkdirAll(segmentsDir, 0o755); err != nil {
+				t.Fatalf("Failed to create tmp directory: %v", err)
+			}
+			segmentDir := filepath.Join(segmentsDir, "1610703495901.3")
+			if err := os.Rename(filepath.Dir(linkFilesDir), segmentDir); err != nil {
+				t.Fatalf("Failed to move segment directory: %v", err)
+			}
+
+			if code := runCompactArchive([]string{segmentsDir}); code != 0 {
+				t.Fatalf("runCompactArchive() = %d, want 0", code)
+			}
+
+			if lines, err := fileutils.ReadGZFileByLine(filepath.Join(dataPath, tt.compactedFile)); err != nil || len(lines) == 0 {
+				t.Errorf("compacted file %s = %d lines, %v, want links", tt.compactedFile, len(lines), err)
+			}
+			if fileutils.FileExists(filepath.Join(segmentDir, "compact"+extensionTxtGz)) {
+				t.Error("segment of tmp directory is compacted into segment directory")
+			}
+			if files, _ := filepath.Glob(filepath.Join(dataPath, "links", "sort_*")); len(files) != 0 {
+				t.Errorf("sorted files %v are not deleted", files)
+			}
+
+			// compacted file of segment is not replaced
+			linkFilesDir, _ = writeMergeLinkFiles(t)
+			if err := os.Rename(linkFilesDir, segmentDir+linkDir); err != nil {
+				t.Fatalf("Failed to move link files: %v", err)
+			}
+			if code := runCompactArchive([]string{segmentsDir}); code != 1 {
+				t.Errorf("runCompactArchive() with compacted segment = %d, want 1", code)
+			}
+		})
+	}
+}
+
+func TestTmpDirSegment(t *testing.T) {
+	dataDir := commoncrawl.NewDataDir("data")
+	archiveDataDir := commoncrawl.NewDataDir("data")
+	archiveDataDir.Naming = commoncrawl.ArchiveFileNaming
+
+	tests := []struct {
+		name       string
+		dataDir    commoncrawl.DataDir
+		segmentDir string
+		want       commoncrawl.WatSegment
+		wantFound  bool
+	}{
+		{"segment", dataDir, "data/tmp/1610703495901.3", commoncrawl.WatSegment{Segment: "1610703495901.3", SegmentID: 3}, true},
+		{"segment of archive", archiveDataDir, "data/tmp/CC-MAIN-2021-04/1610703495901.3", commoncrawl.WatSegment{Archive: "CC-MAIN-2021-04", Segment: "1610703495901.3", SegmentID: 3}, true},
+		{"archive not in template", dataDir, "data/tmp/CC-MAIN-2021-04/1610703495901.3", commoncrawl.WatSegment{}, false},
+		{"not a segment", dataDir, "data/tmp/empty", commoncrawl.WatSegment{}, false},
+		{"outside of tmp directory", dataDir, "archive/1610703495901.3", commoncrawl.WatSegment{}, false},
+		{"tmp directory", dataDir, "data/tmp", commoncrawl.WatSegment{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := tmpDirSegment(tt.dataDir, tt.segmentDir)
+			if found != tt.wantFound || got.Archive != tt.want.Archive || got.Segment != tt.want.Segment || got.SegmentID != tt.want.SegmentID {
+				t.Errorf("tmpDirSegment(%q) = %+v, %v, want %+v, %v", tt.segmentDir, got, found, tt.want, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestRunCompactArchiveInvalidArgs(t *testing.T) {
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{dir, "--workers", "0"},
+		{dir, "--workers", "100"},
+		{dir, "--workers", "8", "--memory-mb", "256"},
+		{filepath.Join(dir, "missing")},
+	} {
+		if code := runCompactArchive(args); code != 1 {
+			t.Errorf("runCompactArchive(%q) = %d, want 1", args, code)
+		}
+	}
+	if code := runCompactArchive([]string{dir}); code != 0 {
+		t.Errorf("runCompactArchive() of empty directory = %d, want 0", code)
+	}
+}
+
+func TestCompactArchiveWorkers(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	var mu sync.Mutex
+	var done []string
+	jobs := make([]compactJob, 0, 6)
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("segment_%d", i)
+		jobs = append(jobs, compactJob{name: name, run: func() error {
+			current := running.Add(1)
+			defer running.Add(-1)
+			for {
+				prev := maxRunning.Load()
+				if current <= prev || maxRunning.CompareAndSwap(prev, current) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			if name == "segment_3" {
+				return errors.New("broken sorted file")
+			}
+			mu.Lock()
+			done = append(done, name)
+			mu.Unlock()
+			return nil
+		}})
+	}
+	err := compactArchive(jobs, 2)
+
+	if err == nil || !strings.Contains(err.Error(), "segment_3: broken sorted file") {
+		t.Errorf("compactArchive() error = %v, want error of failed job", err)
+	}
+	if maxRunning.Load() != 2 {
+		t.Errorf("compactArchive() ran %d jobs at once, want 2", maxRunning.Load())
+	}
+	slices.Sort(done)
+	if want := []string{"segment_0", "segment_1", "segment_2", "segment_4", "segment_5"}; !slices.Equal(done, want) {
+		t.Errorf("compactArchive() finished %v, want %v, failed job does not stop the others", done, want)
+	}
+}
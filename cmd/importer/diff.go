@@ -0,0 +1,276 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+)
+
+// compactedDiff - links added, removed and changed between two compacted files
+type compactedDiff struct {
+	Added     int
+	Removed   int
+	Changed   int // the same link with different dates or qty
+	Unchanged int
+	Skipped   int // malformed lines of both files
+}
+
+// compactedLine - decoded link with its line
+type compactedLine struct {
+	link commoncrawl.FileLinkCompacted
+	line string
+}
+
+// compactedReader - read links of compacted file one by one in sorted order
+type compactedReader struct {
+	filePath string
+	file     *os.File
+	gzReader *gzip.Reader
+	scanner  *fileutils.LineScanner
+	link     commoncrawl.FileLinkCompacted
+	line     string
+	key      string
+	skipped  int
+	done     bool
+}
+
+// runDiff - compare two compacted files and print number of added, removed and changed links, --out saves the links. Returns exit code
+func runDiff(args []string) int {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	outFile := flags.String("out", "", "gzipped file for changed links, lines start with + (added), - (removed) or ~ (changed)")
+	err := flags.Parse(args[2:])
+	if err != nil {
+		return 1
+	}
+
+	var out io.Writer
+	var gzWriter *gzip.Writer
+	if *outFile != "" {
+		file, err := os.Create(*outFile)
+		if err != nil {
+			fmt.Println("Could not create output file: " + err.Error())
+			return 1
+		}
+		defer file.Close()
+		gzWriter = gzip.NewWriter(file)
+		out = gzWriter
+	}
+
+	diff, err := diffCompactedFiles(args[0], args[1], out)
+	if err == nil && gzWriter != nil {
+		err = gzWriter.Close()
+	}
+	if err != nil {
+		fmt.Println("Diff failed: " + err.Error())
+		return 1
+	}
+	fmt.Printf("Added: %d, removed: %d, changed: %d, unchanged: %d, skipped malformed lines: %d\n", diff.Added, diff.Removed, diff.Changed, diff.Unchanged, diff.Skipped)
+
+	return 0
+}
+
+// diffCompactedFiles - merge join of two sorted compacted files, only lines of one link of every file are kept in memory.
+// Links are matched by link url with its scheme and page host, lines of the same link are matched by source page, changed links are
+// written with their new values. Out can be nil
+func diffCompactedFiles(oldFile string, newFile string, out io.Writer) (compactedDiff, error) {
+	diff := compactedDiff{}
+
+	oldLinks, err := openCompactedReader(oldFile)
+	if err != nil {
+		return diff, err
+	}
+	defer oldLinks.Close()
+
+	newLinks, err := openCompactedReader(newFile)
+	if err != nil {
+		return diff, err
+	}
+	defer newLinks.Close()
+
+	if err = oldLinks.Next(); err != nil {
+		return diff, err
+	}
+	if err = newLinks.Next(); err != nil {
+		return diff, err
+	}
+
+	var oldGroup, newGroup []compactedLine
+	for !oldLinks.done || !newLinks.done {
+		switch {
+		case newLinks.done || (!oldLinks.done && oldLinks.key < newLinks.key):
+			oldGroup, err = oldLinks.Group()
+			if err == nil {
+				err = diffLinkGroups(&diff, out, oldGroup, nil)
+			}
+		case oldLinks.done || newLinks.key < oldLinks.key:
+			newGroup, err = newLinks.Group()
+			if err == nil {
+				err = diffLinkGroups(&diff, out, nil, newGroup)
+			}
+		default:
+			oldGroup, err = oldLinks.Group()
+			if err == nil {
+				newGroup, err = newLinks.Group()
+			}
+			if err == nil {
+				err = diffLinkGroups(&diff, out, oldGroup, newGroup)
+			}
+		}
+		if err != nil {
+			return diff, err
+		}
+	}
+	diff.Skipped = oldLinks.skipped + newLinks.skipped
+
+	return diff, nil
+}
+
+// diffLinkGroups - compare lines of one link from both files, lines of the same source page are compared. When link has one line in both
+// files they are compared even with other source page, compaction keeps one page of the host and it can choose other page
+func diffLinkGroups(diff *compactedDiff, out io.Writer, oldGroup []compactedLine, newGroup []compactedLine) error {
+	if len(oldGroup) == 1 && len(newGroup) == 1 {
+		return diffLinkLines(diff, out, oldGroup[0], newGroup[0])
+	}
+
+	matched := make([]bool, len(oldGroup))
+	for _, newLine := range newGroup {
+		i := samePageLine(oldGroup, matched, newLine.link)
+		if i < 0 {
+			diff.Added++
+			if err := writeDiffLine(out, "+", newLine.line); err != nil {
+				return err
+			}
+			continue
+		}
+		matched[i] = true
+		if err := diffLinkLines(diff, out, oldGroup[i], newLine); err != nil {
+			return err
+		}
+	}
+	for i, oldLine := range oldGroup {
+		if matched[i] {
+			continue
+		}
+		diff.Removed++
+		if err := writeDiffLine(out, "-", oldLine.line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// samePageLine - index of not matched line from the same source page or -1
+func samePageLine(group []compactedLine, matched []bool, link commoncrawl.FileLinkCompacted) int {
+	for i, line := range group {
+		if !matched[i] && samePage(line.link, link) {
+			return i
+		}
+	}
+	return -1
+}
+
+// diffLinkLines - count the same link of both files as changed or unchanged
+func diffLinkLines(diff *compactedDiff, out io.Writer, oldLine compactedLine, newLine compactedLine) error {
+	if !isChangedLink(oldLine.link, newLine.link) {
+		diff.Unchanged++
+		return nil
+	}
+	diff.Changed++
+	return writeDiffLine(out, "~", newLine.line)
+}
+
+// isChangedLink - the same link seen in other dates, on other number of pages or on other kept page of the host
+func isChangedLink(oldLink commoncrawl.FileLinkCompacted, newLink commoncrawl.FileLinkCompacted) bool {
+	return oldLink.DateFrom != newLink.DateFrom || oldLink.DateTo != newLink.DateTo || oldLink.Qty != newLink.Qty || !samePage(oldLink, newLink)
+}
+
+// writeDiffLine - write compacted line with prefix of the change
+func writeDiffLine(out io.Writer, prefix string, line string) error {
+	if out == nil {
+		return nil
+	}
+	_, err := io.WriteString(out, prefix+line+"\n")
+	return err
+}
+
+// openCompactedReader - open gzipped compacted file, Next has to be called to read the first link
+func openCompactedReader(filePath string) (*compactedReader, error) {
+	maxCapacityScanner := fileutils.ScannerBufferSize(fileutils.DefaultScannerBufferSize)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("error creating gzip reader of %s: %w", filePath, err)
+	}
+
+	return &compactedReader{
+		filePath: filePath,
+		file:     file,
+		gzReader: gzReader,
+		scanner:  fileutils.NewGZScanner(gzReader, maxCapacityScanner),
+	}, nil
+}
+
+// Next - read next valid link, malformed lines are skipped. Returns error when links are not sorted,
+// merge join would report links of unsorted file as added and removed
+func (r *compactedReader) Next() error {
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+		fileLink, err := commoncrawl.DecodeCompactedLink(line)
+		if err != nil {
+			r.skipped++
+			continue
+		}
+
+		key := compactedLinkKey(line)
+		if key < r.key {
+			return fmt.Errorf("file %s is not sorted: %q after %q", r.filePath, key, r.key)
+		}
+		r.link, r.line, r.key = fileLink, line, key
+		return nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return fmt.Errorf("error scanning %s: %w", r.filePath, err)
+	}
+
+	r.skipped += r.scanner.SkippedLines()
+	r.done = true
+	return nil
+}
+
+// Group - current link and the following lines of the same link from other source pages of its host, reader is moved to the next link
+func (r *compactedReader) Group() ([]compactedLine, error) {
+	key := r.key
+	group := []compactedLine{{link: r.link, line: r.line}}
+	for {
+		if err := r.Next(); err != nil {
+			return nil, err
+		}
+		if r.done || r.key != key {
+			return group, nil
+		}
+		group = append(group, compactedLine{link: r.link, line: r.line})
+	}
+}
+
+// Close - close gzip reader and file
+func (r *compactedReader) Close() {
+	_ = r.gzReader.Close()
+	_ = r.file.Close()
+}
+
+// compactedLinkKey - line prefix with link url fields and page host. Files are sorted by whole lines,
+// so comparing prefixes keeps the order of the file
+func compactedLinkKey(line string) string {
+	return lineKey(line, 6)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// diffOldLines and diffNewLines - overlapping compacted files sorted by whole lines, a.com-x is before a.com because - is before |
+var (
+	diffOldLines = []string{
+		"a.com-x||/||2|src.com|/||2|X|0|0|2023-01-01|2023-01-05|1.1.1.1|1|",
+		"a.com||/x||2|src.com|/||2|A|0|0|2023-01-01|2023-01-05|1.1.1.1|1|",
+		"b.com||/||2|src.com|/p||2|B|0|0|2023-01-01|2023-01-02|1.1.1.1|1|",
+		"broken line",
+		"c.com||/||2|src.com|/||2|C|0|0|2023-01-01|2023-01-02|1.1.1.1|2|",
+	}
+	diffNewLines = []string{
+		"a.com-x||/||2|src.com|/||2|X|0|0|2023-01-01|2023-01-05|1.1.1.1|1|",
+		"a.com||/x||2|src.com|/||2|A|0|0|2023-01-01|2023-01-05|1.1.1.2|1|",
+		"b.com||/||2|src.com|/p||2|B|0|0|2023-01-01|2023-02-10|1.1.1.1|3|",
+		"b.com||/||2|zz.com|/||2|Z|0|0|2023-02-01|2023-02-10|1.1.1.1|1|",
+		"d.com||/||2|src.com|/||2|D|0|0|2023-02-01|2023-02-10|1.1.1.1|1|",
+	}
+)
+
+func TestDiffCompactedFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	oldFile := filepath.Join(tempDir, "compact_old.txt.gz")
+	newFile := filepath.Join(tempDir, "compact_new.txt.gz")
+	writeTestGzFile(t, oldFile, diffOldLines)
+	writeTestGzFile(t, newFile, diffNewLines)
+
+	var out strings.Builder
+	diff, err := diffCompactedFiles(oldFile, newFile, &out)
+	if err != nil {
+		t.Fatalf("diffCompactedFiles() error = %v", err)
+	}
+
+	// a.com keeps dates and qty, other ip is not a change
+	want := compactedDiff{Added: 2, Removed: 1, Changed: 1, Unchanged: 2, Skipped: 1}
+	if diff != want {
+		t.Errorf("diffCompactedFiles() = %+v, want %+v", diff, want)
+	}
+	wantLines := []string{
+		"~" + diffNewLines[2],
+		"+" + diffNewLines[3],
+		"-" + diffOldLines[4],
+		"+" + diffNewLines[4],
+	}
+	if got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"); !slices.Equal(got, wantLines) {
+		t.Errorf("diffCompactedFiles() wrote %q, want %q", got, wantLines)
+	}
+
+	// reversed direction swaps added and removed links
+	diff, err = diffCompactedFiles(newFile, oldFile, nil)
+	if err != nil {
+		t.Fatalf("diffCompactedFiles() error = %v", err)
+	}
+	want = compactedDiff{Added: 1, Removed: 2, Changed: 1, Unchanged: 2, Skipped: 1}
+	if diff != want {
+		t.Errorf("diffCompactedFiles() reversed = %+v, want %+v", diff, want)
+	}
+}
+
+func TestDiffCompactedFilesSourcePages(t *testing.T) {
+	tempDir := t.TempDir()
+	oldFile := filepath.Join(tempDir, "compact_old.txt.gz")
+	newFile := filepath.Join(tempDir, "compact_new.txt.gz")
+	// a.com is kept from several pages of src.com, b.com from one page that differs between files
+	oldLines := []string{
+		"a.com||/||2|src.com|/p0||2|A|0|0|2023-01-01|2023-01-02|1.1.1.1|1|",
+		"a.com||/||2|src.com|/p1||2|A|0|0|2023-01-01|2023-01-02|1.1.1.1|1|",
+		"a.com||/||2|src.com|/p2||2|A|0|0|2023-01-01|2023-01-02|1.1.1.1|1|",
+		"b.com||/||2|src.com|/a||2|B|0|0|2023-01-01|2023-01-02|1.1.1.1|1|",
+	}
+	newLines := []string{
+		"a.com||/||2|src.com|/p1||2|A|0|0|2023-01-01|2023-01-02|1.1.1.1|1|",
+		"a.com||/||2|src.com|/p2||2|A|0|0|2023-01-01|2023-02-10|1.1.1.1|1|",
+		"a.com||/||2|src.com|/p3||2|A|0|0|2023-02-01|2023-02-10|1.1.1.1|1|",
+		"b.com||/||2|src.com|/b||2|B|0|0|2023-01-01|2023-01-02|1.1.1.1|1|",
+	}
+	writeTestGzFile(t, oldFile, oldLines)
+	writeTestGzFile(t, newFile, newLines)
+
+	var out strings.Builder
+	diff, err := diffCompactedFiles(oldFile, newFile, &out)
+	if err != nil {
+		t.Fatalf("diffCompactedFiles() error = %v", err)
+	}
+
+	want := compactedDiff{Added: 1, Removed: 1, Changed: 2, Unchanged: 1}
+	if diff != want {
+		t.Errorf("diffCompactedFiles() = %+v, want %+v", diff, want)
+	}
+	wantLines := []string{
+		"~" + newLines[1],
+		"+" + newLines[2],
+		"-" + oldLines[0],
+		"~" + newLines[3],
+	}
+	if got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"); !slices.Equal(got, wantLines) {
+		t.Errorf("diffCompactedFiles() wrote %q, want %q", got, wantLines)
+	}
+}
+
+func TestDiffCompactedFilesErrors(t *testing.T) {
+	tempDir := t.TempDir()
+	sortedFile := filepath.Join(tempDir, "compact_sorted.txt.gz")
+	unsortedFile := filepath.Join(tempDir, "compact_unsorted.txt.gz")
+	writeTestGzFile(t, sortedFile, diffOldLines)
+	writeTestGzFile(t, unsortedFile, []string{diffNewLines[4], diffNewLines[0]})
+
+	tests := []struct {
+		name    string
+		oldFile string
+		newFile string
+		wantErr string
+	}{
+		{"unsorted file", sortedFile, unsortedFile, "is not sorted"},
+		{"missing file", sortedFile, filepath.Join(tempDir, "missing.txt.gz"), "error opening file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := diffCompactedFiles(tt.oldFile, tt.newFile, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("diffCompactedFiles() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunDiffOutFile(t *testing.T) {
+	tempDir := t.TempDir()
+	oldFile := filepath.Join(tempDir, "compact_old.txt.gz")
+	newFile := filepath.Join(tempDir, "compact_new.txt.gz")
+	outFile := filepath.Join(tempDir, "delta.txt.gz")
+	writeTestGzFile(t, oldFile, diffOldLines)
+	writeTestGzFile(t, newFile, diffNewLines)
+
+	if code := runDiff([]string{oldFile, newFile, "--out", outFile}); code != 0 {
+		t.Fatalf("runDiff() = %d, want 0", code)
+	}
+
+	file, err := os.Open(outFile)
+	if err != nil {
+		t.Fatalf("Failed to open delta file: %v", err)
+	}
+	defer file.Close()
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("Delta file is not gzipped: %v", err)
+	}
+	data, err := io.ReadAll(gzReader)
+	if err != nil {
+		t.Fatalf("Failed to read delta file: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 4 {
+		t.Errorf("delta file has %d lines, want 4", lines)
+	}
+}
+
+func TestCompactedLinkKey(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"a.com|www|/x|q=1|2|src.com|/||2|A|0|0|2023-01-01|2023-01-05|1.1.1.1|1|", "a.com|www|/x|q=1|2|src.com|"},
+		{"short|line", "short|line"},
+	}
+
+	for _, tt := range tests {
+		if got := compactedLinkKey(tt.line); got != tt.want {
+			t.Errorf("compactedLinkKey(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// domainIndexStats - domains written to index and links counted in compacted files
+type domainIndexStats struct {
+	Domains int
+	Links   int
+	Skipped int // malformed lines of all files
+}
+
+// domainCounter - count links of domains of one compacted file, links of the same domain are next to each other in sorted file
+type domainCounter struct {
+	links  *compactedReader
+	domain string
+	count  int
+	done   bool
+}
+
+// runDomains - write sorted index of link domains with number of their links from compacted files. Returns exit code
+func runDomains(args []string) int {
+	indexFile := args[0]
+
+	file, err := os.Create(indexFile)
+	if err != nil {
+		fmt.Println("Could not create index file: " + err.Error())
+		return 1
+	}
+	defer file.Close()
+	gzWriter := gzip.NewWriter(file)
+
+	stats, err := buildDomainIndex(args[1:], gzWriter)
+	if err == nil {
+		err = gzWriter.Close()
+	}
+	if err != nil {
+		_ = os.Remove(indexFile)
+		fmt.Println("Domain index failed: " + err.Error())
+		return 1
+	}
+	fmt.Printf("Domains: %d, links: %d, skipped malformed lines: %d\n", stats.Domains, stats.Links, stats.Skipped)
+
+	return 0
+}
+
+// buildDomainIndex - merge of sorted compacted files, every link domain is written once as domain|links line in the order of compacted files.
+// Only one link of every file is kept in memory, so files of any size can be indexed
+func buildDomainIndex(compactedFiles []string, out io.Writer) (domainIndexStats, error) {
+	stats := domainIndexStats{}
+
+	counters := make([]*domainCounter, 0, len(compactedFiles))
+	defer func() {
+		for _, counter := range counters {
+			counter.links.Close()
+		}
+	}()
+	for _, compactedFile := range compactedFiles {
+		links, err := openCompactedReader(compactedFile)
+		if err != nil {
+			return stats, err
+		}
+		counter := &domainCounter{links: links}
+		counters = append(counters, counter)
+		if err = links.Next(); err != nil {
+			return stats, err
+		}
+		if err = counter.Next(); err != nil {
+			return stats, err
+		}
+	}
+
+	for {
+		// files are sorted by whole lines, so domain followed by | keeps their order, a.com-x is before a.com
+		next, found := "", false
+		for _, counter := range counters {
+			if !counter.done && (!found || counter.domain+"|" < next+"|") {
+				next, found = counter.domain, true
+			}
+		}
+		if !found {
+			break
+		}
+
+		count := 0
+		for _, counter := range counters {
+			if counter.done || counter.domain != next {
+				continue
+			}
+			count += counter.count
+			if err := counter.Next(); err != nil {
+				return stats, err
+			}
+		}
+
+		if _, err := io.WriteString(out, next+"|"+strconv.Itoa(count)+"\n"); err != nil {
+			return stats, err
+		}
+		stats.Domains++
+		stats.Links += count
+	}
+
+	for _, counter := range counters {
+		stats.Skipped += counter.links.skipped
+	}
+
+	return stats, nil
+}
+
+// Next - count links of the next domain of the file
+func (c *domainCounter) Next() error {
+	if c.links.done {
+		c.done = true
+		return nil
+	}
+
+	c.domain = c.links.link.LinkDomain
+	c.count = 0
+	for !c.links.done && c.links.link.LinkDomain == c.domain {
+		c.count++
+		if err := c.links.Next(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
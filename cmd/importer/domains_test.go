@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+)
+
+func TestBuildDomainIndex(t *testing.T) {
+	tempDir := t.TempDir()
+	firstFile := filepath.Join(tempDir, "compact_0.txt.gz")
+	secondFile := filepath.Join(tempDir, "compact_1.txt.gz")
+	writeTestGzFile(t, firstFile, diffOldLines)
+	writeTestGzFile(t, secondFile, diffNewLines)
+
+	tests := []struct {
+		name      string
+		files     []string
+		want      []string
+		wantStats domainIndexStats
+	}{
+		{
+			name:      "one file",
+			files:     []string{firstFile},
+			want:      []string{"a.com-x|1", "a.com|1", "b.com|1", "c.com|1"},
+			wantStats: domainIndexStats{Domains: 4, Links: 4, Skipped: 1},
+		},
+		{
+			name:      "merged files",
+			files:     []string{firstFile, secondFile},
+			want:      []string{"a.com-x|2", "a.com|2", "b.com|3", "c.com|1", "d.com|1"},
+			wantStats: domainIndexStats{Domains: 5, Links: 9, Skipped: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			stats, err := buildDomainIndex(tt.files, &out)
+			if err != nil {
+				t.Fatalf("buildDomainIndex() error = %v", err)
+			}
+			if stats != tt.wantStats {
+				t.Errorf("buildDomainIndex() = %+v, want %+v", stats, tt.wantStats)
+			}
+			if got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"); !slices.Equal(got, tt.want) {
+				t.Errorf("buildDomainIndex() wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildDomainIndexNotSorted(t *testing.T) {
+	unsortedFile := filepath.Join(t.TempDir(), "compact_unsorted.txt.gz")
+	writeTestGzFile(t, unsortedFile, []string{diffNewLines[4], diffNewLines[0]})
+
+	var out strings.Builder
+	if _, err := buildDomainIndex([]string{unsortedFile}, &out); err == nil || !strings.Contains(err.Error(), "not sorted") {
+		t.Errorf("buildDomainIndex() error = %v, want not sorted error", err)
+	}
+}
+
+func TestRunDomains(t *testing.T) {
+	tempDir := t.TempDir()
+	compactedFile := filepath.Join(tempDir, "compact_0.txt.gz")
+	indexFile := filepath.Join(tempDir, "domains.txt.gz")
+	writeTestGzFile(t, compactedFile, diffNewLines)
+
+	if code := runDomains([]string{indexFile, compactedFile}); code != 0 {
+		t.Fatalf("runDomains() = %d, want 0", code)
+	}
+	lines, err := fileutils.ReadGZFileByLine(indexFile)
+	if err != nil {
+		t.Fatalf("Failed to read index file: %v", err)
+	}
+	want := []string{"a.com-x|1", "a.com|1", "b.com|2", "d.com|1"}
+	if !slices.Equal(lines, want) {
+		t.Errorf("runDomains() index = %q, want %q", lines, want)
+	}
+
+	// failed index is removed
+	if code := runDomains([]string{indexFile, filepath.Join(tempDir, "missing.txt.gz")}); code != 1 {
+		t.Errorf("runDomains() with missing file = %d, want 1", code)
+	}
+	if _, err = fileutils.ReadGZFileByLine(indexFile); err == nil {
+		t.Errorf("runDomains() left index file after failure")
+	}
+}
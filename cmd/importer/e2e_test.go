@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+	"github.com/kris-dev-hub/globallinks/pkg/config"
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+	"github.com/kris-dev-hub/globallinks/pkg/linkdb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// e2eMongoEnv - MongoDB connection string used by end-to-end test, links are queried from mocked database when it is not set
+const e2eMongoEnv = "GLOBALLINKS_TEST_MONGODB"
+
+// e2eWatFiles - two WAT files from one segment, blog.net/post is crawled in both of them
+var e2eWatFiles = [][]commoncrawl.WatFixture{
+	{
+		{
+			URL:  "https://blog.net/post",
+			IP:   "1.2.3.4",
+			Date: time.Date(2023, 2, 4, 10, 0, 0, 0, time.UTC),
+			HTML: `<title>Post</title><a href="https://example.com/a">Example A</a><a href="https://www.example.com/b" rel="nofollow">B</a><a href="https://other.org/">Other</a>`,
+		},
+		{
+			URL:  "https://news.org/list",
+			IP:   "1.2.3.5",
+			Date: time.Date(2023, 2, 4, 11, 0, 0, 0, time.UTC),
+			HTML: `<title>News</title><a href="https://example.com/a">Example A</a>`,
+		},
+	},
+	{
+		{
+			URL:  "https://blog.net/post",
+			IP:   "1.2.3.6",
+			Date: time.Date(2023, 2, 6, 10, 0, 0, 0, time.UTC),
+			HTML: `<title>Post</title><a href="https://example.com/a">Example A</a>`,
+		},
+		{
+			URL:  "https://blog.net/archive",
+			IP:   "1.2.3.6",
+			Date: time.Date(2023, 2, 6, 11, 0, 0, 0, time.UTC),
+			HTML: `<title>Archive</title><a href="https://example.com/a">Example A</a>`,
+		},
+	},
+}
+
+// e2eWantLinks - links to example.com returned by API after import of e2eWatFiles
+var e2eWantLinks = []linkdb.LinkOut{
+	{LinkUrl: "https://example.com/a", PageUrl: "https://blog.net/post", PageDomain: "blog.net", LinkText: "Example A", DateFrom: "2023-02-04", DateTo: "2023-02-06", IP: []string{"1.2.3.6"}, Qty: 2},
+	{LinkUrl: "https://example.com/a", PageUrl: "https://news.org/list", PageDomain: "news.org", LinkText: "Example A", DateFrom: "2023-02-04", DateTo: "2023-02-04", IP: []string{"1.2.3.5"}, Qty: 1},
+	{LinkUrl: "https://www.example.com/b", PageUrl: "https://blog.net/post", PageDomain: "blog.net", LinkText: "B", NoFollow: 1, DateFrom: "2023-02-04", DateTo: "2023-02-04", IP: []string{"1.2.3.4"}, Qty: 1},
+}
+
+// TestImportEndToEnd - parse WAT files, sort and compact links, store them and query them the same way API does
+func TestImportEndToEnd(t *testing.T) {
+	tempDir := t.TempDir()
+	linkDir := filepath.Join(tempDir, "link")
+	if err := os.MkdirAll(linkDir, 0o755); err != nil {
+		t.Fatalf("Failed to create link directory: %v", err)
+	}
+
+	// import
+	for i, fixtures := range e2eWatFiles {
+		watFile := filepath.Join(tempDir, fmt.Sprintf("%05d.warc.wat.gz", i))
+		if err := commoncrawl.WriteWatFile(watFile, fixtures); err != nil {
+			t.Fatalf("WriteWatFile() error = %v", err)
+		}
+		linkFile := filepath.Join(linkDir, fmt.Sprintf("%05d%s", i, extensionTxtGz))
+		if _, err := commoncrawl.ParseWatFile(watFile, linkFile, "", false); err != nil {
+			t.Fatalf("ParseWatFile() error = %v", err)
+		}
+	}
+
+	// sort & compact
+	sortedFile := filepath.Join(tempDir, "sort_0.txt.gz")
+	compactedFile := filepath.Join(tempDir, "compact_0.txt.gz")
+	sortLinkFiles(t, linkDir, sortedFile)
+	if err := aggressiveCompacting(sortedFile, compactedFile); err != nil {
+		t.Fatalf("aggressiveCompacting() error = %v", err)
+	}
+	// link to other.org is saved too but it is not returned for example.com
+	report, err := validateCompactedFile(compactedFile, 0)
+	if err != nil || report.Malformed > 0 || report.Lines != len(e2eWantLinks)+1 {
+		t.Fatalf("validateCompactedFile() = %+v, %v, want %d valid lines", report, err, len(e2eWantLinks)+1)
+	}
+
+	// store & query
+	rows := readLinkRows(t, compactedFile)
+	domain := "example.com"
+	request := linkdb.APIRequest{Domain: &domain}
+
+	var outLinks []linkdb.LinkOut
+	if mongoURI := os.Getenv(e2eMongoEnv); mongoURI != "" {
+		outLinks = queryMongoLinks(t, mongoURI, rows, request)
+	} else {
+		outLinks = queryMockLinks(t, rows, request)
+	}
+
+	if !reflect.DeepEqual(outLinks, e2eWantLinks) {
+		t.Errorf("ControllerGetDomainLinks() =\n%+v\nwant\n%+v", outLinks, e2eWantLinks)
+	}
+}
+
+// TestImportDropQueryStrings - queries of pages and links are removed at parse time, so links differing only in query are compacted together
+func TestImportDropQueryStrings(t *testing.T) {
+	fixtures := [][]commoncrawl.WatFixture{
+		{
+			{URL: "https://blog.net/list?page=1", IP: "1.2.3.4", Date: time.Date(2023, 2, 4, 10, 0, 0, 0, time.UTC), HTML: `<a href="https://example.com/a?id=1">A</a><a href="https://example.com/a?id=2">A</a>`},
+			{URL: "https://blog.net/list?page=2", IP: "1.2.3.4", Date: time.Date(2023, 2, 4, 11, 0, 0, 0, time.UTC), HTML: `<a href="https://example.com/a?id=3">A</a>`},
+		},
+		{
+			{URL: "https://blog.net/list?page=1", IP: "1.2.3.4", Date: time.Date(2023, 2, 6, 10, 0, 0, 0, time.UTC), HTML: `<a href="https://example.com/a?id=1">A</a>`},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		drop     bool
+		wantRows int
+	}{
+		{"disabled", false, 3},
+		{"enabled", true, 1},
+	}
+
+	defer func() { config.DropQueryStrings = false }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.DropQueryStrings = tt.drop
+			tempDir := t.TempDir()
+			linkDir := filepath.Join(tempDir, "link")
+			if err := os.MkdirAll(linkDir, 0o755); err != nil {
+				t.Fatalf("Failed to create link directory: %v", err)
+			}
+
+			for i, watFixtures := range fixtures {
+				watFile := filepath.Join(tempDir, fmt.Sprintf("%05d.warc.wat.gz", i))
+				if err := commoncrawl.WriteWatFile(watFile, watFixtures); err != nil {
+					t.Fatalf("WriteWatFile() error = %v", err)
+				}
+				linkFile := filepath.Join(linkDir, fmt.Sprintf("%05d%s", i, extensionTxtGz))
+				if _, err := commoncrawl.ParseWatFile(watFile, linkFile, "", false); err != nil {
+					t.Fatalf("ParseWatFile() error = %v", err)
+				}
+			}
+			sortedFile := filepath.Join(tempDir, "sort_0.txt.gz")
+			compactedFile := filepath.Join(tempDir, "compact_0.txt.gz")
+			sortLinkFiles(t, linkDir, sortedFile)
+			if err := aggressiveCompacting(sortedFile, compactedFile); err != nil {
+				t.Fatalf("aggressiveCompacting() error = %v", err)
+			}
+
+			rows := readLinkRows(t, compactedFile)
+			if len(rows) != tt.wantRows {
+				t.Fatalf("compacted file = %+v, want %d links", rows, tt.wantRows)
+			}
+			if !tt.drop {
+				return
+			}
+			row := rows[0]
+			if row.LinkPath != "/a" || row.LinkRawQuery != "" || row.PagePath != "/list" || row.PageRawQuery != "" {
+				t.Errorf("compacted link = %+v, want /a from /list without queries", row)
+			}
+			if row.DateFrom != "2023-02-04" || row.DateTo != "2023-02-06" {
+				t.Errorf("compacted link dates = %s - %s, want link of both WAT files", row.DateFrom, row.DateTo)
+			}
+		})
+	}
+}
+
+// sortLinkFiles - sort and deduplicate link files in memory the same way as `sort -u` in sortOutFilesWithBashGz, which needs lzop in low disc space mode
+func sortLinkFiles(t *testing.T, linkDir string, sortedFile string) {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(linkDir, "*"+extensionTxtGz))
+	if err != nil {
+		t.Fatalf("Failed to list link files: %v", err)
+	}
+
+	var lines []string
+	for _, file := range files {
+		fileLines, err := fileutils.ReadGZFileByLine(file)
+		if err != nil {
+			t.Fatalf("Failed to read link file: %v", err)
+		}
+		lines = append(lines, fileLines...)
+	}
+	slices.Sort(lines)
+	writeTestGzFile(t, sortedFile, slices.Compact(lines))
+}
+
+// readLinkRows - decode compacted file into rows saved in links collection by storelinks
+func readLinkRows(t *testing.T, compactedFile string) []linkdb.LinkRow {
+	t.Helper()
+
+	lines, err := fileutils.ReadGZFileByLine(compactedFile)
+	if err != nil {
+		t.Fatalf("Failed to read compacted file: %v", err)
+	}
+
+	rows := make([]linkdb.LinkRow, 0, len(lines))
+	for _, line := range lines {
+		link, err := commoncrawl.DecodeCompactedLink(line)
+		if err != nil {
+			t.Fatalf("DecodeCompactedLink(%q) error = %v", line, err)
+		}
+		rows = append(rows, linkdb.LinkRow{
+			LinkDomain:    link.LinkDomain,
+			LinkSubDomain: link.LinkSubDomain,
+			LinkPath:      link.LinkPath,
+			LinkRawQuery:  link.LinkRawQuery,
+			LinkScheme:    link.LinkScheme,
+			PageHost:      link.PageHost,
+			PagePath:      link.PagePath,
+			PageRawQuery:  link.PageRawQuery,
+			PageScheme:    link.PageScheme,
+			LinkText:      link.LinkText,
+			NoFollow:      link.NoFollow,
+			PageNoIndex:   link.PageNoIndex,
+			DateFrom:      link.DateFrom,
+			DateTo:        link.DateTo,
+			IP:            link.IP,
+			Qty:           link.Qty,
+			LinkType:      link.LinkType,
+		})
+	}
+
+	return rows
+}
+
+// queryMongoLinks - save rows in temporary database and query them with controller
+func queryMongoLinks(t *testing.T, mongoURI string, rows []linkdb.LinkRow, request linkdb.APIRequest) []linkdb.LinkOut {
+	t.Helper()
+
+	client, err := linkdb.InitDB(mongoURI, linkdb.DefaultDBConfig)
+	if err != nil {
+		t.Fatalf("InitDB() error = %v", err)
+	}
+	defer client.Disconnect(context.TODO()) //nolint:errcheck
+
+	dbName := fmt.Sprintf("linkdb_e2e_%d", time.Now().UnixNano())
+	defer client.Database(dbName).Drop(context.TODO()) //nolint:errcheck
+
+	documents := make([]interface{}, 0, len(rows))
+	for _, row := range rows {
+		documents = append(documents, row)
+	}
+	_, err = client.Database(dbName).Collection("links").InsertMany(context.TODO(), documents)
+	if err != nil {
+		t.Fatalf("InsertMany() error = %v", err)
+	}
+
+	app := linkdb.App{DB: client, Dbname: dbName}
+	outLinks, _, err := app.ControllerGetDomainLinks(request)
+	if err != nil {
+		t.Fatalf("ControllerGetDomainLinks() error = %v", err)
+	}
+
+	return outLinks
+}
+
+// queryMockLinks - return rows of requested domain from mocked database in the order requested by controller and query them with controller
+func queryMockLinks(t *testing.T, rows []linkdb.LinkRow, request linkdb.APIRequest) []linkdb.LinkOut {
+	t.Helper()
+
+	rows = slices.DeleteFunc(rows, func(row linkdb.LinkRow) bool { return row.LinkDomain != *request.Domain })
+	slices.SortFunc(rows, func(a, b linkdb.LinkRow) int {
+		keyA := []string{a.LinkDomain, a.LinkSubDomain, a.LinkPath, a.LinkRawQuery, a.PageHost, a.PagePath, a.PageRawQuery, a.DateFrom, a.DateTo}
+		keyB := []string{b.LinkDomain, b.LinkSubDomain, b.LinkPath, b.LinkRawQuery, b.PageHost, b.PagePath, b.PageRawQuery, b.DateFrom, b.DateTo}
+		return slices.Compare(keyA, keyB)
+	})
+
+	documents := make([]bson.D, 0, len(rows))
+	for _, row := range rows {
+		data, err := bson.Marshal(row)
+		if err != nil {
+			t.Fatalf("bson.Marshal() error = %v", err)
+		}
+		var document bson.D
+		if err = bson.Unmarshal(data, &document); err != nil {
+			t.Fatalf("bson.Unmarshal() error = %v", err)
+		}
+		documents = append(documents, document)
+	}
+
+	var outLinks []linkdb.LinkOut
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("query links", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "linkdb.links", mtest.FirstBatch, documents...),
+			mtest.CreateCursorResponse(0, "linkdb.links", mtest.NextBatch),
+		)
+
+		app := linkdb.App{DB: mt.Client, Dbname: "linkdb"}
+		var err error
+		outLinks, _, err = app.ControllerGetDomainLinks(request)
+		if err != nil {
+			mt.Fatalf("ControllerGetDomainLinks() error = %v", err)
+		}
+
+		filter := mt.GetStartedEvent().Command.Lookup("filter").String()
+		if !strings.Contains(filter, "example.com") {
+			mt.Errorf("find filter = %s, want example.com domain", filter)
+		}
+	})
+
+	return outLinks
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+)
+
+// yieldSample - links parsed from sample of WAT files, half values are counted after first half of sampled files
+type yieldSample struct {
+	Files       int
+	Pages       int
+	Links       int
+	Domains     int
+	HalfLinks   int
+	HalfDomains int
+	OutputBytes int64 // size of gzipped link files
+}
+
+// yieldEstimate - links expected from whole archive
+type yieldEstimate struct {
+	Files       int
+	Pages       int
+	Links       int
+	Domains     int
+	OutputBytes int64
+}
+
+// runEstimate - parse random sample of archive WAT files and print expected number of links, link domains and size of link files
+func runEstimate(args []string) int {
+	archiveName := args[0]
+	if !commoncrawl.IsCorrectArchiveFormat(archiveName) {
+		fmt.Println("Invalid archive name")
+		return 1
+	}
+	sampleSize, err := strconv.Atoi(args[1])
+	if err != nil || sampleSize < 1 {
+		fmt.Println("Invalid number of WAT files: " + args[1])
+		return 1
+	}
+
+	flags := flag.NewFlagSet("estimate", flag.ContinueOnError)
+	seed := flags.Int64("seed", time.Now().UnixNano(), "random seed, the same seed selects the same WAT files")
+	err = flags.Parse(args[2:])
+	if err != nil {
+		return 1
+	}
+
+	err = setBaseURL()
+	if err != nil {
+		fmt.Printf("Could not set Common Crawl base url: %v\n", err)
+		return 1
+	}
+	dataDir, err := commoncrawl.CreateDataDir(setDataDirectory())
+	if err != nil {
+		fmt.Printf("Could not create data directory: %v\n", err)
+		return 1
+	}
+	segmentList, err := commoncrawl.InitImport(archiveName, dataDir, false)
+	if err != nil {
+		fmt.Printf("Could not load segment list: %v\n", err)
+		return 1
+	}
+
+	watFiles := sampleWatFiles(segmentList, sampleSize, rand.New(rand.NewSource(*seed)))
+	sample, err := parseYieldSample(watFiles, filepath.Join(dataDir.TmpDir, "estimate"))
+	if err != nil {
+		fmt.Printf("Estimate failed: %v\n", err)
+		return 1
+	}
+
+	totalFiles := 0
+	for _, segment := range segmentList {
+		totalFiles += len(segment.WatFiles)
+	}
+	estimate := extrapolateYield(sample, totalFiles)
+
+	fmt.Printf("Sampled %d of %d WAT files from %s, seed %d\n", sample.Files, totalFiles, archiveName, *seed)
+	fmt.Printf("Sample:   %d pages, %d links, %d link domains, %s of link files\n", sample.Pages, sample.Links, sample.Domains, formatBytes(sample.OutputBytes))
+	fmt.Printf("Estimate: %d pages, %d links, %d link domains, %s of link files\n", estimate.Pages, estimate.Links, estimate.Domains, formatBytes(estimate.OutputBytes))
+
+	return 0
+}
+
+// sampleWatFiles - random WAT files from all segments without repetition
+func sampleWatFiles(segmentList []commoncrawl.WatSegment, sampleSize int, rng *rand.Rand) []commoncrawl.WatFile {
+	var watFiles []commoncrawl.WatFile
+	for _, segment := range segmentList {
+		watFiles = append(watFiles, segment.WatFiles...)
+	}
+
+	rng.Shuffle(len(watFiles), func(i, j int) { watFiles[i], watFiles[j] = watFiles[j], watFiles[i] })
+	return watFiles[:min(sampleSize, len(watFiles))]
+}
+
+// parseYieldSample - download and parse WAT files one by one, links are counted without saving link files
+func parseYieldSample(watFiles []commoncrawl.WatFile, tmpDir string) (yieldSample, error) {
+	sample := yieldSample{}
+
+	err := fileutils.CreateDataDirectory(tmpDir)
+	if err != nil {
+		return sample, err
+	}
+
+	domains := make(map[string]struct{})
+	output := &countingWriter{}
+	gzWriter := gzip.NewWriter(output)
+
+	for i, watFile := range watFiles {
+		recordFile := filepath.Join(tmpDir, filepath.Base(watFile.Path))
+		err = fileutils.DownloadFile(commoncrawl.FileURL(watFile.Path), recordFile, 2)
+		if err != nil {
+			_ = os.Remove(recordFile)
+			return sample, fmt.Errorf("could not load WAT file %s: %w", watFile.Path, err)
+		}
+
+		stats, err := commoncrawl.ParseWatStream(recordFile, func(link commoncrawl.FileLink, page commoncrawl.FilePage) error {
+			domains[link.LinkDomain] = struct{}{}
+			_, err := io.WriteString(gzWriter, commoncrawl.EncodeLink(link, page))
+			return err
+		})
+		_ = os.Remove(recordFile)
+		if err != nil {
+			return sample, fmt.Errorf("could not parse WAT file %s: %w", watFile.Path, err)
+		}
+
+		sample.Files++
+		sample.Pages += stats.Pages
+		sample.Links += stats.Links
+		if i+1 == len(watFiles)/2 {
+			sample.HalfLinks = sample.Links
+			sample.HalfDomains = len(domains)
+		}
+	}
+
+	err = gzWriter.Close()
+	if err != nil {
+		return sample, err
+	}
+	sample.Domains = len(domains)
+	sample.OutputBytes = output.written
+
+	return sample, nil
+}
+
+// extrapolateYield - scale sample to all WAT files of archive. Pages, links and output size grow linearly with number of files,
+// number of link domains grows slower as the same domains are linked from many files. It follows Heaps' law (domains = k * links^beta),
+// beta is measured between half and whole sample and it is 1 (linear growth, upper bound) when it can't be measured
+func extrapolateYield(sample yieldSample, totalFiles int) yieldEstimate {
+	if sample.Files == 0 {
+		return yieldEstimate{Files: totalFiles}
+	}
+
+	scale := float64(totalFiles) / float64(sample.Files)
+	estimate := yieldEstimate{
+		Files:       totalFiles,
+		Pages:       int(math.Round(float64(sample.Pages) * scale)),
+		Links:       int(math.Round(float64(sample.Links) * scale)),
+		OutputBytes: int64(math.Round(float64(sample.OutputBytes) * scale)),
+	}
+
+	beta := 1.0
+	if sample.HalfLinks > 0 && sample.HalfDomains > 0 && sample.Links > sample.HalfLinks {
+		beta = math.Log(float64(sample.Domains)/float64(sample.HalfDomains)) / math.Log(float64(sample.Links)/float64(sample.HalfLinks))
+		beta = max(0, min(beta, 1))
+	}
+	estimate.Domains = int(math.Round(float64(sample.Domains) * math.Pow(scale, beta)))
+
+	return estimate
+}
+
+// countingWriter - count bytes written to it
+type countingWriter struct {
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	return len(p), nil
+}
+
+// formatBytes - size in B, KB, MB, GB or TB
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size)
+	units := []string{"KB", "MB", "GB", "TB"}
+	i := -1
+	for value >= unit && i < len(units)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
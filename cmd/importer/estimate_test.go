@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+)
+
+func TestExtrapolateYield(t *testing.T) {
+	tests := []struct {
+		name       string
+		sample     yieldSample
+		totalFiles int
+		want       yieldEstimate
+	}{
+		{
+			name:       "empty sample",
+			sample:     yieldSample{},
+			totalFiles: 100,
+			want:       yieldEstimate{Files: 100},
+		},
+		{
+			name:       "one file scales domains linearly",
+			sample:     yieldSample{Files: 1, Pages: 10, Links: 100, Domains: 40, OutputBytes: 1000},
+			totalFiles: 100,
+			want:       yieldEstimate{Files: 100, Pages: 1000, Links: 10000, Domains: 4000, OutputBytes: 100000},
+		},
+		{
+			name:       "domains doubling with links grow linearly",
+			sample:     yieldSample{Files: 4, Pages: 40, Links: 400, Domains: 200, HalfLinks: 200, HalfDomains: 100, OutputBytes: 4000},
+			totalFiles: 400,
+			want:       yieldEstimate{Files: 400, Pages: 4000, Links: 40000, Domains: 20000, OutputBytes: 400000},
+		},
+		{
+			name: "domains growing with square root of links",
+			// beta = ln(2) / ln(4) = 0.5, 100 times more links give 10 times more domains
+			sample:     yieldSample{Files: 4, Pages: 40, Links: 400, Domains: 200, HalfLinks: 100, HalfDomains: 100, OutputBytes: 4000},
+			totalFiles: 400,
+			want:       yieldEstimate{Files: 400, Pages: 4000, Links: 40000, Domains: 2000, OutputBytes: 400000},
+		},
+		{
+			name:       "no new domains in second half",
+			sample:     yieldSample{Files: 2, Pages: 20, Links: 200, Domains: 50, HalfLinks: 100, HalfDomains: 50, OutputBytes: 2000},
+			totalFiles: 20,
+			want:       yieldEstimate{Files: 20, Pages: 200, Links: 2000, Domains: 50, OutputBytes: 20000},
+		},
+		{
+			name:       "domains faster than links are clamped to linear growth",
+			sample:     yieldSample{Files: 2, Pages: 20, Links: 200, Domains: 90, HalfLinks: 100, HalfDomains: 10, OutputBytes: 2000},
+			totalFiles: 20,
+			want:       yieldEstimate{Files: 20, Pages: 200, Links: 2000, Domains: 900, OutputBytes: 20000},
+		},
+		{
+			name:       "no links in second half",
+			sample:     yieldSample{Files: 2, Pages: 20, Links: 100, Domains: 50, HalfLinks: 100, HalfDomains: 50, OutputBytes: 2000},
+			totalFiles: 20,
+			want:       yieldEstimate{Files: 20, Pages: 200, Links: 1000, Domains: 500, OutputBytes: 20000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extrapolateYield(tt.sample, tt.totalFiles); got != tt.want {
+				t.Errorf("extrapolateYield() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSampleWatFiles(t *testing.T) {
+	segmentList := []commoncrawl.WatSegment{
+		{WatFiles: []commoncrawl.WatFile{{Path: watFileName(0)}, {Path: watFileName(1)}}},
+		{WatFiles: []commoncrawl.WatFile{{Path: watFileName(2)}}},
+	}
+
+	sample := sampleWatFiles(segmentList, 2, rand.New(rand.NewSource(42)))
+	if len(sample) != 2 || sample[0].Path == sample[1].Path {
+		t.Errorf("sampleWatFiles() = %+v, want 2 different files", sample)
+	}
+
+	again := sampleWatFiles(segmentList, 2, rand.New(rand.NewSource(42)))
+	if again[0].Path != sample[0].Path || again[1].Path != sample[1].Path {
+		t.Errorf("sampleWatFiles() with the same seed = %+v, want %+v", again, sample)
+	}
+
+	if all := sampleWatFiles(segmentList, 10, rand.New(rand.NewSource(42))); len(all) != 3 {
+		t.Errorf("sampleWatFiles() returned %d files, want all 3", len(all))
+	}
+}
+
+func TestParseYieldSample(t *testing.T) {
+	downloads := serveTestWatFile(t)
+	tmpDir := t.TempDir()
+
+	watFiles := []commoncrawl.WatFile{{Path: watFileName(0)}, {Path: watFileName(1)}}
+	sample, err := parseYieldSample(watFiles, tmpDir)
+	if err != nil {
+		t.Fatalf("parseYieldSample() error = %v", err)
+	}
+
+	// both files have the same page linking example.com
+	if sample.Files != 2 || sample.Pages != 2 || sample.Links != 2 || sample.Domains != 1 || sample.HalfLinks != 1 || sample.HalfDomains != 1 {
+		t.Errorf("parseYieldSample() = %+v, want 2 files, 2 pages, 2 links, 1 domain, half 1 link and 1 domain", sample)
+	}
+	if sample.OutputBytes == 0 {
+		t.Error("parseYieldSample() OutputBytes = 0")
+	}
+	if len(downloads) != 2 {
+		t.Errorf("downloaded %d files, want 2", len(downloads))
+	}
+	if entries, _ := os.ReadDir(tmpDir); len(entries) != 0 {
+		t.Errorf("parseYieldSample() left %d files in tmp directory", len(entries))
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		size int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KB"},
+		{300 * 1024 * 1024, "300.0 MB"},
+		{5 * 1024 * 1024 * 1024 * 1024 * 1024, "5120.0 TB"},
+	}
+
+	for _, tt := range tests {
+		if got := formatBytes(tt.size); got != tt.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", tt.size, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+)
+
+// importEvents - progress of import printed as text for people or, with --json-logs, as JSON lines for CI and dashboards
+type importEvents struct {
+	out    io.Writer
+	logger *slog.Logger // nil prints text
+}
+
+// events - progress of current import, replaced in main with --json-logs and in tests
+var events = &importEvents{out: os.Stdout}
+
+// newJSONEvents - events written to w as JSON lines, one event per line with event name in msg
+func newJSONEvents(w io.Writer) *importEvents {
+	return &importEvents{out: w, logger: slog.New(slog.NewJSONHandler(w, nil))}
+}
+
+// useJSONEvents - write events as JSON lines to w, output of log package goes through the same handler, so warnings are JSON lines too
+func useJSONEvents(w io.Writer) {
+	events = newJSONEvents(w)
+	slog.SetDefault(events.logger)
+}
+
+// importStarted - segments selected for import
+func (e *importEvents) importStarted(archive string, segments int) {
+	if e.logger != nil {
+		e.logger.Info("import_started", "archive", archive, "segments", segments)
+		return
+	}
+	fmt.Fprintf(e.out, "Importing %d segments\n", segments)
+}
+
+// segmentStarted - import of segment WAT files started
+func (e *importEvents) segmentStarted(segment string) {
+	if e.logger != nil {
+		e.logger.Info("segment_started", "segment", segment)
+		return
+	}
+	fmt.Fprintf(e.out, "Importing segment %s\n", segment)
+}
+
+// fileStarted - WAT file downloaded, parsing started
+func (e *importEvents) fileStarted(segment string, file string) {
+	if e.logger != nil {
+		e.logger.Info("file_started", "segment", segment, "file", file)
+		return
+	}
+	fmt.Fprintln(e.out, "Importing file: ", file)
+}
+
+// fileFinished - WAT file parsed and its links saved
+func (e *importEvents) fileFinished(segment string, file fileMetrics) {
+	if e.logger != nil {
+		e.logger.Info("file_finished", "segment", segment, "file", file.File, "duration_ms", file.Duration.Milliseconds(), "links", file.Links,
+			"links_per_second", linksPerSecond(file.Links, file.Duration), "domain_cache_hit_rate", file.DomainCacheHitRate)
+		return
+	}
+	fmt.Fprintf(e.out, "Parsed file %s in %s: %d links (%.0f links/s), domain cache hit rate %.1f%%\n", file.File, file.Duration.Round(time.Millisecond),
+		file.Links, linksPerSecond(file.Links, file.Duration), file.DomainCacheHitRate*100)
+}
+
+// fileFailed - WAT file failed all attempts and was saved to dead letter files
+func (e *importEvents) fileFailed(segment string, watPath string, attempts int, failure error) {
+	if e.logger != nil {
+		e.logger.Warn("file_failed", "segment", segment, "file", watPath, "attempts", attempts, "error", failure.Error())
+		return
+	}
+	log.Printf("WAT file %s failed %d attempts, it is retried in the next run: %v", watPath, attempts, failure)
+}
+
+// segmentFinished - segment links sorted and compacted, stats of all its files. Urls without registrable domain and domain cache
+// lookups are counted since start of the run, domain cache is shared by all parsing threads
+func (e *importEvents) segmentFinished(segment string, summary segmentSummary, failures commoncrawl.DomainFailures, cache commoncrawl.DomainCacheLookups) {
+	if e.logger != nil {
+		e.logger.Info("segment_finished", "segment", segment, "duration_ms", summary.TotalTime.Milliseconds(), "files", summary.Files,
+			"parse_ms", summary.ParseTime.Milliseconds(), "links", summary.Links, "links_per_second", summary.LinksPerSecond,
+			"zero_link_files", summary.ZeroLinkFiles, "public_suffix_hosts", failures.PublicSuffixHosts, "kept_hosts", failures.KeptHosts,
+			"invalid_hosts", failures.InvalidHosts, "domain_cache_hit_rate", cache.HitRate(), "published_links", summary.PublishedLinks)
+		return
+	}
+
+	fmt.Fprintf(e.out, "Segment %s finished in %s: %d files parsed in %s, %d links (%.0f links/s)\n", segment, summary.TotalTime.Round(time.Second),
+		summary.Files, summary.ParseTime.Round(time.Second), summary.Links, summary.LinksPerSecond)
+	if summary.ZeroLinkFiles > 0 {
+		fmt.Fprintf(e.out, "WAT files without links: %d of %d\n", summary.ZeroLinkFiles, summary.Files)
+	}
+	if summary.PublishedLinks > 0 {
+		fmt.Fprintf(e.out, "Links published to broker: %d\n", summary.PublishedLinks)
+	}
+	if failures.PublicSuffixHosts+failures.InvalidHosts > 0 {
+		fmt.Fprintf(e.out, "Urls without registrable domain since start: %d public suffix hosts (%d kept), %d invalid hosts\n",
+			failures.PublicSuffixHosts, failures.KeptHosts, failures.InvalidHosts)
+	}
+	if cache.Hits+cache.Misses > 0 {
+		fmt.Fprintf(e.out, "Domain cache hit rate since start: %.1f%%\n", cache.HitRate()*100)
+	}
+}
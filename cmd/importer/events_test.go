@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+)
+
+// readJSONEvents - events written as JSON lines, test fails on line that is not valid JSON
+func readJSONEvents(t *testing.T, out string) []map[string]any {
+	t.Helper()
+
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		event := make(map[string]any)
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("event %q is not valid JSON: %v", line, err)
+		}
+		lines = append(lines, event)
+	}
+	return lines
+}
+
+func TestImportEventsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	jsonEvents := newJSONEvents(&buf)
+
+	jsonEvents.importStarted("CC-MAIN-2021-04", 2)
+	jsonEvents.segmentStarted("1610703495901.0")
+	jsonEvents.fileStarted("1610703495901.0", "00000.warc.wat.gz")
+	jsonEvents.fileFinished("1610703495901.0", fileMetrics{File: "00000.warc.wat.gz", Duration: 2 * time.Second, Links: 30, DomainCacheHitRate: 0.5})
+	jsonEvents.fileFailed("1610703495901.0", "00001.warc.wat.gz", 3, errors.New("broken file"))
+	jsonEvents.segmentFinished("1610703495901.0", segmentSummary{Files: 1, Links: 30, ZeroLinkFiles: 1, TotalTime: 3 * time.Second}, commoncrawl.DomainFailures{InvalidHosts: 2}, commoncrawl.DomainCacheLookups{Hits: 24, Misses: 8})
+
+	lines := readJSONEvents(t, buf.String())
+	wantEvents := []string{"import_started", "segment_started", "file_started", "file_finished", "file_failed", "segment_finished"}
+	if len(lines) != len(wantEvents) {
+		t.Fatalf("got %d events, want %d: %s", len(lines), len(wantEvents), buf.String())
+	}
+	for i, want := range wantEvents {
+		if lines[i]["msg"] != want {
+			t.Errorf("event %d = %v, want %s", i, lines[i]["msg"], want)
+		}
+	}
+
+	// numbers are JSON numbers, not formatted text
+	if finished := lines[3]; finished["links"] != 30.0 || finished["duration_ms"] != 2000.0 || finished["links_per_second"] != 15.0 || finished["domain_cache_hit_rate"] != 0.5 {
+		t.Errorf("file_finished = %v, want 30 links in 2000 ms", finished)
+	}
+	if failed := lines[4]; failed["level"] != "WARN" || failed["error"] != "broken file" || failed["attempts"] != 3.0 {
+		t.Errorf("file_failed = %v, want warning with error and attempts", failed)
+	}
+	if segment := lines[5]; segment["files"] != 1.0 || segment["zero_link_files"] != 1.0 || segment["invalid_hosts"] != 2.0 || segment["domain_cache_hit_rate"] != 0.75 {
+		t.Errorf("segment_finished = %v, want files, zero link files, invalid hosts and domain cache hit rate", segment)
+	}
+}
+
+func TestImportEventsText(t *testing.T) {
+	var buf bytes.Buffer
+	textEvents := &importEvents{out: &buf}
+
+	textEvents.fileFinished("1610703495901.0", fileMetrics{File: "00000.warc.wat.gz", Duration: 2 * time.Second, Links: 30, DomainCacheHitRate: 0.5})
+	textEvents.segmentFinished("1610703495901.0", segmentSummary{Files: 1, Links: 30, PublishedLinks: 30, TotalTime: 3 * time.Second}, commoncrawl.DomainFailures{}, commoncrawl.DomainCacheLookups{Hits: 3, Misses: 1})
+
+	want := "Parsed file 00000.warc.wat.gz in 2s: 30 links (15 links/s), domain cache hit rate 50.0%\n" +
+		"Segment 1610703495901.0 finished in 3s: 1 files parsed in 0s, 30 links (0 links/s)\n" +
+		"Links published to broker: 30\n" +
+		"Domain cache hit rate since start: 75.0%\n"
+	if buf.String() != want {
+		t.Errorf("text events = %q, want %q", buf.String(), want)
+	}
+}
+
+// TestImportSegmentJSONEvents - import of segment emits started and finished events of its WAT file and segment as JSON lines
+func TestImportSegmentJSONEvents(t *testing.T) {
+	serveTestWatFile(t)
+
+	var buf bytes.Buffer
+	defer func(orig *importEvents) { events = orig }(events)
+	events = newJSONEvents(&buf)
+
+	dataDir, err := commoncrawl.CreateDataDir(t.TempDir())
+	if err != nil {
+		t.Fatalf("CreateDataDir() error = %v", err)
+	}
+	segmentList := []commoncrawl.WatSegment{{
+		Archive:   "CC-MAIN-2021-04",
+		Segment:   "1610703495901.0",
+		WatFiles:  []commoncrawl.WatFile{{Number: "00000", Path: "crawl-data/CC-MAIN-2021-04/segments/1610703495901.0/wat/" + watFileName(0)}},
+		SegmentID: 0,
+	}}
+
+	maxWatFiles := 1
+	importSegment(segmentList[0], dataDir, &segmentList, 1, &maxWatFiles, nil, nil, nil)
+
+	var names []string
+	for _, event := range readJSONEvents(t, buf.String()) {
+		names = append(names, event["msg"].(string))
+		if event["msg"] == "file_finished" && event["links"] != 1.0 {
+			t.Errorf("file_finished = %v, want 1 link", event)
+		}
+	}
+	for _, want := range []string{"file_started", "file_finished", "segment_finished"} {
+		if !strings.Contains(strings.Join(names, ","), want) {
+			t.Errorf("events = %v, want %s", names, want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+)
+
+// loadImportState - load imported and dead letter WAT files of data directory and check them against imported segments.
+// Problems are logged, with repair broken files are set aside and state is rebuilt from data directory
+func loadImportState(segmentList []commoncrawl.WatSegment, dataDir commoncrawl.DataDir, repair bool) (*commoncrawl.ImportedWatFiles, *commoncrawl.DeadLetterWatFiles, error) {
+	segmentList = withCompactedSegments(segmentList, dataDir)
+
+	// WAT files imported from all archives sharing data directory
+	importedWatFiles, err := loadStateFile(dataDir.ImportedWatFilesFile(), repair, commoncrawl.LoadImportedWatFiles)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load imported WAT files: %w", err)
+	}
+
+	// WAT files that failed all attempts, files failed in previous runs are retried
+	deadLetter, err := loadStateFile(dataDir.DeadLetterWatFilesFile(), repair, commoncrawl.LoadDeadLetterWatFiles)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load dead letter WAT files: %w", err)
+	}
+
+	if repair {
+		repaired, err := commoncrawl.RepairImportState(segmentList, importedWatFiles, deadLetter)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not repair import state: %w", err)
+		}
+		log.Printf("Repaired %d problems of import state\n", repaired)
+		return importedWatFiles, deadLetter, nil
+	}
+
+	problems := commoncrawl.ValidateImportState(segmentList, importedWatFiles, deadLetter)
+	for _, problem := range problems {
+		log.Printf("Import state: %s\n", problem)
+	}
+	if len(problems) > 0 {
+		log.Printf("Import state has %d problems, run with --repair to rebuild it from data directory\n", len(problems))
+	}
+
+	return importedWatFiles, deadLetter, nil
+}
+
+// clearSegmentState - remove WAT files of selected segments from imported and dead letter WAT files, so they are downloaded and parsed
+// again. Segment with sorted or compacted file is not cleared, it would be skipped or its compacted file replaced
+func clearSegmentState(segmentList []commoncrawl.WatSegment, segmentIDs []int, dataDir commoncrawl.DataDir, imported *commoncrawl.ImportedWatFiles, deadLetter *commoncrawl.DeadLetterWatFiles) error {
+	if len(segmentIDs) == 0 {
+		return fmt.Errorf("select segments to clear")
+	}
+
+	for _, segmentID := range segmentIDs {
+		segment, err := commoncrawl.SelectSegmentByID(segmentList, segmentID)
+		if err != nil {
+			return fmt.Errorf("segment %d: %w", segmentID, err)
+		}
+		for _, segmentFile := range []string{dataDir.SortedLinksFile(segment), dataDir.CompactedLinksFile(segment)} {
+			if fileutils.FileExists(segmentFile) {
+				return fmt.Errorf("segment %s is imported to %s, move it away to import the segment again", segment.Segment, segmentFile)
+			}
+		}
+
+		watPaths := make([]string, 0, len(segment.WatFiles))
+		for _, watFile := range segment.WatFiles {
+			watPaths = append(watPaths, watFile.Path)
+		}
+		clearedImported, err := imported.Clear(watPaths)
+		if err != nil {
+			return err
+		}
+		clearedDeadLetter, err := deadLetter.ClearSegment(segment.Segment)
+		if err != nil {
+			return err
+		}
+		log.Printf("Cleared import state of segment %s: %d imported and %d dead letter WAT files\n", segment.Segment, clearedImported, clearedDeadLetter)
+	}
+
+	return nil
+}
+
+// withCompactedSegments - copy of segments where segment with compacted file is imported too, its sorted file is deleted after compaction
+func withCompactedSegments(segmentList []commoncrawl.WatSegment, dataDir commoncrawl.DataDir) []commoncrawl.WatSegment {
+	segments := slices.Clone(segmentList)
+	for i, segment := range segments {
+		if segment.ImportEnded == nil && fileutils.FileExists(dataDir.CompactedLinksFile(segment)) {
+			now := time.Now()
+			segments[i].ImportEnded = &now
+		}
+	}
+
+	return segments
+}
+
+// loadStateFile - load state file, with repair file that can't be loaded is set aside and empty state is loaded
+func loadStateFile[T any](filePath string, repair bool, load func(string) (*T, error)) (*T, error) {
+	state, err := load(filePath)
+	if err == nil || !repair {
+		return state, err
+	}
+
+	log.Printf("Setting aside broken state file: %v\n", err)
+	err = commoncrawl.SetAsideBrokenStateFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return load(filePath)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+)
+
+func TestLoadImportStateRepair(t *testing.T) {
+	dataDir, err := commoncrawl.CreateDataDir(t.TempDir())
+	if err != nil {
+		t.Fatalf("CreateDataDir() error = %v", err)
+	}
+
+	watPath := "crawl-data/CC-MAIN-2021-04/segments/1610703495901.0/wat/CC-MAIN-20210115134101-20210115164101-00000.warc.wat.gz"
+	segmentList := []commoncrawl.WatSegment{
+		{Archive: "CC-MAIN-2021-04", Segment: "1610703495901.0", SegmentID: 0, WatFiles: []commoncrawl.WatFile{{Number: "00000", Path: watPath}}},
+	}
+	// segment is compacted but partially written imported WAT files do not have its file
+	if err := os.WriteFile(dataDir.CompactedLinksFile(segmentList[0]), []byte{}, 0o666); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := os.WriteFile(dataDir.ImportedWatFilesFile(), []byte(`{"files":{"1a`), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	commoncrawl.ValidateSegmentImportEndAtStart(&segmentList, dataDir)
+
+	if _, _, err := loadImportState(segmentList, dataDir, false); err == nil {
+		t.Fatal("loadImportState() error = nil for broken imported WAT files without repair")
+	}
+
+	imported, deadLetter, err := loadImportState(segmentList, dataDir, true)
+	if err != nil {
+		t.Fatalf("loadImportState() with repair error = %v", err)
+	}
+	if !imported.IsImported(watPath) {
+		t.Error("IsImported() = false, WAT file of compacted segment is rebuilt from data directory")
+	}
+	if problems := commoncrawl.ValidateImportState(withCompactedSegments(segmentList, dataDir), imported, deadLetter); len(problems) != 0 {
+		t.Errorf("ValidateImportState() after repair = %q, want no problems", problems)
+	}
+	if _, err := os.Stat(dataDir.ImportedWatFilesFile() + ".broken"); err != nil {
+		t.Errorf("broken imported WAT files are not set aside: %v", err)
+	}
+
+	// repaired state loads without repair
+	if _, _, err := loadImportState(segmentList, dataDir, false); err != nil {
+		t.Errorf("loadImportState() of repaired state error = %v", err)
+	}
+}
+
+func TestClearSegmentState(t *testing.T) {
+	dataDir, err := commoncrawl.CreateDataDir(t.TempDir())
+	if err != nil {
+		t.Fatalf("CreateDataDir() error = %v", err)
+	}
+
+	watPath := func(segment string, number string) string {
+		return "crawl-data/CC-MAIN-2021-04/segments/" + segment + "/wat/CC-MAIN-20210115134101-20210115164101-" + number + ".warc.wat.gz"
+	}
+	segmentList := []commoncrawl.WatSegment{
+		{Archive: "CC-MAIN-2021-04", Segment: "1610703495901.0", SegmentID: 0, WatFiles: []commoncrawl.WatFile{{Number: "00000", Path: watPath("1610703495901.0", "00000")}, {Number: "00001", Path: watPath("1610703495901.0", "00001")}}},
+		{Archive: "CC-MAIN-2021-04", Segment: "1610703495901.1", SegmentID: 1, WatFiles: []commoncrawl.WatFile{{Number: "00002", Path: watPath("1610703495901.1", "00002")}}},
+	}
+
+	imported, deadLetter, err := loadImportState(segmentList, dataDir, false)
+	if err != nil {
+		t.Fatalf("loadImportState() error = %v", err)
+	}
+	for _, path := range []string{watPath("1610703495901.0", "00000"), watPath("1610703495901.1", "00002")} {
+		if err = imported.MarkImported(path); err != nil {
+			t.Fatalf("MarkImported() error = %v", err)
+		}
+	}
+	if err = deadLetter.Add("1610703495901.0", watPath("1610703495901.0", "00001"), 3, os.ErrDeadlineExceeded); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	if err = clearSegmentState(segmentList, nil, dataDir, imported, deadLetter); err == nil {
+		t.Error("clearSegmentState() error = nil without selected segments")
+	}
+	if err = clearSegmentState(segmentList, []int{0}, dataDir, imported, deadLetter); err != nil {
+		t.Fatalf("clearSegmentState() error = %v", err)
+	}
+
+	// cleared state is saved, other segment stays imported
+	imported, deadLetter, err = loadImportState(segmentList, dataDir, false)
+	if err != nil {
+		t.Fatalf("loadImportState() error = %v", err)
+	}
+	if imported.IsImported(watPath("1610703495901.0", "00000")) || !imported.IsImported(watPath("1610703495901.1", "00002")) || len(deadLetter.Files) != 0 {
+		t.Errorf("import state after clear = %v, %v, want only WAT file of segment 1", imported.Files, deadLetter.Files)
+	}
+
+	// compacted segment is not cleared
+	if err = os.WriteFile(dataDir.CompactedLinksFile(segmentList[1]), []byte{}, 0o666); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err = clearSegmentState(segmentList, []int{1}, dataDir, imported, deadLetter); err == nil {
+		t.Error("clearSegmentState() error = nil for compacted segment")
+	}
+	if !imported.IsImported(watPath("1610703495901.1", "00002")) {
+		t.Error("clearSegmentState() cleared compacted segment")
+	}
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,6 +26,7 @@ import (
 
 	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
 	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+	"github.com/kris-dev-hub/globallinks/pkg/linksink"
 
 	_ "net/http/pprof"
 )
@@ -29,35 +36,20 @@ const (
 	lowDiscSpaceMode = true  // encrypt tmp files to save disc space during sorting, requires lzop installed
 	healthCheckMode  = true  // enable health check api to monitor application on port 3005: http://localhost:3005/health
 	pprofMode        = false // enable pprof api to monitor application on port 6060: http://localhost:6060/debug/pprof/
-	sleepBetweenWat  = 10    // sleep between WAT files in seconds - there is a problem with common crawl transfer limitation and from certain speed they slow the transfer down
 )
 
+// keepWatFiles - keep downloaded WAT files after parsing to debug parser output, set with --keep-wat
+var keepWatFiles = false
+
+// sleepBetweenWat - sleep between WAT files in seconds - there is a problem with common crawl transfer limitation and from certain speed they slow the transfer down
+var sleepBetweenWat = 10
+
 const (
 	extensionTxtGz = ".txt.gz"
 	linkDir        = "/link/"
 	pageDir        = "/page/"
 )
 
-// FileLinkCompacted - compacted link file
-type FileLinkCompacted struct {
-	LinkDomain    string
-	LinkSubDomain string
-	LinkPath      string
-	LinkRawQuery  string
-	LinkScheme    string
-	PageHost      string
-	PagePath      string
-	PageRawQuery  string
-	PageScheme    string
-	LinkText      string
-	NoFollow      int
-	NoIndex       int
-	DateFrom      string
-	DateTo        string
-	IP            string
-	Qty           int
-}
-
 func main() {
 	if pprofMode == true {
 		go func() {
@@ -69,6 +61,82 @@ func main() {
 	var archiveName string
 	var segmentsToImport []int
 
+	// --refresh downloads segments file again instead of using the cached one
+	refreshSegments := false
+	if i := slices.Index(os.Args, "--refresh"); i > 0 {
+		refreshSegments = true
+		os.Args = slices.Delete(os.Args, i, i+1)
+	}
+
+	// --keep-wat keeps WAT files after parsing, files already downloaded are parsed again without download
+	if i := slices.Index(os.Args, "--keep-wat"); i > 0 {
+		keepWatFiles = true
+		os.Args = slices.Delete(os.Args, i, i+1)
+	}
+
+	// --repair rebuilds imported and dead letter WAT files from data directory, broken files are set aside
+	repairState := false
+	if i := slices.Index(os.Args, "--repair"); i > 0 {
+		repairState = true
+		os.Args = slices.Delete(os.Args, i, i+1)
+	}
+
+	// --clear-state removes selected segments from imported and dead letter WAT files, so their WAT files are imported again
+	clearState := false
+	if i := slices.Index(os.Args, "--clear-state"); i > 0 {
+		clearState = true
+		os.Args = slices.Delete(os.Args, i, i+1)
+	}
+
+	// --json-logs prints import progress and stats as JSON lines
+	if i := slices.Index(os.Args, "--json-logs"); i > 0 {
+		useJSONEvents(os.Stdout)
+		os.Args = slices.Delete(os.Args, i, i+1)
+	}
+
+	// --segments-file reads segment IDs and ranges from file, one per line
+	segmentsFile := ""
+	if i := slices.Index(os.Args, "--segments-file"); i > 0 {
+		if i+1 >= len(os.Args) {
+			fmt.Println("--segments-file requires path of file with segment IDs")
+			os.Exit(1)
+		}
+		segmentsFile = os.Args[i+1]
+		os.Args = slices.Delete(os.Args, i, i+2)
+	}
+
+	// --target-domains imports only WAT files with pages of these domains, found in Common Crawl URL index
+	var targetDomains []string
+	if i := slices.Index(os.Args, "--target-domains"); i > 0 {
+		if i+1 >= len(os.Args) {
+			fmt.Println("--target-domains requires comma separated list of domains")
+			os.Exit(1)
+		}
+		targetDomains, err = parseTargetDomains(os.Args[i+1])
+		if err != nil {
+			fmt.Println("Invalid target domains: " + err.Error())
+			os.Exit(1)
+		}
+		os.Args = slices.Delete(os.Args, i, i+2)
+	}
+
+	// --target-domains-file reads target domains from file, one per line
+	if i := slices.Index(os.Args, "--target-domains-file"); i > 0 {
+		if i+1 >= len(os.Args) {
+			fmt.Println("--target-domains-file requires path of file with domains")
+			os.Exit(1)
+		}
+		fileDomains, err := parseTargetDomainsFile(os.Args[i+1])
+		if err != nil {
+			fmt.Println("Invalid target domains file: " + err.Error())
+			os.Exit(1)
+		}
+		targetDomains = append(targetDomains, fileDomains...)
+		slices.Sort(targetDomains)
+		targetDomains = slices.Compact(targetDomains)
+		os.Args = slices.Delete(os.Args, i, i+2)
+	}
+
 	if len(os.Args) == 4 && os.Args[1] == "compacting" {
 		fmt.Println("compacting")
 		err = aggressiveCompacting(os.Args[2], os.Args[3])
@@ -79,8 +147,43 @@ func main() {
 		os.Exit(0)
 	}
 
+	if len(os.Args) >= 3 && os.Args[1] == "recompact" {
+		os.Exit(runRecompact(os.Args[2:]))
+	}
+
+	if len(os.Args) >= 3 && os.Args[1] == "compact-archive" {
+		os.Exit(runCompactArchive(os.Args[2:]))
+	}
+
+	if len(os.Args) >= 3 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
+	}
+
+	if len(os.Args) >= 4 && os.Args[1] == "sample" {
+		os.Exit(runSample(os.Args[2:]))
+	}
+
+	if len(os.Args) >= 4 && os.Args[1] == "diff" {
+		os.Exit(runDiff(os.Args[2:]))
+	}
+
+	if len(os.Args) >= 4 && os.Args[1] == "domains" {
+		os.Exit(runDomains(os.Args[2:]))
+	}
+
+	if len(os.Args) >= 4 && os.Args[1] == "estimate" {
+		os.Exit(runEstimate(os.Args[2:]))
+	}
+
 	if len(os.Args) < 2 {
-		fmt.Println("No archive name or segment specified. Example: ./importer CC-MAIN-2020-24 <num_of_wat_to_import> <num_of_threads> <optional_segment_list>")
+		fmt.Println("No archive name or segment specified. Example: ./importer CC-MAIN-2020-24 <num_of_wat_to_import> <num_of_threads> <optional_segment_list> [--segments-file segments.txt] [--target-domains example.com,example.org] [--target-domains-file domains.txt] [--refresh] [--keep-wat] [--json-logs] [--repair] [--clear-state]")
+		fmt.Println("Validate compacted file: ./importer validate data/links/compact_0.txt.gz <optional_accepted_malformed_lines>")
+		fmt.Println("Print random links from compacted file: ./importer sample data/links/compact_0.txt.gz <num_of_links> [--seed 42]")
+		fmt.Println("Estimate links of archive from random WAT files: ./importer estimate CC-MAIN-2020-24 <num_of_wat_to_sample> [--seed 42]")
+		fmt.Println("Compare compacted files: ./importer diff data/links/compact_0.txt.gz data/links/compact_1.txt.gz [--out delta.txt.gz]")
+		fmt.Println("Index link domains of compacted files: ./importer domains domains.txt.gz data/links/compact_0.txt.gz [data/links/compact_1.txt.gz ...]")
+		fmt.Println("Sort and compact link files left by interrupted import: ./importer recompact data/tmp/<segment> <optional_compacted_file>")
+		fmt.Println("Compact sorted files and segment directories in parallel: ./importer compact-archive data/links [--workers 4] [--memory-mb 4096]")
 		os.Exit(1)
 	}
 
@@ -115,29 +218,99 @@ func main() {
 
 	}
 
+	if segmentsFile != "" {
+		fileSegments, err := parseSegmentsFile(segmentsFile)
+		if err != nil {
+			fmt.Println("Invalid segments file: " + err.Error())
+			os.Exit(1)
+		}
+		segmentsToImport = unionSegmentIDs(segmentsToImport, fileSegments)
+	}
+
 	archiveName = os.Args[1]
 	maxThreads := setMaxThreads()
 	maxWatFiles := setMaxWATFiles()
 	defaultDir := setDataDirectory()
+	if len(targetDomains) > 0 {
+		defaultDir = targetDataDirectory(defaultDir, targetDomains)
+		log.Printf("Import of target domains uses data directory %s\n", defaultDir)
+	}
 
-	// import segment information
-	segmentList, err := commoncrawl.InitImport(archiveName)
+	err = setBaseURL()
 	if err != nil {
-		log.Printf("Could not load segment list: %v\n", err)
+		log.Printf("Could not set Common Crawl base url: %v\n", err)
+		os.Exit(1)
+	}
+
+	// links are published to message broker next to link files when sink is configured
+	sink, err := setLinkSink()
+	if err != nil {
+		log.Printf("Could not set link sink: %v\n", err)
 		os.Exit(1)
 	}
+	// os.Exit skips deferred calls, sink is closed before every exit so the broker connection is drained
+	exit := func(code int) {
+		if sink != nil {
+			if err := sink.Close(); err != nil {
+				log.Printf("Could not close link sink: %v\n", err)
+				code = 1
+			}
+		}
+		os.Exit(code)
+	}
 
 	// create data directories
 	dataDir, err := commoncrawl.CreateDataDir(defaultDir)
 	if err != nil {
 		log.Printf("Could not create data directory: %v\n", err)
-		os.Exit(1)
+		exit(1)
+	}
+
+	// import segment information
+	segmentList, err := commoncrawl.InitImport(archiveName, dataDir, refreshSegments)
+	if err != nil {
+		log.Printf("Could not load segment list: %v\n", err)
+		exit(1)
 	}
 
+	// set names of segment files
+	dataDir.Naming = setFileNaming()
+
 	// update information about imported segments
-	commoncrawl.ValidateSegmentImportEndAtStart(&segmentList, dataDir, extensionTxtGz)
+	commoncrawl.ValidateSegmentImportEndAtStart(&segmentList, dataDir)
+
+	// imported and dead letter WAT files checked against imported segments
+	importedWatFiles, deadLetter, err := loadImportState(segmentList, dataDir, repairState)
+	if err != nil {
+		log.Printf("%v\n", err)
+		exit(1)
+	}
+
+	// all selected segments have to exist in archive before import starts
+	err = validateSegmentIDs(segmentList, segmentsToImport)
+	if err != nil {
+		log.Printf("Invalid segment input: %v\n", err)
+		exit(1)
+	}
+
+	if clearState {
+		err = clearSegmentState(segmentList, segmentsToImport, dataDir, importedWatFiles, deadLetter)
+		if err != nil {
+			log.Printf("Could not clear import state: %v\n", err)
+			exit(1)
+		}
+	}
+
+	// only WAT files with pages of target domains are imported
+	if len(targetDomains) > 0 {
+		segmentList, err = filterTargetWatFiles(segmentList, archiveName, targetDomains)
+		if err != nil {
+			log.Printf("%v\n", err)
+			exit(1)
+		}
+	}
 
-	fmt.Printf("Importing %d segments\n", len(segmentList))
+	events.importStarted(archiveName, len(segmentList))
 
 	if len(segmentsToImport) > 0 {
 		for _, segmentID := range segmentsToImport {
@@ -145,17 +318,18 @@ func main() {
 			// select only segments from command line
 			segment, err := commoncrawl.SelectSegmentByID(segmentList, segmentID)
 			if err != nil {
-				log.Printf("Could not select segment to import: %v\n", err)
-				os.Exit(0)
+				// segment was validated before, it is missing only when it has no WAT files of target domains
+				log.Printf("Segment %d has no WAT files to import\n", segmentID)
+				continue
 			}
 
 			// parse only unfinished segments
 			if segment.ImportEnded == nil && maxWatFiles > 0 {
-				fmt.Printf("Importing segment %s\n", segment.Segment)
-				importSegment(segment, dataDir, &segmentList, maxThreads, &maxWatFiles)
+				events.segmentStarted(segment.Segment)
+				importSegment(segment, dataDir, &segmentList, maxThreads, &maxWatFiles, sink, importedWatFiles, deadLetter)
 			}
 		}
-		os.Exit(0)
+		exit(0)
 	}
 
 	// allow to monitor script health on external servers
@@ -175,24 +349,170 @@ func main() {
 
 	for i := 0; i < len(segmentList); i++ {
 
-		// select segment to import
-		segment, err := commoncrawl.SelectSegmentToImport(segmentList)
+		// select segment to import, segments with WAT files failed in this run are left for the next run
+		segment, err := commoncrawl.SelectSegmentToImport(slices.DeleteFunc(slices.Clone(segmentList), func(segment commoncrawl.WatSegment) bool {
+			return deadLetter.SegmentFailedInRun(segment.Segment)
+		}))
 		if err != nil {
 			log.Printf("Could not select segment to import: %v\n", err)
-			os.Exit(0)
+			exit(0)
 		}
 
 		// parse only unfinished segments
 		if segment.ImportEnded == nil && maxWatFiles > 0 {
-			fmt.Printf("Importing segment %s\n", segment.Segment)
-			importSegment(segment, dataDir, &segmentList, maxThreads, &maxWatFiles)
+			events.segmentStarted(segment.Segment)
+			importSegment(segment, dataDir, &segmentList, maxThreads, &maxWatFiles, sink, importedWatFiles, deadLetter)
+		}
+	}
+	exit(0)
+}
+
+// now - clock used for import timing, replaced in tests
+var now = time.Now
+
+// fileMetrics - parse duration and saved links of one WAT file
+type fileMetrics struct {
+	File               string
+	Duration           time.Duration
+	Links              int
+	DomainCacheHitRate float64
+}
+
+// segmentMetrics - timing of WAT files parsed for one segment in the current run
+type segmentMetrics struct {
+	mu               sync.Mutex
+	Started          time.Time
+	Files            []fileMetrics
+	published        func() int // links received by broker since start of the run, nil without sink
+	publishedAtStart int
+}
+
+// segmentSummary - total time and throughput of one segment
+type segmentSummary struct {
+	Files          int
+	Links          int
+	ZeroLinkFiles  int // parsed files without links
+	PublishedLinks int // links received by broker, links of files parsed again are counted again
+	ParseTime      time.Duration
+	TotalTime      time.Duration
+	LinksPerSecond float64
+}
+
+// newSegmentMetrics - start measuring segment import time
+func newSegmentMetrics() *segmentMetrics {
+	return &segmentMetrics{Started: now()}
+}
+
+// trackPublished - count links received by broker during segment import
+func (m *segmentMetrics) trackPublished(published func() int) {
+	m.published = published
+	m.publishedAtStart = published()
+}
+
+// trackFile - run parse for one WAT file, record its duration and number of links
+func (m *segmentMetrics) trackFile(file string, parse func() (commoncrawl.WatFileStats, error)) (fileMetrics, error) {
+	started := now()
+	stats, err := parse()
+	metrics := fileMetrics{File: file, Duration: now().Sub(started), Links: stats.Links, DomainCacheHitRate: stats.DomainCacheHitRate()}
+	if err != nil {
+		return metrics, err
+	}
+
+	m.mu.Lock()
+	m.Files = append(m.Files, metrics)
+	m.mu.Unlock()
+
+	return metrics, nil
+}
+
+// summary - sum up parsed files and time elapsed since segment start
+func (m *segmentMetrics) summary() segmentSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	summary := segmentSummary{Files: len(m.Files), TotalTime: now().Sub(m.Started)}
+	for _, file := range m.Files {
+		summary.Links += file.Links
+		if file.Links == 0 {
+			summary.ZeroLinkFiles++
+		}
+		summary.ParseTime += file.Duration
+	}
+	summary.LinksPerSecond = linksPerSecond(summary.Links, summary.TotalTime)
+	if m.published != nil {
+		summary.PublishedLinks = m.published() - m.publishedAtStart
+	}
+
+	return summary
+}
+
+// retryWatFile - run download or parse of WAT file up to attempts times, returns error of the last attempt.
+// File which timed out is not retried, downloaded again it would block the worker for the same time. File which failed
+// to emit its links is not retried either, links emitted before the error would be published again
+func retryWatFile(attempts int, run func() error) error {
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = run()
+		if err == nil {
+			return nil
 		}
+		if errors.Is(err, commoncrawl.ErrWatParseTimeout) {
+			log.Printf("Attempt %d of %d timed out, file is not retried: %v", attempt, attempts, err)
+			return err
+		}
+		if errors.Is(err, commoncrawl.ErrLinkEmit) {
+			return err
+		}
+		if attempt < attempts {
+			log.Printf("Attempt %d of %d failed: %v", attempt, attempts, err)
+		}
+	}
+	return err
+}
+
+// downloadWatFile - download WAT file, it is saved only when download is complete, so interrupted download is not parsed in next run
+func downloadWatFile(watPath string, recordWatFile string) error {
+	err := fileutils.DownloadFile(commoncrawl.FileURL(watPath), recordWatFile+".tmp", 2)
+	if err == nil {
+		err = os.Rename(recordWatFile+".tmp", recordWatFile)
+	}
+	if err != nil {
+		_ = os.Remove(recordWatFile + ".tmp")
+		return fmt.Errorf("could not load WAT file %s: %w", watPath, err)
+	}
+	return nil
+}
+
+// addDeadLetterWatFile - save WAT file that failed all attempts, import continues with other files and segment is not compacted in this run
+func addDeadLetterWatFile(deadLetter *commoncrawl.DeadLetterWatFiles, segment string, watPath string, attempts int, failure error) {
+	events.fileFailed(segment, watPath, attempts, failure)
+	if deadLetter == nil {
+		return
+	}
+	err := deadLetter.Add(segment, watPath, attempts, failure)
+	if err != nil {
+		log.Fatalf("Could not save dead letter WAT files: %v", err)
+	}
+}
+
+// linksPerSecond - throughput, zero when no time was measured
+func linksPerSecond(links int, duration time.Duration) float64 {
+	if duration <= 0 {
+		return 0
 	}
+	return float64(links) / duration.Seconds()
 }
 
-func importSegment(segment commoncrawl.WatSegment, dataDir commoncrawl.DataDir, segmentList *[]commoncrawl.WatSegment, maxThreads int, maxWatFiles *int) {
+func importSegment(segment commoncrawl.WatSegment, dataDir commoncrawl.DataDir, segmentList *[]commoncrawl.WatSegment, maxThreads int, maxWatFiles *int, sink *linksink.BrokerSink, importedWatFiles *commoncrawl.ImportedWatFiles, deadLetter *commoncrawl.DeadLetterWatFiles) {
 	var err error
 
+	metrics := newSegmentMetrics()
+	if sink != nil {
+		metrics.trackPublished(sink.Published)
+	}
+	attempts := setWatAttempts()
+	parseTimeout := setWatParseTimeout()
+
 	guard := make(chan struct{}, maxThreads) // limits the number of goroutines running at once
 	var wg sync.WaitGroup
 
@@ -209,12 +529,12 @@ func importSegment(segment commoncrawl.WatSegment, dataDir commoncrawl.DataDir,
 			continue
 		}
 
-		linkFile := dataDir.TmpDir + "/" + segment.Segment + linkDir + watFile.Number + extensionTxtGz
+		linkFile := dataDir.SegmentTmpDir(segment) + linkDir + watFile.Number + extensionTxtGz
 		err := fileutils.CreateDataDirectory(filepath.Dir(linkFile))
 		if err != nil {
 			panic(fmt.Sprintf("Failed to create link file: %v", err))
 		}
-		pageFile := dataDir.TmpDir + "/" + segment.Segment + "/page/" + watFile.Number + extensionTxtGz
+		pageFile := dataDir.SegmentTmpDir(segment) + pageDir + watFile.Number + extensionTxtGz
 		if savePageData == true {
 			err = fileutils.CreateDataDirectory(filepath.Dir(pageFile))
 			if err != nil {
@@ -224,6 +544,15 @@ func importSegment(segment commoncrawl.WatSegment, dataDir commoncrawl.DataDir,
 
 		recordWatFile := dataDir.TmpDir + "/wat/" + filepath.Base(watFile.Path)
 
+		// the same WAT file was imported in other segment or archive, its links are already saved there
+		if importedWatFiles != nil && importedWatFiles.IsImported(watFile.Path) {
+			err = commoncrawl.UpdateSegmentLinkImportStatus(segmentList, segment.Segment, recordWatFile)
+			if err != nil {
+				panic(fmt.Sprintf("%s: %v", segment.Segment, err))
+			}
+			continue
+		}
+
 		if fileutils.FileExists(linkFile) {
 			// update segmentList with imported files info
 			err = commoncrawl.UpdateSegmentLinkImportStatus(segmentList, segment.Segment, recordWatFile)
@@ -233,6 +562,11 @@ func importSegment(segment commoncrawl.WatSegment, dataDir commoncrawl.DataDir,
 			continue
 		}
 
+		// file failed all attempts in this run, it is retried in the next run
+		if deadLetter != nil && deadLetter.FailedInRun(watFile.Path) {
+			continue
+		}
+
 		if *maxWatFiles <= 0 {
 			continue
 		}
@@ -249,8 +583,17 @@ func importSegment(segment commoncrawl.WatSegment, dataDir commoncrawl.DataDir,
 			panic(fmt.Sprintf("Failed to create file: %v", err))
 		}
 
+		// WAT file kept by --keep-wat is parsed again without download, empty file left by broken download is downloaded again
+		downloaded := fileutils.NonEmptyFileExists(recordWatFile)
+		if !downloaded && fileutils.FileExists(recordWatFile) {
+			err = os.Remove(recordWatFile)
+			if err != nil {
+				panic(fmt.Sprintf("Failed to remove empty WAT file: %v", err))
+			}
+		}
+
 		// sleep between WAT files to avoid common crawl transfer limitation
-		if sleepBetweenWat > 0 {
+		if !downloaded && sleepBetweenWat > 0 {
 			time.Sleep(time.Duration(sleepBetweenWat) * time.Second)
 		}
 
@@ -260,35 +603,98 @@ func importSegment(segment commoncrawl.WatSegment, dataDir commoncrawl.DataDir,
 		// this will block until one of the running goroutines finishes and reads from the channel.
 		guard <- struct{}{}
 
-		if !fileutils.FileExists(recordWatFile) {
-			err := fileutils.DownloadFile("https://data.commoncrawl.org/"+watFile.Path, recordWatFile, 2)
+		if !downloaded {
+			err = retryWatFile(attempts, func() error {
+				return downloadWatFile(watFile.Path, recordWatFile)
+			})
 			if err != nil {
-				log.Fatalf("Could not load WAT file %s: %v", watFile.Path, err)
+				<-guard
+				wg.Done()
+				addDeadLetterWatFile(deadLetter, segment.Segment, watFile.Path, attempts, err)
+				continue
 			}
 		}
 
-		fmt.Println("Importing file: ", recordWatFile)
+		events.fileStarted(segment.Segment, recordWatFile)
 
-		go func(recordFile string, linkFile string, pageFile string) {
+		go func(recordFile string, linkFile string, pageFile string, watPath string) {
 			defer wg.Done()            // Signal the WaitGroup that the goroutine is done after it finishes
 			defer func() { <-guard }() // Release the guard when the goroutine is done
 
-			err = commoncrawl.ParseWatByLine(recordWatFile, linkFile, pageFile, savePageData)
+			var emit commoncrawl.LinkEmitter
+			if sink != nil {
+				emit = sink.Emit
+			}
+			// broken WAT file is downloaded again, links of failed attempt are removed
+			attempt := 0
+			var fileStats fileMetrics
+			err := retryWatFile(attempts, func() error {
+				attempt++
+				if attempt > 1 {
+					_ = os.Remove(linkFile)
+					_ = os.Remove(pageFile)
+					_ = os.Remove(recordFile)
+					if err := downloadWatFile(watPath, recordFile); err != nil {
+						return err
+					}
+				}
+				var err error
+				fileStats, err = metrics.trackFile(recordFile, func() (commoncrawl.WatFileStats, error) {
+					ctx, cancel := watParseContext(parseTimeout)
+					defer cancel()
+					return commoncrawl.ParseWatFileContext(ctx, recordFile, linkFile, pageFile, savePageData, emit)
+				})
+				return err
+			})
+			if errors.Is(err, commoncrawl.ErrLinkEmit) {
+				_ = os.Remove(linkFile)
+				log.Fatalf("Could not publish links of %s: %v", recordFile, err)
+			}
 			if err != nil {
-				log.Fatalf("Could not open WAT file: %v", err)
+				_ = os.Remove(linkFile)
+				_ = os.Remove(pageFile)
+				if !keepWatFiles {
+					_ = os.Remove(recordFile)
+				}
+				addDeadLetterWatFile(deadLetter, segment.Segment, watPath, attempt, err)
+				return
+			}
+
+			// file is marked as imported only when broker received all its links, otherwise it is parsed again in next run
+			if sink != nil {
+				err = sink.Flush()
+				if err != nil {
+					_ = os.Remove(linkFile)
+					log.Fatalf("Could not publish links of %s: %v", recordFile, err)
+				}
 			}
+			events.fileFinished(segment.Segment, fileStats)
 
 			// save info that this file was parsed
-			err = commoncrawl.UpdateSegmentLinkImportStatus(segmentList, segment.Segment, recordWatFile)
+			err = commoncrawl.UpdateSegmentLinkImportStatus(segmentList, segment.Segment, recordFile)
 			if err != nil {
 				panic(fmt.Sprintf("%s: %v", segment.Segment, err))
 			}
+			if importedWatFiles != nil {
+				err = importedWatFiles.MarkImported(watPath)
+				if err != nil {
+					log.Fatalf("Could not save imported WAT file %s: %v", watPath, err)
+				}
+			}
+			if deadLetter != nil {
+				err = deadLetter.Remove(watPath)
+				if err != nil {
+					log.Fatalf("Could not save dead letter WAT files: %v", err)
+				}
+			}
 
-			err = os.Remove(recordFile)
-			if err != nil {
-				log.Fatalf("Could not delete file: %v", err)
+			if !keepWatFiles {
+				err = os.Remove(recordFile)
+				if err != nil {
+					log.Fatalf("Could not delete file: %v", err)
+				}
 			}
-		}(recordWatFile, linkFile, pageFile)
+		}(recordWatFile, linkFile, pageFile, watFile.Path)
 
 	}
 	wg.Wait() // This will block until all goroutines have called wg.Done()
@@ -296,7 +702,7 @@ func importSegment(segment commoncrawl.WatSegment, dataDir commoncrawl.DataDir,
 	// sort & compact the links and pages files
 	watFilesLeftQty := commoncrawl.CountFilesInSegmentToProcess(segment)
 	if watFilesLeftQty == 0 {
-		err = compactSegmentData(segment, dataDir, segmentList)
+		err = compactSegmentData(segment, dataDir, segmentList, metrics, importedWatFiles)
 		if err != nil {
 			panic(fmt.Sprintf("%s: %v", segment.Segment, err))
 		}
@@ -355,197 +761,609 @@ func setMaxWATFiles() int {
 	return maxFiles
 }
 
-// setDataDirectory set directory for datafiles
-func setDataDirectory() string {
-	envVar := "GLOBALLINKS_DATAPATH"
-	defaultVal := "data"
+// setCompactBufferSize sets the number of compacted links buffered before they are written to compacted file
+func setCompactBufferSize() int {
+	envVar := "GLOBALLINKS_COMPACTBUFFER"
+	defaultVal := 10000
+	minVal := 1
+	maxVal := 1000000
 
-	dataDir := os.Getenv(envVar)
-	if dataDir == "" {
+	bufferSizeStr := os.Getenv(envVar)
+	if bufferSizeStr == "" {
 		return defaultVal
 	}
 
-	return dataDir
+	bufferSize, err := strconv.Atoi(bufferSizeStr)
+	if err != nil {
+		log.Printf("Invalid number for %s: %v. Using default %d", envVar, err, defaultVal)
+		return defaultVal
+	}
+
+	if bufferSize < minVal || bufferSize > maxVal {
+		log.Printf("Number for %s must be between %d and %d. Using default %d", envVar, minVal, maxVal, defaultVal)
+		return defaultVal
+	}
+
+	return bufferSize
 }
 
-// sortOutFilesWithBashGz - sort the file with bash sort and save as gz with segment in name - you can use these segments to move pre processed data to other server
-func sortOutFilesWithBashGz(segmentSortedFile string, segmentLinksDir string) error {
-	cmdStr := "zcat " + segmentLinksDir + "/*.txt.gz | sort -u -S 1G | gzip > " + segmentSortedFile
-	if lowDiscSpaceMode == true {
-		// this solves disc problem on VPS servers at cost of sorting performance
-		cmdStr = "zcat " + segmentLinksDir + "/*.txt.gz | sort --compress-program=lzop -u -S 1G | gzip > " + segmentSortedFile
+// setMergeFanIn sets the maximum number of link files merged at once, more files are merged in passes
+func setMergeFanIn() int {
+	envVar := "GLOBALLINKS_MERGEFANIN"
+	defaultVal := 64
+	minVal := 2
+	maxVal := 1024
+
+	fanInStr := os.Getenv(envVar)
+	if fanInStr == "" {
+		return defaultVal
 	}
 
-	// Execute the command
-	cmd := exec.Command("bash", "-c", cmdStr)
-	err := cmd.Run()
+	fanIn, err := strconv.Atoi(fanInStr)
 	if err != nil {
-		return err
+		log.Printf("Invalid number for %s: %v. Using default %d", envVar, err, defaultVal)
+		return defaultVal
 	}
-	return err
-}
 
-// aggressiveCompacting - compact data from sort file to new compacted file saving space leave only strongest link from each host and number of similar links
-func aggressiveCompacting(segmentSortedFile string, linkSegmentCompacted string) error {
-	segmentCompactedFile := linkSegmentCompacted
+	if fanIn < minVal || fanIn > maxVal {
+		log.Printf("Number for %s must be between %d and %d. Using default %d", envVar, minVal, maxVal, defaultVal)
+		return defaultVal
+	}
 
-	// load data from sort file
-	const maxCapacityScanner = 3 * 1024 * 1024 // 3*1MB
+	return fanIn
+}
 
-	// Open the .gz file
-	file, err := os.Open(segmentSortedFile)
-	if err != nil {
-		return fmt.Errorf("error opening file: %w", err)
+// setWatAttempts sets how many times a WAT file is downloaded and parsed before it is saved in dead letter list
+func setWatAttempts() int {
+	envVar := "GLOBALLINKS_WATATTEMPTS"
+	defaultVal := 3
+	minVal := 1
+	maxVal := 10
+
+	attemptsStr := os.Getenv(envVar)
+	if attemptsStr == "" {
+		return defaultVal
 	}
-	defer file.Close()
 
-	// Create a gzip Reader
-	gzReader, err := gzip.NewReader(file)
+	attempts, err := strconv.Atoi(attemptsStr)
 	if err != nil {
-		return fmt.Errorf("error creating gzip reader: %w", err)
+		log.Printf("Invalid number for %s: %v. Using default %d", envVar, err, defaultVal)
+		return defaultVal
 	}
-	defer gzReader.Close()
 
-	// Use a bufio.Scanner to read the file line by line
-	scanner := bufio.NewScanner(gzReader)
-	// create buffer to avoid going over token size
-	buf := make([]byte, maxCapacityScanner)
-	scanner.Buffer(buf, maxCapacityScanner)
+	if attempts < minVal || attempts > maxVal {
+		log.Printf("Number for %s must be between %d and %d. Using default %d", envVar, minVal, maxVal, defaultVal)
+		return defaultVal
+	}
 
-	// Read each line and append to the records slice
-	line := ""
+	return attempts
+}
 
-	fileLink := FileLinkCompacted{}
-	finalLink := FileLinkCompacted{}
+// setWatParseTimeout sets how long one WAT file can be parsed before it is abandoned and saved in dead letter list, 0 disables the timeout
+func setWatParseTimeout() time.Duration {
+	envVar := "GLOBALLINKS_WATPARSETIMEOUT"
+	defaultVal := 1800
+	minVal := 0
+	maxVal := 86400
 
-	linksToSave := make([]FileLinkCompacted, 0, 10000)
+	timeoutStr := os.Getenv(envVar)
+	if timeoutStr == "" {
+		return time.Duration(defaultVal) * time.Second
+	}
 
-	i := 0
-	for scanner.Scan() {
-		i++
-		line = scanner.Text()
-		parts := strings.Split(line, "|")
-		if len(parts) != 14 {
-			// Invalid line - skip
-			continue
-		}
-		fileLink = FileLinkCompacted{}
-		fileLink.LinkDomain = parts[0]
-		fileLink.LinkSubDomain = parts[1]
-		fileLink.LinkPath = parts[2]
-		fileLink.LinkRawQuery = parts[3]
-		fileLink.LinkScheme = parts[4]
-		fileLink.PageHost = parts[5]
-		fileLink.PagePath = parts[6]
-		fileLink.PageRawQuery = parts[7]
-		fileLink.PageScheme = parts[8]
-		fileLink.LinkText = parts[9]
-		fileLink.NoFollow, _ = strconv.Atoi(parts[10])
-		fileLink.NoIndex, _ = strconv.Atoi(parts[11])
-		fileLink.DateFrom = parts[12]
-		fileLink.DateTo = parts[12]
-		fileLink.IP = parts[13]
-		fileLink.Qty = 1
-
-		saveLink := compareRecords(fileLink, &finalLink)
-		if saveLink {
-			if finalLink.LinkDomain != "" {
-				linksToSave = append(linksToSave, finalLink)
-			}
-			finalLink = fileLink
-		}
-		// save file every 10000 lines and reset linksToSave
-		if i >= 10000 {
-			i = 0
-			err = saveFinalLinksToFile(segmentCompactedFile, linksToSave)
-			if err != nil {
-				return err
-			}
-			linksToSave = make([]FileLinkCompacted, 0, 10000)
-		}
+	timeout, err := strconv.Atoi(timeoutStr)
+	if err != nil {
+		log.Printf("Invalid number for %s: %v. Using default %d seconds", envVar, err, defaultVal)
+		return time.Duration(defaultVal) * time.Second
 	}
 
-	// save final part of data
-	if len(linksToSave) > 0 {
-		err = saveFinalLinksToFile(segmentCompactedFile, linksToSave)
-		if err != nil {
-			return err
-		}
+	if timeout < minVal || timeout > maxVal {
+		log.Printf("Number for %s must be between %d and %d seconds. Using default %d seconds", envVar, minVal, maxVal, defaultVal)
+		return time.Duration(defaultVal) * time.Second
 	}
-	return err
-}
 
-// deleteWatPreProcessed - Delete files build during WAT processing
-func deleteWatPreProcessed(dirPath string) error {
-	pattern := `[0-9]{5}\.txt\.gz`
-	re := regexp.MustCompile(pattern)
+	return time.Duration(timeout) * time.Second
+}
 
-	files, err := filepath.Glob(filepath.Join(dirPath, "*.txt.gz"))
-	if err != nil {
-		return err
+// watParseContext - context of one WAT file parse, without deadline when timeout is 0
+func watParseContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
 	}
+	return context.WithTimeout(context.Background(), timeout)
+}
 
-	for _, file := range files {
-		if re.MatchString(filepath.Base(file)) {
-			err := os.Remove(file)
-			if err != nil {
-				// Handle the error, but continue processing other files.
-				fmt.Printf("Error deleting file %s: %s\n", file, err)
-			}
-		}
+// setBaseURL use Common Crawl mirror or cache instead of data.commoncrawl.org
+func setBaseURL() error {
+	envVar := "GLOBALLINKS_CC_BASE_URL"
+
+	baseURL := os.Getenv(envVar)
+	if baseURL == "" {
+		return nil
 	}
 
-	err = fileutils.DeleteDirectoryIfEmpty(dirPath)
+	err := commoncrawl.SetBaseURL(baseURL)
 	if err != nil {
-		return err
+		return fmt.Errorf("%s: %w", envVar, err)
 	}
 
 	return nil
 }
 
-// compactSegmentData - sort the file with bash sort and save as gz with segment in name - you can use these segments to move pre-processed data to other server
-func compactSegmentData(segment commoncrawl.WatSegment, dataDir commoncrawl.DataDir, segmentList *[]commoncrawl.WatSegment) error {
-	var err error
+// setLinkSink create sink publishing links to message broker, only link files are saved when GLOBALLINKS_SINK is empty or "file"
+func setLinkSink() (*linksink.BrokerSink, error) {
+	envVar := "GLOBALLINKS_SINK"
 
-	linkSegmentSorted := dataDir.LinksDir + "/sort_" + strconv.Itoa(segment.SegmentID) + extensionTxtGz
-	pageSegmentSorted := dataDir.PagesDir + "/sort_" + strconv.Itoa(segment.SegmentID) + extensionTxtGz
-	linkSegmentCompacted := dataDir.LinksDir + "/compact_" + strconv.Itoa(segment.SegmentID) + extensionTxtGz
+	switch os.Getenv(envVar) {
+	case "", "file":
+		return nil, nil
+	case "nats":
+	default:
+		return nil, fmt.Errorf("%s: unknown sink %q, use file or nats", envVar, os.Getenv(envVar))
+	}
 
-	if !fileutils.FileExists(linkSegmentSorted) {
+	sinkURL := os.Getenv("GLOBALLINKS_SINK_URL")
+	if sinkURL == "" {
+		sinkURL = "nats://127.0.0.1:4222"
+	}
 
-		err = sortOutFilesWithBashGz(linkSegmentSorted, dataDir.TmpDir+"/"+segment.Segment+linkDir)
+	sinkConfig := linksink.DefaultConfig
+	if subject := os.Getenv("GLOBALLINKS_SINK_SUBJECT"); subject != "" {
+		sinkConfig.Subject = subject
+	}
+	if batchSize, err := strconv.Atoi(os.Getenv("GLOBALLINKS_SINK_BATCH")); err == nil && batchSize > 0 {
+		sinkConfig.BatchSize = batchSize
+	}
+
+	publisher, err := linksink.NewNATSPublisher(sinkURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %w", sinkURL, err)
+	}
+
+	return linksink.NewBrokerSink(publisher, sinkConfig), nil
+}
+
+// setDataDirectory set directory for datafiles
+func setDataDirectory() string {
+	envVar := "GLOBALLINKS_DATAPATH"
+	defaultVal := "data"
+
+	dataDir := os.Getenv(envVar)
+	if dataDir == "" {
+		return defaultVal
+	}
+
+	return dataDir
+}
+
+// setFileNaming sets templates of segment files. GLOBALLINKS_ARCHIVEINFILENAME=true adds archive name to default names,
+// GLOBALLINKS_SORTFILE, GLOBALLINKS_COMPACTFILE and GLOBALLINKS_SEGMENTTMPDIR override single templates
+func setFileNaming() commoncrawl.FileNaming {
+	naming := commoncrawl.DefaultFileNaming
+	if os.Getenv("GLOBALLINKS_ARCHIVEINFILENAME") == "true" {
+		naming = commoncrawl.ArchiveFileNaming
+	}
+
+	if template := os.Getenv("GLOBALLINKS_SORTFILE"); template != "" {
+		naming.SortedFile = template
+	}
+	if template := os.Getenv("GLOBALLINKS_COMPACTFILE"); template != "" {
+		naming.CompactedFile = template
+	}
+	if template := os.Getenv("GLOBALLINKS_SEGMENTTMPDIR"); template != "" {
+		naming.SegmentTmpDir = template
+	}
+
+	if err := naming.Validate(); err != nil {
+		log.Printf("Invalid file naming: %v. Using default", err)
+		return commoncrawl.DefaultFileNaming
+	}
+
+	return naming
+}
+
+// setDofollowOnly - GLOBALLINKS_DOFOLLOWONLY=true drops nofollow links during compaction, by default all links are kept
+func setDofollowOnly() bool {
+	return os.Getenv("GLOBALLINKS_DOFOLLOWONLY") == "true"
+}
+
+// setPagePathPolicy - GLOBALLINKS_PAGEPATHPOLICY chooses page path of link found on many pages of one host during compaction:
+// shortest (default), most-recent or most-frequent
+func setPagePathPolicy() string {
+	envVar := "GLOBALLINKS_PAGEPATHPOLICY"
+	policy := os.Getenv(envVar)
+	switch policy {
+	case "":
+		return pagePathShortest
+	case pagePathShortest, pagePathMostRecent, pagePathMostFrequent:
+		return policy
+	}
+
+	log.Printf("Invalid page path policy for %s: %s. Using default %s", envVar, policy, pagePathShortest)
+	return pagePathShortest
+}
+
+// setMergeSorted - GLOBALLINKS_MERGESORTED=true merges link files parsed from WAT files, which are already sorted, instead of sorting all lines again
+func setMergeSorted() bool {
+	return os.Getenv("GLOBALLINKS_MERGESORTED") == "true"
+}
+
+// sortFiles - sort and deduplicate all files from directory into one gzipped file, replaced in tests
+var sortFiles = sortOutFilesWithBashGz
+
+// sortOutFilesWithBashGz - sort the file with bash sort and save as gz with segment in name - you can use these segments to move pre processed data to other server
+func sortOutFilesWithBashGz(segmentSortedFile string, segmentLinksDir string) error {
+	// pipefail reports failed zcat or sort, otherwise only exit code of gzip is checked.
+	// LC_ALL=C sorts bytes like merge of sorted files and diff expect, locale of server would change order of lines
+	sortBuffer := strconv.Itoa(sortBufferMB) + "M"
+	cmdStr := "set -o pipefail; zcat " + segmentLinksDir + "/*.txt.gz | LC_ALL=C sort -u -S " + sortBuffer + " | gzip > " + segmentSortedFile
+	if lowDiscSpaceMode == true {
+		// this solves disc problem on VPS servers at cost of sorting performance
+		cmdStr = "set -o pipefail; zcat " + segmentLinksDir + "/*.txt.gz | LC_ALL=C sort --compress-program=lzop -u -S " + sortBuffer + " | gzip > " + segmentSortedFile
+	}
+
+	// Execute the command
+	cmd := exec.Command("bash", "-c", cmdStr)
+	err := cmd.Run()
+	if err != nil {
+		return err
+	}
+	return err
+}
+
+// saveCompactedLinks - write buffered compacted links, replaced in tests
+var saveCompactedLinks = saveFinalLinksToFile
+
+// aggressiveCompacting - compact data from sort file to new compacted file saving space leave only strongest link from each host and number of similar links.
+// Compacted file is written with one gzip stream, links are buffered and written every GLOBALLINKS_COMPACTBUFFER links.
+// Nofollow links are dropped when GLOBALLINKS_DOFOLLOWONLY is enabled, page path of link found on many pages of one host is chosen by GLOBALLINKS_PAGEPATHPOLICY
+func aggressiveCompacting(segmentSortedFile string, linkSegmentCompacted string) error {
+	segmentCompactedFile := linkSegmentCompacted
+	bufferSize := setCompactBufferSize()
+	dofollowOnly := setDofollowOnly()
+	pagePolicy := setPagePathPolicy()
+	pagePaths := newPagePathChooser(pagePolicy)
+	// with more than one page per link every kept page is saved as own compacted link
+	var keptPages *sourcePages
+	if compactPages := setCompactPages(); compactPages > 1 {
+		keptPages = newSourcePages(compactPages, pagePolicy)
+	}
+
+	// load data from sort file
+	maxCapacityScanner := fileutils.ScannerBufferSize(fileutils.DefaultScannerBufferSize)
+
+	// Open the .gz file
+	file, err := os.Open(segmentSortedFile)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	// Create a gzip Reader
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("error creating gzip reader: %w", err)
+	}
+	defer gzReader.Close()
+
+	// compacted file left by interrupted compaction is replaced, appending to it would duplicate links
+	fileOut, err := os.Create(segmentCompactedFile)
+	if err != nil {
+		return fmt.Errorf("error creating compacted file: %w", err)
+	}
+	defer fileOut.Close()
+	writer := gzip.NewWriter(fileOut)
+
+	// read the file line by line, too long lines are skipped instead of stopping the scan
+	scanner := fileutils.NewGZScanner(gzReader, maxCapacityScanner)
+
+	// Read each line and append to the records slice
+	line := ""
+
+	finalLink := commoncrawl.FileLinkCompacted{}
+
+	linksToSave := make([]commoncrawl.FileLinkCompacted, 0, bufferSize)
+
+	for scanner.Scan() {
+		line = scanner.Text()
+		fileLink, decodeErr := commoncrawl.DecodeSortedLink(line)
+		if decodeErr != nil {
+			// Invalid line - skip
+			continue
+		}
+		if dofollowOnly && fileLink.NoFollow == 1 {
+			continue
+		}
+
+		if keptPages != nil {
+			linksToSave = append(linksToSave, keptPages.add(fileLink)...)
+		} else if compareRecords(fileLink, &finalLink, pagePaths) {
+			if finalLink.LinkDomain != "" {
+				linksToSave = append(linksToSave, finalLink)
+			}
+			finalLink = fileLink
+			pagePaths.start(fileLink)
+		}
+		// write buffered links to gzip stream and reset linksToSave, number of buffered links is checked
+		// because many sorted lines can be compacted into one link
+		if len(linksToSave) >= bufferSize {
+			err = saveCompactedLinks(writer, linksToSave)
+			if err != nil {
+				return err
+			}
+			linksToSave = linksToSave[:0]
+		}
+	}
+
+	if skippedLines := scanner.SkippedLines(); skippedLines > 0 {
+		log.Printf("Skipped %d lines longer than %d bytes in %s\n", skippedLines, maxCapacityScanner, segmentSortedFile)
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("error scanning the file: %w", err)
+	}
+
+	// last link is not followed by a different one, so it has to be added here
+	if finalLink.LinkDomain != "" {
+		linksToSave = append(linksToSave, finalLink)
+	}
+	if keptPages != nil {
+		linksToSave = append(linksToSave, keptPages.flush()...)
+	}
+
+	// save final part of data
+	err = saveCompactedLinks(writer, linksToSave)
+	if err != nil {
+		return err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("error closing compacted file: %w", err)
+	}
+
+	return fileOut.Close()
+}
+
+// watPreProcessedFile - link or page file parsed from one WAT file, deleted after sort
+var watPreProcessedFile = regexp.MustCompile(`[0-9]{5}\.txt\.gz`)
+
+// sortWatPreProcessed - sort files parsed from WAT files and delete them only when sorted file covers all of them.
+// Sorted file is removed when verification fails, so inputs can be sorted again in next run
+func sortWatPreProcessed(sortedFile string, dirPath string) error {
+	inputFiles, err := watPreProcessedFiles(dirPath)
+	if err != nil {
+		return err
+	}
+	if len(inputFiles) == 0 {
+		return fmt.Errorf("no files to sort in %s", dirPath)
+	}
+
+	if setMergeSorted() {
+		err = mergeSortedFiles(sortedFile, inputFiles, memoryFanIn(setMergeFanIn(), sortBufferMB))
+		if errors.Is(err, errNotSorted) {
+			log.Printf("Sorting all lines of %s, files can't be merged: %v", dirPath, err)
+			err = sortFiles(sortedFile, dirPath)
+		}
+	} else {
+		err = sortFiles(sortedFile, dirPath)
+	}
+	if err != nil {
+		_ = os.Remove(sortedFile)
+		return fmt.Errorf("could not sort file: %v", err)
+	}
+
+	err = verifySortedFile(sortedFile, inputFiles)
+	if err != nil {
+		_ = os.Remove(sortedFile)
+		return fmt.Errorf("sorted file %s is not complete, %d input files are kept: %v", sortedFile, len(inputFiles), err)
+	}
+
+	err = deleteWatPreProcessed(dirPath)
+	if err != nil {
+		return fmt.Errorf("could not delete WAT processed files: %v", err)
+	}
+
+	return nil
+}
+
+// sortSegmentFiles - sort files parsed from WAT files of segment. When every WAT file of segment was imported in other archive or segment
+// nothing was parsed, sorted file is empty and segment is compacted into empty file. Missing files of WAT files not imported before are
+// an error, their links would be lost
+func sortSegmentFiles(sortedFile string, dirPath string, allImported bool) error {
+	inputFiles, err := watPreProcessedFiles(dirPath)
+	if err != nil {
+		return err
+	}
+	if len(inputFiles) > 0 {
+		return sortWatPreProcessed(sortedFile, dirPath)
+	}
+	if !allImported {
+		return fmt.Errorf("no files parsed from WAT files in %s, but not all WAT files of segment were imported before", dirPath)
+	}
+
+	log.Printf("No files parsed from WAT files in %s, all WAT files were imported before\n", dirPath)
+	if fileutils.DirExists(dirPath) {
+		err = fileutils.DeleteDirectoryIfEmpty(dirPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeEmptyGzFile(sortedFile)
+}
+
+// allWatFilesImported - every WAT file of segment is saved in imported WAT files
+func allWatFilesImported(segment commoncrawl.WatSegment, importedWatFiles *commoncrawl.ImportedWatFiles) bool {
+	if importedWatFiles == nil {
+		return false
+	}
+	for _, watFile := range segment.WatFiles {
+		if !importedWatFiles.IsImported(watFile.Path) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeEmptyGzFile - create gzip file without lines
+func writeEmptyGzFile(filePath string) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+
+	err = gzip.NewWriter(file).Close()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// watPreProcessedFiles - files parsed from WAT files in directory
+func watPreProcessedFiles(dirPath string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dirPath, "*.txt.gz"))
+	if err != nil {
+		return nil, err
+	}
+
+	inputFiles := make([]string, 0, len(files))
+	for _, file := range files {
+		if watPreProcessedFile.MatchString(filepath.Base(file)) {
+			inputFiles = append(inputFiles, file)
+		}
+	}
+	return inputFiles, nil
+}
+
+// verifySortedFile - sorted file has no more lines than input files and it is not empty when inputs have lines, all files have to be complete gzip files
+func verifySortedFile(sortedFile string, inputFiles []string) error {
+	inputLines := 0
+	for _, file := range inputFiles {
+		lines, err := countGzLines(file)
+		if err != nil {
+			return fmt.Errorf("input file %s: %w", file, err)
+		}
+		inputLines += lines
+	}
+
+	sortedLines, err := countGzLines(sortedFile)
+	if err != nil {
+		return err
+	}
+
+	if inputLines > 0 && sortedLines == 0 {
+		return fmt.Errorf("sorted file is empty, input files have %d lines", inputLines)
+	}
+	// sort -u only removes duplicates
+	if sortedLines > inputLines {
+		return fmt.Errorf("sorted file has %d lines, input files have %d lines", sortedLines, inputLines)
+	}
+
+	return nil
+}
+
+// countGzLines - number of lines in gzipped file, truncated file is reported as error
+func countGzLines(filePath string) (int, error) {
+	maxCapacityScanner := fileutils.ScannerBufferSize(fileutils.DefaultScannerBufferSize)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, fmt.Errorf("error creating gzip reader: %w", err)
+	}
+	defer gzReader.Close()
+
+	// too long lines are counted too, compacting skips them but they are still part of sorted file
+	scanner := fileutils.NewGZScanner(gzReader, maxCapacityScanner)
+
+	lines := 0
+	for scanner.Scan() {
+		lines++
+	}
+	if err = scanner.Err(); err != nil {
+		return lines + scanner.SkippedLines(), fmt.Errorf("error reading file after line %d: %w", lines+scanner.SkippedLines(), err)
+	}
+
+	return lines + scanner.SkippedLines(), nil
+}
+
+// deleteWatPreProcessed - Delete files build during WAT processing
+func deleteWatPreProcessed(dirPath string) error {
+	files, err := watPreProcessedFiles(dirPath)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		err := os.Remove(file)
+		if err != nil {
+			// Handle the error, but continue processing other files.
+			fmt.Printf("Error deleting file %s: %s\n", file, err)
+		}
+	}
+
+	err = fileutils.DeleteDirectoryIfEmpty(dirPath)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// compactSegmentData - sort the file with bash sort and save as gz with segment in name - you can use these segments to move pre-processed data to other server
+func compactSegmentData(segment commoncrawl.WatSegment, dataDir commoncrawl.DataDir, segmentList *[]commoncrawl.WatSegment, metrics *segmentMetrics, importedWatFiles *commoncrawl.ImportedWatFiles) error {
+	var err error
+
+	linkSegmentSorted := dataDir.SortedLinksFile(segment)
+	pageSegmentSorted := dataDir.SortedPagesFile(segment)
+	linkSegmentCompacted := dataDir.CompactedLinksFile(segment)
+	segmentTmpDir := dataDir.SegmentTmpDir(segment)
+
+	// compacted file of earlier run is never replaced, segment imported again has all its WAT files imported and would be compacted empty
+	if fileutils.FileExists(linkSegmentCompacted) {
+		inputFiles, err := watPreProcessedFiles(segmentTmpDir + linkDir)
 		if err != nil {
-			return fmt.Errorf("could not sort file: %v", err)
+			return err
+		}
+		if len(inputFiles) > 0 {
+			return fmt.Errorf("compacted file %s exists, %d link files in %s are not compacted into it", linkSegmentCompacted, len(inputFiles), segmentTmpDir+linkDir)
 		}
-		err = deleteWatPreProcessed(dataDir.TmpDir + "/" + segment.Segment + linkDir)
+		log.Printf("Segment %s is already compacted to %s\n", segment.Segment, linkSegmentCompacted)
+		return commoncrawl.UpdateSegmentImportEnd(segmentList, segment.Segment)
+	}
+
+	if !fileutils.FileExists(linkSegmentSorted) {
+
+		allImported := allWatFilesImported(segment, importedWatFiles)
+		err = sortSegmentFiles(linkSegmentSorted, segmentTmpDir+linkDir, allImported)
 		if err != nil {
-			return fmt.Errorf("could not delete WAT processed files: %v", err)
+			return err
 		}
 		if savePageData == true {
-			err = sortOutFilesWithBashGz(pageSegmentSorted, dataDir.TmpDir+"/"+segment.Segment+pageDir)
-			if err != nil {
-				return fmt.Errorf("could not sort file: %v", err)
-			}
-			err = deleteWatPreProcessed(dataDir.TmpDir + "/" + segment.Segment + pageDir)
+			err = sortSegmentFiles(pageSegmentSorted, segmentTmpDir+pageDir, allImported)
 			if err != nil {
-				return fmt.Errorf("could not delete WAT processed files: %v", err)
+				return err
 			}
 		}
 
 		if fileutils.FileExists(linkSegmentSorted) {
 
-			err = fileutils.DeleteDirectoryIfEmpty(dataDir.TmpDir + "/" + segment.Segment)
+			err = fileutils.DeleteDirectoryIfEmpty(segmentTmpDir)
 			if err != nil {
 				return fmt.Errorf("could not delete tmp directories: %v", err)
 			}
 
-			err = aggressiveCompacting(linkSegmentSorted, linkSegmentCompacted)
-			if err != nil {
-				return fmt.Errorf("could not compact file: %v", err)
-			}
-			err = os.Remove(linkSegmentSorted)
+			err = compactSortedLinks(linkSegmentSorted, linkSegmentCompacted)
 			if err != nil {
-				return fmt.Errorf("could not delete file: %v", err)
+				return err
 			}
 
 			// save info that segment was finished
@@ -553,6 +1371,8 @@ func compactSegmentData(segment commoncrawl.WatSegment, dataDir commoncrawl.Data
 			if err != nil {
 				return fmt.Errorf("%v", err)
 			}
+
+			events.segmentFinished(segment.Segment, metrics.summary(), commoncrawl.GetDomainFailures(), commoncrawl.GetDomainCacheLookups())
 		} else {
 			if err != nil {
 				return fmt.Errorf("can't find sorted file!\n")
@@ -563,14 +1383,66 @@ func compactSegmentData(segment commoncrawl.WatSegment, dataDir commoncrawl.Data
 	return nil
 }
 
-// compareRecords - compare compacted record and next record return true if we should save current record, also update compacted with information from current record when we don't have to save it
-func compareRecords(fileLink FileLinkCompacted, finalLink *FileLinkCompacted) bool {
+// compactSortedLinks - compact sorted link file of segment and delete it
+func compactSortedLinks(sortedFile string, compactedFile string) error {
+	err := aggressiveCompacting(sortedFile, compactedFile)
+	if err != nil {
+		return fmt.Errorf("could not compact file: %v", err)
+	}
+	err = os.Remove(sortedFile)
+	if err != nil {
+		return fmt.Errorf("could not delete file: %v", err)
+	}
+	return nil
+}
+
+// runRecompact - sort and compact link files parsed from WAT files left in segment directory, compacted file is saved in segment directory
+// when it is not given. Returns exit code
+func runRecompact(args []string) int {
+	segmentDir := args[0]
+	compactedFile := filepath.Join(segmentDir, "compact"+extensionTxtGz)
+	if len(args) > 1 {
+		compactedFile = args[1]
+	}
+
+	sortedFile := filepath.Join(filepath.Dir(compactedFile), "sort_"+filepath.Base(compactedFile))
+
+	err := recompactSegmentDir(segmentDir, sortedFile, compactedFile)
+	if err != nil {
+		fmt.Println("Recompacting failed: " + err.Error())
+		return 1
+	}
+	fmt.Println("Compacted links saved in " + compactedFile)
+
+	return 0
+}
+
+// recompactSegmentDir - rebuild compacted file from link files of segment directory the same way as compactSegmentData, link files are deleted
+// after they are sorted. Sorted file is compacted again when link files were already deleted by interrupted compaction
+func recompactSegmentDir(segmentDir string, sortedFile string, compactedFile string) error {
+	inputFiles, err := watPreProcessedFiles(segmentDir + linkDir)
+	if err != nil {
+		return err
+	}
+	if len(inputFiles) > 0 || !fileutils.FileExists(sortedFile) {
+		err = sortWatPreProcessed(sortedFile, segmentDir+linkDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return compactSortedLinks(sortedFile, compactedFile)
+}
+
+// compareRecords - compare compacted record and next record return true if we should save current record, also update compacted with information from current record when we don't have to save it.
+// Page path of compacted record is chosen by pagePaths
+func compareRecords(fileLink commoncrawl.FileLinkCompacted, finalLink *commoncrawl.FileLinkCompacted, pagePaths *pagePathChooser) bool {
 	if fileLink.LinkDomain == "" {
 		return true
 	}
 
 	// if both record are different return true to save current link
-	if fileLink.LinkDomain != "" && (fileLink.LinkDomain != finalLink.LinkDomain || fileLink.LinkSubDomain != finalLink.LinkSubDomain || fileLink.LinkPath != finalLink.LinkPath || fileLink.LinkRawQuery != finalLink.LinkRawQuery || fileLink.PageHost != finalLink.PageHost) {
+	if !sameCompactedLink(fileLink, *finalLink) {
 		return true
 	}
 
@@ -579,6 +1451,18 @@ func compareRecords(fileLink FileLinkCompacted, finalLink *FileLinkCompacted) bo
 		return false
 	}
 
+	mergeLinkType(finalLink, fileLink)
+
+	// link from other page of the same host
+	if !samePage(fileLink, *finalLink) {
+		finalLink.Qty++
+	}
+	// page path is chosen before dates are updated, so the most recent page is known
+	if pagePaths.better(fileLink, *finalLink) {
+		finalLink.PageRawQuery = fileLink.PageRawQuery
+		finalLink.PagePath = fileLink.PagePath
+	}
+
 	// update date from and date to
 	if fileLink.DateFrom < finalLink.DateFrom {
 		finalLink.DateFrom = fileLink.DateFrom
@@ -590,115 +1474,340 @@ func compareRecords(fileLink FileLinkCompacted, finalLink *FileLinkCompacted) bo
 	// take ip from latest record
 	finalLink.IP = fileLink.IP
 
-	if fileLink.PagePath != finalLink.PagePath || fileLink.PageRawQuery != finalLink.PageRawQuery {
-		if len(fileLink.PagePath) < len(finalLink.PagePath) {
-			// select shortest path if query is the same or shorter
-			if len(fileLink.PageRawQuery) <= len(finalLink.PageRawQuery) {
-				finalLink.PageRawQuery = fileLink.PageRawQuery
-				finalLink.PagePath = fileLink.PagePath
-			}
-		} else if len(fileLink.PagePath) == len(finalLink.PagePath) && len(fileLink.PageRawQuery) < len(finalLink.PageRawQuery) {
-			// select shortest query if path is the same
-			finalLink.PageRawQuery = fileLink.PageRawQuery
-		}
-		finalLink.Qty++
-		//		fmt.Printf("%d", finalLink.Qty)
-	}
-
 	return false
 }
 
-// saveFinalLinksToFile - save final compacted links to file
-func saveFinalLinksToFile(segmentCompactedFile string, linksToSave []FileLinkCompacted) error {
-	// Open the file for writing, create it if not exists, append to it if it does.
-	fileOut, err := os.OpenFile(segmentCompactedFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o666)
-	if err != nil {
-		fmt.Printf("Error opening file: %s\n", err)
-		return err
+// page path policies of compaction, link found on many pages of one host is saved once with path of one of them
+const (
+	pagePathShortest     = "shortest"      // the shortest path, then the shortest query, usually the most canonical page
+	pagePathMostRecent   = "most-recent"   // page of the latest crawl
+	pagePathMostFrequent = "most-frequent" // page found in the most sorted lines, duplicated pages of many WAT files
+)
+
+// pagePathChooser - choose page path of compacted link, numbers of lines of every page path are counted for most-frequent policy
+type pagePathChooser struct {
+	policy string
+	counts map[string]int // page path and query -> number of lines of current compacted link
+}
+
+// newPagePathChooser - chooser of page path with policy, unknown policy chooses the shortest path
+func newPagePathChooser(policy string) *pagePathChooser {
+	return &pagePathChooser{policy: policy, counts: make(map[string]int)}
+}
+
+// start - first line of new compacted link
+func (c *pagePathChooser) start(link commoncrawl.FileLinkCompacted) {
+	if c.policy != pagePathMostFrequent {
+		return
 	}
-	defer fileOut.Close()
-	writer := gzip.NewWriter(fileOut)
+	clear(c.counts)
+	c.counts[link.PagePath+"?"+link.PageRawQuery] = 1
+}
 
+// better - page of fileLink should replace page of compacted link, ties keep page of compacted link
+func (c *pagePathChooser) better(fileLink commoncrawl.FileLinkCompacted, finalLink commoncrawl.FileLinkCompacted) bool {
+	switch c.policy {
+	case pagePathMostRecent:
+		return fileLink.DateTo > finalLink.DateTo
+	case pagePathMostFrequent:
+		page := fileLink.PagePath + "?" + fileLink.PageRawQuery
+		c.counts[page]++
+		return c.counts[page] > c.counts[finalLink.PagePath+"?"+finalLink.PageRawQuery]
+	}
+
+	if fileLink.PagePath == finalLink.PagePath && fileLink.PageRawQuery == finalLink.PageRawQuery {
+		return false
+	}
+	if len(fileLink.PagePath) < len(finalLink.PagePath) {
+		// select shortest path if query is the same or shorter
+		return len(fileLink.PageRawQuery) <= len(finalLink.PageRawQuery)
+	}
+	// select shortest query if path is the same
+	return len(fileLink.PagePath) == len(finalLink.PagePath) && len(fileLink.PageRawQuery) < len(finalLink.PageRawQuery)
+}
+
+// saveFinalLinksToFile - write final compacted links to gzip stream of compacted file, the writer is kept open for next links
+func saveFinalLinksToFile(writer io.Writer, linksToSave []commoncrawl.FileLinkCompacted) error {
 	for _, finalLinkToSave := range linksToSave {
 		// ignore empty records created while building linkToSave
 		if finalLinkToSave.LinkDomain == "" {
 			continue
 		}
-		_, err = writer.Write([]byte(fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%d|%d|%s|%s|%s|%d\n",
-			finalLinkToSave.LinkDomain,
-			finalLinkToSave.LinkSubDomain,
-			finalLinkToSave.LinkPath,
-			finalLinkToSave.LinkRawQuery,
-			finalLinkToSave.LinkScheme,
-			finalLinkToSave.PageHost,
-			finalLinkToSave.PagePath,
-			finalLinkToSave.PageRawQuery,
-			finalLinkToSave.PageScheme,
-			finalLinkToSave.LinkText,
-			finalLinkToSave.NoFollow,
-			finalLinkToSave.NoIndex,
-			finalLinkToSave.DateFrom,
-			finalLinkToSave.DateTo,
-			finalLinkToSave.IP,
-			finalLinkToSave.Qty,
-		)))
+		_, err := io.WriteString(writer, commoncrawl.EncodeCompactedLink(finalLinkToSave))
 		if err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
+
+// compactedFileReport - result of compacted file validation
+type compactedFileReport struct {
+	Lines     int
+	Malformed int
+	Examples  []string // first malformed lines with line number and reason
+}
+
+// runValidate - validate compacted file, optional second argument is accepted number of malformed lines. Returns exit code
+func runValidate(args []string) int {
+	maxMalformed := 0
+	if len(args) > 1 {
+		var err error
+		maxMalformed, err = strconv.Atoi(args[1])
+		if err != nil || maxMalformed < 0 {
+			fmt.Println("Invalid number of accepted malformed lines: " + args[1])
+			return 1
+		}
+	}
 
+	report, err := validateCompactedFile(args[0], 10)
+	fmt.Printf("Lines: %d, malformed: %d\n", report.Lines, report.Malformed)
+	for _, example := range report.Examples {
+		fmt.Println(example)
 	}
+	if err != nil {
+		fmt.Println("File is broken: " + err.Error())
+		return 1
+	}
+	if report.Malformed > maxMalformed {
+		return 1
+	}
+	return 0
+}
 
-	err = writer.Close()
+// validateCompactedFile - stream compacted file and count malformed lines, error is returned when file can't be read till the end
+func validateCompactedFile(filePath string, maxExamples int) (compactedFileReport, error) {
+	report := compactedFileReport{}
+
+	maxCapacityScanner := fileutils.ScannerBufferSize(fileutils.DefaultScannerBufferSize)
+
+	file, err := os.Open(filePath)
 	if err != nil {
-		return err
+		return report, fmt.Errorf("error opening file: %w", err)
 	}
+	defer file.Close()
 
-	return nil
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		return report, fmt.Errorf("error creating gzip reader: %w", err)
+	}
+	defer gzReader.Close()
+
+	scanner := fileutils.NewGZScanner(gzReader, maxCapacityScanner)
+
+	for scanner.Scan() {
+		report.Lines++
+		line := scanner.Text()
+		fileLink, lineErr := commoncrawl.DecodeCompactedLink(line)
+		if lineErr == nil {
+			lineErr = commoncrawl.ValidateCompactedLink(fileLink)
+		}
+		if lineErr != nil {
+			report.Malformed++
+			if len(report.Examples) < maxExamples {
+				report.Examples = append(report.Examples, fmt.Sprintf("line %d: %v: %s", report.Lines, lineErr, line))
+			}
+		}
+	}
+
+	// truncated gzip stream or broken checksum is reported here
+	if err = scanner.Err(); err != nil {
+		return report, fmt.Errorf("error reading file after line %d: %w", report.Lines, err)
+	}
+
+	// too long lines are skipped by scanner, they are malformed too
+	if skippedLines := scanner.SkippedLines(); skippedLines > 0 {
+		report.Lines += skippedLines
+		report.Malformed += skippedLines
+		if len(report.Examples) < maxExamples {
+			report.Examples = append(report.Examples, fmt.Sprintf("%d lines longer than %d bytes", skippedLines, maxCapacityScanner))
+		}
+	}
+
+	return report, nil
 }
 
-// parseSegmentInput - parse segment input from command line to generate list of segmentID to import
+// parseSegmentInput - parse segment input from command line to generate list of segmentID to import.
+// Input is comma separated list of segment IDs and ranges like 1-3,7, returns sorted segment IDs without duplicates
 func parseSegmentInput(segments string) ([]int, error) {
 	var results []int
-	parts := strings.Split(segments, ",")
-	if len(parts) > 1 {
-		for _, part := range parts {
-			result, err := strconv.Atoi(part)
-			if err != nil {
-				return nil, err
-			}
-			results = append(results, result)
+	for _, token := range strings.Split(segments, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			// trailing comma
+			continue
 		}
-		return results, nil
+
+		tokenSegments, err := parseSegmentToken(token)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, tokenSegments...)
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no segments in %q", segments)
+	}
+
+	slices.Sort(results)
+	return slices.Compact(results), nil
+}
+
+// parseSegmentToken - segment IDs of single segment ID or range of segments
+func parseSegmentToken(token string) ([]int, error) {
+	startStr, endStr, isRange := strings.Cut(token, "-")
+	start, err := strconv.Atoi(startStr)
+	if err != nil || start < 0 {
+		return nil, fmt.Errorf("invalid segment: %q", token)
+	}
+	if !isRange {
+		return []int{start}, nil
+	}
+
+	end, err := strconv.Atoi(endStr)
+	if err != nil || start > end {
+		return nil, fmt.Errorf("invalid range: %q", token)
+	}
+	results := make([]int, 0, end-start+1)
+	for i := start; i <= end; i++ {
+		results = append(results, i)
+	}
+	return results, nil
+}
+
+// parseSegmentsFile - parse file with one segment ID or range per line in the format of parseSegmentInput.
+// Empty lines and comments starting with # are skipped, returns sorted segment IDs without duplicates
+func parseSegmentsFile(path string) ([]int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
+	defer file.Close()
 
-	if strings.Contains(segments, "-") {
-		rangeParts := strings.Split(segments, "-")
-		if len(rangeParts) != 2 {
-			return nil, fmt.Errorf("invalid range: %s", segments)
+	var results []int
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
 		}
-		start, err := strconv.Atoi(rangeParts[0])
+
+		segments, err := parseSegmentInput(line)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
 		}
-		end, err := strconv.Atoi(rangeParts[1])
+		results = unionSegmentIDs(results, segments)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// unionSegmentIDs - sorted segment IDs from both lists without duplicates
+func unionSegmentIDs(a []int, b []int) []int {
+	results := append(slices.Clone(a), b...)
+	slices.Sort(results)
+	return slices.Compact(results)
+}
+
+// validateSegmentIDs - check if all segment IDs exist in segment list
+func validateSegmentIDs(segmentList []commoncrawl.WatSegment, segmentIDs []int) error {
+	var missing []string
+	for _, segmentID := range segmentIDs {
+		_, err := commoncrawl.SelectSegmentByID(segmentList, segmentID)
 		if err != nil {
-			return nil, err
+			missing = append(missing, strconv.Itoa(segmentID))
 		}
-		if start > end {
-			return nil, fmt.Errorf("invalid range: %s", segments)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("segments not found in archive: %s", strings.Join(missing, ","))
+	}
+	return nil
+}
+
+// runSample - print random links from compacted file, --seed makes the sample reproducible. Returns exit code
+func runSample(args []string) int {
+	sampleSize, err := strconv.Atoi(args[1])
+	if err != nil || sampleSize < 1 {
+		fmt.Println("Invalid number of links: " + args[1])
+		return 1
+	}
+
+	flags := flag.NewFlagSet("sample", flag.ContinueOnError)
+	seed := flags.Int64("seed", time.Now().UnixNano(), "random seed, the same seed returns the same sample")
+	err = flags.Parse(args[2:])
+	if err != nil {
+		return 1
+	}
+
+	sample, lines, err := sampleCompactedFile(args[0], sampleSize, rand.New(rand.NewSource(*seed)))
+	if err != nil {
+		fmt.Println("Sampling failed: " + err.Error())
+		return 1
+	}
+
+	for _, fileLink := range sample {
+		fmt.Printf("%s <- %s\n", fileLink.LinkURL(), fileLink.PageURL())
+		fmt.Printf("    text: %q, nofollow: %d, page noindex: %d, dates: %s - %s, ip: %s, qty: %d", fileLink.LinkText, fileLink.NoFollow, fileLink.PageNoIndex, fileLink.DateFrom, fileLink.DateTo, fileLink.IP, fileLink.Qty)
+		if fileLink.LinkType != "" {
+			fmt.Printf(", type: %s", fileLink.LinkType)
 		}
-		for i := start; i <= end; i++ {
-			results = append(results, i)
+		if fileLink.LinkTitle != "" {
+			fmt.Printf(", title: %q", fileLink.LinkTitle)
 		}
-		return results, nil
+		fmt.Println()
 	}
+	fmt.Printf("Sampled %d of %d links, seed %d\n", len(sample), lines, *seed)
 
-	// Handling a single number
-	number, err := strconv.Atoi(segments)
+	return 0
+}
+
+// sampleCompactedFile - reservoir sampling of links from compacted file in one pass, memory is bounded by sample size.
+// Malformed lines are skipped. Returns sample and number of sampled lines
+func sampleCompactedFile(filePath string, sampleSize int, rng *rand.Rand) ([]commoncrawl.FileLinkCompacted, int, error) {
+	maxCapacityScanner := fileutils.ScannerBufferSize(fileutils.DefaultScannerBufferSize)
+
+	file, err := os.Open(filePath)
 	if err != nil {
-		return nil, err
+		return nil, 0, fmt.Errorf("error opening file: %w", err)
 	}
-	results = append(results, number)
+	defer file.Close()
 
-	return results, nil
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating gzip reader: %w", err)
+	}
+	defer gzReader.Close()
+
+	scanner := fileutils.NewGZScanner(gzReader, maxCapacityScanner)
+
+	sample := make([]commoncrawl.FileLinkCompacted, 0, sampleSize)
+	lines := 0
+	for scanner.Scan() {
+		fileLink, lineErr := commoncrawl.DecodeCompactedLink(scanner.Text())
+		if lineErr != nil {
+			continue
+		}
+		lines++
+
+		// every line has sampleSize/lines chance to be in the sample
+		if len(sample) < sampleSize {
+			sample = append(sample, fileLink)
+			continue
+		}
+		if i := rng.Intn(lines); i < sampleSize {
+			sample[i] = fileLink
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, lines, fmt.Errorf("error reading file: %w", err)
+	}
+
+	return sample, lines, nil
 }
@@ -0,0 +1,1387 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+)
+
+// writeTestGzFile - write lines to gzipped file
+func writeTestGzFile(t *testing.T, filePath string, lines []string) {
+	t.Helper()
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer file.Close()
+
+	writer := gzip.NewWriter(file)
+	for _, line := range lines {
+		if _, err = writer.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatalf("Failed to close file: %v", err)
+	}
+}
+
+// TestAggressiveCompactingLastLink - link in the last line of sorted file is not followed by a different link and has to be saved too
+func TestAggressiveCompactingLastLink(t *testing.T) {
+	tests := []struct {
+		name      string
+		lines     []string
+		wantLines int
+	}{
+		{"single link", []string{"example.com||/a||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4"}, 1},
+		{"different last link", []string{
+			"example.com||/a||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4",
+			"example.com||/b||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4",
+		}, 2},
+		{"last link compacted from many lines", []string{
+			"example.com||/a||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4",
+			"example.com||/b||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4",
+			"example.com||/b||2|source.com|/||2|Anchor|0|0|2023-02-05|1.2.3.4",
+		}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sortedFile := filepath.Join(t.TempDir(), "sort_1.txt.gz")
+			compactedFile := filepath.Join(t.TempDir(), "compact_1.txt.gz")
+			writeTestGzFile(t, sortedFile, tt.lines)
+
+			if err := aggressiveCompacting(sortedFile, compactedFile); err != nil {
+				t.Fatalf("aggressiveCompacting() error = %v", err)
+			}
+
+			report, err := validateCompactedFile(compactedFile, 0)
+			if err != nil {
+				t.Fatalf("validateCompactedFile() error = %v", err)
+			}
+			if report.Lines != tt.wantLines || report.Malformed != 0 {
+				t.Errorf("compacted file lines = %d, malformed = %d, want %d and 0", report.Lines, report.Malformed, tt.wantLines)
+			}
+		})
+	}
+}
+
+// TestSortOutFilesWithBashGzByteOrder - lines are sorted byte by byte whatever locale is set
+func TestSortOutFilesWithBashGzByteOrder(t *testing.T) {
+	t.Setenv("LC_ALL", "en_US.UTF-8")
+	dirPath := t.TempDir()
+	writeTestGzFile(t, filepath.Join(dirPath, "00000.txt.gz"), []string{"b.com|x", "a.com|x", "_.com|x"})
+	writeTestGzFile(t, filepath.Join(dirPath, "00001.txt.gz"), []string{"B.com|x", "a.com|x"})
+	sortedFile := filepath.Join(t.TempDir(), "sort.txt.gz")
+
+	if err := sortOutFilesWithBashGz(sortedFile, dirPath); err != nil {
+		t.Fatalf("sortOutFilesWithBashGz() error = %v", err)
+	}
+	lines, err := fileutils.ReadGZFileByLine(sortedFile)
+	if err != nil {
+		t.Fatalf("ReadGZFileByLine() error = %v", err)
+	}
+	if want := []string{"B.com|x", "_.com|x", "a.com|x", "b.com|x"}; !slices.Equal(lines, want) {
+		t.Errorf("sortOutFilesWithBashGz() lines = %v, want %v", lines, want)
+	}
+}
+
+func TestValidateCompactedFile(t *testing.T) {
+	lines := []string{
+		"example.com||/page||2|source.com|/|a=1|2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|3|",
+		"example.com|www|/||1|source.org|/post||1|Anchor|1|0|2023-02-04|2023-02-04|1.2.3.4|1", // before link type was added
+		"example.com||/page||2|source.com|/|a=1|2|Anchor|0|0|2023-02-04|1.2.3.4|3",            // missing field
+		"example.com||/page||2|source.com|/||2|Anchor|0|0|2023-13-04|2023-02-05|1.2.3.4|3|",   // wrong date
+		"example.com||/page||5|source.com|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|3|",   // wrong scheme
+		"example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|x|",   // wrong qty
+		"example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-06|2023-02-05|1.2.3.4|1|",   // date from after date to
+		"example.com||/page||2|source.com|/||2|Anchor|abc|0|2023-02-04|2023-02-05|1.2.3.4|1|", // wrong nofollow
+		"example.com||/page||2|source.com|/||2|Anchor|0||2023-02-04|2023-02-05|1.2.3.4|1|",    // missing noindex
+	}
+
+	filePath := filepath.Join(t.TempDir(), "compact_1.txt.gz")
+	writeTestGzFile(t, filePath, lines)
+
+	report, err := validateCompactedFile(filePath, 2)
+	if err != nil {
+		t.Fatalf("validateCompactedFile() error = %v", err)
+	}
+	if report.Lines != 9 || report.Malformed != 7 {
+		t.Errorf("validateCompactedFile() lines = %d, malformed = %d, want 9 and 7", report.Lines, report.Malformed)
+	}
+	if len(report.Examples) != 2 || !strings.HasPrefix(report.Examples[0], "line 3:") || !strings.HasPrefix(report.Examples[1], "line 4:") {
+		t.Errorf("validateCompactedFile() examples = %v", report.Examples)
+	}
+
+	if code := runValidate([]string{filePath}); code != 1 {
+		t.Errorf("runValidate() = %d, want 1", code)
+	}
+	if code := runValidate([]string{filePath, "7"}); code != 0 {
+		t.Errorf("runValidate() with threshold 7 = %d, want 0", code)
+	}
+}
+
+func TestValidateCompactedFileTruncated(t *testing.T) {
+	lines := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, "example.com||/page||2|source.com|/||2|Anchor "+strings.Repeat("x", i%50)+"|0|0|2023-02-04|2023-02-05|1.2.3.4|1|")
+	}
+	filePath := filepath.Join(t.TempDir(), "compact_1.txt.gz")
+	writeTestGzFile(t, filePath, lines)
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if err = os.WriteFile(filePath, data[:len(data)-10], 0o666); err != nil {
+		t.Fatalf("Failed to truncate file: %v", err)
+	}
+
+	if _, err = validateCompactedFile(filePath, 10); err == nil {
+		t.Error("validateCompactedFile() expected error for truncated file")
+	}
+	if code := runValidate([]string{filePath, "100"}); code != 1 {
+		t.Errorf("runValidate() = %d, want 1", code)
+	}
+}
+
+func TestAggressiveCompactingTooLongLine(t *testing.T) {
+	tempDir := t.TempDir()
+	sortedFile := filepath.Join(tempDir, "sort_1.txt.gz")
+	compactedFile := filepath.Join(tempDir, "compact_1.txt.gz")
+
+	// line over 3MB scanner buffer is skipped and lines after it are still compacted
+	writeTestGzFile(t, sortedFile, []string{
+		"example.com||/a||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4|",
+		"example.com||/b||2|source.com|/||2|" + strings.Repeat("x", 4*1024*1024) + "|0|0|2023-02-04|1.2.3.4|",
+		"example.com||/c||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4|",
+		"example.org||/d||2|source.com|/||2|Anchor|0|0|2023-02-05|1.2.3.4|",
+	})
+
+	if err := aggressiveCompacting(sortedFile, compactedFile); err != nil {
+		t.Fatalf("aggressiveCompacting() error = %v", err)
+	}
+
+	report, err := validateCompactedFile(compactedFile, 0)
+	if err != nil || report.Lines != 3 || report.Malformed != 0 {
+		t.Errorf("validateCompactedFile() = %+v, %v, want 3 valid lines", report, err)
+	}
+
+	lines, err := countGzLines(sortedFile)
+	if err != nil || lines != 4 {
+		t.Errorf("countGzLines() = %d, %v, want 4 lines", lines, err)
+	}
+}
+
+func TestAggressiveCompactingRaisedScannerBuffer(t *testing.T) {
+	tempDir := t.TempDir()
+	sortedFile := filepath.Join(tempDir, "sort_1.txt.gz")
+	compactedFile := filepath.Join(tempDir, "compact_1.txt.gz")
+
+	// line over default 3MB scanner buffer is kept when buffer is raised
+	longAnchor := strings.Repeat("x", 4*1024*1024)
+	writeTestGzFile(t, sortedFile, []string{
+		"example.com||/a||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4|",
+		"example.com||/b||2|source.com|/||2|" + longAnchor + "|0|0|2023-02-04|1.2.3.4|",
+		"example.org||/d||2|source.com|/||2|Anchor|0|0|2023-02-05|1.2.3.4|",
+	})
+
+	t.Setenv("GLOBALLINKS_SCANNERBUFFER", "8")
+	if err := aggressiveCompacting(sortedFile, compactedFile); err != nil {
+		t.Fatalf("aggressiveCompacting() error = %v", err)
+	}
+
+	report, err := validateCompactedFile(compactedFile, 0)
+	if err != nil || report.Lines != 3 || report.Malformed != 0 {
+		t.Errorf("validateCompactedFile() = %+v, %v, want 3 valid lines", report, err)
+	}
+
+	// with default buffer the long compacted line is reported as malformed
+	t.Setenv("GLOBALLINKS_SCANNERBUFFER", "")
+	report, err = validateCompactedFile(compactedFile, 1)
+	if err != nil || report.Lines != 3 || report.Malformed != 1 || len(report.Examples) != 1 {
+		t.Errorf("validateCompactedFile() = %d lines, %d malformed, %v, want 1 malformed of 3 lines", report.Lines, report.Malformed, err)
+	}
+}
+
+func TestAggressiveCompactingSingleGzipMember(t *testing.T) {
+	tempDir := t.TempDir()
+	sortedFile := filepath.Join(tempDir, "sort_1.txt.gz")
+	compactedFile := filepath.Join(tempDir, "compact_1.txt.gz")
+
+	// every link is on its own page, so every sorted line gives one compacted link
+	lines := make([]string, 0, 25)
+	for i := 0; i < 25; i++ {
+		lines = append(lines, fmt.Sprintf("example.com||/page%02d||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4|", i))
+	}
+	writeTestGzFile(t, sortedFile, lines)
+	// data of previous, interrupted compaction is replaced
+	writeTestGzFile(t, compactedFile, []string{"stale|line"})
+
+	t.Setenv("GLOBALLINKS_COMPACTBUFFER", "3")
+	if err := aggressiveCompacting(sortedFile, compactedFile); err != nil {
+		t.Fatalf("aggressiveCompacting() error = %v", err)
+	}
+
+	file, err := os.Open(compactedFile)
+	if err != nil {
+		t.Fatalf("Failed to open compacted file: %v", err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	gzReader, err := gzip.NewReader(reader)
+	if err != nil {
+		t.Fatalf("gzip.NewReader() error = %v", err)
+	}
+	gzReader.Multistream(false)
+	data, err := io.ReadAll(gzReader)
+	if err != nil {
+		t.Fatalf("Failed to read first gzip member: %v", err)
+	}
+	if _, err = reader.Peek(1); err != io.EOF {
+		t.Errorf("compacted file has data after first gzip member, Peek() error = %v", err)
+	}
+
+	compacted := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(compacted) != len(lines) {
+		t.Fatalf("compacted file has %d lines, want %d", len(compacted), len(lines))
+	}
+	for i, line := range compacted {
+		link, err := commoncrawl.DecodeCompactedLink(line)
+		if err != nil {
+			t.Fatalf("DecodeCompactedLink(%q) error = %v", line, err)
+		}
+		if want := fmt.Sprintf("/page%02d", i); link.LinkPath != want {
+			t.Errorf("line %d LinkPath = %q, want %q", i, link.LinkPath, want)
+		}
+	}
+}
+
+func TestAggressiveCompactingBufferBounded(t *testing.T) {
+	tempDir := t.TempDir()
+	sortedFile := filepath.Join(tempDir, "sort_1.txt.gz")
+	compactedFile := filepath.Join(tempDir, "compact_1.txt.gz")
+
+	// every link is found on 50 pages of one host, 50 sorted lines are compacted into one link
+	var lines []string
+	for link := 0; link < 20; link++ {
+		for page := 0; page < 50; page++ {
+			lines = append(lines, fmt.Sprintf("example.com||/link%02d||2|source.com|/page%02d||2|Anchor|0|0|2023-02-04|1.2.3.4|", link, page))
+		}
+	}
+	writeTestGzFile(t, sortedFile, lines)
+
+	bufferSize := 3
+	maxBuffered := 0
+	defaultSave := saveCompactedLinks
+	defer func() { saveCompactedLinks = defaultSave }()
+	saveCompactedLinks = func(writer io.Writer, linksToSave []commoncrawl.FileLinkCompacted) error {
+		maxBuffered = max(maxBuffered, len(linksToSave))
+		return defaultSave(writer, linksToSave)
+	}
+
+	t.Setenv("GLOBALLINKS_COMPACTBUFFER", strconv.Itoa(bufferSize))
+	if err := aggressiveCompacting(sortedFile, compactedFile); err != nil {
+		t.Fatalf("aggressiveCompacting() error = %v", err)
+	}
+	if maxBuffered > bufferSize {
+		t.Errorf("aggressiveCompacting() buffered %d links, want at most %d", maxBuffered, bufferSize)
+	}
+
+	compacted, err := fileutils.ReadGZFileByLine(compactedFile)
+	if err != nil {
+		t.Fatalf("Failed to read compacted file: %v", err)
+	}
+	if len(compacted) != 20 {
+		t.Fatalf("compacted file has %d lines, want 20", len(compacted))
+	}
+	for i, line := range compacted {
+		link, err := commoncrawl.DecodeCompactedLink(line)
+		if err != nil {
+			t.Fatalf("DecodeCompactedLink(%q) error = %v", line, err)
+		}
+		if want := fmt.Sprintf("/link%02d", i); link.LinkPath != want || link.Qty != 50 {
+			t.Errorf("line %d = %s %d, want %s 50", i, link.LinkPath, link.Qty, want)
+		}
+	}
+}
+
+func TestAggressiveCompactingDofollowOnly(t *testing.T) {
+	sortedLines := []string{
+		"example.com||/a||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4|",
+		"example.com||/a||2|source.com|/post||2|Anchor|1|0|2023-02-05|1.2.3.4|",
+		"example.com||/b||2|source.com|/||2|Anchor|1|0|2023-02-04|1.2.3.4|",
+		"example.com||/c||2|news.com|/||2|Anchor|1|0|2023-02-04|1.2.3.4|",
+		"example.com||/c||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4|",
+	}
+
+	tests := []struct {
+		name      string
+		value     string
+		wantLinks []string
+	}{
+		{"all links by default", "", []string{"/a|source.com|0", "/b|source.com|1", "/c|news.com|1", "/c|source.com|0"}},
+		{"nofollow links dropped", "true", []string{"/a|source.com|0", "/c|source.com|0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			sortedFile := filepath.Join(tempDir, "sort_1.txt.gz")
+			compactedFile := filepath.Join(tempDir, "compact_1.txt.gz")
+			writeTestGzFile(t, sortedFile, sortedLines)
+
+			t.Setenv("GLOBALLINKS_DOFOLLOWONLY", tt.value)
+			if err := aggressiveCompacting(sortedFile, compactedFile); err != nil {
+				t.Fatalf("aggressiveCompacting() error = %v", err)
+			}
+
+			var links []string
+			for _, row := range readLinkRows(t, compactedFile) {
+				links = append(links, fmt.Sprintf("%s|%s|%d", row.LinkPath, row.PageHost, row.NoFollow))
+			}
+			if !slices.Equal(links, tt.wantLinks) {
+				t.Errorf("aggressiveCompacting() links = %q, want %q", links, tt.wantLinks)
+			}
+		})
+	}
+}
+
+func TestAggressiveCompactingPagePathPolicy(t *testing.T) {
+	// link /a is found on three pages of source.com, /blog/post in the most lines, /news/latest in the latest crawl
+	sortedLines := []string{
+		"example.com||/a||2|source.com|/about||2|Anchor|0|0|2023-02-01|1.2.3.4|",
+		"example.com||/a||2|source.com|/blog/post||2|Anchor|0|0|2023-02-02|1.2.3.4|",
+		"example.com||/a||2|source.com|/blog/post||2|Anchor|0|0|2023-02-03|1.2.3.4|",
+		"example.com||/a||2|source.com|/blog/post||2|Anchor|0|0|2023-02-04|1.2.3.4|",
+		"example.com||/a||2|source.com|/news/latest||2|Anchor|0|0|2023-02-10|1.2.3.4|",
+		"example.com||/b||2|source.com|/news/latest||2|Anchor|0|0|2023-02-01|1.2.3.4|",
+	}
+
+	tests := []struct {
+		policy    string
+		wantPages []string
+	}{
+		{"", []string{"/a|/about", "/b|/news/latest"}},
+		{"shortest", []string{"/a|/about", "/b|/news/latest"}},
+		{"most-recent", []string{"/a|/news/latest", "/b|/news/latest"}},
+		{"most-frequent", []string{"/a|/blog/post", "/b|/news/latest"}},
+		{"unknown", []string{"/a|/about", "/b|/news/latest"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			tempDir := t.TempDir()
+			sortedFile := filepath.Join(tempDir, "sort_1.txt.gz")
+			compactedFile := filepath.Join(tempDir, "compact_1.txt.gz")
+			writeTestGzFile(t, sortedFile, sortedLines)
+
+			t.Setenv("GLOBALLINKS_PAGEPATHPOLICY", tt.policy)
+			if err := aggressiveCompacting(sortedFile, compactedFile); err != nil {
+				t.Fatalf("aggressiveCompacting() error = %v", err)
+			}
+
+			var pages []string
+			for _, row := range readLinkRows(t, compactedFile) {
+				pages = append(pages, row.LinkPath+"|"+row.PagePath)
+				// dates do not depend on policy
+				if row.LinkPath == "/a" && (row.DateFrom != "2023-02-01" || row.DateTo != "2023-02-10") {
+					t.Errorf("aggressiveCompacting() link /a = %+v, want dates 2023-02-01 - 2023-02-10", row)
+				}
+			}
+			if !slices.Equal(pages, tt.wantPages) {
+				t.Errorf("aggressiveCompacting() pages = %q, want %q", pages, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestSetCompactBufferSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 10000},
+		{"500", 500},
+		{"0", 10000},
+		{"2000000", 10000},
+		{"abc", 10000},
+	}
+	for _, tt := range tests {
+		t.Setenv("GLOBALLINKS_COMPACTBUFFER", tt.value)
+		if got := setCompactBufferSize(); got != tt.want {
+			t.Errorf("setCompactBufferSize() with %q = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSetMergeFanIn(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 64},
+		{"8", 8},
+		{"1", 64},
+		{"2000", 64},
+		{"abc", 64},
+	}
+	for _, tt := range tests {
+		t.Setenv("GLOBALLINKS_MERGEFANIN", tt.value)
+		if got := setMergeFanIn(); got != tt.want {
+			t.Errorf("setMergeFanIn() with %q = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSetWatParseTimeout(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 30 * time.Minute},
+		{"60", time.Minute},
+		{"0", 0},
+		{"-1", 30 * time.Minute},
+		{"100000", 30 * time.Minute},
+		{"abc", 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Setenv("GLOBALLINKS_WATPARSETIMEOUT", tt.value)
+		if got := setWatParseTimeout(); got != tt.want {
+			t.Errorf("setWatParseTimeout() with %q = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRetryWatFileParseTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantRuns int
+	}{
+		{"broken file", errors.New("broken WAT file"), 3},
+		{"timed out", fmt.Errorf("%w: slow.warc.wat.gz", commoncrawl.ErrWatParseTimeout), 1},
+		{"emit failed", fmt.Errorf("%w: sink is down", commoncrawl.ErrLinkEmit), 1},
+	}
+	for _, tt := range tests {
+		runs := 0
+		err := retryWatFile(3, func() error {
+			runs++
+			return tt.err
+		})
+		if !errors.Is(err, tt.err) || runs != tt.wantRuns {
+			t.Errorf("%s: retryWatFile() = %v after %d runs, want %d runs", tt.name, err, runs, tt.wantRuns)
+		}
+	}
+}
+
+func TestSampleCompactedFile(t *testing.T) {
+	lines := make([]string, 0, 1001)
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, strings.TrimSuffix(commoncrawl.EncodeCompactedLink(commoncrawl.FileLinkCompacted{
+			LinkDomain: "example.com", LinkPath: fmt.Sprintf("/page%d", i), LinkScheme: "2", PageHost: "source.com", PagePath: "/", PageScheme: "1",
+			LinkText: "Anchor", DateFrom: "2023-02-04", DateTo: "2023-02-05", IP: "1.2.3.4", Qty: 1,
+		}), "\n"))
+	}
+	lines = append(lines, "broken|line")
+	filePath := filepath.Join(t.TempDir(), "compact_1.txt.gz")
+	writeTestGzFile(t, filePath, lines)
+
+	sample, sampled, err := sampleCompactedFile(filePath, 10, rand.New(rand.NewSource(42)))
+	if err != nil {
+		t.Fatalf("sampleCompactedFile() error = %v", err)
+	}
+	if len(sample) != 10 || sampled != 1000 {
+		t.Fatalf("sampleCompactedFile() = %d links of %d, want 10 of 1000", len(sample), sampled)
+	}
+
+	again, _, err := sampleCompactedFile(filePath, 10, rand.New(rand.NewSource(42)))
+	if err != nil {
+		t.Fatalf("sampleCompactedFile() error = %v", err)
+	}
+	for i := range sample {
+		if sample[i] != again[i] {
+			t.Errorf("sample with the same seed differs at %d: %s != %s", i, sample[i].LinkURL(), again[i].LinkURL())
+		}
+	}
+
+	// with 1000 lines the first 10 lines would stay only when sampling is broken
+	head := 0
+	for i, fileLink := range sample {
+		if fileLink.LinkPath == fmt.Sprintf("/page%d", i) {
+			head++
+		}
+	}
+	if head == len(sample) {
+		t.Error("sampleCompactedFile() returned first lines of the file")
+	}
+
+	all, sampled, err := sampleCompactedFile(filePath, 5000, rand.New(rand.NewSource(42)))
+	if err != nil || len(all) != 1000 || sampled != 1000 {
+		t.Errorf("sampleCompactedFile() bigger than file = %d links of %d, error %v", len(all), sampled, err)
+	}
+
+	if code := runSample([]string{filePath, "3", "--seed", "7"}); code != 0 {
+		t.Errorf("runSample() = %d, want 0", code)
+	}
+	if code := runSample([]string{filePath, "0"}); code != 1 {
+		t.Errorf("runSample() with 0 links = %d, want 1", code)
+	}
+}
+
+func TestSegmentMetrics(t *testing.T) {
+	clock := time.Date(2023, 2, 4, 10, 0, 0, 0, time.UTC)
+	defer func(orig func() time.Time) { now = orig }(now)
+	now = func() time.Time {
+		clock = clock.Add(1500 * time.Millisecond)
+		return clock
+	}
+
+	metrics := newSegmentMetrics()
+	for _, file := range []string{"00000.warc.wat.gz", "00001.warc.wat.gz"} {
+		fileStats, err := metrics.trackFile(file, func() (commoncrawl.WatFileStats, error) {
+			return commoncrawl.WatFileStats{Pages: 2, Links: 30, DomainCacheHits: 24, DomainCacheMisses: 8}, nil
+		})
+		if err != nil {
+			t.Fatalf("trackFile() error = %v", err)
+		}
+		if fileStats.File != file || fileStats.Links != 30 || fileStats.Duration <= 0 || fileStats.DomainCacheHitRate != 0.75 {
+			t.Errorf("trackFile() = %+v, want duration, 30 links and 0.75 domain cache hit rate for %s", fileStats, file)
+		}
+	}
+
+	_, err := metrics.trackFile("broken.warc.wat.gz", func() (commoncrawl.WatFileStats, error) {
+		return commoncrawl.WatFileStats{}, fmt.Errorf("broken file")
+	})
+	if err == nil {
+		t.Errorf("trackFile() expected error for broken file")
+	}
+
+	_, err = metrics.trackFile("empty.warc.wat.gz", func() (commoncrawl.WatFileStats, error) {
+		return commoncrawl.WatFileStats{Pages: 0, Records: 3}, nil
+	})
+	if err != nil {
+		t.Fatalf("trackFile() error = %v", err)
+	}
+
+	summary := metrics.summary()
+	if summary.Files != 3 || summary.Links != 60 || summary.ZeroLinkFiles != 1 {
+		t.Errorf("summary() files = %d, links = %d, zero link files = %d, want 3 files, 60 links and 1 zero link file", summary.Files, summary.Links, summary.ZeroLinkFiles)
+	}
+	if summary.ParseTime <= 0 || summary.TotalTime < summary.ParseTime || summary.LinksPerSecond <= 0 {
+		t.Errorf("summary() timing not populated: %+v", summary)
+	}
+	if summary.PublishedLinks != 0 {
+		t.Errorf("summary() published links = %d without sink, want 0", summary.PublishedLinks)
+	}
+
+	// links published before segment started are not counted
+	published := 40
+	metrics.trackPublished(func() int { return published })
+	published += 25
+	if summary := metrics.summary(); summary.PublishedLinks != 25 {
+		t.Errorf("summary() published links = %d, want 25", summary.PublishedLinks)
+	}
+}
+
+// TestImportSegmentImportedWatFiles - WAT file listed in segments of two archives sharing data directory is downloaded and parsed once
+func TestImportSegmentImportedWatFiles(t *testing.T) {
+	downloads := serveTestWatFile(t)
+
+	dataDir, err := commoncrawl.CreateDataDir(t.TempDir())
+	if err != nil {
+		t.Fatalf("CreateDataDir() error = %v", err)
+	}
+	importedWatFiles, err := commoncrawl.LoadImportedWatFiles(dataDir.ImportedWatFilesFile())
+	if err != nil {
+		t.Fatalf("LoadImportedWatFiles() error = %v", err)
+	}
+
+	// only one WAT file is downloaded per segment and the last one is left for later, so segments are not compacted
+	duplicate := watFileName(0)
+	var segmentList []commoncrawl.WatSegment
+	for i, archive := range []string{"CC-MAIN-2021-04", "CC-MAIN-2021-10"} {
+		segment := "1610703495901." + strconv.Itoa(i)
+		prefix := "crawl-data/" + archive + "/segments/" + segment + "/wat/"
+		segmentList = append(segmentList, commoncrawl.WatSegment{
+			Archive:   archive,
+			Segment:   segment,
+			SegmentID: i,
+			WatFiles: []commoncrawl.WatFile{
+				{Number: "00000", Path: prefix + duplicate},
+				{Number: fmt.Sprintf("%05d", 2*i+1), Path: prefix + watFileName(2*i+1)},
+				{Number: fmt.Sprintf("%05d", 2*i+2), Path: prefix + watFileName(2*i+2)},
+			},
+		})
+	}
+
+	for _, segment := range slices.Clone(segmentList) {
+		maxWatFiles := 1
+		importSegment(segment, dataDir, &segmentList, 1, &maxWatFiles, nil, importedWatFiles, nil)
+	}
+
+	// second archive downloads its next WAT file instead of the duplicated one
+	if downloads[duplicate] != 1 || downloads[watFileName(3)] != 1 || len(downloads) != 2 {
+		t.Errorf("downloads = %v, want %s downloaded once", downloads, duplicate)
+	}
+	for _, segment := range segmentList {
+		if segment.WatFiles[0].Imported == nil {
+			t.Errorf("segment %s: duplicated WAT file is not marked as imported", segment.Segment)
+		}
+	}
+	if !fileutils.FileExists(dataDir.SegmentTmpDir(segmentList[0]) + linkDir + "00000" + extensionTxtGz) {
+		t.Error("link file of first archive was not created")
+	}
+	if fileutils.FileExists(dataDir.SegmentTmpDir(segmentList[1]) + linkDir + "00000" + extensionTxtGz) {
+		t.Error("duplicated WAT file was parsed again in second archive")
+	}
+}
+
+// TestImportSegmentAllWatFilesImported - segment with all WAT files imported in other archive has no link files and is compacted into empty file
+func TestImportSegmentAllWatFilesImported(t *testing.T) {
+	downloads := serveTestWatFile(t)
+	defaultSort := sortFiles
+	t.Cleanup(func() { sortFiles = defaultSort })
+	sortFiles = func(sortedFile string, dirPath string) error {
+		sortLinkFiles(t, dirPath, sortedFile)
+		return nil
+	}
+
+	root := t.TempDir()
+	importedWatFiles, err := commoncrawl.LoadImportedWatFiles(filepath.Join(root, "imported_wat.txt"))
+	if err != nil {
+		t.Fatalf("LoadImportedWatFiles() error = %v", err)
+	}
+
+	// both archives list the same WAT files, the second one has all of them imported
+	var segmentList []commoncrawl.WatSegment
+	for i, archive := range []string{"CC-MAIN-2021-04", "CC-MAIN-2021-10"} {
+		prefix := "crawl-data/" + archive + "/segments/1610703495901.0/wat/"
+		segmentList = append(segmentList, commoncrawl.WatSegment{
+			Archive:   archive,
+			Segment:   "1610703495901.0",
+			SegmentID: i,
+			WatFiles: []commoncrawl.WatFile{
+				{Number: "00000", Path: prefix + watFileName(0)},
+				{Number: "00001", Path: prefix + watFileName(1)},
+			},
+		})
+	}
+
+	for i := range segmentList {
+		archiveDataDir, err := commoncrawl.CreateDataDir(filepath.Join(root, segmentList[i].Archive))
+		if err != nil {
+			t.Fatalf("CreateDataDir() error = %v", err)
+		}
+		archiveSegments := segmentList[i : i+1]
+		maxWatFiles := 10
+		importSegment(archiveSegments[0], archiveDataDir, &archiveSegments, 1, &maxWatFiles, nil, importedWatFiles, nil)
+
+		if archiveSegments[0].ImportEnded == nil {
+			t.Errorf("segment of %s is not finished", segmentList[i].Archive)
+		}
+		lines, err := countGzLines(archiveDataDir.CompactedLinksFile(archiveSegments[0]))
+		if err != nil {
+			t.Fatalf("segment of %s is not compacted: %v", segmentList[i].Archive, err)
+		}
+		if wantLines := []bool{true, false}[i]; (lines > 0) != wantLines {
+			t.Errorf("compacted file of %s has %d lines", segmentList[i].Archive, lines)
+		}
+	}
+
+	if len(downloads) != 2 {
+		t.Errorf("downloads = %v, want every WAT file downloaded once", downloads)
+	}
+}
+
+// watFileName - name of WAT file with number
+func watFileName(number int) string {
+	return fmt.Sprintf("CC-MAIN-20210115134101-20210115164101-%05d.warc.wat.gz", number)
+}
+
+func TestSortWatPreProcessed(t *testing.T) {
+	inputs := map[string][]string{
+		"00000.txt.gz": {"b.com||/|||2|source.com|/||2|B|0|0|2023-02-04|1.2.3.4|", "a.com||/|||2|source.com|/||2|A|0|0|2023-02-04|1.2.3.4|"},
+		"00001.txt.gz": {"a.com||/|||2|source.com|/||2|A|0|0|2023-02-04|1.2.3.4|"},
+	}
+
+	tests := []struct {
+		name      string
+		inputs    map[string][]string
+		sort      func(t *testing.T, sortedFile string, dirPath string) error
+		wantLines int
+		wantErr   string
+	}{
+		{
+			name:   "sorted",
+			inputs: inputs,
+			sort: func(t *testing.T, sortedFile string, dirPath string) error {
+				sortLinkFiles(t, dirPath, sortedFile)
+				return nil
+			},
+			wantLines: 2,
+		},
+		{
+			name:   "empty sort output",
+			inputs: inputs,
+			sort: func(t *testing.T, sortedFile string, dirPath string) error {
+				writeTestGzFile(t, sortedFile, nil)
+				return nil
+			},
+			wantErr: "sorted file is empty",
+		},
+		{
+			name:   "more lines than inputs",
+			inputs: inputs,
+			sort: func(t *testing.T, sortedFile string, dirPath string) error {
+				writeTestGzFile(t, sortedFile, []string{"a", "b", "c", "d"})
+				return nil
+			},
+			wantErr: "sorted file has 4 lines",
+		},
+		{
+			name:   "truncated sort output",
+			inputs: inputs,
+			sort: func(t *testing.T, sortedFile string, dirPath string) error {
+				return os.WriteFile(sortedFile, []byte{0x1f, 0x8b}, 0o644)
+			},
+			wantErr: "sorted file",
+		},
+		{
+			name:   "failed sort",
+			inputs: inputs,
+			sort: func(t *testing.T, sortedFile string, dirPath string) error {
+				writeTestGzFile(t, sortedFile, []string{"a"})
+				return fmt.Errorf("exit status 2")
+			},
+			wantErr: "could not sort file",
+		},
+		{
+			name:   "no input files",
+			inputs: map[string][]string{},
+			sort: func(t *testing.T, sortedFile string, dirPath string) error {
+				t.Error("sort called without input files")
+				return nil
+			},
+			wantErr: "no files to sort",
+		},
+	}
+
+	defaultSort := sortFiles
+	defer func() { sortFiles = defaultSort }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			dirPath := filepath.Join(tempDir, "link")
+			if err := os.MkdirAll(dirPath, 0o755); err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+			for name, lines := range tt.inputs {
+				writeTestGzFile(t, filepath.Join(dirPath, name), lines)
+			}
+			sortedFile := filepath.Join(tempDir, "sort_0.txt.gz")
+			sortFiles = func(sortedFile string, dirPath string) error { return tt.sort(t, sortedFile, dirPath) }
+
+			err := sortWatPreProcessed(sortedFile, dirPath)
+
+			inputFiles, _ := watPreProcessedFiles(dirPath)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("sortWatPreProcessed() error = %v, want %q", err, tt.wantErr)
+				}
+				if len(inputFiles) != len(tt.inputs) {
+					t.Errorf("sortWatPreProcessed() kept %d input files, want %d", len(inputFiles), len(tt.inputs))
+				}
+				if fileutils.FileExists(sortedFile) {
+					t.Error("sortWatPreProcessed() kept incomplete sorted file")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("sortWatPreProcessed() error = %v", err)
+			}
+			if len(inputFiles) != 0 {
+				t.Errorf("sortWatPreProcessed() kept input files %v", inputFiles)
+			}
+			if lines, err := countGzLines(sortedFile); err != nil || lines != tt.wantLines {
+				t.Errorf("sorted file lines = %d, %v, want %d", lines, err, tt.wantLines)
+			}
+		})
+	}
+}
+
+// TestCompactSegmentDataEmptySort - segment is not finished and link files are kept when sort produced empty file
+func TestCompactSegmentDataEmptySort(t *testing.T) {
+	dataDir, err := commoncrawl.CreateDataDir(t.TempDir())
+	if err != nil {
+		t.Fatalf("CreateDataDir() error = %v", err)
+	}
+	segment := commoncrawl.WatSegment{Archive: "CC-MAIN-2021-04", Segment: "1610703495901.0", SegmentID: 0}
+	segmentList := []commoncrawl.WatSegment{segment}
+
+	linkFile := dataDir.SegmentTmpDir(segment) + linkDir + "00000" + extensionTxtGz
+	if err = os.MkdirAll(filepath.Dir(linkFile), 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	writeTestGzFile(t, linkFile, []string{"a.com||/|||2|source.com|/||2|A|0|0|2023-02-04|1.2.3.4|"})
+
+	defaultSort := sortFiles
+	defer func() { sortFiles = defaultSort }()
+	sortFiles = func(sortedFile string, dirPath string) error {
+		writeTestGzFile(t, sortedFile, nil)
+		return nil
+	}
+
+	err = compactSegmentData(segment, dataDir, &segmentList, newSegmentMetrics(), nil)
+	if err == nil {
+		t.Fatal("compactSegmentData() error = nil for empty sort output")
+	}
+	if !fileutils.FileExists(linkFile) {
+		t.Error("compactSegmentData() deleted link file")
+	}
+	if fileutils.FileExists(dataDir.SortedLinksFile(segment)) || fileutils.FileExists(dataDir.CompactedLinksFile(segment)) {
+		t.Error("compactSegmentData() kept sorted or compacted file")
+	}
+	if segmentList[0].ImportEnded != nil {
+		t.Error("compactSegmentData() marked segment as finished")
+	}
+}
+
+// TestCompactSegmentDataMissingLinkFiles - segment without link files is compacted into empty file only when all its WAT files were imported before
+func TestCompactSegmentDataMissingLinkFiles(t *testing.T) {
+	watPath := "crawl-data/CC-MAIN-2021-04/segments/1610703495901.0/wat/" + watFileName(0)
+
+	tests := []struct {
+		name         string
+		imported     bool
+		wantErr      bool
+		wantFinished bool
+	}{
+		{"WAT file imported before", true, false, true},
+		{"WAT file not imported", false, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir, err := commoncrawl.CreateDataDir(t.TempDir())
+			if err != nil {
+				t.Fatalf("CreateDataDir() error = %v", err)
+			}
+			segment := commoncrawl.WatSegment{Archive: "CC-MAIN-2021-04", Segment: "1610703495901.0", SegmentID: 0, WatFiles: []commoncrawl.WatFile{{Number: "00000", Path: watPath}}}
+			segmentList := []commoncrawl.WatSegment{segment}
+			// link directory is created by import for every WAT file
+			if err = os.MkdirAll(dataDir.SegmentTmpDir(segment)+linkDir, 0o755); err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+
+			importedWatFiles, err := commoncrawl.LoadImportedWatFiles(dataDir.ImportedWatFilesFile())
+			if err != nil {
+				t.Fatalf("LoadImportedWatFiles() error = %v", err)
+			}
+			if tt.imported {
+				if err = importedWatFiles.MarkImported(watPath); err != nil {
+					t.Fatalf("MarkImported() error = %v", err)
+				}
+			}
+
+			err = compactSegmentData(segment, dataDir, &segmentList, newSegmentMetrics(), importedWatFiles)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("compactSegmentData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if fileutils.FileExists(dataDir.CompactedLinksFile(segment)) != tt.wantFinished || (segmentList[0].ImportEnded != nil) != tt.wantFinished {
+				t.Errorf("compactSegmentData() compacted file %v, finished %v, want %v", fileutils.FileExists(dataDir.CompactedLinksFile(segment)), segmentList[0].ImportEnded != nil, tt.wantFinished)
+			}
+		})
+	}
+}
+
+// TestCompactSegmentDataKeepsCompacted - segment imported again is not compacted over compacted file of earlier run
+func TestCompactSegmentDataKeepsCompacted(t *testing.T) {
+	dataDir, err := commoncrawl.CreateDataDir(t.TempDir())
+	if err != nil {
+		t.Fatalf("CreateDataDir() error = %v", err)
+	}
+	watPath := "crawl-data/CC-MAIN-2021-04/segments/1610703495901.0/wat/" + watFileName(0)
+	segment := commoncrawl.WatSegment{Archive: "CC-MAIN-2021-04", Segment: "1610703495901.0", SegmentID: 0, WatFiles: []commoncrawl.WatFile{{Number: "00000", Path: watPath}}}
+	segmentList := []commoncrawl.WatSegment{segment}
+
+	importedWatFiles, err := commoncrawl.LoadImportedWatFiles(dataDir.ImportedWatFilesFile())
+	if err != nil {
+		t.Fatalf("LoadImportedWatFiles() error = %v", err)
+	}
+	if err = importedWatFiles.MarkImported(watPath); err != nil {
+		t.Fatalf("MarkImported() error = %v", err)
+	}
+	compacted := []string{"a.com||/|||2|source.com|/||2|A|0|0|2023-02-04|1.2.3.4|1|2023-02-04|"}
+	writeTestGzFile(t, dataDir.CompactedLinksFile(segment), compacted)
+
+	if err = compactSegmentData(segment, dataDir, &segmentList, newSegmentMetrics(), importedWatFiles); err != nil {
+		t.Fatalf("compactSegmentData() error = %v", err)
+	}
+	if lines, err := fileutils.ReadGZFileByLine(dataDir.CompactedLinksFile(segment)); err != nil || !slices.Equal(lines, compacted) {
+		t.Errorf("compacted file = %v, %v, want file of earlier run", lines, err)
+	}
+	if segmentList[0].ImportEnded == nil || fileutils.FileExists(dataDir.SortedLinksFile(segment)) {
+		t.Error("compactSegmentData() did not finish segment without sorting")
+	}
+
+	// link files parsed again are not dropped next to compacted file
+	linkFile := dataDir.SegmentTmpDir(segment) + linkDir + "00000" + extensionTxtGz
+	if err = os.MkdirAll(filepath.Dir(linkFile), 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	writeTestGzFile(t, linkFile, []string{"b.com||/|||2|source.com|/||2|A|0|0|2023-02-04|1.2.3.4|"})
+	if err = compactSegmentData(segment, dataDir, &segmentList, newSegmentMetrics(), importedWatFiles); err == nil {
+		t.Error("compactSegmentData() error = nil for link files of compacted segment")
+	}
+	if !fileutils.FileExists(linkFile) {
+		t.Error("compactSegmentData() deleted link file of compacted segment")
+	}
+}
+
+// serveTestWatFile - serve the same WAT file for every path from test server used as Common Crawl base url, returns number of downloads of every file
+func serveTestWatFile(t *testing.T) map[string]int {
+	return serveTestWatFileAfterEmpty(t, 0)
+}
+
+// serveTestWatFileAfterEmpty - serve WAT file like serveTestWatFile, first emptyResponses downloads of every file return empty body
+func serveTestWatFileAfterEmpty(t *testing.T, emptyResponses int) map[string]int {
+	t.Helper()
+
+	watFile := filepath.Join(t.TempDir(), "fixture.warc.wat.gz")
+	err := commoncrawl.WriteWatFile(watFile, []commoncrawl.WatFixture{
+		{URL: "https://blog.net/post", IP: "1.2.3.4", Date: time.Date(2023, 2, 4, 10, 0, 0, 0, time.UTC), HTML: `<title>Post</title><a href="https://example.com/a">Example A</a>`},
+	})
+	if err != nil {
+		t.Fatalf("WriteWatFile() error = %v", err)
+	}
+	watData, err := os.ReadFile(watFile)
+	if err != nil {
+		t.Fatalf("Failed to read WAT file: %v", err)
+	}
+
+	downloads := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads[path.Base(r.URL.Path)]++
+		if downloads[path.Base(r.URL.Path)] > emptyResponses {
+			_, _ = w.Write(watData)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	defaultSleep := sleepBetweenWat
+	defaultRetryDelay := fileutils.RetryDelay
+	t.Cleanup(func() {
+		sleepBetweenWat = defaultSleep
+		fileutils.RetryDelay = defaultRetryDelay
+		_ = commoncrawl.SetBaseURL(commoncrawl.DefaultBaseURL)
+	})
+	sleepBetweenWat = 0
+	fileutils.RetryDelay = time.Millisecond
+	if err = commoncrawl.SetBaseURL(server.URL); err != nil {
+		t.Fatalf("SetBaseURL() error = %v", err)
+	}
+
+	return downloads
+}
+
+func TestImportSegmentEmptyWatFile(t *testing.T) {
+	tests := []struct {
+		name           string
+		emptyResponses int
+		emptyKeptFile  bool
+		wantDownloads  int
+	}{
+		{name: "empty download retried", emptyResponses: 1, wantDownloads: 2},
+		{name: "empty kept file downloaded again", emptyKeptFile: true, wantDownloads: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downloads := serveTestWatFileAfterEmpty(t, tt.emptyResponses)
+
+			dataDir, err := commoncrawl.CreateDataDir(t.TempDir())
+			if err != nil {
+				t.Fatalf("CreateDataDir() error = %v", err)
+			}
+			// second WAT file is left for later, so segment is not compacted
+			prefix := "crawl-data/CC-MAIN-2021-04/segments/1610703495901.0/wat/"
+			segment := commoncrawl.WatSegment{
+				Archive: "CC-MAIN-2021-04",
+				Segment: "1610703495901.0",
+				WatFiles: []commoncrawl.WatFile{
+					{Number: "00000", Path: prefix + watFileName(0)},
+					{Number: "00001", Path: prefix + watFileName(1)},
+				},
+			}
+			recordWatFile := dataDir.TmpDir + "/wat/" + watFileName(0)
+			if tt.emptyKeptFile {
+				if err = fileutils.CreateDataDirectory(filepath.Dir(recordWatFile)); err != nil {
+					t.Fatalf("CreateDataDirectory() error = %v", err)
+				}
+				if err = os.WriteFile(recordWatFile, nil, 0o644); err != nil {
+					t.Fatalf("Failed to write empty WAT file: %v", err)
+				}
+			}
+
+			segmentList := []commoncrawl.WatSegment{segment}
+			maxWatFiles := 1
+			importSegment(segmentList[0], dataDir, &segmentList, 1, &maxWatFiles, nil, nil, nil)
+
+			linkFile := dataDir.SegmentTmpDir(segment) + linkDir + "00000" + extensionTxtGz
+			if !fileutils.NonEmptyFileExists(linkFile) {
+				t.Error("link file was not created")
+			}
+			if downloads[watFileName(0)] != tt.wantDownloads {
+				t.Errorf("downloads = %d, want %d", downloads[watFileName(0)], tt.wantDownloads)
+			}
+		})
+	}
+}
+
+func TestImportSegmentDeadLetter(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int // response to requests of the first WAT file
+		wantDownloads int
+	}{
+		{name: "broken WAT file", status: http.StatusOK, wantDownloads: 3},
+		// every attempt downloads file 3 times, DownloadFile retries 503 twice
+		{name: "failed download", status: http.StatusServiceUnavailable, wantDownloads: 9},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// test server of valid WAT files is replaced, it only sets short delays and restores base url
+			serveTestWatFile(t)
+			downloads := make(map[string]int)
+			validWat := filepath.Join(t.TempDir(), "fixture.warc.wat.gz")
+			err := commoncrawl.WriteWatFile(validWat, []commoncrawl.WatFixture{
+				{URL: "https://blog.net/post", IP: "1.2.3.4", Date: time.Date(2023, 2, 4, 10, 0, 0, 0, time.UTC), HTML: `<title>Post</title><a href="https://example.com/a">Example A</a>`},
+			})
+			if err != nil {
+				t.Fatalf("WriteWatFile() error = %v", err)
+			}
+			watData, err := os.ReadFile(validWat)
+			if err != nil {
+				t.Fatalf("Failed to read WAT file: %v", err)
+			}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				name := path.Base(r.URL.Path)
+				downloads[name]++
+				if name != watFileName(0) {
+					_, _ = w.Write(watData)
+					return
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte("not a gzip file"))
+			}))
+			defer server.Close()
+			if err = commoncrawl.SetBaseURL(server.URL); err != nil {
+				t.Fatalf("SetBaseURL() error = %v", err)
+			}
+			t.Setenv("GLOBALLINKS_WATATTEMPTS", "3")
+
+			dataDir, err := commoncrawl.CreateDataDir(t.TempDir())
+			if err != nil {
+				t.Fatalf("CreateDataDir() error = %v", err)
+			}
+			deadLetter, err := commoncrawl.LoadDeadLetterWatFiles(dataDir.DeadLetterWatFilesFile())
+			if err != nil {
+				t.Fatalf("LoadDeadLetterWatFiles() error = %v", err)
+			}
+			prefix := "crawl-data/CC-MAIN-2021-04/segments/1610703495901.0/wat/"
+			segment := commoncrawl.WatSegment{
+				Archive: "CC-MAIN-2021-04",
+				Segment: "1610703495901.0",
+				WatFiles: []commoncrawl.WatFile{
+					{Number: "00000", Path: prefix + watFileName(0)},
+					{Number: "00001", Path: prefix + watFileName(1)},
+				},
+			}
+			segmentList := []commoncrawl.WatSegment{segment}
+
+			// the same segment is selected again in the run, failed file is not retried
+			for i := 0; i < 2; i++ {
+				maxWatFiles := 2
+				importSegment(segmentList[0], dataDir, &segmentList, 1, &maxWatFiles, nil, nil, deadLetter)
+			}
+
+			if downloads[watFileName(0)] != tt.wantDownloads {
+				t.Errorf("downloads of failed file = %d, want %d", downloads[watFileName(0)], tt.wantDownloads)
+			}
+			if !fileutils.FileExists(dataDir.SegmentTmpDir(segment) + linkDir + "00001" + extensionTxtGz) {
+				t.Error("other WAT file of segment was not imported")
+			}
+			if fileutils.FileExists(dataDir.SegmentTmpDir(segment) + linkDir + "00000" + extensionTxtGz) {
+				t.Error("link file of failed WAT file was kept")
+			}
+			if segmentList[0].ImportEnded != nil {
+				t.Error("segment with failed WAT file was compacted")
+			}
+
+			reloaded, err := commoncrawl.LoadDeadLetterWatFiles(dataDir.DeadLetterWatFilesFile())
+			if err != nil {
+				t.Fatalf("LoadDeadLetterWatFiles() error = %v", err)
+			}
+			failed, ok := reloaded.Files[commoncrawl.WatFileKey(prefix+watFileName(0))]
+			if !ok || failed.Attempts != 3 || failed.Segment != segment.Segment || len(reloaded.Files) != 1 {
+				t.Errorf("dead letter files = %+v, want only %s after 3 attempts", reloaded.Files, watFileName(0))
+			}
+		})
+	}
+}
+
+func TestImportSegmentKeepWatFiles(t *testing.T) {
+	tests := []struct {
+		name          string
+		keep          bool
+		wantKept      bool
+		wantDownloads int
+	}{
+		{name: "WAT file deleted after parsing", wantDownloads: 2},
+		{name: "WAT file kept with --keep-wat", keep: true, wantKept: true, wantDownloads: 1},
+	}
+
+	defer func() { keepWatFiles = false }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downloads := serveTestWatFile(t)
+			keepWatFiles = tt.keep
+
+			dataDir, err := commoncrawl.CreateDataDir(t.TempDir())
+			if err != nil {
+				t.Fatalf("CreateDataDir() error = %v", err)
+			}
+			prefix := "crawl-data/CC-MAIN-2021-04/segments/1610703495901.0/wat/"
+			segment := commoncrawl.WatSegment{
+				Archive: "CC-MAIN-2021-04",
+				Segment: "1610703495901.0",
+				WatFiles: []commoncrawl.WatFile{
+					{Number: "00000", Path: prefix + watFileName(0)},
+					{Number: "00001", Path: prefix + watFileName(1)},
+				},
+			}
+			recordWatFile := dataDir.TmpDir + "/wat/" + watFileName(0)
+			linkFile := dataDir.SegmentTmpDir(segment) + linkDir + "00000" + extensionTxtGz
+
+			// file is parsed twice, link file is removed to parse it again the way it is done when debugging parser
+			for i := 0; i < 2; i++ {
+				segmentList := []commoncrawl.WatSegment{segment}
+				segmentList[0].WatFiles = slices.Clone(segment.WatFiles)
+				maxWatFiles := 1
+				importSegment(segmentList[0], dataDir, &segmentList, 1, &maxWatFiles, nil, nil, nil)
+
+				if !fileutils.FileExists(linkFile) {
+					t.Fatalf("run %d: link file was not created", i)
+				}
+				if fileutils.FileExists(recordWatFile) != tt.wantKept {
+					t.Errorf("run %d: WAT file exists = %v, want %v", i, !tt.wantKept, tt.wantKept)
+				}
+				if err = os.Remove(linkFile); err != nil {
+					t.Fatalf("Failed to remove link file: %v", err)
+				}
+			}
+
+			if downloads[watFileName(0)] != tt.wantDownloads {
+				t.Errorf("downloads = %d, want %d", downloads[watFileName(0)], tt.wantDownloads)
+			}
+		})
+	}
+}
+
+func TestParseSegmentsFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []int
+		wantErr string
+	}{
+		{"single IDs and ranges", "# first batch\n12\n\n3-5\n  40  \n7,9 # weekend\n4-6\n", []int{3, 4, 5, 6, 7, 9, 12, 40}, ""},
+		{"only comments", "# nothing to import\n\n", nil, ""},
+		{"invalid range", "1\n5-2\n", nil, "line 2"},
+		{"invalid ID", "1\nsegment\n", nil, "line 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "segments.txt")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatalf("Failed to write segments file: %v", err)
+			}
+
+			got, err := parseSegmentsFile(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseSegmentsFile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSegmentsFile() error = %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseSegmentsFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseSegmentsFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("parseSegmentsFile() of missing file returned no error")
+	}
+}
+
+func TestUnionSegmentIDs(t *testing.T) {
+	got := unionSegmentIDs([]int{5, 2}, []int{2, 3, 9})
+	if want := []int{2, 3, 5, 9}; !slices.Equal(got, want) {
+		t.Errorf("unionSegmentIDs() = %v, want %v", got, want)
+	}
+}
+
+func TestValidateSegmentIDs(t *testing.T) {
+	segmentList := []commoncrawl.WatSegment{{SegmentID: 0}, {SegmentID: 1}, {SegmentID: 2}}
+
+	tests := []struct {
+		name       string
+		segmentIDs []int
+		wantErr    string
+	}{
+		{"all exist", []int{0, 2}, ""},
+		{"nothing selected", nil, ""},
+		{"missing segments listed", []int{1, 5, 100}, "5,100"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSegmentIDs(segmentList, tt.segmentIDs)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validateSegmentIDs() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateSegmentIDs() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseSegmentInput(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []int
+		wantErr bool
+	}{
+		{"5", []int{5}, false},
+		{"2-5", []int{2, 3, 4, 5}, false},
+		{"2,3,4,5", []int{2, 3, 4, 5}, false},
+		{"1-3,7", []int{1, 2, 3, 7}, false},
+		{"5,", []int{5}, false},
+		{"7, 1-2", []int{1, 2, 7}, false},
+		{"3,1,3", []int{1, 3}, false},
+		{"1-3,2-4,3", []int{1, 2, 3, 4}, false},
+		{"3-1", nil, true},
+		{"1-3,5-2", nil, true},
+		{"1-2-3", nil, true},
+		{"-1", nil, true},
+		{"1,a", nil, true},
+		{",", nil, true},
+		{"", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseSegmentInput(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSegmentInput(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseSegmentInput(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecompactSegmentDir(t *testing.T) {
+	defaultSort := sortFiles
+	defer func() { sortFiles = defaultSort }()
+	sortFiles = func(sortedFile string, dirPath string) error {
+		sortLinkFiles(t, dirPath, sortedFile)
+		return nil
+	}
+
+	// compacted file of the same link files built step by step
+	expectedDir, _ := writeMergeLinkFiles(t)
+	expectedSorted := filepath.Join(t.TempDir(), "sort_0.txt.gz")
+	expectedCompacted := filepath.Join(t.TempDir(), "compact_0.txt.gz")
+	sortLinkFiles(t, expectedDir, expectedSorted)
+	if err := aggressiveCompacting(expectedSorted, expectedCompacted); err != nil {
+		t.Fatalf("aggressiveCompacting() error = %v", err)
+	}
+	want, err := fileutils.ReadGZFileByLine(expectedCompacted)
+	if err != nil {
+		t.Fatalf("Failed to read compacted file: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		interrupted bool // link files were sorted and deleted before compaction
+	}{
+		{name: "link files"},
+		{name: "sorted file of interrupted compaction", interrupted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			linkFilesDir, _ := writeMergeLinkFiles(t)
+			segmentDir := filepath.Dir(linkFilesDir)
+			compactedFile := filepath.Join(segmentDir, "compact"+extensionTxtGz)
+			if tt.interrupted {
+				if err := sortWatPreProcessed(filepath.Join(segmentDir, "sort_compact"+extensionTxtGz), segmentDir+linkDir); err != nil {
+					t.Fatalf("sortWatPreProcessed() error = %v", err)
+				}
+			}
+
+			if code := runRecompact([]string{segmentDir}); code != 0 {
+				t.Fatalf("runRecompact() = %d, want 0", code)
+			}
+
+			got, err := fileutils.ReadGZFileByLine(compactedFile)
+			if err != nil {
+				t.Fatalf("Failed to read compacted file: %v", err)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("recompacted links =\n%q\nwant\n%q", got, want)
+			}
+			if files, _ := watPreProcessedFiles(segmentDir + linkDir); len(files) > 0 {
+				t.Errorf("link files were not deleted: %v", files)
+			}
+			if fileutils.FileExists(filepath.Join(segmentDir, "sort_compact"+extensionTxtGz)) {
+				t.Error("sorted file was not deleted")
+			}
+		})
+	}
+
+	if code := runRecompact([]string{t.TempDir()}); code != 1 {
+		t.Errorf("runRecompact() of directory without link files = %d, want 1", code)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+)
+
+// errNotSorted - input file of merge is not in order of link file lines, it has to be sorted
+var errNotSorted = errors.New("file is not sorted")
+
+// mergeKeyFields - number of fields in merge key: link domain, subdomain and path, files parsed from WAT files are sorted by them
+const mergeKeyFields = 3
+
+// sortedLinkReader - read lines of link file parsed from WAT file one by one
+type sortedLinkReader struct {
+	filePath string
+	file     *os.File
+	gzReader *gzip.Reader
+	scanner  *fileutils.LineScanner
+	line     string
+	key      string
+	done     bool
+}
+
+// sortedLinkHeap - readers ordered by key of their current line
+type sortedLinkHeap []*sortedLinkReader
+
+func (h sortedLinkHeap) Len() int           { return len(h) }
+func (h sortedLinkHeap) Less(i, j int) bool { return h[i].key < h[j].key }
+func (h sortedLinkHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *sortedLinkHeap) Push(x any)        { *h = append(*h, x.(*sortedLinkReader)) }
+func (h *sortedLinkHeap) Pop() any {
+	old := *h
+	reader := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return reader
+}
+
+// mergeBufferSize - initial line buffer of every merged file, it grows up to scanner buffer size only for longer lines
+const mergeBufferSize = 64 * 1024
+
+// mergeGzipMemory - memory of gzip reader of one merged file, its window and huffman tables
+const mergeGzipMemory = 64 * 1024
+
+// memoryFanIn - fanIn limited so line buffers and gzip readers of all files merged at once fit in memoryMB,
+// even when every line buffer grows to scanner buffer size. At least 2 files are merged at once
+func memoryFanIn(fanIn int, memoryMB int) int {
+	fileMemory := fileutils.ScannerBufferSize(fileutils.DefaultScannerBufferSize) + mergeGzipMemory
+	return max(min(fanIn, memoryMB*1024*1024/fileMemory), 2)
+}
+
+// mergeSortedFiles - merge link files parsed from WAT files into one gzipped file without sorting all lines again.
+// Lines of every file are ordered by link domain, subdomain and path, lines with the same key from all files are sorted
+// and deduplicated in memory, so the result is the same as `LC_ALL=C sort -u`. At most fanIn files are open at once, more files
+// are merged in passes through temporary files next to sortedFile. Returns errNotSorted when an input file is not ordered
+func mergeSortedFiles(sortedFile string, inputFiles []string, fanIn int) error {
+	fanIn = max(fanIn, 2)
+
+	var passFiles []string
+	defer func() {
+		for _, passFile := range passFiles {
+			_ = os.Remove(passFile)
+		}
+	}()
+	for pass := 1; len(inputFiles) > fanIn; pass++ {
+		var merged []string
+		for i := 0; i < len(inputFiles); i += fanIn {
+			passFile := fmt.Sprintf("%s.pass%d_%d.tmp", sortedFile, pass, len(merged))
+			passFiles = append(passFiles, passFile)
+			if err := mergeFiles(passFile, inputFiles[i:min(i+fanIn, len(inputFiles))]); err != nil {
+				return err
+			}
+			merged = append(merged, passFile)
+		}
+		// files of previous pass are merged, only link files given by caller are kept
+		if pass > 1 {
+			for _, passFile := range inputFiles {
+				_ = os.Remove(passFile)
+			}
+		}
+		inputFiles = merged
+	}
+
+	return mergeFiles(sortedFile, inputFiles)
+}
+
+// mergeFiles - merge sorted files into one gzipped file, all of them are open at once
+func mergeFiles(sortedFile string, inputFiles []string) error {
+	readers := make(sortedLinkHeap, 0, len(inputFiles))
+	defer func() {
+		for _, reader := range readers {
+			reader.Close()
+		}
+	}()
+	for _, inputFile := range inputFiles {
+		reader, err := openSortedLinkReader(inputFile)
+		if err != nil {
+			return err
+		}
+		readers = append(readers, reader)
+	}
+
+	fileOut, err := os.Create(sortedFile)
+	if err != nil {
+		return fmt.Errorf("error creating sorted file: %w", err)
+	}
+	defer fileOut.Close()
+	writer := gzip.NewWriter(fileOut)
+
+	queue := make(sortedLinkHeap, 0, len(readers))
+	for _, reader := range readers {
+		if err = reader.Next(); err != nil {
+			return err
+		}
+		if !reader.done {
+			queue = append(queue, reader)
+		}
+	}
+	heap.Init(&queue)
+
+	var group []string
+	for queue.Len() > 0 {
+		key := queue[0].key
+		group = group[:0]
+		for queue.Len() > 0 && queue[0].key == key {
+			reader := queue[0]
+			group = append(group, reader.line)
+			if err = reader.Next(); err != nil {
+				return err
+			}
+			if reader.done {
+				heap.Pop(&queue)
+			} else {
+				heap.Fix(&queue, 0)
+			}
+		}
+
+		slices.Sort(group)
+		for _, line := range slices.Compact(group) {
+			if _, err = io.WriteString(writer, line+"\n"); err != nil {
+				return err
+			}
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("error closing sorted file: %w", err)
+	}
+
+	return fileOut.Close()
+}
+
+// openSortedLinkReader - open gzipped link file, Next has to be called to read the first line. Its buffer starts small,
+// so merging many files does not allocate the whole scanner buffer for each of them
+func openSortedLinkReader(filePath string) (*sortedLinkReader, error) {
+	maxCapacityScanner := fileutils.ScannerBufferSize(fileutils.DefaultScannerBufferSize)
+	buf := make([]byte, min(mergeBufferSize, maxCapacityScanner))
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("error creating gzip reader of %s: %w", filePath, err)
+	}
+
+	return &sortedLinkReader{
+		filePath: filePath,
+		file:     file,
+		gzReader: gzReader,
+		scanner:  fileutils.NewLineScanner(gzReader, buf, maxCapacityScanner),
+	}, nil
+}
+
+// Next - read next line, returns errNotSorted when its key is lower than key of previous line
+func (r *sortedLinkReader) Next() error {
+	if r.scanner.Scan() {
+		line := r.scanner.Text()
+		key := lineKey(line, mergeKeyFields)
+		if key < r.key {
+			return fmt.Errorf("%w: %s has %q after %q", errNotSorted, r.filePath, key, r.key)
+		}
+		r.line, r.key = line, key
+		return nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return fmt.Errorf("error scanning %s: %w", r.filePath, err)
+	}
+
+	r.done = true
+	return nil
+}
+
+// Close - close gzip reader and file
+func (r *sortedLinkReader) Close() {
+	_ = r.gzReader.Close()
+	_ = r.file.Close()
+}
+
+// lineKey - line prefix with first fields and their separators, whole line when it has less fields
+func lineKey(line string, fields int) string {
+	end := 0
+	for i := 0; i < fields; i++ {
+		next := strings.IndexByte(line[end:], '|')
+		if next < 0 {
+			return line
+		}
+		end += next + 1
+	}
+	return line[:end]
+}
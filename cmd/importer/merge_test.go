@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+)
+
+// mergeWatFiles - WAT files with links to domains and paths starting with other ones and the same page crawled twice
+var mergeWatFiles = [][]commoncrawl.WatFixture{
+	{
+		{
+			URL:  "https://blog.net/post",
+			IP:   "1.2.3.4",
+			Date: time.Date(2023, 2, 4, 10, 0, 0, 0, time.UTC),
+			HTML: `<title>Post</title><a href="https://example.com/page">Page</a><a href="https://example.com.au/">AU</a><a href="https://example.com/page/sub">Sub</a><a href="https://www.example.com/page?b=1">Query</a>`,
+		},
+		{
+			URL:  "https://news.org/list",
+			IP:   "1.2.3.5",
+			Date: time.Date(2023, 2, 4, 11, 0, 0, 0, time.UTC),
+			HTML: `<title>News</title><a href="https://example.com/page">Page</a><a href="http://example.com/page-2">Page 2</a>`,
+		},
+	},
+	{
+		{
+			URL:  "https://blog.net/post",
+			IP:   "1.2.3.4",
+			Date: time.Date(2023, 2, 4, 10, 0, 0, 0, time.UTC),
+			HTML: `<title>Post</title><a href="https://example.com/page">Page</a><a href="https://example.com.au/">AU</a>`,
+		},
+		{
+			URL:  "https://shop.com/",
+			IP:   "1.2.3.6",
+			Date: time.Date(2023, 2, 6, 10, 0, 0, 0, time.UTC),
+			HTML: `<title>Shop</title><a href="https://example.com/page/sub">Sub</a><a href="https://example.com.au/">AU</a><a href="https://other.org/a">Other</a>`,
+		},
+	},
+}
+
+// writeMergeLinkFiles - parse mergeWatFiles into link files, the same way the importer does
+func writeMergeLinkFiles(t *testing.T) (string, []string) {
+	t.Helper()
+
+	tempDir := t.TempDir()
+	linkDir := filepath.Join(tempDir, "link")
+	if err := os.MkdirAll(linkDir, 0o755); err != nil {
+		t.Fatalf("Failed to create link directory: %v", err)
+	}
+
+	var linkFiles []string
+	for i, fixtures := range mergeWatFiles {
+		watFile := filepath.Join(tempDir, fmt.Sprintf("%05d.warc.wat.gz", i))
+		if err := commoncrawl.WriteWatFile(watFile, fixtures); err != nil {
+			t.Fatalf("WriteWatFile() error = %v", err)
+		}
+		linkFile := filepath.Join(linkDir, fmt.Sprintf("%05d%s", i, extensionTxtGz))
+		if _, err := commoncrawl.ParseWatFile(watFile, linkFile, "", false); err != nil {
+			t.Fatalf("ParseWatFile() error = %v", err)
+		}
+		linkFiles = append(linkFiles, linkFile)
+	}
+
+	return linkDir, linkFiles
+}
+
+func TestMergeSortedFiles(t *testing.T) {
+	linkDir, linkFiles := writeMergeLinkFiles(t)
+	tempDir := t.TempDir()
+
+	mergedFile := filepath.Join(tempDir, "sort_merged.txt.gz")
+	if err := mergeSortedFiles(mergedFile, linkFiles, 64); err != nil {
+		t.Fatalf("mergeSortedFiles() error = %v", err)
+	}
+	sortedFile := filepath.Join(tempDir, "sort_full.txt.gz")
+	sortLinkFiles(t, linkDir, sortedFile)
+
+	merged, err := fileutils.ReadGZFileByLine(mergedFile)
+	if err != nil {
+		t.Fatalf("Failed to read merged file: %v", err)
+	}
+	sorted, err := fileutils.ReadGZFileByLine(sortedFile)
+	if err != nil {
+		t.Fatalf("Failed to read sorted file: %v", err)
+	}
+	if !slices.Equal(merged, sorted) {
+		t.Errorf("mergeSortedFiles() =\n%q\nwant\n%q", merged, sorted)
+	}
+
+	// compacted files are the same too
+	mergedCompacted := filepath.Join(tempDir, "compact_merged.txt.gz")
+	sortedCompacted := filepath.Join(tempDir, "compact_full.txt.gz")
+	if err = aggressiveCompacting(mergedFile, mergedCompacted); err != nil {
+		t.Fatalf("aggressiveCompacting() error = %v", err)
+	}
+	if err = aggressiveCompacting(sortedFile, sortedCompacted); err != nil {
+		t.Fatalf("aggressiveCompacting() error = %v", err)
+	}
+	diff, err := diffCompactedFiles(sortedCompacted, mergedCompacted, nil)
+	if err != nil || diff.Added+diff.Removed+diff.Changed > 0 || diff.Unchanged == 0 {
+		t.Errorf("diffCompactedFiles() = %+v, %v, want the same links", diff, err)
+	}
+}
+
+func TestMergeSortedFilesPasses(t *testing.T) {
+	tempDir := t.TempDir()
+	// the same lines are repeated in files merged in different passes
+	fileLines := [][]string{
+		{"a.com||/|x", "c.com||/|x"},
+		{"a.com||/|x", "b.com||/|x"},
+		{"b.com||/|y", "d.com||/|x"},
+		{"a.com||/|y", "d.com||/|x"},
+		{"c.com||/|x", "e.com||/|x"},
+	}
+	var inputFiles []string
+	for i, lines := range fileLines {
+		inputFile := filepath.Join(tempDir, fmt.Sprintf("%05d%s", i, extensionTxtGz))
+		writeTestGzFile(t, inputFile, lines)
+		inputFiles = append(inputFiles, inputFile)
+	}
+	want := []string{"a.com||/|x", "a.com||/|y", "b.com||/|x", "b.com||/|y", "c.com||/|x", "d.com||/|x", "e.com||/|x"}
+
+	for _, fanIn := range []int{2, 3, 64} {
+		t.Run(fmt.Sprintf("fan-in %d", fanIn), func(t *testing.T) {
+			outDir := t.TempDir()
+			mergedFile := filepath.Join(outDir, "sort_0.txt.gz")
+			if err := mergeSortedFiles(mergedFile, inputFiles, fanIn); err != nil {
+				t.Fatalf("mergeSortedFiles() error = %v", err)
+			}
+			merged, err := fileutils.ReadGZFileByLine(mergedFile)
+			if err != nil {
+				t.Fatalf("Failed to read merged file: %v", err)
+			}
+			if !slices.Equal(merged, want) {
+				t.Errorf("mergeSortedFiles() = %q, want %q", merged, want)
+			}
+
+			// temporary files of passes are removed
+			entries, err := os.ReadDir(outDir)
+			if err != nil || len(entries) != 1 {
+				t.Errorf("merge left %d files in output directory, want 1, error = %v", len(entries), err)
+			}
+			for _, inputFile := range inputFiles {
+				if !fileutils.FileExists(inputFile) {
+					t.Errorf("input file %s was removed", inputFile)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryFanIn(t *testing.T) {
+	tests := []struct {
+		name      string
+		scannerMB string
+		fanIn     int
+		memoryMB  int
+		wantFanIn int
+	}{
+		{"memory for more files", "", 64, 1024, 64},
+		{"64MB for 3MB lines", "", 64, 64, 20},
+		{"1MB lines", "1", 64, 64, 60},
+		{"too little memory", "", 64, 1, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GLOBALLINKS_SCANNERBUFFER", tt.scannerMB)
+			if got := memoryFanIn(tt.fanIn, tt.memoryMB); got != tt.wantFanIn {
+				t.Errorf("memoryFanIn(%d, %d) = %d, want %d", tt.fanIn, tt.memoryMB, got, tt.wantFanIn)
+			}
+		})
+	}
+}
+
+func TestMergeSortedFilesNotSorted(t *testing.T) {
+	tempDir := t.TempDir()
+	linkFile := filepath.Join(tempDir, "00000"+extensionTxtGz)
+	writeTestGzFile(t, linkFile, []string{
+		"example.org||/|||2|source.com|/||2|A|0|0|2023-02-04|1.2.3.4|",
+		"example.com||/|||2|source.com|/||2|A|0|0|2023-02-04|1.2.3.4|",
+	})
+
+	err := mergeSortedFiles(filepath.Join(tempDir, "sort_0.txt.gz"), []string{linkFile}, 64)
+	if !errors.Is(err, errNotSorted) {
+		t.Errorf("mergeSortedFiles() error = %v, want errNotSorted", err)
+	}
+}
+
+func TestSortWatPreProcessedMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		unsorted bool
+		wantSort bool
+	}{
+		{name: "sorted files are merged"},
+		{name: "unsorted files are sorted", unsorted: true, wantSort: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			linkDir, linkFiles := writeMergeLinkFiles(t)
+			if tt.unsorted {
+				writeTestGzFile(t, linkFiles[0], []string{
+					"example.org||/|||2|source.com|/||2|A|0|0|2023-02-04|1.2.3.4|",
+					"example.com||/|||2|source.com|/||2|A|0|0|2023-02-04|1.2.3.4|",
+				})
+			}
+
+			defaultSort := sortFiles
+			defer func() { sortFiles = defaultSort }()
+			sorted := false
+			sortFiles = func(sortedFile string, dirPath string) error {
+				sorted = true
+				sortLinkFiles(t, dirPath, sortedFile)
+				return nil
+			}
+
+			t.Setenv("GLOBALLINKS_MERGESORTED", "true")
+			sortedFile := filepath.Join(t.TempDir(), "sort_0.txt.gz")
+			if err := sortWatPreProcessed(sortedFile, linkDir); err != nil {
+				t.Fatalf("sortWatPreProcessed() error = %v", err)
+			}
+			if sorted != tt.wantSort {
+				t.Errorf("sortWatPreProcessed() sorted all lines = %v, want %v", sorted, tt.wantSort)
+			}
+			if lines, err := countGzLines(sortedFile); err != nil || lines == 0 {
+				t.Errorf("countGzLines() = %d, %v, want sorted lines", lines, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cmp"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+)
+
+// sourcePage - one source page of compacted link with number of its sorted lines
+type sourcePage struct {
+	link  commoncrawl.FileLinkCompacted
+	lines int
+}
+
+// sourcePages - up to limit source pages of one compacted link (link and page host), pages are chosen by page path policy.
+// Lines of one page are next to each other in sorted file, so only the page of current lines and the best pages are kept in memory
+type sourcePages struct {
+	limit  int
+	policy string
+	first  commoncrawl.FileLinkCompacted // first line of current compacted link, empty before the first line
+	run    sourcePage                    // page of the last lines
+	pages  []sourcePage                  // the best pages of current compacted link, the best first
+}
+
+// newSourcePages - keep up to limit source pages of every compacted link, unknown policy keeps the shortest paths
+func newSourcePages(limit int, policy string) *sourcePages {
+	return &sourcePages{limit: max(limit, 1), policy: policy, pages: make([]sourcePage, 0, limit+1)}
+}
+
+// add - add line of sorted file, links of the previous compacted link are returned when the line starts a new one
+func (s *sourcePages) add(fileLink commoncrawl.FileLinkCompacted) []commoncrawl.FileLinkCompacted {
+	if s.first.LinkDomain == "" || !sameCompactedLink(fileLink, s.first) {
+		links := s.flush()
+		s.first = fileLink
+		s.run = sourcePage{link: fileLink, lines: 1}
+		return links
+	}
+
+	// ignore nofollow link if we have dofollow
+	if s.first.NoFollow == 0 && fileLink.NoFollow == 1 {
+		return nil
+	}
+
+	if samePage(fileLink, s.run.link) {
+		mergeSourcePage(&s.run.link, fileLink)
+		s.run.lines++
+		return nil
+	}
+	s.keep(s.run)
+	s.run = sourcePage{link: fileLink, lines: 1}
+
+	return nil
+}
+
+// flush - links of current compacted link, one for every kept page in order of page path and query, so compacted file stays sorted.
+// Qty of every link is the number of lines of its page
+func (s *sourcePages) flush() []commoncrawl.FileLinkCompacted {
+	if s.first.LinkDomain == "" {
+		return nil
+	}
+	s.keep(s.run)
+
+	// fields are compared like whole lines, /a-b| is before /a| in sorted file
+	slices.SortFunc(s.pages, func(a, b sourcePage) int {
+		if c := commoncrawl.CompareLineField(a.link.PagePath, b.link.PagePath); c != 0 {
+			return c
+		}
+		return commoncrawl.CompareLineField(a.link.PageRawQuery, b.link.PageRawQuery)
+	})
+	links := make([]commoncrawl.FileLinkCompacted, 0, len(s.pages))
+	for _, page := range s.pages {
+		page.link.Qty = page.lines
+		links = append(links, page.link)
+	}
+
+	s.pages = s.pages[:0]
+	s.first = commoncrawl.FileLinkCompacted{}
+
+	return links
+}
+
+// keep - add page to the best pages, the worst page over limit is dropped. Page found again after lines of other link scheme is merged
+func (s *sourcePages) keep(page sourcePage) {
+	for i := range s.pages {
+		if samePage(s.pages[i].link, page.link) {
+			mergeSourcePage(&s.pages[i].link, page.link)
+			s.pages[i].lines += page.lines
+			page = s.pages[i]
+			s.pages = slices.Delete(s.pages, i, i+1)
+			break
+		}
+	}
+
+	s.pages = append(s.pages, page)
+	// stable sort keeps the page found first on ties
+	slices.SortStableFunc(s.pages, s.compare)
+	if len(s.pages) > s.limit {
+		s.pages = s.pages[:s.limit]
+	}
+}
+
+// compare - order of pages by policy, the best page first
+func (s *sourcePages) compare(a, b sourcePage) int {
+	switch s.policy {
+	case pagePathMostRecent:
+		return cmp.Compare(b.link.DateTo, a.link.DateTo)
+	case pagePathMostFrequent:
+		return cmp.Compare(b.lines, a.lines)
+	}
+	if c := cmp.Compare(len(a.link.PagePath), len(b.link.PagePath)); c != 0 {
+		return c
+	}
+	return cmp.Compare(len(a.link.PageRawQuery), len(b.link.PageRawQuery))
+}
+
+// sameCompactedLink - lines are compacted into one link: the same link found on one page host
+func sameCompactedLink(a commoncrawl.FileLinkCompacted, b commoncrawl.FileLinkCompacted) bool {
+	return a.LinkDomain == b.LinkDomain && a.LinkSubDomain == b.LinkSubDomain && a.LinkPath == b.LinkPath && a.LinkRawQuery == b.LinkRawQuery && a.PageHost == b.PageHost
+}
+
+// samePage - lines of the same source page
+func samePage(a commoncrawl.FileLinkCompacted, b commoncrawl.FileLinkCompacted) bool {
+	return a.PagePath == b.PagePath && a.PageRawQuery == b.PageRawQuery
+}
+
+// mergeSourcePage - add dates and ip of next line of the same page
+func mergeSourcePage(page *commoncrawl.FileLinkCompacted, fileLink commoncrawl.FileLinkCompacted) {
+	page.DateFrom = min(page.DateFrom, fileLink.DateFrom)
+	page.DateTo = max(page.DateTo, fileLink.DateTo)
+	// take ip from latest record
+	page.IP = fileLink.IP
+	mergeLinkType(page, fileLink)
+}
+
+// mergeLinkType - link type is not part of compacted link, <a> link wins over head link to the same url and its anchor text is kept
+func mergeLinkType(link *commoncrawl.FileLinkCompacted, fileLink commoncrawl.FileLinkCompacted) {
+	if link.LinkType != "" && fileLink.LinkType == "" {
+		link.LinkType = ""
+		link.LinkText = fileLink.LinkText
+	}
+}
+
+// setCompactPages - GLOBALLINKS_COMPACTPAGES sets how many source pages of one host are kept for every link during compaction, default 1
+func setCompactPages() int {
+	envVar := "GLOBALLINKS_COMPACTPAGES"
+	defaultVal := 1
+	minVal := 1
+	maxVal := 100
+
+	pagesStr := os.Getenv(envVar)
+	if pagesStr == "" {
+		return defaultVal
+	}
+
+	pages, err := strconv.Atoi(pagesStr)
+	if err != nil {
+		log.Printf("Invalid number for %s: %v. Using default %d", envVar, err, defaultVal)
+		return defaultVal
+	}
+
+	if pages < minVal || pages > maxVal {
+		log.Printf("Number for %s must be between %d and %d. Using default %d", envVar, minVal, maxVal, defaultVal)
+		return defaultVal
+	}
+
+	return pages
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+)
+
+func TestAggressiveCompactingSourcePages(t *testing.T) {
+	// link /a is found on four pages of source.com, /blog/post in the most lines, /news/latest in the latest crawl,
+	// nofollow line of /z is ignored because the link is dofollow on the other pages, /b is found on one page only
+	sortedLines := []string{
+		"example.com||/a||2|source.com|/about||2|Anchor|0|0|2023-02-01|1.2.3.4|",
+		"example.com||/a||2|source.com|/blog/post||2|Anchor|0|0|2023-02-02|1.2.3.4|",
+		"example.com||/a||2|source.com|/blog/post||2|Anchor|0|0|2023-02-03|1.2.3.4|",
+		"example.com||/a||2|source.com|/blog/post||2|Anchor|0|0|2023-02-04|1.2.3.4|",
+		"example.com||/a||2|source.com|/contact||2|Anchor|0|0|2023-02-05|1.2.3.4|",
+		"example.com||/a||2|source.com|/news/latest||2|Anchor|0|0|2023-02-10|1.2.3.4|",
+		"example.com||/a||2|source.com|/z||2|Anchor|1|0|2023-02-11|1.2.3.4|",
+		"example.com||/b||2|source.com|/news/latest||2|Anchor|0|0|2023-02-01|1.2.3.4|",
+	}
+
+	tests := []struct {
+		name      string
+		pages     string
+		policy    string
+		wantPages []string
+	}{
+		{"one page", "", "", []string{"/a|/about|6", "/b|/news/latest|1"}},
+		{"shortest", "3", "shortest", []string{"/a|/about|1", "/a|/blog/post|3", "/a|/contact|1", "/b|/news/latest|1"}},
+		{"most recent", "2", "most-recent", []string{"/a|/contact|1", "/a|/news/latest|1", "/b|/news/latest|1"}},
+		{"most frequent", "2", "most-frequent", []string{"/a|/about|1", "/a|/blog/post|3", "/b|/news/latest|1"}},
+		{"more than pages", "10", "", []string{"/a|/about|1", "/a|/blog/post|3", "/a|/contact|1", "/a|/news/latest|1", "/b|/news/latest|1"}},
+		{"invalid", "0", "", []string{"/a|/about|6", "/b|/news/latest|1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			sortedFile := filepath.Join(tempDir, "sort_1.txt.gz")
+			compactedFile := filepath.Join(tempDir, "compact_1.txt.gz")
+			writeTestGzFile(t, sortedFile, sortedLines)
+
+			t.Setenv("GLOBALLINKS_COMPACTPAGES", tt.pages)
+			t.Setenv("GLOBALLINKS_PAGEPATHPOLICY", tt.policy)
+			if err := aggressiveCompacting(sortedFile, compactedFile); err != nil {
+				t.Fatalf("aggressiveCompacting() error = %v", err)
+			}
+
+			var pages []string
+			for _, row := range readLinkRows(t, compactedFile) {
+				pages = append(pages, fmt.Sprintf("%s|%s|%d", row.LinkPath, row.PagePath, row.Qty))
+				if row.NoFollow != 0 {
+					t.Errorf("aggressiveCompacting() link = %+v, want dofollow", row)
+				}
+			}
+			// pages of one link are saved in order of page path, so compacted file stays sorted
+			if !slices.Equal(pages, tt.wantPages) {
+				t.Errorf("aggressiveCompacting() pages = %q, want %q", pages, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestAggressiveCompactingSourcePagesByteOrder(t *testing.T) {
+	// - is before | byte by byte, so /a-b and query x-y are before /a and query x in sorted file
+	sortedLines := []string{
+		"example.com||/a||2|source.com|/a-b||2|Anchor|0|0|2023-02-01|1.2.3.4|",
+		"example.com||/a||2|source.com|/a||2|Anchor|0|0|2023-02-01|1.2.3.4|",
+		"example.com||/a||2|source.com|/p|x-y|2|Anchor|0|0|2023-02-01|1.2.3.4|",
+		"example.com||/a||2|source.com|/p|x|2|Anchor|0|0|2023-02-01|1.2.3.4|",
+	}
+	if !slices.IsSorted(sortedLines) {
+		t.Fatal("sorted lines are not in byte order")
+	}
+
+	tempDir := t.TempDir()
+	sortedFile := filepath.Join(tempDir, "sort_1.txt.gz")
+	compactedFile := filepath.Join(tempDir, "compact_1.txt.gz")
+	writeTestGzFile(t, sortedFile, sortedLines)
+
+	t.Setenv("GLOBALLINKS_COMPACTPAGES", "5")
+	if err := aggressiveCompacting(sortedFile, compactedFile); err != nil {
+		t.Fatalf("aggressiveCompacting() error = %v", err)
+	}
+
+	verifySorted(t, compactedFile, len(sortedLines))
+}
+
+// verifySorted - lines of gzipped file are sorted byte by byte like `LC_ALL=C sort` sorts them
+func verifySorted(t *testing.T, filePath string, wantLines int) {
+	t.Helper()
+
+	lines, err := fileutils.ReadGZFileByLine(filePath)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", filePath, err)
+	}
+	if len(lines) != wantLines {
+		t.Errorf("%s has %d lines, want %d", filePath, len(lines), wantLines)
+	}
+	for i := 1; i < len(lines); i++ {
+		if lines[i-1] > lines[i] {
+			t.Errorf("%s is not sorted, %q is before %q", filePath, lines[i-1], lines[i])
+		}
+	}
+}
+
+func TestSourcePagesMergeDates(t *testing.T) {
+	// the same page found again after lines of other link scheme is one source page with dates of all its lines
+	sortedLines := []string{
+		"example.com||/a||1|source.com|/about||2|Anchor|0|0|2023-02-05|1.2.3.4|",
+		"example.com||/a||1|source.com|/blog||2|Anchor|0|0|2023-02-06|1.2.3.4|",
+		"example.com||/a||2|source.com|/about||2|Anchor|0|0|2023-02-01|1.2.3.5|",
+		"example.com||/a||2|source.com|/about||2|Anchor|0|0|2023-02-09|1.2.3.6|",
+	}
+
+	tempDir := t.TempDir()
+	sortedFile := filepath.Join(tempDir, "sort_1.txt.gz")
+	compactedFile := filepath.Join(tempDir, "compact_1.txt.gz")
+	writeTestGzFile(t, sortedFile, sortedLines)
+
+	t.Setenv("GLOBALLINKS_COMPACTPAGES", "5")
+	if err := aggressiveCompacting(sortedFile, compactedFile); err != nil {
+		t.Fatalf("aggressiveCompacting() error = %v", err)
+	}
+
+	rows := readLinkRows(t, compactedFile)
+	if len(rows) != 2 {
+		t.Fatalf("aggressiveCompacting() saved %d links, want 2", len(rows))
+	}
+	about := rows[0]
+	if about.PagePath != "/about" || about.Qty != 3 || about.DateFrom != "2023-02-01" || about.DateTo != "2023-02-09" || about.IP != "1.2.3.6" {
+		t.Errorf("aggressiveCompacting() page /about = %+v, want 3 lines 2023-02-01 - 2023-02-09 from 1.2.3.6", about)
+	}
+	if rows[1].PagePath != "/blog" || rows[1].Qty != 1 {
+		t.Errorf("aggressiveCompacting() page /blog = %+v, want 1 line", rows[1])
+	}
+}
+
+func TestSetCompactPages(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 1},
+		{"5", 5},
+		{"0", 1},
+		{"101", 1},
+		{"abc", 1},
+	}
+	for _, tt := range tests {
+		t.Setenv("GLOBALLINKS_COMPACTPAGES", tt.value)
+		if got := setCompactPages(); got != tt.want {
+			t.Errorf("setCompactPages() with %q = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestAggressiveCompactingLinkType(t *testing.T) {
+	// link /a is found as head link and <a> link of source.com pages, head link line is sorted first
+	sortedLines := []string{
+		"example.com||/a||2|source.com|/about||2||0|0|2023-02-01|1.2.3.4|alternate",
+		"example.com||/a||2|source.com|/about||2|Anchor|0|0|2023-02-02|1.2.3.4|",
+		"example.com||/a||2|source.com|/blog||2||0|0|2023-02-03|1.2.3.4|alternate",
+		"example.com||/b||2|source.com|/about||2||0|0|2023-02-01|1.2.3.4|alternate",
+	}
+
+	tests := []struct {
+		pages string
+		want  []string
+	}{
+		// the shortest page path is kept, <a> link of other page of the host wins
+		{"1", []string{"/a|/blog||Anchor", "/b|/about|alternate|"}},
+		// <a> link wins over head link of the same page, head link stays on page without <a> link
+		{"5", []string{"/a|/about||Anchor", "/a|/blog|alternate|", "/b|/about|alternate|"}},
+	}
+
+	for _, tt := range tests {
+		t.Run("pages "+tt.pages, func(t *testing.T) {
+			tempDir := t.TempDir()
+			sortedFile := filepath.Join(tempDir, "sort_1.txt.gz")
+			compactedFile := filepath.Join(tempDir, "compact_1.txt.gz")
+			writeTestGzFile(t, sortedFile, sortedLines)
+
+			t.Setenv("GLOBALLINKS_COMPACTPAGES", tt.pages)
+			if err := aggressiveCompacting(sortedFile, compactedFile); err != nil {
+				t.Fatalf("aggressiveCompacting() error = %v", err)
+			}
+
+			var got []string
+			for _, row := range readLinkRows(t, compactedFile) {
+				got = append(got, fmt.Sprintf("%s|%s|%s|%s", row.LinkPath, row.PagePath, row.LinkType, row.LinkText))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("aggressiveCompacting() links = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
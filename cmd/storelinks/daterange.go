@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// dateRangeCrawl - every import inserts its links, datefrom and dateto of a row are crawl dates of its segment.
+	// Links of one archive usually have one or a few dates, API merges rows of the same link from many archives
+	dateRangeCrawl = "crawl"
+	// dateRangeSpan - link from the same page is stored once, datefrom and dateto span all imported archives with it
+	dateRangeSpan = "span"
+)
+
+// duplicateKeyCode - MongoDB error code of insert of document with already stored unique key
+const duplicateKeyCode = 11000
+
+// spanLinkKey - fields of link from one source page, the same fields identify link in API link detail. Link and page schemes are
+// not part of the key, compacting merges http and https links from the same page, so compacted file has one line per key and
+// scheme of the last imported archive is kept
+var spanLinkKey = []string{"linkdomain", "linksubdomain", "linkpath", "linkrawquery", "pagehost", "pagepath", "pagerawquery"}
+
+const (
+	spanArchivesField = "archives" // archives merged to link, archive is removed from it when archive is deleted
+	spanImportsField  = "imports"  // segments merged to link as archive/segment, qty of segment is added only once
+)
+
+// setDateRange sets with GLOBALLINKS_STORE_DATERANGE if imported links are inserted with dates of their crawl (crawl)
+// or merged with stored link so its dates span all archives (span)
+func setDateRange() string {
+	envVar := "GLOBALLINKS_STORE_DATERANGE"
+	valStr := os.Getenv(envVar)
+	switch valStr {
+	case "":
+		return dateRangeCrawl
+	case dateRangeCrawl, dateRangeSpan:
+		return valStr
+	}
+
+	log.Printf("Invalid date range for %s: %q, use %s or %s. Using %s", envVar, valStr, dateRangeCrawl, dateRangeSpan, dateRangeCrawl)
+	return dateRangeCrawl
+}
+
+// saveLinkBatch - insert links or merge them with stored links when dates span archives, number of links saved by earlier import of
+// the same segment is returned
+func saveLinkBatch(ctx context.Context, collection linkInserter, links []interface{}, dateRange string, importInfo ImportedSegments) (int, error) {
+	if dateRange != dateRangeSpan {
+		// links saved by failed import of segment are rejected by their id, other links of batch are still inserted
+		_, err := collection.InsertMany(ctx, links, options.InsertMany().SetOrdered(false))
+		if err == nil {
+			return 0, nil
+		}
+		if !onlyDuplicateKeys(err, duplicateIDIndex) {
+			return 0, err
+		}
+		var bulkErr mongo.BulkWriteException
+		errors.As(err, &bulkErr)
+		return len(bulkErr.WriteErrors), nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(links))
+	for _, link := range links {
+		model, err := spanLinkModel(link.(FileLinkCompacted), importInfo)
+		if err != nil {
+			return 0, err
+		}
+		models = append(models, model)
+	}
+	// links of one batch are unique, they can be saved in any order
+	_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err == nil {
+		return 0, nil
+	}
+	if !onlyDuplicateKeys(err, "") {
+		return 0, err
+	}
+
+	// link with this segment in imports is not matched by upsert filter and its insert is rejected by unique index, so segment imported
+	// again does not add its qty twice. Link inserted at the same time by import of other segment is rejected too, it is updated when tried again
+	var bulkErr mongo.BulkWriteException
+	errors.As(err, &bulkErr)
+	retry := make([]mongo.WriteModel, 0, len(bulkErr.WriteErrors))
+	for _, writeErr := range bulkErr.WriteErrors {
+		retry = append(retry, models[writeErr.Index])
+	}
+	_, err = collection.BulkWrite(ctx, retry, options.BulkWrite().SetOrdered(false))
+	if err == nil {
+		return 0, nil
+	}
+	if !onlyDuplicateKeys(err, "") {
+		return 0, err
+	}
+	errors.As(err, &bulkErr)
+	return len(bulkErr.WriteErrors), nil
+}
+
+// duplicateIDIndex - index of _id, named in message of duplicate key error
+const duplicateIDIndex = "_id_"
+
+// onlyDuplicateKeys - all failed writes of bulk insert have key of already stored document, with index set only keys of that index
+func onlyDuplicateKeys(err error, index string) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0 {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != duplicateKeyCode {
+			return false
+		}
+		if index != "" && !strings.Contains(writeErr.Message, "index: "+index+" ") {
+			return false
+		}
+	}
+	return true
+}
+
+// spanImportKey - segment in imports of merged link
+func spanImportKey(importInfo ImportedSegments) string {
+	return importInfo.ArchName + "/" + importInfo.Segment
+}
+
+// spanLinkModel - upsert of link from one source page, the earliest datefrom and the latest dateto are kept and qty is added when segment
+// was not merged to link yet. Archive and segment are added to archives and imports, other fields are set from the last imported archive,
+// so archives should be imported from the oldest one
+func spanLinkModel(link FileLinkCompacted, importInfo ImportedSegments) (*mongo.UpdateOneModel, error) {
+	data, err := bson.Marshal(link)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding link: %w", err)
+	}
+	var fields bson.M
+	if err = bson.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("error encoding link: %w", err)
+	}
+
+	importKey := spanImportKey(importInfo)
+	filter := make(bson.D, 0, len(spanLinkKey)+1)
+	for _, key := range spanLinkKey {
+		filter = append(filter, bson.E{Key: key, Value: fields[key]})
+		delete(fields, key)
+	}
+	filter = append(filter, bson.E{Key: spanImportsField, Value: bson.D{{Key: "$ne", Value: importKey}}})
+	for _, key := range []string{"datefrom", "dateto", "qty", archiveIndexedField} {
+		delete(fields, key)
+	}
+
+	update := bson.D{
+		{Key: "$min", Value: bson.D{{Key: "datefrom", Value: link.DateFrom}}},
+		{Key: "$max", Value: bson.D{{Key: "dateto", Value: link.DateTo}}},
+		{Key: "$inc", Value: bson.D{{Key: "qty", Value: link.Qty}}},
+		{Key: "$addToSet", Value: bson.D{{Key: spanArchivesField, Value: link.Archive}, {Key: spanImportsField, Value: importKey}}},
+		{Key: "$set", Value: fields},
+	}
+
+	return mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true), nil
+}
+
+// createSpanIndex - unique index of link from one source page, every upserted link is found by it and link is never stored twice.
+// Index of archives finds links to remove archive from
+func createSpanIndex(ctx context.Context, collection *mongo.Collection) error {
+	keys := make(bson.D, 0, len(spanLinkKey))
+	for _, key := range spanLinkKey {
+		keys = append(keys, bson.E{Key: key, Value: 1})
+	}
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: keys, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: spanArchivesField, Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating unique link index, index of links created by older version has to be dropped: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestSetDateRange(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", dateRangeCrawl},
+		{"crawl", dateRangeCrawl},
+		{"span", dateRangeSpan},
+		{"archives", dateRangeCrawl},
+	}
+	for _, tt := range tests {
+		t.Setenv("GLOBALLINKS_STORE_DATERANGE", tt.value)
+		if got := setDateRange(); got != tt.want {
+			t.Errorf("setDateRange() with %q = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLoadLinksMergeArchives(t *testing.T) {
+	// the same link from the same page crawled in two archives, the second archive has also link from other page
+	archives := []struct {
+		name  string
+		lines string
+	}{
+		{"CC-MAIN-2021-04", "example.com||/a||2|source.com|/post||2|Old anchor|0|0|2021-01-15|2021-01-16|1.2.3.4|2|\n"},
+		{"CC-MAIN-2023-06", "example.com||/a||2|source.com|/post||2|New anchor|1|0|2023-02-04|2023-02-05|1.2.3.5|3|\n" +
+			"example.com||/a||2|other.com|/||2|Other|0|0|2023-02-06|2023-02-06|1.2.3.6|1|\n"},
+	}
+
+	tests := []struct {
+		name      string
+		dateRange string
+		reversed  bool // archives imported from the newest one
+		want      []FileLinkCompacted
+	}{
+		{
+			name:      "crawl dates",
+			dateRange: dateRangeCrawl,
+			want: []FileLinkCompacted{
+				{LinkText: "Old anchor", DateFrom: "2021-01-15", DateTo: "2021-01-16", Qty: 2, Archive: "CC-MAIN-2021-04"},
+				{LinkText: "New anchor", NoFollow: 1, DateFrom: "2023-02-04", DateTo: "2023-02-05", Qty: 3, Archive: "CC-MAIN-2023-06"},
+				{PageHost: "other.com", LinkText: "Other", DateFrom: "2023-02-06", DateTo: "2023-02-06", Qty: 1, Archive: "CC-MAIN-2023-06"},
+			},
+		},
+		{
+			name:      "dates span archives",
+			dateRange: dateRangeSpan,
+			want: []FileLinkCompacted{
+				{LinkText: "New anchor", NoFollow: 1, DateFrom: "2021-01-15", DateTo: "2023-02-05", Qty: 5, Archives: []string{"CC-MAIN-2021-04", "CC-MAIN-2023-06"}},
+				{PageHost: "other.com", LinkText: "Other", DateFrom: "2023-02-06", DateTo: "2023-02-06", Qty: 1, Archives: []string{"CC-MAIN-2023-06"}},
+			},
+		},
+		{
+			name:      "dates span archives imported from the newest",
+			dateRange: dateRangeSpan,
+			reversed:  true,
+			want: []FileLinkCompacted{
+				{LinkText: "Old anchor", DateFrom: "2021-01-15", DateTo: "2023-02-05", Qty: 5, Archives: []string{"CC-MAIN-2023-06", "CC-MAIN-2021-04"}},
+				{PageHost: "other.com", LinkText: "Other", DateFrom: "2023-02-06", DateTo: "2023-02-06", Qty: 1, Archives: []string{"CC-MAIN-2023-06"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inserter := &fakeLinkInserter{}
+			for i := range archives {
+				archive := archives[i]
+				if tt.reversed {
+					archive = archives[len(archives)-1-i]
+				}
+				savedQty, err := loadLinks(context.Background(), inserter, strings.NewReader(archive.lines), ImportedSegments{ArchName: archive.name, Segment: "1"}, 1, tt.dateRange, nil)
+				if err != nil || savedQty != strings.Count(archive.lines, "\n") {
+					t.Fatalf("loadLinks() of %s = %d, %v", archive.name, savedQty, err)
+				}
+			}
+
+			got := make([]FileLinkCompacted, 0, len(inserter.saved))
+			for _, link := range inserter.saved {
+				if link.LinkDomain != "example.com" || link.LinkPath != "/a" {
+					t.Errorf("saved link = %+v, want link to example.com/a", link)
+				}
+				if link.PageHost == "source.com" {
+					link.PageHost = ""
+				}
+				got = append(got, FileLinkCompacted{
+					PageHost: link.PageHost, LinkText: link.LinkText, NoFollow: link.NoFollow,
+					DateFrom: link.DateFrom, DateTo: link.DateTo, Qty: link.Qty, Archive: link.Archive, Archives: link.Archives,
+				})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("saved links = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreLinksDateRangeSpan(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("upsert links with span index", func(mt *mtest.T) {
+		mt.Setenv("GLOBALLINKS_STORE_DATERANGE", "span")
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+		importInfo := ImportedSegments{ArchName: "CC-MAIN-2023-06", Segment: "1"}
+		err := storeLinks(context.Background(), mt.DB, "links", strings.NewReader(compactedLines(2)), importInfo, nil)
+		if err != nil {
+			mt.Fatalf("storeLinks() error = %v", err)
+		}
+
+		uniqueIndexes := 0
+		for _, command := range []string{"createIndexes", "createIndexes", "update", "insert"} {
+			event := mt.GetStartedEvent()
+			if event.CommandName != command {
+				mt.Fatalf("command = %s, want %s", event.CommandName, command)
+			}
+			if command == "createIndexes" {
+				indexes, _ := event.Command.Lookup("indexes").Array().Values()
+				for _, index := range indexes {
+					if unique, ok := index.Document().Lookup("unique").BooleanOK(); ok && unique {
+						uniqueIndexes++
+					}
+				}
+			}
+			if command != "update" {
+				continue
+			}
+			updates, _ := event.Command.Lookup("updates").Array().Values()
+			if len(updates) != 2 {
+				mt.Fatalf("update has %d links, want 2", len(updates))
+			}
+			update := updates[0].Document()
+			if !update.Lookup("upsert").Boolean() || update.Lookup("q", "pagehost").StringValue() != "source.com" {
+				mt.Errorf("update = %s, want upsert of link from source.com", update)
+			}
+			if update.Lookup("u", "$min", "datefrom").StringValue() != "2023-02-04" || update.Lookup("u", "$max", "dateto").StringValue() != "2023-02-05" {
+				mt.Errorf("update = %s, want $min of datefrom and $max of dateto", update)
+			}
+			if update.Lookup("u", "$addToSet", "archives").StringValue() != "CC-MAIN-2023-06" || update.Lookup("u", "$set", "archive").Type != 0 {
+				mt.Errorf("update = %s, want archive added to archives", update)
+			}
+			if update.Lookup("q", "imports", "$ne").StringValue() != "CC-MAIN-2023-06/1" || update.Lookup("u", "$addToSet", "imports").StringValue() != "CC-MAIN-2023-06/1" {
+				mt.Errorf("update = %s, want link not merged from segment yet", update)
+			}
+		}
+		if uniqueIndexes != 1 {
+			mt.Errorf("created %d unique indexes, want unique index of link key", uniqueIndexes)
+		}
+	})
+}
+
+// TestLoadLinksSpanImportedAgain - segment imported again, like after failed import, does not add qty of its links twice
+func TestLoadLinksSpanImportedAgain(t *testing.T) {
+	lines := "example.com||/a||2|source.com|/post||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.5|3|\n"
+	inserter := &fakeLinkInserter{}
+	for _, importInfo := range []ImportedSegments{
+		{ArchName: "CC-MAIN-2023-06", Segment: "1"},
+		{ArchName: "CC-MAIN-2023-06", Segment: "1"},
+		{ArchName: "CC-MAIN-2023-06", Segment: "2"},
+	} {
+		if _, err := loadLinks(context.Background(), inserter, strings.NewReader(lines), importInfo, 1, dateRangeSpan, nil); err != nil {
+			t.Fatalf("loadLinks() of segment %s error = %v", importInfo.Segment, err)
+		}
+	}
+
+	if len(inserter.saved) != 1 {
+		t.Fatalf("saved %d links, want 1", len(inserter.saved))
+	}
+	link := inserter.saved[0]
+	if link.Qty != 6 || !reflect.DeepEqual(link.Archives, []string{"CC-MAIN-2023-06"}) || !reflect.DeepEqual(link.Imports, []string{"CC-MAIN-2023-06/1", "CC-MAIN-2023-06/2"}) {
+		t.Errorf("saved link qty = %d, archives = %v, imports = %v, want qty 6 of segments 1 and 2", link.Qty, link.Archives, link.Imports)
+	}
+}
+
+// racingLinkInserter - link inserter where the first bulk write loses race with import of other segment saving the same links
+type racingLinkInserter struct {
+	*fakeLinkInserter
+	other ImportedSegments
+	raced bool
+}
+
+func (r *racingLinkInserter) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	if r.raced {
+		return r.fakeLinkInserter.BulkWrite(ctx, models, opts...)
+	}
+	r.raced = true
+
+	var bulkErr mongo.BulkWriteException
+	otherModels := make([]mongo.WriteModel, 0, len(models))
+	for i, model := range models {
+		upsert := model.(*mongo.UpdateOneModel)
+		filter := bsonFields(upsert.Filter)
+		filter[spanImportsField] = bson.M{"$ne": spanImportKey(r.other)}
+		update := bson.D{}
+		for _, operator := range upsert.Update.(bson.D) {
+			if operator.Key == "$addToSet" {
+				operator.Value = bson.M{spanArchivesField: r.other.ArchName, spanImportsField: spanImportKey(r.other)}
+			}
+			update = append(update, operator)
+		}
+		otherModels = append(otherModels, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
+		bulkErr.WriteErrors = append(bulkErr.WriteErrors, mongo.BulkWriteError{WriteError: mongo.WriteError{Index: i, Code: duplicateKeyCode, Message: duplicateMessage("span_link")}})
+	}
+	if _, err := r.fakeLinkInserter.BulkWrite(ctx, otherModels, opts...); err != nil {
+		return nil, err
+	}
+	return &mongo.BulkWriteResult{}, bulkErr
+}
+
+// TestLoadLinksSpanRetryDuplicates - links rejected as duplicates because other import inserted them first are merged when tried again
+func TestLoadLinksSpanRetryDuplicates(t *testing.T) {
+	lines := compactedLines(3)
+	inserter := &racingLinkInserter{fakeLinkInserter: &fakeLinkInserter{}, other: ImportedSegments{ArchName: "CC-MAIN-2023-06", Segment: "2"}}
+	savedQty, err := loadLinks(context.Background(), inserter, strings.NewReader(lines), ImportedSegments{ArchName: "CC-MAIN-2023-06", Segment: "1"}, 1, dateRangeSpan, nil)
+	if err != nil || savedQty != 3 {
+		t.Fatalf("loadLinks() = %d, %v, want 3 links saved", savedQty, err)
+	}
+
+	if inserter.bulkWrites != 2 {
+		t.Errorf("bulk writes = %d, want write of other import and retry of rejected links", inserter.bulkWrites)
+	}
+	if len(inserter.saved) != 3 {
+		t.Fatalf("saved %d links, want 3", len(inserter.saved))
+	}
+	for _, link := range inserter.saved {
+		if !reflect.DeepEqual(link.Imports, []string{"CC-MAIN-2023-06/2", "CC-MAIN-2023-06/1"}) {
+			t.Errorf("saved link imports = %v, want links merged from both segments", link.Imports)
+		}
+	}
+}
+
+func TestOnlyDuplicateKeys(t *testing.T) {
+	duplicate := mongo.BulkWriteError{WriteError: mongo.WriteError{Code: duplicateKeyCode, Message: duplicateMessage("span_link")}}
+	duplicateID := mongo.BulkWriteError{WriteError: mongo.WriteError{Code: duplicateKeyCode, Message: duplicateMessage(duplicateIDIndex)}}
+	tests := []struct {
+		name  string
+		err   error
+		index string
+		want  bool
+	}{
+		{"no error", nil, "", false},
+		{"other error", errors.New("connection lost"), "", false},
+		{"duplicates", mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{duplicate, duplicate}}, "", true},
+		{"duplicate and other write error", mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{duplicate, {WriteError: mongo.WriteError{Code: 121}}}}, "", false},
+		{"write concern error", mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{duplicate}, WriteConcernError: &mongo.WriteConcernError{Code: 64}}, "", false},
+		{"duplicate ids", mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{duplicateID, duplicateID}}, duplicateIDIndex, true},
+		{"duplicate of other index", mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{duplicateID, duplicate}}, duplicateIDIndex, false},
+	}
+	for _, tt := range tests {
+		if got := onlyDuplicateKeys(tt.err, tt.index); got != tt.want {
+			t.Errorf("onlyDuplicateKeys() of %s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
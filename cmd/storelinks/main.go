@@ -1,58 +1,166 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
 
 	"github.com/klauspost/compress/gzip"
 
 	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+	"github.com/kris-dev-hub/globallinks/pkg/healthcheck"
+	"github.com/kris-dev-hub/globallinks/pkg/linkdb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 // FileLinkCompacted - compacted link file
 type FileLinkCompacted struct {
-	LinkDomain    string `json:"ld"`
-	LinkSubDomain string `json:"lsd"`
-	LinkPath      string `json:"lp"`
-	LinkRawQuery  string `json:"lrq"`
-	LinkScheme    string `json:"ls"`
-	PageHost      string `json:"ph"`
-	PagePath      string `json:"pp"`
-	PageRawQuery  string `json:"prq"`
-	PageScheme    string `json:"ps"`
-	LinkText      string `json:"lt"`
-	NoFollow      int    `json:"nf"`
-	NoIndex       int    `json:"ni"`
-	DateFrom      string `json:"dfrom"`
-	DateTo        string `json:"dto"`
+	ID            string   `json:"-" bson:"_id,omitempty"` // archive, segment and hash of link in crawl mode, segment imported again does not duplicate its links
+	LinkDomain    string   `json:"ld"`
+	LinkSubDomain string   `json:"lsd"`
+	LinkPath      string   `json:"lp"`
+	LinkRawQuery  string   `json:"lrq"`
+	LinkScheme    string   `json:"ls"`
+	PageHost      string   `json:"ph"`
+	PagePath      string   `json:"pp"`
+	PageRawQuery  string   `json:"prq"`
+	PageScheme    string   `json:"ps"`
+	PageDomain    string   `json:"pd"`
+	LinkText      string   `json:"lt"`
+	NoFollow      int      `json:"nf"`
+	PageNoIndex   int      `json:"ni" bson:"noindex"` // noindex of source page, saved with the name used before it was renamed
+	DateFrom      string   `json:"dfrom"`             // the first crawl date of link, the first of all archives when dates span archives
+	DateTo        string   `json:"dto"`               // the last crawl date of link, the last of all archives when dates span archives
+	IP            string   `json:"ip"`
+	Qty           int      `json:"qty"`
+	LinkType      string   `json:"ltype"`
+	LinkTitle     string   `json:"ltitle"`
+	PageTitle     string   `json:"ptitle" bson:"pagetitle,omitempty"` // title of source page, not stored when importer did not save it
+	Archive       string   `json:"archive"`
+	Archives      []string `json:"-" bson:"archives,omitempty"` // archives merged to link when dates span archives, archive is not set
+	Imports       []string `json:"-" bson:"imports,omitempty"`  // segments merged to link when dates span archives
+}
+
+// FilePageImported - page info loaded from page file
+type FilePageImported struct {
+	Host          string `json:"host"`
+	Domain        string `json:"domain"`
+	Path          string `json:"path"`
+	RawQuery      string `json:"rq"`
+	Scheme        string `json:"scheme"`
+	Title         string `json:"title"`
 	IP            string `json:"ip"`
-	Qty           int    `json:"qty"`
+	Imported      string `json:"imported"`
+	InternalLinks int    `json:"il"`
+	ExternalLinks int    `json:"el"`
+	NoIndex       int    `json:"ni"`
+	Language      string `json:"lang"`
+	Archive       string `json:"archive"`
 }
 
 type ImportedSegments struct {
-	ArchName string `json:"archName"`
-	Segment  string `json:"segment"`
+	ArchName   string `json:"archName"`
+	Segment    string `json:"segment"`
+	Collection string `json:"collection"` // links collection segment was imported to, many collections share imported collection
+}
+
+const (
+	mongoURI             = "mongodb://localhost:27017"
+	defaultDatabaseName  = "linkdb"
+	importedCollection   = "imported"
+	archiveIndexedField  = "archive"
+	importedArchiveField = "archname"
+	importedLinksField   = "collection"
+	pagesBatchSize       = 25000
+)
+
+// linksBatchSize - links saved with one bulk insert
+var linksBatchSize = 25000
+
+// progressInterval - links saved so far are printed at most once per interval, import of segment prints hundreds of batches
+var progressInterval = 30 * time.Second
+
+// dbNames - database and collections links and pages are saved to
+type dbNames struct {
+	Database string
+	Links    string
+	Pages    string
+}
+
+// linkInserter - collection links are saved to, implemented by *mongo.Collection. Links are upserted with BulkWrite when dates span archives
+type linkInserter interface {
+	InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error)
+	BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+}
+
+// linkBatch - links saved with one bulk insert, firstLine is line of compacted file with the first link
+type linkBatch struct {
+	firstLine int
+	links     []interface{}
+}
+
+// linkBatchError - error of bulk insert of batch starting at firstLine
+type linkBatchError struct {
+	firstLine int
+	err       error
 }
 
 func main() {
 	var err error
 
-	if len(os.Args) < 4 {
-		fmt.Println("Require target directory and source file : ./storelinks data/links/compact_01.tar.gz CC-MAIN-2021-04 1")
+	if len(os.Args) > 1 && os.Args[1] == "delete" {
+		err = runDelete(os.Args[2:])
+		if err != nil {
+			fmt.Println("Delete failed: " + err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "export-parquet" {
+		os.Exit(runExportParquet(os.Args[2:]))
+	}
+
+	if len(os.Args) > 3 && os.Args[1] == "pages" {
+		err = uploadPagesToDatabase(os.Args[2], os.Args[3], setDBNames())
+		if err != nil {
+			fmt.Println("Loading pages failed: " + err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	healthAddr, args, err := parseUploadArgs(os.Args[1:])
+	if err != nil || len(args) < 3 {
+		fmt.Println("Require target directory and source file : ./storelinks [--health :3006] data/links/compact_01.tar.gz CC-MAIN-2021-04 1")
+		fmt.Println("Load page file : ./storelinks pages data/pages/sort_01.txt.gz CC-MAIN-2021-04")
+		fmt.Println("Remove imported archive : ./storelinks delete --archive CC-MAIN-2021-04 [--dry-run]")
+		fmt.Println("Export compacted file to parquet : ./storelinks export-parquet data/links/compact_0.txt.gz links.parquet")
 		os.Exit(1)
 	}
 
-	linkSegmentCompacted := os.Args[1]
-	importInfo := ImportedSegments{ArchName: os.Args[2], Segment: os.Args[3]}
+	linkSegmentCompacted := args[0]
+	importInfo := ImportedSegments{ArchName: args[1], Segment: args[2]}
 
 	if !fileutils.FileExists(linkSegmentCompacted) {
 		fmt.Println("Source file does not exist")
@@ -61,7 +169,18 @@ func main() {
 
 	// TODO: validate if segment is not already imported in imported collection
 
-	err = uploadDataToDatabase(linkSegmentCompacted, importInfo)
+	// allow to detect stuck import, progress is reported on /progress
+	progress := healthcheck.NewProgress()
+	if healthAddr != "" {
+		router := healthcheck.InitRoutesWithProgress(progress)
+		go func() {
+			if err := http.ListenAndServe(healthAddr, router); err != nil {
+				log.Fatalf("Failed to set up health server: %v", err)
+			}
+		}()
+	}
+
+	err = uploadDataToDatabase(linkSegmentCompacted, importInfo, setDBNames(), progress)
 	if err != nil {
 		log.Fatalf("Could not split files: %v", err)
 	}
@@ -70,22 +189,26 @@ func main() {
 	//	os.Remove(linkSegmentCompacted)
 }
 
+// parseUploadArgs - address of health server set with --health and positional arguments of link import
+func parseUploadArgs(args []string) (string, []string, error) {
+	flags := flag.NewFlagSet("storelinks", flag.ContinueOnError)
+	healthAddr := flags.String("health", "", "address of health and progress server, example :3006")
+	err := flags.Parse(args)
+	if err != nil {
+		return "", nil, err
+	}
+	return *healthAddr, flags.Args(), nil
+}
+
 // split data into many files sorted by domain names
-func uploadDataToDatabase(sortFile string, importInfo ImportedSegments) error {
+func uploadDataToDatabase(sortFile string, importInfo ImportedSegments, names dbNames, progress *healthcheck.Progress) error {
 	// Set client options and connect to MongoDB
-	clientOptions := options.Client().ApplyURI("mongodb://localhost:27017")
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+	client, err := connectDB()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer client.Disconnect(context.TODO()) //nolint:errcheck
 
-	// Choose the database and collection
-	collection := client.Database("linkdb").Collection("links")
-
-	// load data from sort file
-	const maxCapacityScanner = 3 * 1024 * 1024 // 3*1MB
-
 	// Open the gzipped file
 	file, err := os.Open(sortFile)
 	if err != nil {
@@ -100,79 +223,519 @@ func uploadDataToDatabase(sortFile string, importInfo ImportedSegments) error {
 	}
 	defer gzReader.Close()
 
-	scanner := bufio.NewScanner(gzReader)
-	// create buffer to avoid going over token size
-	buf := make([]byte, maxCapacityScanner)
-	scanner.Buffer(buf, maxCapacityScanner)
+	return storeLinks(context.TODO(), client.Database(names.Database), names.Links, gzReader, importInfo, progress)
+}
 
-	// Read each line and append to the records slice
-	line := ""
+// storeLinks - save links of compacted file in links collection of database and mark segment as imported
+func storeLinks(ctx context.Context, database *mongo.Database, linksCollection string, reader io.Reader, importInfo ImportedSegments, progress *healthcheck.Progress) error {
+	collection := database.Collection(linksCollection)
 
-	fileLink := FileLinkCompacted{}
-	linksToSave := make([]interface{}, 0, 25000)
-	i := 0
-	for scanner.Scan() {
-		line = scanner.Text()
-		parts := strings.Split(line, "|")
-		if len(parts) != 16 {
+	// archive index is required to remove imported archive without full collection scan
+	err := createArchiveIndex(ctx, collection)
+	if err != nil {
+		return err
+	}
+
+	dateRange := setDateRange()
+	if dateRange == dateRangeSpan {
+		err = createSpanIndex(ctx, collection)
+		if err != nil {
+			return err
+		}
+	}
+
+	savedQty, err := loadLinks(ctx, collection, reader, importInfo, setInsertWorkers(), dateRange, progress)
+	if err != nil {
+		return fmt.Errorf("saved %d links, segment is not marked as imported: %w", savedQty, err)
+	}
+
+	importInfo.Collection = linksCollection
+	_, err = database.Collection(importedCollection).InsertOne(ctx, importInfo)
+
+	return err
+}
+
+// loadLinks - read compacted link lines and save them in batches, workers run bulk inserts concurrently.
+// After the first failed batch no new batches are started, errors of all failed batches are joined.
+// Segment is recorded as imported only when all links are saved, so failed segment is imported again, links saved before the failure
+// keep their ids and are not inserted twice. Progress counts processed lines, saved batches and failed batches, it can be nil.
+// Links are merged with stored links when dateRange is span
+func loadLinks(ctx context.Context, collection linkInserter, reader io.Reader, importInfo ImportedSegments, workers int, dateRange string, progress *healthcheck.Progress) (int, error) {
+	maxCapacityScanner := fileutils.ScannerBufferSize(fileutils.DefaultScannerBufferSize)
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		wg           sync.WaitGroup
+		mu           sync.Mutex
+		failed       atomic.Bool
+		savedQty     int
+		skippedQty   int
+		savedBatches int
+		batchErrs    []linkBatchError
+		lastReport   = time.Now()
+	)
+	batches := make(chan linkBatch)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				// batches queued before failure are dropped, they are saved again with the whole segment
+				if failed.Load() {
+					continue
+				}
+				skipped, err := saveLinkBatch(ctx, collection, batch.links, dateRange, importInfo)
+				mu.Lock()
+				if err != nil {
+					failed.Store(true)
+					batchErrs = append(batchErrs, linkBatchError{firstLine: batch.firstLine, err: err})
+					progress.AddErrors(1)
+				} else {
+					savedQty += len(batch.links) - skipped
+					skippedQty += skipped
+					savedBatches++
+					progress.AddBatches(1)
+					if time.Since(lastReport) >= progressInterval {
+						lastReport = time.Now()
+						fmt.Printf("Saved %d links in %d batches\n", savedQty, savedBatches)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// too long lines are skipped like invalid ones
+	scanner := fileutils.NewGZScanner(reader, maxCapacityScanner)
+
+	batch := linkBatch{links: make([]interface{}, 0, linksBatchSize)}
+	lineNum := 0
+	for !failed.Load() && scanner.Scan() {
+		lineNum++
+		progress.AddLines(1)
+		fileLink, ok := decodeCompactedLine(scanner.Text(), importInfo.ArchName)
+		if !ok {
 			// Invalid line - skip
 			continue
 		}
-		if !commoncrawl.IsValidDomain(parts[0]) {
-			//			fmt.Printf("!")
+		if dateRange != dateRangeSpan {
+			fileLink.ID = crawlLinkID(importInfo, fileLink)
+		}
+
+		if len(batch.links) == 0 {
+			batch.firstLine = lineNum
+		}
+		batch.links = append(batch.links, fileLink)
+		if len(batch.links) >= linksBatchSize {
+			batches <- batch
+			batch = linkBatch{links: make([]interface{}, 0, linksBatchSize)}
+		}
+	}
+	scanErr := scanner.Err()
+	if scanErr != nil {
+		progress.AddErrors(1)
+	}
+	if scanErr == nil && len(batch.links) > 0 {
+		batches <- batch
+	}
+	close(batches)
+	wg.Wait()
+	fmt.Printf("Saved %d links in %d batches, %d links were saved before, %d batches failed\n", savedQty, savedBatches, skippedQty, len(batchErrs))
+
+	// workers finish in any order, report failed batches in file order
+	sort.Slice(batchErrs, func(i, j int) bool { return batchErrs[i].firstLine < batchErrs[j].firstLine })
+	errs := make([]error, 0, len(batchErrs)+1)
+	for _, batchErr := range batchErrs {
+		errs = append(errs, fmt.Errorf("batch from line %d: %w", batchErr.firstLine, batchErr.err))
+	}
+	if scanErr != nil {
+		errs = append(errs, scanErr)
+	}
+
+	return savedQty, errors.Join(errs...)
+}
+
+// decodeCompactedLine - link from compacted file line with registered domain of its page, false for invalid line
+func decodeCompactedLine(line string, archiveName string) (FileLinkCompacted, bool) {
+	parts := strings.Split(line, "|")
+	// files compacted before link type was added have 16 fields, before link title was added 17 fields, lines with page title have 19 fields
+	if len(parts) < 16 || len(parts) > 19 {
+		return FileLinkCompacted{}, false
+	}
+	if !commoncrawl.IsValidDomain(parts[0]) {
+		return FileLinkCompacted{}, false
+	}
+
+	fileLink := FileLinkCompacted{}
+	fileLink.LinkDomain = parts[0]
+	fileLink.LinkSubDomain = parts[1]
+	fileLink.LinkPath = parts[2]
+	fileLink.LinkRawQuery = parts[3]
+	fileLink.LinkScheme = parts[4]
+	fileLink.PageHost = parts[5]
+	fileLink.PagePath = parts[6]
+	fileLink.PageRawQuery = parts[7]
+	fileLink.PageScheme = parts[8]
+	fileLink.PageDomain = pageDomain(parts[5])
+	fileLink.LinkText = commoncrawl.DecodeTextField(parts[9])
+	fileLink.DateFrom = parts[12]
+	fileLink.DateTo = parts[13]
+	fileLink.IP = parts[14]
+	// line with broken number is invalid, it is not imported as 0
+	var noFollowErr, noIndexErr, qtyErr error
+	fileLink.NoFollow, noFollowErr = strconv.Atoi(parts[10])
+	fileLink.PageNoIndex, noIndexErr = strconv.Atoi(parts[11])
+	fileLink.Qty, qtyErr = strconv.Atoi(parts[15])
+	if noFollowErr != nil || noIndexErr != nil || qtyErr != nil {
+		return FileLinkCompacted{}, false
+	}
+	if len(parts) > 16 {
+		fileLink.LinkType = parts[16]
+	}
+	if len(parts) > 17 {
+		fileLink.LinkTitle = commoncrawl.DecodeTextField(parts[17])
+	}
+	if len(parts) > 18 {
+		fileLink.PageTitle = commoncrawl.DecodeTextField(parts[18])
+	}
+	fileLink.Archive = archiveName
+
+	return fileLink, true
+}
+
+// crawlLinkID - id of link of segment derived from link and page url and link type, compaction keeps one line of link from one source page,
+// so the id does not change when compacted file of segment is built again with other lines
+func crawlLinkID(importInfo ImportedSegments, link FileLinkCompacted) string {
+	key := strings.Join([]string{
+		link.LinkDomain, link.LinkSubDomain, link.LinkPath, link.LinkRawQuery, link.PageHost, link.PagePath, link.PageRawQuery,
+		link.LinkScheme, link.PageScheme, link.LinkType,
+	}, "|")
+	hash := sha256.Sum256([]byte(key))
+
+	return importInfo.ArchName + "/" + importInfo.Segment + "/" + hex.EncodeToString(hash[:16])
+}
+
+// pageDomain - registered domain of page host, host itself when it has no registered domain
+func pageDomain(host string) string {
+	host = strings.ToLower(host)
+	domain, ok := commoncrawl.RegistrableDomain(host)
+	if !ok {
+		return host
+	}
+	return domain
+}
+
+// connectDB - connect to MongoDB used to store links
+// setDBNames sets database with GLOBALLINKS_DATABASE and collections with GLOBALLINKS_LINKSCOLLECTION and GLOBALLINKS_PAGESCOLLECTION,
+// API reads the same collection variables
+func setDBNames() dbNames {
+	envVar := "GLOBALLINKS_DATABASE"
+	names := dbNames{
+		Database: os.Getenv(envVar),
+		Links:    linkdb.CollectionName("GLOBALLINKS_LINKSCOLLECTION", linkdb.DefaultLinksCollection),
+		Pages:    linkdb.CollectionName("GLOBALLINKS_PAGESCOLLECTION", linkdb.DefaultPagesCollection),
+	}
+
+	if names.Database == "" {
+		names.Database = defaultDatabaseName
+	} else if len(names.Database) > 63 || strings.ContainsAny(names.Database, "/\\. \"$*<>:|?\x00") {
+		log.Printf("Invalid database name for %s: %q. Using default %s", envVar, names.Database, defaultDatabaseName)
+		names.Database = defaultDatabaseName
+	}
+
+	return names
+}
+
+func connectDB() (*mongo.Client, error) {
+	return mongo.Connect(context.TODO(), newClientOptions(mongoURI, setWriteConcern()))
+}
+
+// newClientOptions - client options with write concern used by inserts, nil keeps server default
+func newClientOptions(uri string, writeConcern *writeconcern.WriteConcern) *options.ClientOptions {
+	clientOptions := options.Client().ApplyURI(uri)
+	if writeConcern != nil {
+		clientOptions.SetWriteConcern(writeConcern)
+	}
+	return clientOptions
+}
+
+// setWriteConcern sets write concern of inserts: majority or number of members which have to confirm the write.
+// Unacknowledged writes (0) are not allowed, inserts would report them as errors
+func setWriteConcern() *writeconcern.WriteConcern {
+	envVar := "GLOBALLINKS_STORE_WRITECONCERN"
+	valStr := os.Getenv(envVar)
+	if valStr == "" {
+		return nil
+	}
+
+	if valStr == "majority" {
+		return writeconcern.Majority()
+	}
+
+	val, err := strconv.Atoi(valStr)
+	if err != nil || val < 1 || val > 50 {
+		log.Printf("Invalid write concern for %s: %q, use majority or number between 1 and 50. Using server default", envVar, valStr)
+		return nil
+	}
+
+	return &writeconcern.WriteConcern{W: val}
+}
+
+// setInsertWorkers sets number of concurrent bulk inserts of links, default 1 saves batches one by one
+func setInsertWorkers() int {
+	envVar := "GLOBALLINKS_STORE_WORKERS"
+	valStr := os.Getenv(envVar)
+	if valStr == "" {
+		return 1
+	}
+
+	val, err := strconv.Atoi(valStr)
+	if err != nil || val < 1 || val > 32 {
+		log.Printf("Invalid number of insert workers for %s: %q, use number between 1 and 32. Using 1", envVar, valStr)
+		return 1
+	}
+
+	return val
+}
+
+// createArchiveIndex - create index on archive field, it is used to find all links imported from one archive.
+// Index on link and page domain is used to skip links from the same domain and to group links by referring domain,
+// index on link domain and path is used by case sensitive prefix filter of link path
+func createArchiveIndex(ctx context.Context, collection *mongo.Collection) error {
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: archiveIndexedField, Value: 1}}},
+		{Keys: bson.D{{Key: "linkdomain", Value: 1}, {Key: "pagedomain", Value: 1}}},
+		{Keys: bson.D{{Key: "linkdomain", Value: 1}, {Key: "linkpath", Value: 1}}},
+	})
+	return err
+}
+
+// uploadPagesToDatabase - load page file created with savePageData into pages collection
+func uploadPagesToDatabase(pageFile string, archiveName string, names dbNames) error {
+	if !fileutils.FileExists(pageFile) {
+		return fmt.Errorf("page file does not exist: %s", pageFile)
+	}
+
+	if !commoncrawl.IsCorrectArchiveFormat(archiveName) {
+		return fmt.Errorf("invalid archive name: %q", archiveName)
+	}
+
+	client, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.TODO()) //nolint:errcheck
+
+	collection := client.Database(names.Database).Collection(names.Pages)
+
+	err = createPageIndex(context.TODO(), collection)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(pageFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gzReader.Close()
+
+	savedQty, err := loadPages(context.TODO(), collection, gzReader, archiveName)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Loaded %d pages from %s\n", savedQty, pageFile)
+
+	return nil
+}
+
+// createPageIndex - create indexes used by API to find page by url and to search page titles within domain
+func createPageIndex(ctx context.Context, collection *mongo.Collection) error {
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "host", Value: 1}, {Key: "path", Value: 1}, {Key: "rawquery", Value: 1}}},
+		{Keys: bson.D{{Key: "domain", Value: 1}, {Key: "title", Value: 1}}},
+		{Keys: bson.D{{Key: archiveIndexedField, Value: 1}}},
+	})
+	return err
+}
+
+// loadPages - read page lines and save them in batches, broken lines are skipped
+func loadPages(ctx context.Context, collection *mongo.Collection, reader io.Reader, archiveName string) (int, error) {
+	maxCapacityScanner := fileutils.ScannerBufferSize(fileutils.DefaultScannerBufferSize)
+
+	scanner := fileutils.NewGZScanner(reader, maxCapacityScanner)
+
+	savedQty := 0
+	pagesToSave := make([]interface{}, 0, pagesBatchSize)
+	for scanner.Scan() {
+		filePage, err := commoncrawl.DecodePage(scanner.Text())
+		if err != nil {
 			continue
 		}
 
-		fileLink = FileLinkCompacted{}
-		fileLink.LinkDomain = parts[0]
-		fileLink.LinkSubDomain = parts[1]
-		fileLink.LinkPath = parts[2]
-		fileLink.LinkRawQuery = parts[3]
-		fileLink.LinkScheme = parts[4]
-		fileLink.PageHost = parts[5]
-		fileLink.PagePath = parts[6]
-		fileLink.PageRawQuery = parts[7]
-		fileLink.PageScheme = parts[8]
-		fileLink.LinkText = parts[9]
-		fileLink.NoFollow, _ = strconv.Atoi(parts[10])
-		fileLink.NoIndex, _ = strconv.Atoi(parts[11])
-		fileLink.DateFrom = parts[12]
-		fileLink.DateTo = parts[13]
-		fileLink.IP = parts[14]
-		fileLink.Qty, _ = strconv.Atoi(parts[15])
-
-		linksToSave = append(linksToSave, fileLink)
-		i++
-
-		// save file every 25000 records and reset linksToSave
-		if i >= 25000 {
-			i = 0
-			// Insert multiple documents
-			_, err := collection.InsertMany(context.TODO(), linksToSave)
+		// domain is used to search pages from all subdomains, it is empty for hosts without known suffix
+		domain, _ := commoncrawl.RegistrableDomain(filePage.Host)
+
+		pagesToSave = append(pagesToSave, FilePageImported{
+			Host:          filePage.Host,
+			Domain:        domain,
+			Path:          filePage.Path,
+			RawQuery:      filePage.RawQuery,
+			Scheme:        filePage.Scheme,
+			Title:         filePage.Title,
+			IP:            filePage.IP,
+			Imported:      filePage.Imported,
+			InternalLinks: filePage.InternalLinks,
+			ExternalLinks: filePage.ExternalLinks,
+			NoIndex:       filePage.NoIndex,
+			Language:      filePage.Language,
+			Archive:       archiveName,
+		})
+
+		if len(pagesToSave) >= pagesBatchSize {
+			_, err = collection.InsertMany(ctx, pagesToSave)
 			if err != nil {
-				log.Fatal(err)
+				return savedQty, err
 			}
-			linksToSave = make([]interface{}, 0, 25000)
-			fmt.Printf("V")
+			savedQty += len(pagesToSave)
+			pagesToSave = make([]interface{}, 0, pagesBatchSize)
 		}
-
 	}
 
 	if err := scanner.Err(); err != nil {
+		return savedQty, err
+	}
+
+	if len(pagesToSave) > 0 {
+		_, err := collection.InsertMany(ctx, pagesToSave)
+		if err != nil {
+			return savedQty, err
+		}
+		savedQty += len(pagesToSave)
+	}
+
+	return savedQty, nil
+}
+
+// runDelete - remove all links imported from given archive, with --dry-run only count them
+func runDelete(args []string) error {
+	flags := flag.NewFlagSet("delete", flag.ContinueOnError)
+	archiveName := flags.String("archive", "", "archive name to remove, example CC-MAIN-2021-04")
+	dryRun := flags.Bool("dry-run", false, "only count links that would be removed")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if !commoncrawl.IsCorrectArchiveFormat(*archiveName) {
+		return fmt.Errorf("invalid archive name: %q", *archiveName)
+	}
+
+	client, err := connectDB()
+	if err != nil {
 		return err
 	}
-	if len(linksToSave) > 0 {
-		_, err := collection.InsertMany(context.TODO(), linksToSave)
+	defer client.Disconnect(context.TODO()) //nolint:errcheck
+
+	names := setDBNames()
+	database := client.Database(names.Database)
+
+	err = createArchiveIndex(context.TODO(), database.Collection(names.Links))
+	if err != nil {
+		return err
+	}
+	dateRange := setDateRange()
+	if dateRange == dateRangeSpan {
+		err = createSpanIndex(context.TODO(), database.Collection(names.Links))
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
 
-	collectionImported := client.Database("linkdb").Collection("imported")
-	_, err = collectionImported.InsertOne(context.TODO(), importInfo)
+	linksQty, err := countArchiveLinks(context.TODO(), database.Collection(names.Links), *archiveName, dateRange)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	fmt.Printf("Archive %s has %d links\n", *archiveName, linksQty)
+
+	if *dryRun {
+		return nil
+	}
+
+	deletedQty, keptQty, err := deleteArchive(context.TODO(), database.Collection(names.Links), database.Collection(importedCollection), *archiveName, dateRange)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %d links from archive %s\n", deletedQty, *archiveName)
+	if keptQty > 0 {
+		fmt.Printf("Removed archive %s from %d links merged with other archives\n", *archiveName, keptQty)
 	}
 
 	return nil
 }
+
+// countArchiveLinks - count links imported from given archive, with links merged from it and other archives when dates span archives
+func countArchiveLinks(ctx context.Context, collection *mongo.Collection, archiveName string, dateRange string) (int64, error) {
+	if dateRange == dateRangeSpan {
+		return collection.CountDocuments(ctx, bson.M{spanArchivesField: archiveName})
+	}
+	return collection.CountDocuments(ctx, bson.M{archiveIndexedField: archiveName})
+}
+
+// deleteArchive - delete links imported from given archive and the information that its segments were imported to the same collection,
+// segments of the archive imported to other collections stay imported. When dates span archives only links merged from this archive alone
+// are deleted, the archive and its segments are removed from links merged with other archives, their dates and qty are kept
+func deleteArchive(ctx context.Context, collection *mongo.Collection, collectionImported *mongo.Collection, archiveName string, dateRange string) (deleted int64, kept int64, err error) {
+	if dateRange == dateRangeSpan {
+		deleted, kept, err = deleteSpanArchive(ctx, collection, archiveName)
+	} else {
+		var result *mongo.DeleteResult
+		result, err = collection.DeleteMany(ctx, bson.M{archiveIndexedField: archiveName})
+		if result != nil {
+			deleted = result.DeletedCount
+		}
+	}
+	if err != nil {
+		return deleted, kept, err
+	}
+
+	_, err = collectionImported.DeleteMany(ctx, bson.M{importedArchiveField: archiveName, importedLinksField: importedLinksFilter(collection.Name())})
+
+	return deleted, kept, err
+}
+
+// importedLinksFilter - filter of imported segments of links collection, segments saved by older versions have no collection
+// and were imported to the default links collection
+func importedLinksFilter(linksCollection string) any {
+	if linksCollection == linkdb.DefaultLinksCollection {
+		return bson.M{"$in": bson.A{linksCollection, nil}}
+	}
+	return linksCollection
+}
+
+// deleteSpanArchive - delete links merged only from given archive and remove the archive from links merged with other archives
+func deleteSpanArchive(ctx context.Context, collection *mongo.Collection, archiveName string) (int64, int64, error) {
+	result, err := collection.DeleteMany(ctx, bson.M{spanArchivesField: bson.A{archiveName}})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	update := bson.M{"$pull": bson.M{
+		spanArchivesField: archiveName,
+		spanImportsField:  bson.M{"$regex": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(archiveName) + "/"}},
+	}}
+	updated, err := collection.UpdateMany(ctx, bson.M{spanArchivesField: archiveName}, update)
+	if err != nil {
+		return result.DeletedCount, 0, err
+	}
+
+	return result.DeletedCount, updated.ModifiedCount, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kris-dev-hub/globallinks/pkg/linkdb"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// benchMongoEnv - MongoDB connection string used by insert benchmark, benchmark is skipped when it is not set
+const benchMongoEnv = "GLOBALLINKS_TEST_MONGODB"
+
+// BenchmarkLoadLinks - bulk insert throughput of 100000 links with different number of workers
+func BenchmarkLoadLinks(b *testing.B) {
+	uri := os.Getenv(benchMongoEnv)
+	if uri == "" {
+		b.Skipf("%s is not set", benchMongoEnv)
+	}
+
+	client, err := mongo.Connect(context.Background(), newClientOptions(uri, setWriteConcern()))
+	if err != nil {
+		b.Fatalf("Connect() error = %v", err)
+	}
+	defer client.Disconnect(context.Background()) //nolint:errcheck
+
+	database := client.Database("linkdb_bench")
+	defer database.Drop(context.Background()) //nolint:errcheck
+	collection := database.Collection(linkdb.DefaultLinksCollection)
+
+	const linksQty = 100000
+	lines := compactedLines(linksQty)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(lines)))
+			for i := 0; i < b.N; i++ {
+				savedQty, err := loadLinks(context.Background(), collection, strings.NewReader(lines), ImportedSegments{ArchName: "CC-MAIN-2021-04", Segment: "1"}, workers, dateRangeCrawl, nil)
+				if err != nil || savedQty != linksQty {
+					b.Fatalf("loadLinks() = %d, %v, want %d links", savedQty, err, linksQty)
+				}
+				b.StopTimer()
+				if err := collection.Drop(context.Background()); err != nil {
+					b.Fatalf("Drop() error = %v", err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
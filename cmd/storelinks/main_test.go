@@ -0,0 +1,806 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kris-dev-hub/globallinks/pkg/healthcheck"
+	"github.com/kris-dev-hub/globallinks/pkg/linkdb"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestCountArchiveLinks(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	tests := []struct {
+		dateRange string
+		field     string
+	}{
+		{dateRangeCrawl, archiveIndexedField},
+		{dateRangeSpan, spanArchivesField},
+	}
+	for _, tt := range tests {
+		mt.Run("count only selected archive with "+tt.dateRange+" dates", func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "linkdb.links", mtest.FirstBatch, bson.D{{Key: "n", Value: 3}}))
+
+			qty, err := countArchiveLinks(context.Background(), mt.Coll, "CC-MAIN-2020-24", tt.dateRange)
+			if err != nil {
+				t.Fatalf("countArchiveLinks() error = %v", err)
+			}
+			if qty != 3 {
+				t.Errorf("countArchiveLinks() = %d, want 3", qty)
+			}
+
+			pipeline := mt.GetStartedEvent().Command.Lookup("pipeline").Array()
+			match := pipeline.Index(0).Value().Document().Lookup("$match").Document()
+			if got := match.Lookup(tt.field).StringValue(); got != "CC-MAIN-2020-24" {
+				t.Errorf("count filter %s = %q, want %q", tt.field, got, "CC-MAIN-2020-24")
+			}
+		})
+	}
+}
+
+// deleteCommand - collection and filter of delete or update command started by deleteArchive
+func deleteCommand(t *testing.T, mt *mtest.T, command string) (string, bson.Raw) {
+	t.Helper()
+	event := mt.GetStartedEvent()
+	if event.CommandName != command {
+		t.Fatalf("expected %s command, got %s", command, event.CommandName)
+	}
+	statements := "deletes"
+	if command == "update" {
+		statements = "updates"
+	}
+	return event.Command.Lookup(command).StringValue(), event.Command.Lookup(statements).Array().Index(0).Value().Document()
+}
+
+func TestDeleteArchive(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("delete only selected archive", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		imported := mt.DB.Collection(importedCollection)
+		deleted, kept, err := deleteArchive(context.Background(), mt.Coll, imported, "CC-MAIN-2020-24", dateRangeCrawl)
+		if err != nil {
+			t.Fatalf("deleteArchive() error = %v", err)
+		}
+		if deleted != 2 || kept != 0 {
+			t.Errorf("deleteArchive() = %d, %d, want 2 deleted", deleted, kept)
+		}
+
+		tests := []struct {
+			collection string
+			filter     map[string]string
+		}{
+			{mt.Coll.Name(), map[string]string{archiveIndexedField: "CC-MAIN-2020-24"}},
+			{importedCollection, map[string]string{importedArchiveField: "CC-MAIN-2020-24", importedLinksField: mt.Coll.Name()}},
+		}
+		for _, tt := range tests {
+			collection, statement := deleteCommand(t, mt, "delete")
+			if collection != tt.collection {
+				t.Errorf("delete collection = %q, want %q", collection, tt.collection)
+			}
+			filter := statement.Lookup("q").Document()
+			elements, _ := filter.Elements()
+			if len(elements) != len(tt.filter) {
+				t.Errorf("delete filter = %v, want only %v", filter, tt.filter)
+			}
+			for field, value := range tt.filter {
+				if got, ok := filter.Lookup(field).StringValueOK(); !ok || got != value {
+					t.Errorf("delete filter = %v, want %s=%s", filter, field, value)
+				}
+			}
+		}
+	})
+
+	mt.Run("default collection removes segments saved without collection", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		links := mt.DB.Collection(linkdb.DefaultLinksCollection)
+		imported := mt.DB.Collection(importedCollection)
+		if _, _, err := deleteArchive(context.Background(), links, imported, "CC-MAIN-2020-24", dateRangeCrawl); err != nil {
+			t.Fatalf("deleteArchive() error = %v", err)
+		}
+
+		_, _ = deleteCommand(t, mt, "delete")
+		_, statement := deleteCommand(t, mt, "delete")
+		values, _ := statement.Lookup("q", importedLinksField, "$in").Array().Values()
+		if len(values) != 2 || values[0].StringValue() != linkdb.DefaultLinksCollection || values[1].Type != bson.TypeNull {
+			t.Errorf("delete filter = %v, want %s or no collection", statement.Lookup("q"), linkdb.DefaultLinksCollection)
+		}
+	})
+
+	mt.Run("remove archive from links merged with other archives", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 3}, bson.E{Key: "nModified", Value: 3}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		imported := mt.DB.Collection(importedCollection)
+		deleted, kept, err := deleteArchive(context.Background(), mt.Coll, imported, "CC-MAIN-2020-24", dateRangeSpan)
+		if err != nil {
+			t.Fatalf("deleteArchive() error = %v", err)
+		}
+		if deleted != 2 || kept != 3 {
+			t.Errorf("deleteArchive() = %d, %d, want 2 deleted and 3 kept", deleted, kept)
+		}
+
+		// links merged only from the archive are deleted
+		_, statement := deleteCommand(t, mt, "delete")
+		archives, _ := statement.Lookup("q", spanArchivesField).Array().Values()
+		if len(archives) != 1 || archives[0].StringValue() != "CC-MAIN-2020-24" {
+			t.Errorf("delete filter = %v, want links with only archive CC-MAIN-2020-24", statement.Lookup("q"))
+		}
+
+		// archive and its segments are removed from other links
+		_, statement = deleteCommand(t, mt, "update")
+		if statement.Lookup("q", spanArchivesField).StringValue() != "CC-MAIN-2020-24" || !statement.Lookup("multi").Boolean() {
+			t.Errorf("update = %v, want all links with archive CC-MAIN-2020-24", statement)
+		}
+		pull := statement.Lookup("u", "$pull").Document()
+		pattern, _ := pull.Lookup(spanImportsField, "$regex").Regex()
+		if pull.Lookup(spanArchivesField).StringValue() != "CC-MAIN-2020-24" || pattern != `^CC-MAIN-2020-24/` {
+			t.Errorf("update $pull = %v, want archive and its segments", pull)
+		}
+
+		if collection, _ := deleteCommand(t, mt, "delete"); collection != importedCollection {
+			t.Errorf("delete collection = %q, want %q", collection, importedCollection)
+		}
+	})
+}
+
+func TestLoadPages(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("save valid pages with archive", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}))
+
+		pageLines := strings.Join([]string{
+			"www.example.com|/blog|p=1|2|Blog title|1.2.3.4|2023-02-04|12|3|0",
+			"www.example.com|/broken|",
+			"example.org|/||1|Home|1.2.3.5|2023-02-05|4|1|1|en",
+		}, "\n")
+
+		savedQty, err := loadPages(context.Background(), mt.Coll, strings.NewReader(pageLines), "CC-MAIN-2020-24")
+		if err != nil {
+			t.Fatalf("loadPages() error = %v", err)
+		}
+		if savedQty != 2 {
+			t.Errorf("loadPages() = %d, want 2", savedQty)
+		}
+
+		event := mt.GetStartedEvent()
+		if event.CommandName != "insert" {
+			t.Fatalf("expected insert command, got %s", event.CommandName)
+		}
+		documents, _ := event.Command.Lookup("documents").Array().Values()
+		if len(documents) != 2 {
+			t.Fatalf("inserted %d documents, want 2", len(documents))
+		}
+		page := documents[0].Document()
+		if page.Lookup("host").StringValue() != "www.example.com" || page.Lookup("domain").StringValue() != "example.com" || page.Lookup("title").StringValue() != "Blog title" ||
+			page.Lookup("internallinks").Int32() != 12 || page.Lookup(archiveIndexedField).StringValue() != "CC-MAIN-2020-24" {
+			t.Errorf("inserted page = %v", page)
+		}
+		if language := documents[1].Document().Lookup("language").StringValue(); language != "en" {
+			mt.Errorf("inserted page language = %q, want en", language)
+		}
+	})
+}
+
+func TestStoreLinksCollection(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("save links in collection of one archive", func(mt *mtest.T) {
+		mt.Setenv("GLOBALLINKS_LINKSCOLLECTION", "links_cc2021")
+		names := setDBNames()
+		if names.Database != defaultDatabaseName || names.Links != "links_cc2021" || names.Pages != "pages" {
+			mt.Fatalf("setDBNames() = %+v", names)
+		}
+
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 3}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+		importInfo := ImportedSegments{ArchName: "CC-MAIN-2021-04", Segment: "1"}
+		err := storeLinks(context.Background(), mt.DB, names.Links, strings.NewReader(compactedLines(3)), importInfo, nil)
+		if err != nil {
+			mt.Fatalf("storeLinks() error = %v", err)
+		}
+
+		tests := []struct {
+			command    string
+			collection string
+		}{
+			{"createIndexes", "links_cc2021"},
+			{"insert", "links_cc2021"},
+			{"insert", importedCollection},
+		}
+		for _, tt := range tests {
+			event := mt.GetStartedEvent()
+			if event.CommandName != tt.command || event.Command.Lookup(tt.command).StringValue() != tt.collection {
+				mt.Errorf("command = %s on %s, want %s on %s", event.CommandName, event.Command.Lookup(event.CommandName), tt.command, tt.collection)
+			}
+			if tt.collection != importedCollection {
+				continue
+			}
+			segment := event.Command.Lookup("documents").Array().Index(0).Value().Document()
+			if got := segment.Lookup(importedLinksField).StringValue(); got != "links_cc2021" {
+				mt.Errorf("imported segment collection = %q, want links_cc2021", got)
+			}
+		}
+	})
+}
+
+func TestSetDBNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		database string
+		pages    string
+		want     dbNames
+	}{
+		{"defaults", "", "", dbNames{Database: "linkdb", Links: "links", Pages: "pages"}},
+		{"database and pages collection", "linkdb_test", "pages_cc2021", dbNames{Database: "linkdb_test", Links: "links", Pages: "pages_cc2021"}},
+		{"invalid database name", "link.db", "", dbNames{Database: "linkdb", Links: "links", Pages: "pages"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GLOBALLINKS_DATABASE", tt.database)
+			t.Setenv("GLOBALLINKS_PAGESCOLLECTION", tt.pages)
+			if got := setDBNames(); got != tt.want {
+				t.Errorf("setDBNames() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetWriteConcern(t *testing.T) {
+	tests := []struct {
+		value string
+		want  interface{} // w of write concern, nil when server default is used
+	}{
+		{"", nil},
+		{"majority", "majority"},
+		{"1", 1},
+		{"3", 3},
+		{"0", nil},
+		{"-1", nil},
+		{"all", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("GLOBALLINKS_STORE_WRITECONCERN", tt.value)
+
+			clientOptions := newClientOptions(mongoURI, setWriteConcern())
+			if tt.want == nil {
+				if clientOptions.WriteConcern != nil {
+					t.Errorf("WriteConcern = %+v, want server default", clientOptions.WriteConcern)
+				}
+				return
+			}
+			if clientOptions.WriteConcern == nil || clientOptions.WriteConcern.W != tt.want {
+				t.Errorf("WriteConcern = %+v, want w %v", clientOptions.WriteConcern, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCompactedLine(t *testing.T) {
+	tests := []struct {
+		name           string
+		line           string
+		wantOk         bool
+		wantPageDomain string
+	}{
+		{"page on subdomain", "example.com||/page||2|blog.source.com|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|3|", true, "source.com"},
+		{"multi-label TLD", "example.com||/page||2|www.Source.co.uk|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|3|", true, "source.co.uk"},
+		{"multi-label TLD apex", "example.com||/page||2|source.com.au|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|3|", true, "source.com.au"},
+		{"before link type was added", "example.com||/page||2|news.bbc.co.uk|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|3", true, "bbc.co.uk"},
+		{"with link title", "example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|3||Read the docs", true, "source.com"},
+		{"with page title", "example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|3|||Source post", true, "source.com"},
+		{"extra field", "example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|3||||x", false, ""},
+		{"missing field", "example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4|3", false, ""},
+		{"invalid link domain", "localhost||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|3|", false, ""},
+		{"invalid nofollow", "example.com||/page||2|source.com|/||2|Anchor|abc|0|2023-02-04|2023-02-05|1.2.3.4|3|", false, ""},
+		{"invalid noindex", "example.com||/page||2|source.com|/||2|Anchor|0|x|2023-02-04|2023-02-05|1.2.3.4|3|", false, ""},
+		{"invalid qty", "example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4||", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileLink, ok := decodeCompactedLine(tt.line, "CC-MAIN-2021-04")
+			if ok != tt.wantOk {
+				t.Fatalf("decodeCompactedLine() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if fileLink.PageDomain != tt.wantPageDomain || fileLink.Archive != "CC-MAIN-2021-04" || fileLink.Qty != 3 || (tt.name == "with page title") != (fileLink.PageTitle == "Source post") {
+				t.Errorf("decodeCompactedLine() = %+v, want page domain %q", fileLink, tt.wantPageDomain)
+			}
+		})
+	}
+}
+
+func TestDecodeCompactedLineEncodedText(t *testing.T) {
+	fileLink, ok := decodeCompactedLine("example.com||/page||2|source.com|/||2|Home %7C Blog%0A|0|0|2023-02-04|2023-02-05|1.2.3.4|3||A %7C B|Post %7C 100%25", "CC-MAIN-2021-04")
+	if !ok || fileLink.LinkText != "Home | Blog\n" || fileLink.LinkTitle != "A | B" || fileLink.PageTitle != "Post | 100%" {
+		t.Errorf("decodeCompactedLine() = %+v, %v, want decoded link text, link title and page title", fileLink, ok)
+	}
+}
+
+func TestDecodeCompactedLinePageNoIndex(t *testing.T) {
+	fileLink, ok := decodeCompactedLine("example.com||/page||2|source.com|/||2|Anchor|0|1|2023-02-04|2023-02-05|1.2.3.4|3|", "CC-MAIN-2021-04")
+	if !ok || fileLink.PageNoIndex != 1 || fileLink.NoFollow != 0 {
+		t.Fatalf("decodeCompactedLine() = %+v, %v, want link from noindex page", fileLink, ok)
+	}
+
+	// stored links keep the field name used by the API
+	doc, err := bson.Marshal(fileLink)
+	if err != nil {
+		t.Fatalf("bson.Marshal() error = %v", err)
+	}
+	if noIndex, ok := bson.Raw(doc).Lookup("noindex").AsInt64OK(); !ok || noIndex != 1 {
+		t.Errorf("stored noindex = %d, %v, want 1", noIndex, ok)
+	}
+	// empty page title is not stored
+	if _, err = bson.Raw(doc).LookupErr("pagetitle"); err == nil {
+		t.Errorf("stored empty page title")
+	}
+}
+
+// fakeLinkInserter - saves batches in memory, fails batches with link to failDomain or all of them and counts concurrent inserts
+type fakeLinkInserter struct {
+	mu            sync.Mutex
+	failDomain    string
+	failAll       bool
+	saved         []FileLinkCompacted
+	running       int
+	maxConcurrent int
+	bulkWrites    int
+}
+
+func (f *fakeLinkInserter) InsertMany(_ context.Context, documents []interface{}, _ ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	f.mu.Lock()
+	f.running++
+	f.maxConcurrent = max(f.maxConcurrent, f.running)
+	f.mu.Unlock()
+
+	// keep insert running to let other workers start
+	time.Sleep(time.Millisecond)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.running--
+	if f.failAll {
+		return nil, errors.New("insert failed")
+	}
+	for _, document := range documents {
+		if document.(FileLinkCompacted).LinkDomain == f.failDomain {
+			return nil, errors.New("insert failed")
+		}
+	}
+	// like unordered insert, links with already stored id are rejected and the others are saved
+	var bulkErr mongo.BulkWriteException
+	for i, document := range documents {
+		link := document.(FileLinkCompacted)
+		if link.ID != "" && slices.ContainsFunc(f.saved, func(saved FileLinkCompacted) bool { return saved.ID == link.ID }) {
+			bulkErr.WriteErrors = append(bulkErr.WriteErrors, mongo.BulkWriteError{WriteError: mongo.WriteError{Index: i, Code: duplicateKeyCode, Message: duplicateMessage(duplicateIDIndex)}})
+			continue
+		}
+		f.saved = append(f.saved, link)
+	}
+	if len(bulkErr.WriteErrors) > 0 {
+		return &mongo.InsertManyResult{}, bulkErr
+	}
+	return &mongo.InsertManyResult{}, nil
+}
+
+// BulkWrite - apply link upserts like MongoDB: link is found by filter or added, the lower datefrom and the higher dateto are kept,
+// qty is added, values are added to sets and other fields are set. Link not found by filter is rejected as duplicate when link
+// with the same key is stored, like by unique index of links
+func (f *fakeLinkInserter) BulkWrite(_ context.Context, models []mongo.WriteModel, _ ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bulkWrites++
+	if f.failAll {
+		return nil, errors.New("upsert failed")
+	}
+
+	var bulkErr mongo.BulkWriteException
+	for i, model := range models {
+		upsert := model.(*mongo.UpdateOneModel)
+		filter := bsonFields(upsert.Filter)
+		index := slices.IndexFunc(f.saved, func(link FileLinkCompacted) bool { return matchFields(bsonFields(link), filter) })
+		doc := bson.M{}
+		for _, key := range spanLinkKey {
+			doc[key] = filter[key]
+		}
+		if index >= 0 {
+			doc = bsonFields(f.saved[index])
+		} else if slices.ContainsFunc(f.saved, func(link FileLinkCompacted) bool { return matchFields(bsonFields(link), doc) }) {
+			bulkErr.WriteErrors = append(bulkErr.WriteErrors, mongo.BulkWriteError{WriteError: mongo.WriteError{Index: i, Code: duplicateKeyCode, Message: duplicateMessage("span_link")}})
+			continue
+		}
+
+		for _, operator := range upsert.Update.(bson.D) {
+			for key, val := range bsonFields(operator.Value) {
+				current, ok := doc[key]
+				switch operator.Key {
+				case "$min":
+					if !ok || val.(string) < current.(string) {
+						doc[key] = val
+					}
+				case "$max":
+					if !ok || val.(string) > current.(string) {
+						doc[key] = val
+					}
+				case "$inc":
+					doc[key] = bsonInt(current) + bsonInt(val)
+				case "$addToSet":
+					values, _ := current.(bson.A)
+					if !slices.Contains(values, val) {
+						doc[key] = append(values, val)
+					}
+				case "$set":
+					doc[key] = val
+				}
+			}
+		}
+
+		var link FileLinkCompacted
+		data, _ := bson.Marshal(doc)
+		if err := bson.Unmarshal(data, &link); err != nil {
+			return nil, err
+		}
+		if index >= 0 {
+			f.saved[index] = link
+		} else {
+			f.saved = append(f.saved, link)
+		}
+	}
+	if len(bulkErr.WriteErrors) > 0 {
+		return &mongo.BulkWriteResult{}, bulkErr
+	}
+	return &mongo.BulkWriteResult{}, nil
+}
+
+// matchFields - document has fields of filter, field with $ne condition is an array without the value
+func matchFields(doc bson.M, filter bson.M) bool {
+	for key, val := range filter {
+		if condition, ok := val.(bson.M); ok {
+			values, _ := doc[key].(bson.A)
+			if slices.Contains(values, condition["$ne"]) {
+				return false
+			}
+			continue
+		}
+		if doc[key] != val {
+			return false
+		}
+	}
+	return true
+}
+
+// bsonFields - fields of document as map
+func bsonFields(document interface{}) bson.M {
+	data, _ := bson.Marshal(document)
+	fields := bson.M{}
+	_ = bson.Unmarshal(data, &fields)
+	return fields
+}
+
+// bsonInt - integer field of document, 0 when it is missing
+func bsonInt(val interface{}) int {
+	switch v := val.(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// compactedLines - compacted file with qty links to domains link0.com, link1.com, ...
+func compactedLines(qty int) string {
+	var lines strings.Builder
+	for i := 0; i < qty; i++ {
+		fmt.Fprintf(&lines, "link%d.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|1|\n", i)
+	}
+	return lines.String()
+}
+
+func TestLoadLinks(t *testing.T) {
+	batchSize := linksBatchSize
+	linksBatchSize = 10
+	t.Cleanup(func() { linksBatchSize = batchSize })
+
+	tests := []struct {
+		name       string
+		lines      string
+		workers    int
+		failDomain string
+		wantSaved  int
+		wantErr    string
+	}{
+		{"one worker", compactedLines(95), 1, "", 95, ""},
+		{"many workers", compactedLines(95), 4, "", 95, ""},
+		{"workers not set", compactedLines(5), 0, "", 5, ""},
+		{"invalid lines skipped", "broken\n" + compactedLines(20) + "localhost||/||2|source.com|/||2|A|0|0|2023-02-04|2023-02-05|1.2.3.4|1|\n", 4, "", 20, ""},
+		{"failed batch reports its first line", "broken\n" + compactedLines(30), 1, "link15.com", 10, "batch from line 12"},
+		{"failed last batch", compactedLines(25), 4, "link24.com", 20, "batch from line 21"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inserter := &fakeLinkInserter{failDomain: tt.failDomain}
+			savedQty, err := loadLinks(context.Background(), inserter, strings.NewReader(tt.lines), ImportedSegments{ArchName: "CC-MAIN-2021-04", Segment: "1"}, tt.workers, dateRangeCrawl, nil)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("loadLinks() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("loadLinks() error = %v, want %q", err, tt.wantErr)
+			}
+			if savedQty != tt.wantSaved || len(inserter.saved) != tt.wantSaved {
+				t.Errorf("loadLinks() saved %d, inserted %d, want %d", savedQty, len(inserter.saved), tt.wantSaved)
+			}
+			if inserter.maxConcurrent > max(tt.workers, 1) {
+				t.Errorf("loadLinks() ran %d concurrent inserts, want at most %d", inserter.maxConcurrent, tt.workers)
+			}
+			for _, link := range inserter.saved {
+				if link.Archive != "CC-MAIN-2021-04" {
+					t.Errorf("inserted link archive = %q, want CC-MAIN-2021-04", link.Archive)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadLinksJoinsBatchErrors(t *testing.T) {
+	batchSize := linksBatchSize
+	linksBatchSize = 10
+	t.Cleanup(func() { linksBatchSize = batchSize })
+
+	// every batch fails, batches started before the first failure are all reported
+	inserter := &fakeLinkInserter{failAll: true}
+	savedQty, err := loadLinks(context.Background(), inserter, strings.NewReader(compactedLines(40)), ImportedSegments{ArchName: "CC-MAIN-2021-04", Segment: "1"}, 4, dateRangeCrawl, nil)
+	if err == nil || savedQty != 0 {
+		t.Fatalf("loadLinks() = %d, %v, want error and nothing saved", savedQty, err)
+	}
+	if !strings.HasPrefix(err.Error(), "batch from line 1: insert failed") {
+		t.Errorf("loadLinks() error = %q, want first batch reported first", err)
+	}
+}
+
+// TestLoadLinksAgainAfterFailedBatch - segment imported again after failed batch has every link saved once
+func TestLoadLinksAgainAfterFailedBatch(t *testing.T) {
+	batchSize := linksBatchSize
+	linksBatchSize = 10
+	t.Cleanup(func() { linksBatchSize = batchSize })
+
+	importInfo := ImportedSegments{ArchName: "CC-MAIN-2021-04", Segment: "1"}
+	inserter := &fakeLinkInserter{failDomain: "link35.com"}
+	if _, err := loadLinks(context.Background(), inserter, strings.NewReader(compactedLines(55)), importInfo, 1, dateRangeCrawl, nil); err == nil {
+		t.Fatal("loadLinks() expected error of failed batch")
+	}
+	if len(inserter.saved) != 30 {
+		t.Fatalf("loadLinks() inserted %d links before failed batch, want 30", len(inserter.saved))
+	}
+
+	// compacted file built again has the same links in other order
+	inserter.failDomain = ""
+	lines := strings.Split(strings.TrimSuffix(compactedLines(55), "\n"), "\n")
+	slices.Reverse(lines)
+	savedQty, err := loadLinks(context.Background(), inserter, strings.NewReader(strings.Join(lines, "\n")+"\n"), importInfo, 4, dateRangeCrawl, nil)
+	if err != nil || savedQty != 25 {
+		t.Fatalf("loadLinks() again = %d, %v, want 25 links not saved before", savedQty, err)
+	}
+	ids := make(map[string]bool)
+	for _, link := range inserter.saved {
+		ids[link.ID] = true
+	}
+	if len(inserter.saved) != 55 || len(ids) != 55 {
+		t.Errorf("loadLinks() again inserted %d links with %d ids, want 55 links inserted once", len(inserter.saved), len(ids))
+	}
+	for id := range ids {
+		if !strings.HasPrefix(id, "CC-MAIN-2021-04/1/") || len(id) != len("CC-MAIN-2021-04/1/")+32 {
+			t.Errorf("loadLinks() id = %q, want archive, segment and hash of link", id)
+		}
+	}
+
+	// duplicate of other unique index is an error, not link saved before
+	duplicateIndex := &duplicateIndexInserter{}
+	if _, err = loadLinks(context.Background(), duplicateIndex, strings.NewReader(compactedLines(3)), importInfo, 1, dateRangeCrawl, nil); err == nil {
+		t.Error("loadLinks() error = nil for duplicate key of other index")
+	}
+}
+
+// duplicateIndexInserter - rejects every link as duplicate of unique index other than _id
+type duplicateIndexInserter struct {
+	fakeLinkInserter
+}
+
+func (d *duplicateIndexInserter) InsertMany(_ context.Context, documents []interface{}, _ ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	var bulkErr mongo.BulkWriteException
+	for i := range documents {
+		bulkErr.WriteErrors = append(bulkErr.WriteErrors, mongo.BulkWriteError{WriteError: mongo.WriteError{Index: i, Code: duplicateKeyCode, Message: duplicateMessage("span_link")}})
+	}
+	return &mongo.InsertManyResult{}, bulkErr
+}
+
+// duplicateMessage - message of duplicate key error of index like MongoDB returns it
+func duplicateMessage(index string) string {
+	return "E11000 duplicate key error collection: globallinks.links index: " + index + " dup key: { : \"example.com\" }"
+}
+
+func TestCrawlLinkID(t *testing.T) {
+	importInfo := ImportedSegments{ArchName: "CC-MAIN-2021-04", Segment: "1"}
+	link, ok := decodeCompactedLine("example.com|www|/page||2|source.com|/post||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|1|", importInfo.ArchName)
+	if !ok {
+		t.Fatal("decodeCompactedLine() rejected valid line")
+	}
+	id := crawlLinkID(importInfo, link)
+
+	changed := link
+	changed.LinkText, changed.DateTo, changed.Qty = "Other anchor", "2023-02-06", 3
+	if crawlLinkID(importInfo, changed) != id {
+		t.Error("crawlLinkID() changed with text, dates and qty of the same link")
+	}
+
+	other := []func(link *FileLinkCompacted){
+		func(link *FileLinkCompacted) { link.LinkPath = "/other" },
+		func(link *FileLinkCompacted) { link.PagePath = "/other" },
+		func(link *FileLinkCompacted) { link.PageScheme = "1" },
+		func(link *FileLinkCompacted) { link.LinkType = "alternate" },
+	}
+	for i, change := range other {
+		otherLink := link
+		change(&otherLink)
+		if crawlLinkID(importInfo, otherLink) == id {
+			t.Errorf("crawlLinkID() of changed link %d = id of link", i)
+		}
+	}
+	if crawlLinkID(ImportedSegments{ArchName: "CC-MAIN-2021-04", Segment: "2"}, link) == id {
+		t.Error("crawlLinkID() of other segment = id of link")
+	}
+}
+
+func TestSetInsertWorkers(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 1},
+		{"1", 1},
+		{"8", 8},
+		{"32", 32},
+		{"0", 1},
+		{"33", 1},
+		{"many", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("GLOBALLINKS_STORE_WORKERS", tt.value)
+			if got := setInsertWorkers(); got != tt.want {
+				t.Errorf("setInsertWorkers() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// blockingLinkInserter - saves the first batch and blocks next inserts until release is closed
+type blockingLinkInserter struct {
+	inserts     atomic.Int32
+	blockedOnce sync.Once
+	blocked     chan struct{}
+	release     chan struct{}
+}
+
+func (b *blockingLinkInserter) InsertMany(_ context.Context, _ []interface{}, _ ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	if b.inserts.Add(1) > 1 {
+		b.blockedOnce.Do(func() { close(b.blocked) })
+		<-b.release
+	}
+	return &mongo.InsertManyResult{}, nil
+}
+
+func (b *blockingLinkInserter) BulkWrite(_ context.Context, _ []mongo.WriteModel, _ ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	return &mongo.BulkWriteResult{}, nil
+}
+
+func TestLoadLinksProgress(t *testing.T) {
+	batchSize := linksBatchSize
+	linksBatchSize = 10
+	t.Cleanup(func() { linksBatchSize = batchSize })
+
+	progress := healthcheck.NewProgress()
+	server := httptest.NewServer(healthcheck.InitRoutesWithProgress(progress))
+	defer server.Close()
+
+	inserter := &blockingLinkInserter{blocked: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		_, err := loadLinks(context.Background(), inserter, strings.NewReader(compactedLines(45)), ImportedSegments{ArchName: "CC-MAIN-2021-04", Segment: "1"}, 1, dateRangeCrawl, progress)
+		done <- err
+	}()
+
+	// import is stuck on the second batch
+	<-inserter.blocked
+	resp, err := http.Get(server.URL + "/progress")
+	if err != nil {
+		t.Fatalf("GET /progress error = %v", err)
+	}
+	var status healthcheck.ProgressStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("could not decode progress: %v", err)
+	}
+	if status.Batches != 1 || status.Errors != 0 || status.Lines < 20 || status.Lines > 30 {
+		t.Errorf("progress during import = %+v, want 1 batch, no errors and 20-30 lines", status)
+	}
+
+	close(inserter.release)
+	if err := <-done; err != nil {
+		t.Fatalf("loadLinks() error = %v", err)
+	}
+	status = progress.Status()
+	if status.Batches != 5 || status.Lines != 45 || status.Errors != 0 {
+		t.Errorf("progress after import = %+v, want 5 batches and 45 lines", status)
+	}
+}
+
+func TestParseUploadArgs(t *testing.T) {
+	tests := []struct {
+		name           string
+		args           []string
+		wantHealthAddr string
+		wantArgs       []string
+		wantErr        bool
+	}{
+		{"without health", []string{"compact_0.txt.gz", "CC-MAIN-2021-04", "1"}, "", []string{"compact_0.txt.gz", "CC-MAIN-2021-04", "1"}, false},
+		{"with health", []string{"--health", ":3006", "compact_0.txt.gz", "CC-MAIN-2021-04", "1"}, ":3006", []string{"compact_0.txt.gz", "CC-MAIN-2021-04", "1"}, false},
+		{"unknown flag", []string{"--port", "3006", "compact_0.txt.gz"}, "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			healthAddr, args, err := parseUploadArgs(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseUploadArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if healthAddr != tt.wantHealthAddr || !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("parseUploadArgs() = %q, %v, want %q, %v", healthAddr, args, tt.wantHealthAddr, tt.wantArgs)
+			}
+		})
+	}
+}
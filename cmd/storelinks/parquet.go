@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+	"github.com/parquet-go/parquet-go"
+)
+
+// parquetRowGroupSize - links written in one row group, only one row group is kept in memory
+var parquetRowGroupSize = 100000
+
+// ParquetLink - link saved in parquet file, urls are rebuilt from compacted fields and dates are days since 1970-01-01 (date32)
+type ParquetLink struct {
+	LinkURL       string `parquet:"link_url"`
+	LinkDomain    string `parquet:"link_domain,dict"`
+	LinkSubDomain string `parquet:"link_sub_domain,dict"`
+	PageURL       string `parquet:"page_url"`
+	PageHost      string `parquet:"page_host,dict"`
+	LinkText      string `parquet:"link_text"`
+	LinkTitle     string `parquet:"link_title"`
+	NoFollow      int32  `parquet:"no_follow"`
+	PageNoIndex   int32  `parquet:"no_index"` // noindex of source page, column keeps its name for existing readers
+	DateFrom      int32  `parquet:"date_from,date"`
+	DateTo        int32  `parquet:"date_to,date"`
+	IP            string `parquet:"ip,dict"`
+	Qty           int32  `parquet:"qty"`
+	LinkType      string `parquet:"link_type,dict"`
+	PageTitle     string `parquet:"page_title"`
+}
+
+// runExportParquet - export compacted file to parquet file. Returns exit code
+func runExportParquet(args []string) int {
+	if len(args) < 2 {
+		fmt.Println("Export compacted file to parquet : ./storelinks export-parquet data/links/compact_0.txt.gz links.parquet")
+		return 1
+	}
+	if !fileutils.FileExists(args[0]) {
+		fmt.Println("Source file does not exist")
+		return 1
+	}
+
+	links, skipped, err := exportParquet(args[0], args[1])
+	if err != nil {
+		fmt.Println("Export failed: " + err.Error())
+		return 1
+	}
+	fmt.Printf("Exported %d links to %s, skipped %d malformed lines\n", links, args[1], skipped)
+
+	return 0
+}
+
+// exportParquet - write links from compacted file to parquet file row group by row group, malformed lines are skipped.
+// File is written to temporary file and renamed when complete
+func exportParquet(compactedFile string, parquetFile string) (links int, skipped int, err error) {
+	maxCapacityScanner := fileutils.ScannerBufferSize(fileutils.DefaultScannerBufferSize)
+
+	file, err := os.Open(compactedFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer gzReader.Close()
+
+	tmpFile := parquetFile + ".tmp"
+	out, err := os.Create(tmpFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(tmpFile)
+		}
+	}()
+
+	writer := parquet.NewGenericWriter[ParquetLink](out, parquet.Compression(&parquet.Zstd), parquet.MaxRowsPerRowGroup(int64(parquetRowGroupSize)))
+
+	scanner := fileutils.NewGZScanner(gzReader, maxCapacityScanner)
+	rows := make([]ParquetLink, 0, parquetRowGroupSize)
+	for scanner.Scan() {
+		row, ok := newParquetLink(scanner.Text())
+		if !ok {
+			skipped++
+			continue
+		}
+		rows = append(rows, row)
+
+		if len(rows) == parquetRowGroupSize {
+			err = writeParquetRowGroup(writer, rows)
+			if err != nil {
+				return links, skipped, err
+			}
+			links += len(rows)
+			rows = rows[:0]
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return links, skipped, err
+	}
+	skipped += scanner.SkippedLines()
+
+	if len(rows) > 0 {
+		err = writeParquetRowGroup(writer, rows)
+		if err != nil {
+			return links, skipped, err
+		}
+		links += len(rows)
+	}
+
+	if err = writer.Close(); err != nil {
+		return links, skipped, err
+	}
+	if err = out.Close(); err != nil {
+		return links, skipped, err
+	}
+
+	return links, skipped, os.Rename(tmpFile, parquetFile)
+}
+
+// writeParquetRowGroup - write rows and flush them as one row group
+func writeParquetRowGroup(writer *parquet.GenericWriter[ParquetLink], rows []ParquetLink) error {
+	_, err := writer.Write(rows)
+	if err != nil {
+		return fmt.Errorf("could not write parquet rows: %w", err)
+	}
+	return writer.Flush()
+}
+
+// newParquetLink - parquet row from compacted file line, false when line is malformed
+func newParquetLink(line string) (ParquetLink, bool) {
+	fileLink, err := commoncrawl.DecodeCompactedLink(line)
+	if err != nil || commoncrawl.ValidateCompactedLink(fileLink) != nil {
+		return ParquetLink{}, false
+	}
+
+	dateFrom, err := parquetDate(fileLink.DateFrom)
+	if err != nil {
+		return ParquetLink{}, false
+	}
+	dateTo, err := parquetDate(fileLink.DateTo)
+	if err != nil {
+		return ParquetLink{}, false
+	}
+
+	return ParquetLink{
+		LinkURL:       fileLink.LinkURL(),
+		LinkDomain:    fileLink.LinkDomain,
+		LinkSubDomain: fileLink.LinkSubDomain,
+		PageURL:       fileLink.PageURL(),
+		PageHost:      fileLink.PageHost,
+		LinkText:      fileLink.LinkText,
+		LinkTitle:     fileLink.LinkTitle,
+		NoFollow:      int32(fileLink.NoFollow),
+		PageNoIndex:   int32(fileLink.PageNoIndex),
+		DateFrom:      dateFrom,
+		DateTo:        dateTo,
+		IP:            fileLink.IP,
+		Qty:           int32(fileLink.Qty),
+		LinkType:      fileLink.LinkType,
+		PageTitle:     fileLink.PageTitle,
+	}, true
+}
+
+// parquetDate - days since 1970-01-01 for date saved as 2006-01-02
+func parquetDate(date string) (int32, error) {
+	day, err := time.Parse(time.DateOnly, date)
+	if err != nil {
+		return 0, err
+	}
+	return int32(day.Unix() / 86400), nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestExportParquet(t *testing.T) {
+	tempDir := t.TempDir()
+	compactedFile := filepath.Join(tempDir, "compact_0.txt.gz")
+	parquetFile := filepath.Join(tempDir, "links.parquet")
+
+	lines := "example.com|blog|/post||2|source.com|/|a=1|1|Anchor|1|0|2023-02-04|2023-02-05|1.2.3.4|3|alternate\n" +
+		"example.com||/||2|other.org|/page||2|Home|0|1|2023-02-04|2023-02-04|5.6.7.8|1\n" + // compacted before link type was added
+		"broken|line\n" +
+		"example.org||/||1|source.com|/||2|Text|0|0|2023-13-04|2023-02-04|1.2.3.4|1|\n" // wrong date
+
+	file, err := os.Create(compactedFile)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	writer := gzip.NewWriter(file)
+	_, _ = writer.Write([]byte(lines))
+	_ = writer.Close()
+	_ = file.Close()
+
+	// every link in separate row group to check streaming
+	defer func(size int) { parquetRowGroupSize = size }(parquetRowGroupSize)
+	parquetRowGroupSize = 1
+
+	links, skipped, err := exportParquet(compactedFile, parquetFile)
+	if err != nil {
+		t.Fatalf("exportParquet() error = %v", err)
+	}
+	if links != 2 || skipped != 2 {
+		t.Errorf("exportParquet() = %d links, %d skipped, want 2 and 2", links, skipped)
+	}
+	if _, err = os.Stat(parquetFile + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("exportParquet() left tmp file: %v", err)
+	}
+
+	out, err := os.Open(parquetFile)
+	if err != nil {
+		t.Fatalf("Failed to open parquet file: %v", err)
+	}
+	defer out.Close()
+	info, _ := out.Stat()
+	pf, err := parquet.OpenFile(out, info.Size())
+	if err != nil {
+		t.Fatalf("parquet.OpenFile() error = %v", err)
+	}
+	if pf.NumRows() != 2 || len(pf.RowGroups()) != 2 {
+		t.Errorf("parquet file has %d rows in %d row groups, want 2 in 2", pf.NumRows(), len(pf.RowGroups()))
+	}
+
+	wantColumns := map[string]string{
+		"link_url":  "BYTE_ARRAY",
+		"page_url":  "BYTE_ARRAY",
+		"no_follow": "INT32",
+		"no_index":  "INT32",
+		"qty":       "INT32",
+		"date_from": "INT32",
+		"date_to":   "INT32",
+	}
+	for name, wantType := range wantColumns {
+		field, ok := pf.Schema().Lookup(name)
+		if !ok {
+			t.Errorf("column %s is missing", name)
+			continue
+		}
+		if got := field.Node.Type().Kind().String(); got != wantType {
+			t.Errorf("column %s type = %s, want %s", name, got, wantType)
+		}
+	}
+	for _, name := range []string{"date_from", "date_to"} {
+		field, _ := pf.Schema().Lookup(name)
+		if logicalType := field.Node.Type().LogicalType(); logicalType == nil || logicalType.Date == nil {
+			t.Errorf("column %s logical type = %v, want DATE", name, logicalType)
+		}
+	}
+
+	rows, err := parquet.ReadFile[ParquetLink](parquetFile)
+	if err != nil {
+		t.Fatalf("parquet.ReadFile() error = %v", err)
+	}
+	want := []ParquetLink{
+		{
+			LinkURL: "https://blog.example.com/post", LinkDomain: "example.com", LinkSubDomain: "blog", PageURL: "http://source.com/?a=1", PageHost: "source.com",
+			LinkText: "Anchor", NoFollow: 1, PageNoIndex: 0, DateFrom: 19392, DateTo: 19393, IP: "1.2.3.4", Qty: 3, LinkType: "alternate",
+		},
+		{
+			LinkURL: "https://example.com/", LinkDomain: "example.com", PageURL: "https://other.org/page", PageHost: "other.org",
+			LinkText: "Home", NoFollow: 0, PageNoIndex: 1, DateFrom: 19392, DateTo: 19392, IP: "5.6.7.8", Qty: 1,
+		},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("parquet.ReadFile() = %d rows, want %d", len(rows), len(want))
+	}
+	for i := range want {
+		if rows[i] != want[i] {
+			t.Errorf("row %d = %+v, want %+v", i, rows[i], want[i])
+		}
+	}
+}
+
+func TestExportParquetMissingFile(t *testing.T) {
+	parquetFile := filepath.Join(t.TempDir(), "links.parquet")
+
+	if code := runExportParquet([]string{filepath.Join(t.TempDir(), "missing.txt.gz"), parquetFile}); code != 1 {
+		t.Errorf("runExportParquet() = %d, want 1", code)
+	}
+	if _, err := os.Stat(parquetFile); !os.IsNotExist(err) {
+		t.Errorf("runExportParquet() created parquet file: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package commoncrawl
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+)
+
+// DefaultIndexURL - Common Crawl URL index server (CDX API), it lists WARC files with captures of every url
+const DefaultIndexURL = "https://index.commoncrawl.org/"
+
+// indexMaxRetries - number of retries of index queries, index server answers 503 when it is overloaded
+const indexMaxRetries = 3
+
+// IndexWatFiles - paths of WAT files of archive with pages of domains (and their subdomains), found in Common Crawl URL index.
+// Paths are relative like paths in segments file. Captures of robots.txt and crawl diagnostics have no WAT record and are skipped
+func IndexWatFiles(indexURL string, archiveName string, domains []string) (map[string]bool, error) {
+	parsed, err := url.Parse(indexURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid index url %q", indexURL)
+	}
+	endpoint := strings.TrimSuffix(parsed.String(), "/") + "/" + archiveName + "-index"
+
+	watPaths := make(map[string]bool)
+	for _, domain := range domains {
+		query := url.Values{}
+		query.Set("url", domain)
+		query.Set("matchType", "domain")
+		query.Set("output", "json")
+		query.Set("fl", "filename")
+		domainURL := endpoint + "?" + query.Encode()
+
+		pages, err := indexPages(domainURL)
+		if err != nil {
+			return nil, fmt.Errorf("index of domain %s: %w", domain, err)
+		}
+
+		found := len(watPaths)
+		for page := 0; page < pages; page++ {
+			err = readIndexPage(fmt.Sprintf("%s&page=%d", domainURL, page), watPaths)
+			if err != nil {
+				return nil, fmt.Errorf("index of domain %s: %w", domain, err)
+			}
+		}
+		log.Printf("Domain %s found in %d index pages, %d new WAT files\n", domain, pages, len(watPaths)-found)
+	}
+
+	return watPaths, nil
+}
+
+// indexPages - number of result pages of index query, domain without captures has no pages
+func indexPages(queryURL string) (int, error) {
+	resp, err := fileutils.GetWithRetry(queryURL+"&showNumPages=true", indexMaxRetries)
+	if isIndexNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var numPages struct {
+		Pages int `json:"pages"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&numPages); err != nil {
+		return 0, fmt.Errorf("error reading number of index pages: %w", err)
+	}
+
+	return numPages.Pages, nil
+}
+
+// readIndexPage - add WAT files of captures from one result page of index query to watPaths
+func readIndexPage(pageURL string, watPaths map[string]bool) error {
+	resp, err := fileutils.GetWithRetry(pageURL, indexMaxRetries)
+	if isIndexNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var capture struct {
+			Filename string `json:"filename"`
+		}
+		if err = json.Unmarshal([]byte(line), &capture); err != nil {
+			return fmt.Errorf("error reading index record %q: %w", line, err)
+		}
+		if watPath, ok := WatPathFromWarc(capture.Filename); ok {
+			watPaths[watPath] = true
+		}
+	}
+
+	return scanner.Err()
+}
+
+// isIndexNotFound - index server answers 404 when query has no captures
+func isIndexNotFound(err error) bool {
+	var statusErr *fileutils.StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
+}
+
+// WatPathFromWarc - path of WAT file with metadata of WARC file, WAT file has the same name and segment as WARC file.
+// Only files from warc directory have WAT files, captures of robots.txt and crawl diagnostics do not
+func WatPathFromWarc(warcPath string) (string, bool) {
+	dir, file, found := strings.Cut(warcPath, "/warc/")
+	if !found || strings.Contains(file, "/") || !strings.HasSuffix(file, ".warc.gz") {
+		return "", false
+	}
+
+	return dir + "/wat/" + strings.TrimSuffix(file, ".warc.gz") + ".warc.wat.gz", true
+}
+
+// FilterWatFiles - keep only WAT files from watPaths in segments, segments without such files are removed
+func FilterWatFiles(segmentList []WatSegment, watPaths map[string]bool) []WatSegment {
+	var filtered []WatSegment
+	for _, segment := range segmentList {
+		var watFiles []WatFile
+		for _, watFile := range segment.WatFiles {
+			if watPaths[watFile.Path] {
+				watFiles = append(watFiles, watFile)
+			}
+		}
+		if len(watFiles) == 0 {
+			continue
+		}
+		segment.WatFiles = watFiles
+		filtered = append(filtered, segment)
+	}
+
+	return filtered
+}
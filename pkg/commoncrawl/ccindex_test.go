@@ -0,0 +1,131 @@
+package commoncrawl
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// serveTestIndex - mock of Common Crawl URL index, every domain has its captures split into result pages
+func serveTestIndex(t *testing.T, archiveName string, captures map[string][][]string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/"+archiveName+"-index" || query.Get("matchType") != "domain" || query.Get("fl") != "filename" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		pages, ok := captures[query.Get("url")]
+		if !ok {
+			http.Error(w, `{"message": "No Captures found"}`, http.StatusNotFound)
+			return
+		}
+		if query.Get("showNumPages") == "true" {
+			fmt.Fprintf(w, `{"pages": %d, "pageSize": 5, "blocks": %d}`, len(pages), len(pages))
+			return
+		}
+		var page int
+		if _, err := fmt.Sscan(query.Get("page"), &page); err != nil || page >= len(pages) {
+			http.Error(w, "bad page", http.StatusBadRequest)
+			return
+		}
+		for _, filename := range pages[page] {
+			fmt.Fprintf(w, "{\"url\": \"https://%s/\", \"filename\": \"%s\"}\n", query.Get("url"), filename)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// testWarcPath - path of WARC file like in index records
+func testWarcPath(segment string, dir string, number int) string {
+	return fmt.Sprintf("crawl-data/CC-MAIN-2021-04/segments/%s/%s/CC-MAIN-20210115134101-20210115164101-%05d.warc.gz", segment, dir, number)
+}
+
+// testWatPath - path of WAT file like in segments file
+func testWatPath(segment string, number int) string {
+	return fmt.Sprintf("crawl-data/CC-MAIN-2021-04/segments/%s/wat/CC-MAIN-20210115134101-20210115164101-%05d.warc.wat.gz", segment, number)
+}
+
+func TestWatPathFromWarc(t *testing.T) {
+	tests := []struct {
+		name     string
+		warcPath string
+		want     string
+		wantOk   bool
+	}{
+		{"warc file", testWarcPath("1610703495901.0", "warc", 12), testWatPath("1610703495901.0", 12), true},
+		{"robots.txt", testWarcPath("1610703495901.0", "robotstxt", 12), "", false},
+		{"crawl diagnostics", testWarcPath("1610703495901.0", "crawldiagnostics", 12), "", false},
+		{"not warc file", "crawl-data/CC-MAIN-2021-04/segments/1610703495901.0/warc/file.txt", "", false},
+		{"empty", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := WatPathFromWarc(tt.warcPath)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("WatPathFromWarc(%q) = %q, %v, want %q, %v", tt.warcPath, got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestIndexWatFiles(t *testing.T) {
+	server := serveTestIndex(t, "CC-MAIN-2021-04", map[string][][]string{
+		"example.com": {
+			{testWarcPath("1610703495901.0", "warc", 1), testWarcPath("1610703495901.0", "warc", 1), testWarcPath("1610703495901.0", "robotstxt", 2)},
+			{testWarcPath("1610703495901.1", "warc", 7)},
+		},
+		"blog.net": {
+			{testWarcPath("1610703495901.1", "warc", 7), testWarcPath("1610703495901.1", "crawldiagnostics", 8)},
+		},
+	})
+
+	got, err := IndexWatFiles(server.URL, "CC-MAIN-2021-04", []string{"example.com", "blog.net", "missing.org"})
+	if err != nil {
+		t.Fatalf("IndexWatFiles() error = %v", err)
+	}
+	want := []string{testWatPath("1610703495901.0", 1), testWatPath("1610703495901.1", 7)}
+	var paths []string
+	for path := range got {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	if !slices.Equal(paths, want) {
+		t.Errorf("IndexWatFiles() = %v, want %v", paths, want)
+	}
+
+	_, err = IndexWatFiles(server.URL, "CC-MAIN-2021-10", []string{"example.com"})
+	if err == nil || !strings.Contains(err.Error(), "example.com") {
+		t.Errorf("IndexWatFiles() error = %v, want error of failed query", err)
+	}
+	if _, err = IndexWatFiles("ftp://index", "CC-MAIN-2021-04", []string{"example.com"}); err == nil {
+		t.Errorf("IndexWatFiles() expected error for invalid index url")
+	}
+}
+
+func TestFilterWatFiles(t *testing.T) {
+	segmentList := []WatSegment{
+		{Segment: "1610703495901.0", SegmentID: 0, WatFiles: []WatFile{{Number: "00000", Path: testWatPath("1610703495901.0", 0)}, {Number: "00001", Path: testWatPath("1610703495901.0", 1)}}},
+		{Segment: "1610703495901.1", SegmentID: 1, WatFiles: []WatFile{{Number: "00002", Path: testWatPath("1610703495901.1", 2)}}},
+		{Segment: "1610703495901.2", SegmentID: 2, WatFiles: []WatFile{{Number: "00003", Path: testWatPath("1610703495901.2", 3)}}},
+	}
+
+	got := FilterWatFiles(segmentList, map[string]bool{testWatPath("1610703495901.0", 1): true, testWatPath("1610703495901.2", 3): true})
+
+	if len(got) != 2 || got[0].SegmentID != 0 || got[1].SegmentID != 2 {
+		t.Fatalf("FilterWatFiles() = %+v, want segments 0 and 2", got)
+	}
+	if len(got[0].WatFiles) != 1 || got[0].WatFiles[0].Number != "00001" {
+		t.Errorf("FilterWatFiles() segment 0 files = %+v, want only file 00001", got[0].WatFiles)
+	}
+	if len(segmentList[0].WatFiles) != 2 {
+		t.Errorf("FilterWatFiles() changed files of original segment list")
+	}
+}
@@ -0,0 +1,154 @@
+package commoncrawl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/kris-dev-hub/globallinks/pkg/config"
+)
+
+func TestDomainLRU(t *testing.T) {
+	cache := newDomainLRU(2)
+	cache.add("www.a.com", "a.com")
+	cache.add("www.b.com", "b.com")
+
+	// a.com is used, so b.com is the oldest host when c.com is added
+	if domain, ok := cache.get("www.a.com"); !ok || domain != "a.com" {
+		t.Errorf("get(www.a.com) = %q, %v, want a.com, true", domain, ok)
+	}
+	cache.add("www.c.com", "c.com")
+
+	tests := []struct {
+		host       string
+		wantDomain string
+		wantOk     bool
+	}{
+		{"www.a.com", "a.com", true},
+		{"www.b.com", "", false},
+		{"www.c.com", "c.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if domain, ok := cache.get(tt.host); domain != tt.wantDomain || ok != tt.wantOk {
+				t.Errorf("get(%s) = %q, %v, want %q, %v", tt.host, domain, ok, tt.wantDomain, tt.wantOk)
+			}
+		})
+	}
+	if cache.len() != 2 {
+		t.Errorf("len() = %d, want 2", cache.len())
+	}
+
+	// adding cached host updates its domain without eviction
+	cache.add("www.c.com", "www.c.com")
+	if domain, _ := cache.get("www.c.com"); domain != "www.c.com" || cache.len() != 2 {
+		t.Errorf("get(www.c.com) = %q with %d hosts, want www.c.com with 2 hosts", domain, cache.len())
+	}
+
+	// smaller cache keeps the most recently used hosts
+	cache.add("www.d.com", "d.com")
+	cache.resize(1)
+	if _, ok := cache.get("www.d.com"); !ok || cache.len() != 1 {
+		t.Errorf("resize(1) kept %d hosts, want only www.d.com", cache.len())
+	}
+}
+
+func TestShardedDomainCache(t *testing.T) {
+	tests := []struct {
+		size       int
+		wantShards int
+	}{
+		{1, 1},
+		{2, 1},
+		{2047, 1},
+		{4099, 4},
+		{200000, domainCacheShards},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.size), func(t *testing.T) {
+			cache := newShardedDomainCache(tt.size)
+			if len(cache.shards) != tt.wantShards {
+				t.Fatalf("newShardedDomainCache(%d) has %d parts, want %d", tt.size, len(cache.shards), tt.wantShards)
+			}
+			size := 0
+			for i := range cache.shards {
+				size += cache.shards[i].lru.size
+			}
+			if size != tt.size {
+				t.Errorf("parts of newShardedDomainCache(%d) hold %d hosts", tt.size, size)
+			}
+
+			// cache never holds more hosts than its size, the last added host is found
+			for i := 0; i < 2*tt.size+10; i++ {
+				cache.add(fmt.Sprintf("www.host-%d.com", i), fmt.Sprintf("host-%d.com", i))
+			}
+			if cache.len() > tt.size {
+				t.Errorf("cache has %d hosts, want at most %d", cache.len(), tt.size)
+			}
+			last := 2*tt.size + 9
+			if domain, ok := cache.get(fmt.Sprintf("www.host-%d.com", last)); !ok || domain != fmt.Sprintf("host-%d.com", last) {
+				t.Errorf("get() of last host = %q, %v", domain, ok)
+			}
+		})
+	}
+}
+
+func TestDomainCacheSize(t *testing.T) {
+	defaultSize := config.DomainCacheSize
+	defer func() {
+		config.DomainCacheSize = defaultSize
+		resetDomainCache()
+	}()
+	config.DomainCacheSize = 2
+	resetDomainCache()
+
+	// evicted host is computed again by buildURLRecord
+	before := GetDomainFailures()
+	hits := domainCacheStats.hits.Load()
+	for _, sourceURL := range []string{"https://www.a.com/", "https://www.b.com/", "https://www.c.com/", "https://www.a.com/page", "https://www.c.com/page"} {
+		urlRecord := URLRecord{}
+		if !buildURLRecord(sourceURL, &urlRecord, nil) || urlRecord.SubDomain != "www" {
+			t.Errorf("buildURLRecord(%q) = %+v, want subdomain www", sourceURL, urlRecord)
+		}
+	}
+	if got := domainCacheStats.hits.Load() - hits; got != 1 {
+		t.Errorf("domain cache hits = %d, want 1 for www.c.com", got)
+	}
+	if GetDomainFailures() != before {
+		t.Errorf("GetDomainFailures() = %+v, want %+v", GetDomainFailures(), before)
+	}
+
+	// changed size is applied to cache in use
+	config.DomainCacheSize = 1
+	cacheDomain("www.d.com", "d.com")
+	if cache := domainCache.Load(); cache.len() != 1 || cache.size != 1 {
+		t.Errorf("domain cache has %d hosts with size %d, want 1 host with size 1", cache.len(), cache.size)
+	}
+}
+
+func TestDomainCacheConcurrent(t *testing.T) {
+	resetDomainCache()
+	defer resetDomainCache()
+
+	var wg sync.WaitGroup
+	for thread := 0; thread < 8; thread++ {
+		wg.Add(1)
+		go func(thread int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				sourceURL := fmt.Sprintf("https://site%d.example%d.com/page", i%50, (i+thread)%20)
+				urlRecord := URLRecord{}
+				if !buildURLRecord(sourceURL, &urlRecord, nil) || urlRecord.Domain != fmt.Sprintf("example%d.com", (i+thread)%20) {
+					t.Errorf("buildURLRecord(%q) domain = %q", sourceURL, urlRecord.Domain)
+					return
+				}
+			}
+		}(thread)
+	}
+	wg.Wait()
+
+	if cachedHosts := domainCache.Load().len(); cachedHosts == 0 || cachedHosts > 50*20 {
+		t.Errorf("domain cache has %d hosts, want from 1 to %d", cachedHosts, 50*20)
+	}
+}
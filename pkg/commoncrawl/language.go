@@ -0,0 +1,119 @@
+package commoncrawl
+
+import (
+	"strings"
+	"unicode"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/kris-dev-hub/globallinks/pkg/config"
+	"github.com/tidwall/gjson"
+)
+
+// titleScripts - scripts used by a single language, title written only in one of them gives page language
+var titleScripts = []struct {
+	language string
+	script   *unicode.RangeTable
+}{
+	{"ja", unicode.Hiragana},
+	{"ja", unicode.Katakana},
+	{"ko", unicode.Hangul},
+	{"el", unicode.Greek},
+	{"he", unicode.Hebrew},
+	{"th", unicode.Thai},
+	{"hy", unicode.Armenian},
+	{"ka", unicode.Georgian},
+}
+
+// readPageLanguage - language of page from <html lang>, content-language meta tag or header, title is checked when DetectTitleLanguage is enabled
+func readPageLanguage(parsedJSON *gjson.Result, schema *watSchema, metas string, title string) string {
+	if language := normalizeLanguage(parsedJSON.Get(schema.HeadLang).String()); language != "" {
+		return language
+	}
+	if language := normalizeLanguage(metaContentLanguage(metas)); language != "" {
+		return language
+	}
+	if language := normalizeLanguage(parsedJSON.Get(schema.ContentLanguage).String()); language != "" {
+		return language
+	}
+	if config.DetectTitleLanguage {
+		return detectTitleLanguage(title)
+	}
+	return ""
+}
+
+// metaContentLanguage - content of <meta http-equiv="content-language"> tag
+func metaContentLanguage(metas string) string {
+	type MetaData struct {
+		HTTPEquiv string `json:"http-equiv,omitempty"`
+		Content   string `json:"content"`
+	}
+
+	var metaDataArray []MetaData
+	err := jsoniter.Unmarshal([]byte(metas), &metaDataArray)
+	if err != nil {
+		return ""
+	}
+
+	for _, metaData := range metaDataArray {
+		if strings.EqualFold(strings.TrimSpace(metaData.HTTPEquiv), "content-language") {
+			return metaData.Content
+		}
+	}
+	return ""
+}
+
+// normalizeLanguage - primary language subtag in lowercase, "en-US" gives "en". Empty for invalid codes and lists of languages like "en, fr"
+func normalizeLanguage(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if strings.ContainsAny(language, ", ") {
+		return ""
+	}
+
+	language, _, _ = strings.Cut(strings.ReplaceAll(language, "_", "-"), "-")
+	if len(language) < 2 || len(language) > 3 {
+		return ""
+	}
+	for _, r := range language {
+		if r < 'a' || r > 'z' {
+			return ""
+		}
+	}
+	return language
+}
+
+// detectTitleLanguage - language of title written in script used by a single language, Latin, Cyrillic or Arabic titles are ambiguous and give empty code
+func detectTitleLanguage(title string) string {
+	language := ""
+	han := false
+	for _, r := range title {
+		// letters of common script like Japanese prolonged sound mark are used by many languages
+		if !unicode.IsLetter(r) || unicode.Is(unicode.Common, r) {
+			continue
+		}
+		if unicode.Is(unicode.Han, r) {
+			han = true
+			continue
+		}
+
+		scriptLanguage := ""
+		for _, titleScript := range titleScripts {
+			if unicode.Is(titleScript.script, r) {
+				scriptLanguage = titleScript.language
+				break
+			}
+		}
+		if scriptLanguage == "" || (language != "" && language != scriptLanguage) {
+			return ""
+		}
+		language = scriptLanguage
+	}
+
+	// Han is used in Japanese titles with kana, Han only title is Chinese
+	if language == "" && han {
+		return "zh"
+	}
+	if han && language != "ja" {
+		return ""
+	}
+	return language
+}
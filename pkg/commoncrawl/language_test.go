@@ -0,0 +1,122 @@
+package commoncrawl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kris-dev-hub/globallinks/pkg/config"
+)
+
+func TestReadPageContentLanguage(t *testing.T) {
+	links := `<a href="https://other.com/page">Other</a>`
+
+	tests := []struct {
+		name        string
+		html        string
+		detectTitle bool
+		want        string
+	}{
+		{name: "html lang", html: `<html lang="en"><title>Home</title>` + links + `</html>`, want: "en"},
+		{name: "html lang with region", html: `<html lang="pt-BR"><title>Início</title>` + links + `</html>`, want: "pt"},
+		{name: "html lang with underscore and upper case", html: `<html lang="DE_at"><title>Start</title>` + links + `</html>`, want: "de"},
+		{name: "content language meta", html: `<html><head><meta http-equiv="Content-Language" content="fr"><title>Accueil</title></head>` + links + `</html>`, want: "fr"},
+		{name: "html lang before meta", html: `<html lang="es"><head><meta http-equiv="content-language" content="fr"><title>Inicio</title></head>` + links + `</html>`, want: "es"},
+		{name: "broken html lang falls back to meta", html: `<html lang="x"><head><meta http-equiv="content-language" content="nl"><title>Thuis</title></head>` + links + `</html>`, want: "nl"},
+		{name: "many languages", html: `<html><head><meta http-equiv="content-language" content="en, fr"><title>Home</title></head>` + links + `</html>`, want: ""},
+		{name: "missing language", html: `<title>Home</title>` + links, want: ""},
+		{name: "title detection disabled", html: `<title>ニュース</title>` + links, want: ""},
+		{name: "japanese title", html: `<title>東京のニュース</title>` + links, detectTitle: true, want: "ja"},
+		{name: "latin title is ambiguous", html: `<title>Home page</title>` + links, detectTitle: true, want: ""},
+	}
+
+	defer func() { config.DetectTitleLanguage = false }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.DetectTitleLanguage = tt.detectTitle
+
+			record, err := BuildWatRecord(WatFixture{URL: "https://example.com/", IP: "1.2.3.4", Date: time.Date(2023, 2, 4, 10, 0, 0, 0, time.UTC), HTML: tt.html})
+			if err != nil {
+				t.Fatalf("BuildWatRecord() error = %v", err)
+			}
+			sourceURLRecord := URLRecord{}
+			buildURLRecord("https://example.com/", &sourceURLRecord, nil)
+
+			watPage := readPageContent(record, &sourceURLRecord, nil)
+			if watPage == nil {
+				t.Fatal("readPageContent() returned nil")
+			}
+			if watPage.Language != tt.want {
+				t.Errorf("readPageContent() language = %q, want %q", watPage.Language, tt.want)
+			}
+			if page := newFilePage(watPage); page.Language != tt.want {
+				t.Errorf("newFilePage() language = %q, want %q", page.Language, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadPageContentLanguageHeader(t *testing.T) {
+	line := `{"Envelope":{"WARC-Header-Metadata":{"WARC-IP-Address":"1.2.3.4","WARC-Date":"2023-02-04T10:00:00Z"},"Payload-Metadata":{"HTTP-Response-Metadata":{"Headers":{"Content-Language":"it-IT"},` +
+		`"HTML-Metadata":{"Head":{"Title":"Casa"},"Links":[{"path":"A@/href","url":"https://other.com/page","text":"Other"}]}}}}}`
+
+	sourceURLRecord := URLRecord{}
+	buildURLRecord("https://example.com/", &sourceURLRecord, nil)
+
+	watPage := readPageContent(line, &sourceURLRecord, nil)
+	if watPage == nil {
+		t.Fatal("readPageContent() returned nil")
+	}
+	if watPage.Language != "it" {
+		t.Errorf("readPageContent() language = %q, want it", watPage.Language)
+	}
+}
+
+func TestNormalizeLanguage(t *testing.T) {
+	tests := []struct {
+		language string
+		want     string
+	}{
+		{"en", "en"},
+		{" EN-us ", "en"},
+		{"zh_Hant_TW", "zh"},
+		{"fil", "fil"},
+		{"", ""},
+		{"*", ""},
+		{"e", ""},
+		{"english", ""},
+		{"en, de", ""},
+		{"x-default", ""},
+		{"12", ""},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeLanguage(tt.language); got != tt.want {
+			t.Errorf("normalizeLanguage(%q) = %q, want %q", tt.language, got, tt.want)
+		}
+	}
+}
+
+func TestDetectTitleLanguage(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"東京のニュース 2023", "ja"},
+		{"北京新闻", "zh"},
+		{"서울 뉴스", "ko"},
+		{"Ειδήσεις", "el"},
+		{"חדשות", "he"},
+		{"ข่าว", "th"},
+		{"News", ""},
+		{"Новости", ""},
+		{"Ειδήσεις News", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := detectTitleLanguage(tt.title); got != tt.want {
+			t.Errorf("detectTitleLanguage(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+}
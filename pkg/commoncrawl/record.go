@@ -0,0 +1,307 @@
+package commoncrawl
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kris-dev-hub/globallinks/pkg/config"
+)
+
+const (
+	sortedLinkFields        = 14 // fields in link file created from WAT file and in sorted file
+	compactedLinkFields     = 16 // fields in compacted link file
+	linkTypeFields          = 1  // optional link type field added at the end of the line
+	linkTitleFields         = 1  // optional title attribute of link added after link type
+	pageTitleFields         = 1  // optional title of source page added after link title, see config.SavePageTitle
+	pageFields              = 10 // fields in page file
+	pageLanguageFields      = 1  // optional page language field added at the end of the line
+	compactedLinkDateLayout = "2006-01-02"
+)
+
+// FileLinkCompacted - Define a struct to represent a link in sorted and compacted file
+type FileLinkCompacted struct {
+	LinkDomain    string
+	LinkSubDomain string
+	LinkPath      string
+	LinkRawQuery  string
+	LinkScheme    string
+	PageHost      string
+	PagePath      string
+	PageRawQuery  string
+	PageScheme    string
+	LinkText      string
+	NoFollow      int    // rel nofollow of the link or robots nofollow of its page
+	PageNoIndex   int    // robots noindex of source page, links have no noindex of their own
+	DateFrom      string // the first crawl date (WARC-Date of WAT record) of link in compacted segment
+	DateTo        string // the last crawl date of link in compacted segment, links of one archive span a few days at most
+	IP            string
+	Qty           int
+	LinkType      string
+	LinkTitle     string
+	PageTitle     string // title of source page, empty when it was not saved
+}
+
+// LinkURL - url of linked page, fragment saved with link path is moved behind the query
+func (l FileLinkCompacted) LinkURL() string {
+	host := l.LinkDomain
+	if l.LinkSubDomain != "" {
+		host = l.LinkSubDomain + "." + host
+	}
+	return buildURL(l.LinkScheme, host, l.LinkPath, l.LinkRawQuery)
+}
+
+// PageURL - url of page with the link
+func (l FileLinkCompacted) PageURL() string {
+	return buildURL(l.PageScheme, l.PageHost, l.PagePath, l.PageRawQuery)
+}
+
+// buildURL - build url from fields saved in file, scheme is saved by setScheme, url with unknown scheme is protocol relative
+func buildURL(scheme string, host string, path string, rawQuery string) string {
+	path, fragment, hasFragment := strings.Cut(path, "#")
+	if path == "" {
+		path = "/"
+	}
+
+	fullURL := "https://"
+	switch scheme {
+	case "1":
+		fullURL = "http://"
+	case "0":
+		// original scheme is not saved
+		fullURL = "//"
+	}
+	fullURL += host + path
+	if rawQuery != "" {
+		fullURL += "?" + rawQuery
+	}
+	if hasFragment {
+		fullURL += "#" + fragment
+	}
+	return fullURL
+}
+
+// DecodeSortedLink - decode line from link file created from WAT file or sorted file, files created before link type was added have 14 fields,
+// files created before link title was added have 15 fields, lines with page title have 17 fields
+func DecodeSortedLink(line string) (FileLinkCompacted, error) {
+	parts := strings.Split(line, "|")
+	if len(parts) < sortedLinkFields || len(parts) > sortedLinkFields+linkTypeFields+linkTitleFields+pageTitleFields {
+		return FileLinkCompacted{}, fmt.Errorf("invalid number of fields: %d", len(parts))
+	}
+
+	fileLink, err := decodeLinkFields(parts)
+	if err != nil {
+		return fileLink, err
+	}
+	fileLink.DateFrom = parts[12]
+	fileLink.DateTo = parts[12]
+	fileLink.IP = parts[13]
+	fileLink.Qty = 1
+	if len(parts) > sortedLinkFields {
+		fileLink.LinkType = parts[14]
+	}
+	if len(parts) > sortedLinkFields+linkTypeFields {
+		fileLink.LinkTitle = DecodeTextField(parts[15])
+	}
+	if len(parts) > sortedLinkFields+linkTypeFields+linkTitleFields {
+		fileLink.PageTitle = DecodeTextField(parts[16])
+	}
+
+	return fileLink, nil
+}
+
+// DecodeCompactedLink - decode line from compacted file, files compacted before link type was added have 16 fields,
+// files compacted before link title was added have 17 fields, lines with page title have 19 fields
+func DecodeCompactedLink(line string) (FileLinkCompacted, error) {
+	parts := strings.Split(line, "|")
+	if len(parts) < compactedLinkFields || len(parts) > compactedLinkFields+linkTypeFields+linkTitleFields+pageTitleFields {
+		return FileLinkCompacted{}, fmt.Errorf("invalid number of fields: %d", len(parts))
+	}
+
+	fileLink, err := decodeLinkFields(parts)
+	if err != nil {
+		return fileLink, err
+	}
+	fileLink.DateFrom = parts[12]
+	fileLink.DateTo = parts[13]
+	fileLink.IP = parts[14]
+	fileLink.Qty, err = strconv.Atoi(parts[15])
+	if err != nil {
+		return fileLink, fmt.Errorf("invalid qty: %q", parts[15])
+	}
+	if len(parts) > compactedLinkFields {
+		fileLink.LinkType = parts[16]
+	}
+	if len(parts) > compactedLinkFields+linkTypeFields {
+		fileLink.LinkTitle = DecodeTextField(parts[17])
+	}
+	if len(parts) > compactedLinkFields+linkTypeFields+linkTitleFields {
+		fileLink.PageTitle = DecodeTextField(parts[18])
+	}
+
+	return fileLink, nil
+}
+
+// decodeLinkFields - decode fields common for sorted and compacted files
+func decodeLinkFields(parts []string) (FileLinkCompacted, error) {
+	var err error
+
+	fileLink := FileLinkCompacted{}
+	fileLink.LinkDomain = parts[0]
+	fileLink.LinkSubDomain = parts[1]
+	fileLink.LinkPath = parts[2]
+	fileLink.LinkRawQuery = parts[3]
+	fileLink.LinkScheme = parts[4]
+	fileLink.PageHost = parts[5]
+	fileLink.PagePath = parts[6]
+	fileLink.PageRawQuery = parts[7]
+	fileLink.PageScheme = parts[8]
+	fileLink.LinkText = DecodeTextField(parts[9])
+	fileLink.NoFollow, err = strconv.Atoi(parts[10])
+	if err != nil {
+		return fileLink, fmt.Errorf("invalid nofollow: %q", parts[10])
+	}
+	fileLink.PageNoIndex, err = strconv.Atoi(parts[11])
+	if err != nil {
+		return fileLink, fmt.Errorf("invalid noindex: %q", parts[11])
+	}
+	return fileLink, nil
+}
+
+// EncodeCompactedLink - encode link as line of compacted file, page title field is added only when link has page title
+func EncodeCompactedLink(fileLink FileLinkCompacted) string {
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%d|%d|%s|%s|%s|%d|%s|%s%s\n",
+		fileLink.LinkDomain,
+		fileLink.LinkSubDomain,
+		fileLink.LinkPath,
+		fileLink.LinkRawQuery,
+		fileLink.LinkScheme,
+		fileLink.PageHost,
+		fileLink.PagePath,
+		fileLink.PageRawQuery,
+		fileLink.PageScheme,
+		EncodeTextField(fileLink.LinkText),
+		fileLink.NoFollow,
+		fileLink.PageNoIndex,
+		fileLink.DateFrom,
+		fileLink.DateTo,
+		fileLink.IP,
+		fileLink.Qty,
+		fileLink.LinkType,
+		EncodeTextField(fileLink.LinkTitle),
+		pageTitleField(fileLink.PageTitle),
+	)
+}
+
+// pageTitleField - optional page title field with its separator, empty for link without page title
+func pageTitleField(title string) string {
+	if title == "" {
+		return ""
+	}
+	return "|" + EncodeTextField(title)
+}
+
+// textFieldEncoder - percent-encode characters that would break line of link or page file, percent sign is encoded so decoding is lossless
+var textFieldEncoder = strings.NewReplacer("%", "%25", "|", "%7C", "\n", "%0A", "\r", "%0D")
+
+// textFieldDecoder - decode only sequences written by textFieldEncoder, other percent signs of files saved without encoding are kept
+var textFieldDecoder = strings.NewReplacer("%25", "%", "%7C", "|", "%0A", "\n", "%0D", "\r")
+
+// EncodeTextField - encode link text, link title or page title saved in link and page files, see config.EncodeLinkText
+func EncodeTextField(text string) string {
+	if !config.EncodeLinkText {
+		return strings.ReplaceAll(text, "|", " ")
+	}
+	return textFieldEncoder.Replace(text)
+}
+
+// DecodeTextField - decode text field encoded by EncodeTextField. Files saved before text was encoded have no marker, their text is
+// decoded too, so literal %25, %7C, %0A and %0D of such text are changed, files with such text have to be parsed again
+func DecodeTextField(text string) string {
+	if !strings.Contains(text, "%") {
+		return text
+	}
+	return textFieldDecoder.Replace(text)
+}
+
+// ValidateCompactedLink - validate decoded link: domain, schemes, flags, dates and qty
+func ValidateCompactedLink(fileLink FileLinkCompacted) error {
+	if !IsValidDomain(fileLink.LinkDomain) {
+		return fmt.Errorf("invalid link domain: %q", fileLink.LinkDomain)
+	}
+	if fileLink.PageHost == "" {
+		return errors.New("empty page host")
+	}
+	if !isValidScheme(fileLink.LinkScheme) {
+		return fmt.Errorf("invalid link scheme: %q", fileLink.LinkScheme)
+	}
+	if !isValidScheme(fileLink.PageScheme) {
+		return fmt.Errorf("invalid page scheme: %q", fileLink.PageScheme)
+	}
+	if fileLink.NoFollow != 0 && fileLink.NoFollow != 1 {
+		return fmt.Errorf("invalid nofollow: %d", fileLink.NoFollow)
+	}
+	if fileLink.PageNoIndex != 0 && fileLink.PageNoIndex != 1 {
+		return fmt.Errorf("invalid page noindex: %d", fileLink.PageNoIndex)
+	}
+	if _, err := time.Parse(compactedLinkDateLayout, fileLink.DateFrom); err != nil {
+		return fmt.Errorf("invalid date from: %q", fileLink.DateFrom)
+	}
+	if _, err := time.Parse(compactedLinkDateLayout, fileLink.DateTo); err != nil {
+		return fmt.Errorf("invalid date to: %q", fileLink.DateTo)
+	}
+	if fileLink.DateFrom > fileLink.DateTo {
+		return fmt.Errorf("date from %s is after date to %s", fileLink.DateFrom, fileLink.DateTo)
+	}
+	if fileLink.Qty < 1 {
+		return fmt.Errorf("invalid qty: %d", fileLink.Qty)
+	}
+	return nil
+}
+
+// isValidScheme - scheme saved by setScheme
+func isValidScheme(scheme string) bool {
+	return scheme == "0" || scheme == "1" || scheme == "2"
+}
+
+// DecodePage - decode line from page file saved by savePageFile, files created before page language was added have 10 fields
+func DecodePage(line string) (FilePage, error) {
+	var err error
+
+	parts := strings.Split(line, "|")
+	if len(parts) != pageFields && len(parts) != pageFields+pageLanguageFields {
+		return FilePage{}, fmt.Errorf("invalid number of fields: %d", len(parts))
+	}
+
+	filePage := FilePage{
+		Host:     parts[0],
+		Path:     parts[1],
+		RawQuery: parts[2],
+		Scheme:   parts[3],
+		Title:    DecodeTextField(parts[4]),
+		IP:       parts[5],
+		Imported: parts[6],
+	}
+	if filePage.Host == "" {
+		return filePage, errors.New("empty page host")
+	}
+	filePage.InternalLinks, err = strconv.Atoi(parts[7])
+	if err != nil {
+		return filePage, fmt.Errorf("invalid internal links qty: %q", parts[7])
+	}
+	filePage.ExternalLinks, err = strconv.Atoi(parts[8])
+	if err != nil {
+		return filePage, fmt.Errorf("invalid external links qty: %q", parts[8])
+	}
+	filePage.NoIndex, err = strconv.Atoi(parts[9])
+	if err != nil {
+		return filePage, fmt.Errorf("invalid noindex: %q", parts[9])
+	}
+	if len(parts) > pageFields {
+		filePage.Language = parts[10]
+	}
+
+	return filePage, nil
+}
@@ -0,0 +1,287 @@
+package commoncrawl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kris-dev-hub/globallinks/pkg/config"
+)
+
+func TestDecodeSortedLink(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		wantErr   bool
+		wantType  string
+		wantTitle string
+	}{
+		{"with link title", "example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4||Read the docs", false, "", "Read the docs"},
+		{"with empty link title", "example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4|alternate|", false, "alternate", ""},
+		{"with link type", "example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4|alternate", false, "alternate", ""},
+		{"without link type", "example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4", false, "", ""},
+		{"missing field", "example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04", true, "", ""},
+		{"extra field", "example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|1.2.3.4||||x", true, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeSortedLink(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeSortedLink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.DateFrom != "2023-02-04" || got.DateTo != "2023-02-04" || got.Qty != 1 || got.IP != "1.2.3.4" || got.LinkType != tt.wantType || got.LinkTitle != tt.wantTitle {
+				t.Errorf("DecodeSortedLink() = %+v", got)
+			}
+		})
+	}
+}
+
+func TestEncodeDecodeCompactedLink(t *testing.T) {
+	fileLink := FileLinkCompacted{
+		LinkDomain: "example.com", LinkSubDomain: "www", LinkPath: "/page", LinkRawQuery: "a=1", LinkScheme: "2",
+		PageHost: "source.com", PagePath: "/", PageScheme: "1", LinkText: "Anchor", NoFollow: 1,
+		DateFrom: "2023-02-04", DateTo: "2023-03-01", IP: "1.2.3.4", Qty: 4, LinkType: "alternate", LinkTitle: "Anchor title",
+	}
+
+	line := EncodeCompactedLink(fileLink)
+	got, err := DecodeCompactedLink(strings.TrimSuffix(line, "\n"))
+	if err != nil {
+		t.Fatalf("DecodeCompactedLink() error = %v", err)
+	}
+	if got != fileLink {
+		t.Errorf("DecodeCompactedLink() = %+v, want %+v", got, fileLink)
+	}
+	if err = ValidateCompactedLink(got); err != nil {
+		t.Errorf("ValidateCompactedLink() error = %v", err)
+	}
+}
+
+func TestEncodeDecodeTextFields(t *testing.T) {
+	texts := []struct {
+		name string
+		text string
+	}{
+		{"pipes", "Home | Blog || News"},
+		{"newlines", "Read\nmore\r\nhere\n"},
+		{"unicode", "Zażółć gęślą jaźń | 日本語 🔗"},
+		{"percent", "50% off %7C %25 %0A"},
+		{"empty", ""},
+	}
+
+	for _, tt := range texts {
+		t.Run(tt.name, func(t *testing.T) {
+			fileLink := FileLinkCompacted{
+				LinkDomain: "example.com", LinkPath: "/page", LinkScheme: "2", PageHost: "source.com", PagePath: "/", PageScheme: "2",
+				LinkText: tt.text, DateFrom: "2023-02-04", DateTo: "2023-02-04", IP: "1.2.3.4", Qty: 1, LinkTitle: tt.text, PageTitle: tt.text,
+			}
+
+			wantFields := compactedLinkFields + linkTypeFields + linkTitleFields
+			if tt.text != "" {
+				wantFields += pageTitleFields
+			}
+			line := strings.TrimSuffix(EncodeCompactedLink(fileLink), "\n")
+			if strings.ContainsAny(line, "\r\n") || len(strings.Split(line, "|")) != wantFields {
+				t.Fatalf("EncodeCompactedLink() = %q, text breaks the line", line)
+			}
+			got, err := DecodeCompactedLink(line)
+			if err != nil || got != fileLink {
+				t.Errorf("DecodeCompactedLink(%q) = %+v, %v, want %+v", line, got, err, fileLink)
+			}
+
+			link := FileLink{LinkDomain: "example.com", LinkPath: "/page", LinkScheme: "2", LinkText: tt.text, LinkTitle: tt.text}
+			page := FilePage{Host: "source.com", Path: "/", Scheme: "2", Title: tt.text, IP: "1.2.3.4", Imported: "2023-02-04"}
+			sorted, err := DecodeSortedLink(strings.TrimSuffix(EncodeLink(link, page), "\n"))
+			if err != nil || sorted.LinkText != tt.text || sorted.LinkTitle != tt.text {
+				t.Errorf("DecodeSortedLink() = %+v, %v, want link text and title %q", sorted, err, tt.text)
+			}
+		})
+	}
+}
+
+func TestDecodeTextFieldLegacy(t *testing.T) {
+	// files saved before text was encoded have separator replaced with space and percent signs not encoded
+	for _, text := range []string{"Home   Blog", "50% off", "100%", "%zz"} {
+		if got := DecodeTextField(text); got != text {
+			t.Errorf("DecodeTextField(%q) = %q, want text without changes", text, got)
+		}
+	}
+
+	config.EncodeLinkText = false
+	defer func() { config.EncodeLinkText = true }()
+	if got := EncodeTextField("Home | 50%"); got != "Home   50%" {
+		t.Errorf("EncodeTextField() with encoding disabled = %q, want separator replaced with space", got)
+	}
+}
+
+func TestEncodeLinkPageNoIndex(t *testing.T) {
+	// followed link from noindex page keeps noindex of the page, nofollow stays the value of the link
+	link := FileLink{
+		LinkHost: "example.com", LinkPath: "/page", LinkScheme: "2", LinkText: "Anchor", LinkDomain: "example.com",
+	}
+	page := FilePage{Host: "source.com", Path: "/", Scheme: "2", IP: "1.2.3.4", Imported: "2023-02-04", NoIndex: 1}
+
+	line := strings.TrimSuffix(EncodeLink(link, page), "\n")
+	if fields := strings.Split(line, "|"); fields[10] != "0" || fields[11] != "1" {
+		t.Errorf("EncodeLink() nofollow = %s, noindex = %s, want 0 and 1", fields[10], fields[11])
+	}
+
+	got, err := DecodeSortedLink(line)
+	if err != nil {
+		t.Fatalf("DecodeSortedLink() error = %v", err)
+	}
+	if got.PageNoIndex != 1 || got.NoFollow != 0 {
+		t.Errorf("DecodeSortedLink() page noindex = %d, nofollow = %d, want 1 and 0", got.PageNoIndex, got.NoFollow)
+	}
+	if err = ValidateCompactedLink(got); err != nil {
+		t.Errorf("ValidateCompactedLink() error = %v", err)
+	}
+}
+
+func TestDecodeCompactedLinkTitle(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		wantErr   bool
+		wantTitle string
+	}{
+		{"with link title", "example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|3||Read the docs", false, "Read the docs"},
+		{"before link title was added", "example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|3|", false, ""},
+		{"before link type was added", "example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|3", false, ""},
+		{"extra field", "example.com||/page||2|source.com|/||2|Anchor|0|0|2023-02-04|2023-02-05|1.2.3.4|3||||x", true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeCompactedLink(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeCompactedLink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (got.LinkTitle != tt.wantTitle || got.Qty != 3) {
+				t.Errorf("DecodeCompactedLink() = %+v, want title %q", got, tt.wantTitle)
+			}
+		})
+	}
+}
+
+func TestLinkPageTitle(t *testing.T) {
+	link := FileLink{LinkHost: "example.com", LinkPath: "/page", LinkScheme: "2", LinkText: "Anchor", LinkDomain: "example.com"}
+	page := FilePage{Host: "source.com", Path: "/", Scheme: "2", IP: "1.2.3.4", Imported: "2023-02-04", Title: "Source\n  post"}
+
+	tests := []struct {
+		name       string
+		save       bool
+		title      string
+		wantFields int
+		wantTitle  string
+	}{
+		{"disabled", false, page.Title, 16, ""},
+		{"enabled", true, page.Title, 17, "Source post"},
+		{"enabled without title", true, "", 16, ""},
+	}
+
+	defer func() { config.SavePageTitle = false }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.SavePageTitle = tt.save
+			page.Title = tt.title
+
+			line := strings.TrimSuffix(EncodeLink(link, page), "\n")
+			if fields := strings.Count(line, "|") + 1; fields != tt.wantFields {
+				t.Fatalf("EncodeLink() = %q with %d fields, want %d", line, fields, tt.wantFields)
+			}
+			sortedLink, err := DecodeSortedLink(line)
+			if err != nil || sortedLink.PageTitle != tt.wantTitle {
+				t.Fatalf("DecodeSortedLink() = %+v, %v, want page title %q", sortedLink, err, tt.wantTitle)
+			}
+
+			// title is kept by compaction
+			compacted, err := DecodeCompactedLink(strings.TrimSuffix(EncodeCompactedLink(sortedLink), "\n"))
+			if err != nil || compacted != sortedLink {
+				t.Errorf("DecodeCompactedLink() = %+v, %v, want %+v", compacted, err, sortedLink)
+			}
+		})
+	}
+}
+
+func TestDecodePage(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    FilePage
+		wantErr bool
+	}{
+		{
+			name: "valid page",
+			line: "www.example.com|/blog|p=1|2|Blog title|1.2.3.4|2023-02-04|12|3|0",
+			want: FilePage{Host: "www.example.com", Path: "/blog", RawQuery: "p=1", Scheme: "2", Title: "Blog title", IP: "1.2.3.4", Imported: "2023-02-04", InternalLinks: 12, ExternalLinks: 3},
+		},
+		{
+			name: "page with language",
+			line: "www.example.com|/blog|p=1|2|Blog title|1.2.3.4|2023-02-04|12|3|0|en",
+			want: FilePage{Host: "www.example.com", Path: "/blog", RawQuery: "p=1", Scheme: "2", Title: "Blog title", IP: "1.2.3.4", Imported: "2023-02-04", InternalLinks: 12, ExternalLinks: 3, Language: "en"},
+		},
+		{
+			name: "encoded title",
+			line: "www.example.com|/blog|p=1|2|Blog %7C Example%0A|1.2.3.4|2023-02-04|12|3|0",
+			want: FilePage{Host: "www.example.com", Path: "/blog", RawQuery: "p=1", Scheme: "2", Title: "Blog | Example\n", IP: "1.2.3.4", Imported: "2023-02-04", InternalLinks: 12, ExternalLinks: 3},
+		},
+		{name: "missing field", line: "www.example.com|/blog|p=1|2|Blog title|1.2.3.4|2023-02-04|12|3", wantErr: true},
+		{name: "broken qty", line: "www.example.com|/blog|p=1|2|Blog title|1.2.3.4|2023-02-04|x|3|0", wantErr: true},
+		{name: "empty host", line: "|/blog|p=1|2|Blog title|1.2.3.4|2023-02-04|12|3|0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodePage(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodePage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("DecodePage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileLinkCompactedURLs(t *testing.T) {
+	tests := []struct {
+		name        string
+		fileLink    FileLinkCompacted
+		wantLinkURL string
+		wantPageURL string
+	}{
+		{
+			name:        "subdomain and query",
+			fileLink:    FileLinkCompacted{LinkDomain: "example.com", LinkSubDomain: "www", LinkPath: "/page", LinkRawQuery: "a=1", LinkScheme: "2", PageHost: "source.com", PagePath: "/post", PageRawQuery: "p=2", PageScheme: "1"},
+			wantLinkURL: "https://www.example.com/page?a=1",
+			wantPageURL: "http://source.com/post?p=2",
+		},
+		{
+			name:        "empty path and fragment",
+			fileLink:    FileLinkCompacted{LinkDomain: "example.com", LinkPath: "/app#/first", LinkRawQuery: "a=1", LinkScheme: "1", PageHost: "source.com", PageScheme: "2"},
+			wantLinkURL: "http://example.com/app?a=1#/first",
+			wantPageURL: "https://source.com/",
+		},
+		{
+			name:        "unknown scheme",
+			fileLink:    FileLinkCompacted{LinkDomain: "example.com", LinkPath: "/file", LinkScheme: "0", PageHost: "source.com", PagePath: "/", PageScheme: "0"},
+			wantLinkURL: "//example.com/file",
+			wantPageURL: "//source.com/",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.fileLink.LinkURL(); got != tt.wantLinkURL {
+				t.Errorf("LinkURL() = %q, want %q", got, tt.wantLinkURL)
+			}
+			if got := tt.fileLink.PageURL(); got != tt.wantPageURL {
+				t.Errorf("PageURL() = %q, want %q", got, tt.wantPageURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package commoncrawl
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// brokenStateFileExt - extension of state file set aside by repair, it is kept to check what was broken
+const brokenStateFileExt = ".broken"
+
+// ValidateImportState - problems of imported and dead letter WAT files, segments with sorted or compacted file have to be marked imported first. Empty list means the state is consistent with data directory
+func ValidateImportState(segmentList []WatSegment, imported *ImportedWatFiles, deadLetter *DeadLetterWatFiles) []string {
+	imported.mu.Lock()
+	defer imported.mu.Unlock()
+	deadLetter.mu.Lock()
+	defer deadLetter.mu.Unlock()
+
+	var problems []string
+
+	for _, segment := range segmentList {
+		if segment.ImportEnded == nil {
+			continue
+		}
+		missing := 0
+		for _, watFile := range segment.WatFiles {
+			if _, ok := imported.Files[WatFileKey(watFile.Path)]; !ok {
+				missing++
+			}
+		}
+		if missing > 0 {
+			problems = append(problems, fmt.Sprintf("segment %s is imported but %d of %d WAT files are not in imported WAT files", segment.Segment, missing, len(segment.WatFiles)))
+		}
+	}
+
+	for key, importTime := range imported.Files {
+		if importTime.IsZero() {
+			problems = append(problems, fmt.Sprintf("imported WAT file %s has no import time", key))
+		}
+	}
+
+	for key, file := range deadLetter.Files {
+		switch {
+		case file.Path == "" || WatFileKey(file.Path) != key:
+			problems = append(problems, fmt.Sprintf("dead letter WAT file %s does not match its path %q", key, file.Path))
+		case !imported.Files[key].IsZero():
+			problems = append(problems, fmt.Sprintf("dead letter WAT file %s is imported", file.Path))
+		}
+	}
+
+	return problems
+}
+
+// RepairImportState - rebuild imported and dead letter WAT files from data directory: WAT files of imported segments are imported,
+// imported and broken files are removed from dead letter files. Segments with sorted or compacted file have to be marked imported first.
+// Both files are saved once, number of repaired problems is returned
+func RepairImportState(segmentList []WatSegment, imported *ImportedWatFiles, deadLetter *DeadLetterWatFiles) (int, error) {
+	imported.mu.Lock()
+	defer imported.mu.Unlock()
+	deadLetter.mu.Lock()
+	defer deadLetter.mu.Unlock()
+
+	importedRepairs := 0
+	now := time.Now()
+
+	for _, segment := range segmentList {
+		if segment.ImportEnded == nil {
+			continue
+		}
+		for _, watFile := range segment.WatFiles {
+			key := WatFileKey(watFile.Path)
+			if _, ok := imported.Files[key]; !ok {
+				imported.Files[key] = now
+				importedRepairs++
+			}
+		}
+	}
+
+	for key, importTime := range imported.Files {
+		if importTime.IsZero() {
+			imported.Files[key] = now
+			importedRepairs++
+		}
+	}
+
+	deadLetterRepairs := 0
+	for key, file := range deadLetter.Files {
+		if file.Path == "" || WatFileKey(file.Path) != key || !imported.Files[key].IsZero() {
+			delete(deadLetter.Files, key)
+			deadLetterRepairs++
+		}
+	}
+
+	if importedRepairs > 0 {
+		if err := imported.save(); err != nil {
+			return 0, fmt.Errorf("failed to save imported WAT files: %w", err)
+		}
+	}
+	if deadLetterRepairs > 0 {
+		if err := saveStateFile(deadLetter.filePath, deadLetter); err != nil {
+			return importedRepairs, fmt.Errorf("failed to save dead letter WAT files: %w", err)
+		}
+	}
+
+	return importedRepairs + deadLetterRepairs, nil
+}
+
+// SetAsideBrokenStateFile - rename state file that can't be loaded to .broken, so it is rebuilt from data directory and can be checked later.
+// Journal of imported WAT files is set aside with the file
+func SetAsideBrokenStateFile(filePath string) error {
+	setAside := 0
+	for _, stateFile := range []string{filePath, filePath + importedWatJournalExt} {
+		err := os.Rename(stateFile, stateFile+brokenStateFileExt)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set aside broken state file %s: %w", stateFile, err)
+		}
+		setAside++
+	}
+	if setAside == 0 {
+		return fmt.Errorf("failed to set aside broken state file %s: %w", filePath, os.ErrNotExist)
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package commoncrawl
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// inconsistentStateDir - data directory with sorted segment 0 whose WAT files are not imported, zero import time of other file
+// and dead letter files with imported file and entry that does not match its path
+func inconsistentStateDir(tb testing.TB) (DataDir, []WatSegment) {
+	tb.Helper()
+
+	dataDir, err := CreateDataDir(tb.TempDir())
+	if err != nil {
+		tb.Fatalf("CreateDataDir() error = %v", err)
+	}
+
+	watPath := func(segment string, number int) string {
+		return fmt.Sprintf("crawl-data/CC-MAIN-2021-04/segments/%s/wat/CC-MAIN-20210115134101-20210115164101-%05d.warc.wat.gz", segment, number)
+	}
+	segmentList := []WatSegment{
+		{Archive: "CC-MAIN-2021-04", Segment: "1610703495901.0", SegmentID: 0, WatFiles: []WatFile{
+			{Number: "00000", Path: watPath("1610703495901.0", 0)},
+			{Number: "00001", Path: watPath("1610703495901.0", 1)},
+		}},
+		{Archive: "CC-MAIN-2021-04", Segment: "1610703495901.1", SegmentID: 1, WatFiles: []WatFile{
+			{Number: "00002", Path: watPath("1610703495901.1", 2)},
+			{Number: "00003", Path: watPath("1610703495901.1", 3)},
+		}},
+	}
+	if err := os.WriteFile(dataDir.SortedLinksFile(segmentList[0]), []byte{}, 0o666); err != nil {
+		tb.Fatalf("Failed to create file: %v", err)
+	}
+
+	imported := fmt.Sprintf(`{"files":{%q:"2024-01-02T03:04:05Z",%q:"0001-01-01T00:00:00Z"}}`,
+		WatFileKey(watPath("1610703495901.0", 0)), WatFileKey(watPath("1610703495901.1", 3)))
+	deadLetter := fmt.Sprintf(`{"files":{%q:{"path":%q,"segment":"1610703495901.0","attempts":3},"1a2b":{"path":%q,"segment":"1610703495901.1","attempts":3}}}`,
+		WatFileKey(watPath("1610703495901.0", 0)), watPath("1610703495901.0", 0), watPath("1610703495901.1", 2))
+	for filePath, data := range map[string]string{dataDir.ImportedWatFilesFile(): imported, dataDir.DeadLetterWatFilesFile(): deadLetter} {
+		if err := os.WriteFile(filePath, []byte(data), 0o644); err != nil {
+			tb.Fatalf("Failed to write state file: %v", err)
+		}
+	}
+
+	ValidateSegmentImportEndAtStart(&segmentList, dataDir)
+
+	return dataDir, segmentList
+}
+
+// loadTestImportState - imported and dead letter WAT files of data directory
+func loadTestImportState(tb testing.TB, dataDir DataDir) (*ImportedWatFiles, *DeadLetterWatFiles) {
+	tb.Helper()
+
+	imported, err := LoadImportedWatFiles(dataDir.ImportedWatFilesFile())
+	if err != nil {
+		tb.Fatalf("LoadImportedWatFiles() error = %v", err)
+	}
+	deadLetter, err := LoadDeadLetterWatFiles(dataDir.DeadLetterWatFilesFile())
+	if err != nil {
+		tb.Fatalf("LoadDeadLetterWatFiles() error = %v", err)
+	}
+
+	return imported, deadLetter
+}
+
+func TestValidateImportState(t *testing.T) {
+	dataDir, segmentList := inconsistentStateDir(t)
+	imported, deadLetter := loadTestImportState(t, dataDir)
+
+	problems := ValidateImportState(segmentList, imported, deadLetter)
+	wantProblems := []string{
+		"segment 1610703495901.0 is imported but 1 of 2 WAT files are not in imported WAT files",
+		"has no import time",
+		"dead letter WAT file 1a2b does not match its path",
+		"-00000.warc.wat.gz is imported",
+	}
+	if len(problems) != len(wantProblems) {
+		t.Fatalf("ValidateImportState() = %q, want %d problems", problems, len(wantProblems))
+	}
+	for _, want := range wantProblems {
+		found := false
+		for _, problem := range problems {
+			found = found || strings.Contains(problem, want)
+		}
+		if !found {
+			t.Errorf("ValidateImportState() = %q, want problem %q", problems, want)
+		}
+	}
+}
+
+func TestRepairImportState(t *testing.T) {
+	dataDir, segmentList := inconsistentStateDir(t)
+	imported, deadLetter := loadTestImportState(t, dataDir)
+
+	repaired, err := RepairImportState(segmentList, imported, deadLetter)
+	if err != nil {
+		t.Fatalf("RepairImportState() error = %v", err)
+	}
+	if repaired != 4 {
+		t.Errorf("RepairImportState() = %d, want 4 repaired problems", repaired)
+	}
+
+	// repaired state is saved, so it is consistent after reload
+	imported, deadLetter = loadTestImportState(t, dataDir)
+	if problems := ValidateImportState(segmentList, imported, deadLetter); len(problems) != 0 {
+		t.Errorf("ValidateImportState() after repair = %q, want no problems", problems)
+	}
+	for _, watFile := range segmentList[0].WatFiles {
+		if !imported.IsImported(watFile.Path) {
+			t.Errorf("IsImported(%s) = false, WAT files of sorted segment are imported", watFile.Path)
+		}
+	}
+	if imported.IsImported(segmentList[1].WatFiles[0].Path) {
+		t.Error("IsImported() = true for WAT file of segment that is not imported")
+	}
+	if len(deadLetter.Files) != 0 {
+		t.Errorf("dead letter WAT files after repair = %v, want none", deadLetter.Files)
+	}
+
+	// consistent state is not saved again
+	if repaired, err = RepairImportState(segmentList, imported, deadLetter); err != nil || repaired != 0 {
+		t.Errorf("RepairImportState() of consistent state = %d, %v, want 0 repaired problems", repaired, err)
+	}
+}
+
+func TestSetAsideBrokenStateFile(t *testing.T) {
+	dataDir, err := CreateDataDir(t.TempDir())
+	if err != nil {
+		t.Fatalf("CreateDataDir() error = %v", err)
+	}
+	filePath := dataDir.ImportedWatFilesFile()
+	// partially written state file
+	if err := os.WriteFile(filePath, []byte(`{"files":{"1a`), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if err := SetAsideBrokenStateFile(filePath); err != nil {
+		t.Fatalf("SetAsideBrokenStateFile() error = %v", err)
+	}
+	imported, err := LoadImportedWatFiles(filePath)
+	if err != nil || len(imported.Files) != 0 {
+		t.Errorf("LoadImportedWatFiles() after set aside = %v, %v, want empty state", imported, err)
+	}
+
+	data, err := os.ReadFile(filePath + brokenStateFileExt)
+	if err != nil || jsoniter.Valid(data) {
+		t.Errorf("broken state file = %q, %v, want kept broken data", data, err)
+	}
+
+	if err := SetAsideBrokenStateFile(filePath); err == nil {
+		t.Error("SetAsideBrokenStateFile() error = nil for missing file")
+	}
+
+	// broken journal is set aside without imported WAT files
+	if err := os.WriteFile(filePath+importedWatJournalExt, []byte("{\"file\":\n{}\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write journal: %v", err)
+	}
+	if _, err := LoadImportedWatFiles(filePath); err == nil {
+		t.Fatal("LoadImportedWatFiles() error = nil for broken journal")
+	}
+	if err := SetAsideBrokenStateFile(filePath); err != nil {
+		t.Fatalf("SetAsideBrokenStateFile() error = %v", err)
+	}
+	if imported, err := LoadImportedWatFiles(filePath); err != nil || len(imported.Files) != 0 {
+		t.Errorf("LoadImportedWatFiles() after set aside of journal = %v, %v, want empty state", imported, err)
+	}
+}
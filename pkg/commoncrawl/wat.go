@@ -5,19 +5,24 @@ package commoncrawl
 
 import (
 	"bufio"
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/dgryski/go-farm"
 	jsoniter "github.com/json-iterator/go"
@@ -39,20 +44,24 @@ type URLRecord struct {
 	Domain    string
 	SubDomain string
 	Text      string // optional text from link
+	Title     string // optional title attribute of link
 	NoFollow  int
+	Type      string // empty for <a> links, rel of <link> element for links from page head
 }
 
 // WatPage - Define a struct to represent a wat page
 type WatPage struct {
 	IP            *string
-	Imported      *string
+	Imported      *string // crawl date from WARC-Date of record, becomes date from and date to of its links
 	Title         *string
 	NoIndex       *int
 	NoFollow      *int
+	Language      string // ISO 639 language code, empty when unknown
 	InternalLinks int
 	ExternalLinks int
 	URLRecord     *URLRecord
 	Links         []URLRecord
+	schema        *watSchema // schema of WAT record the page was read from
 }
 
 // FilePage - Define a struct to represent a page in file
@@ -67,6 +76,7 @@ type FilePage struct {
 	InternalLinks int
 	ExternalLinks int
 	NoIndex       int
+	Language      string
 }
 
 // FileLink - Define a struct to represent a link in file
@@ -76,13 +86,22 @@ type FileLink struct {
 	LinkRawQuery  string
 	LinkScheme    string
 	LinkText      string
-	NoFollow      int
-	NoIndex       int
+	NoFollow      int // rel nofollow of the link or robots nofollow of its page, applied to every link
 	Imported      string
 	IP            string
-	PageHash      string
+	PageHash      string // noindex of source page is kept only in page data
 	LinkDomain    string
 	LinkSubDomain string
+	LinkType      string
+	LinkTitle     string
+}
+
+// HeadLinkData - Define a struct to represent a <link> element from page head
+type HeadLinkData struct {
+	Path string `json:"path"`
+	URL  string `json:"url"`
+	Rel  string `json:"rel"`
+	Type string `json:"type"`
 }
 
 // SortFileLinkByFields - structure used to sort links
@@ -91,6 +110,11 @@ type SortFileLinkByFields struct {
 	Domain    string
 	Subdomain string
 	Path      string
+	Query     string
+	Scheme    string
+	PageHost  string
+	PagePath  string
+	PageQuery string
 }
 
 // WatFile - Define a struct to represent a wat file
@@ -112,10 +136,33 @@ type WatSegment struct {
 
 // DataDir - Define a struct to represent a data directory, tmp, links, pages folders
 type DataDir struct {
-	DataDir  string `json:"data_dir"`
-	TmpDir   string `json:"tmp_dir"`
-	LinksDir string `json:"links_dir"`
-	PagesDir string `json:"pages_dir"`
+	DataDir  string     `json:"data_dir"`
+	TmpDir   string     `json:"tmp_dir"`
+	LinksDir string     `json:"links_dir"`
+	PagesDir string     `json:"pages_dir"`
+	Naming   FileNaming `json:"naming"`
+}
+
+// FileNaming - Define templates of files and directories created for every segment.
+// Templates can use {archive}, {segment} and {segment_id} placeholders
+type FileNaming struct {
+	SortedFile    string `json:"sorted_file"`
+	CompactedFile string `json:"compacted_file"`
+	SegmentTmpDir string `json:"segment_tmp_dir"`
+}
+
+// DefaultFileNaming - default names of segment files: links/sort_1.txt.gz, links/compact_1.txt.gz, tmp/<segment>/link/
+var DefaultFileNaming = FileNaming{
+	SortedFile:    "sort_{segment_id}.txt.gz",
+	CompactedFile: "compact_{segment_id}.txt.gz",
+	SegmentTmpDir: "{segment}",
+}
+
+// ArchiveFileNaming - names with archive name to avoid collisions when many archives are imported into one data directory
+var ArchiveFileNaming = FileNaming{
+	SortedFile:    "sort_{archive}_{segment_id}.txt.gz",
+	CompactedFile: "compact_{archive}_{segment_id}.txt.gz",
+	SegmentTmpDir: "{archive}/{segment}",
 }
 
 // use to validate if host is not an IP address. precompile it here to make it faster and avoid compiling it every time
@@ -135,41 +182,197 @@ var (
 	fileExtensionsMutex sync.RWMutex
 )
 
-// domain cache to lower amount of publicsuffix.EffectiveTLDPlusOne - 500ms faster per 1M lines
-var (
-	domainCache      = map[string]string{}
-	domainCacheMutex sync.RWMutex
-)
+// domainCacheStats - lookups of host domain in domain cache for all parsed files
+var domainCacheStats struct {
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// DomainCacheLookups - lookups of host domain found in domain cache and computed from public suffix list
+type DomainCacheLookups struct {
+	Hits   int64
+	Misses int64
+}
+
+// HitRate - share of domain lookups found in domain cache, 0 when no domain was looked up
+func (l DomainCacheLookups) HitRate() float64 {
+	lookups := l.Hits + l.Misses
+	if lookups == 0 {
+		return 0
+	}
+	return float64(l.Hits) / float64(lookups)
+}
+
+// count - count lookup in lookups of one parsed file and in lookups of the whole run, lookups of file can be nil
+func (l *DomainCacheLookups) count(hit bool) {
+	if hit {
+		domainCacheStats.hits.Add(1)
+	} else {
+		domainCacheStats.misses.Add(1)
+	}
+	if l == nil {
+		return
+	}
+	if hit {
+		l.Hits++
+	} else {
+		l.Misses++
+	}
+}
+
+// domainFailures - urls with host without eTLD+1, counted for all parsed files
+var domainFailures struct {
+	publicSuffixHosts atomic.Int64
+	keptHosts         atomic.Int64
+	invalidHosts      atomic.Int64
+}
+
+// DomainFailures - urls with host without eTLD+1
+type DomainFailures struct {
+	PublicSuffixHosts int64 // host is itself a public suffix like github.io or co.uk
+	KeptHosts         int64 // public suffix hosts kept with host as domain, see config.KeepPublicSuffixHosts
+	InvalidHosts      int64 // host is not a domain, for example localhost or ip address
+}
+
+const maxCapacityScanner = 5 * 1024 * 1024 // 5*1MB default buffer for WAT lines, GLOBALLINKS_SCANNERBUFFER overrides it
+
+// watScannerBufferSize - size of scanner buffer for WAT lines, every parsing thread holds one buffer
+func watScannerBufferSize() int {
+	return fileutils.ScannerBufferSize(maxCapacityScanner)
+}
+
+// warcTargetURIHeader - name of WARC header with url of record
+const warcTargetURIHeader = "WARC-Target-URI:"
+
+// watParseBuffers - maps and scanner buffer reused between parsed WAT files to avoid allocating them for every file
+type watParseBuffers struct {
+	pageMap    map[string]FilePage
+	linkMap    map[string]FileLink
+	scannerBuf []byte
+}
+
+// pool of buffers, every parsing thread takes its own buffers so they are never shared between files parsed at the same time
+var watParseBuffersPool = sync.Pool{
+	New: func() interface{} {
+		return &watParseBuffers{
+			pageMap:    make(map[string]FilePage),
+			linkMap:    make(map[string]FileLink),
+			scannerBuf: make([]byte, watScannerBufferSize()),
+		}
+	},
+}
+
+// releaseWatParseBuffers - clear maps, keeping their capacity, and return buffers to the pool
+func releaseWatParseBuffers(buffers *watParseBuffers) {
+	clear(buffers.pageMap)
+	clear(buffers.linkMap)
+	watParseBuffersPool.Put(buffers)
+}
+
+// DefaultBaseURL - Common Crawl data server, segments file and WAT files are downloaded from it
+const DefaultBaseURL = "https://data.commoncrawl.org/"
+
+// commonCrawlURL - base URL of Common Crawl data server or its mirror, always ends with slash
+var commonCrawlURL = DefaultBaseURL
+
+// SetBaseURL - use custom Common Crawl data server (cache, S3 mirror, local fixture server) instead of default one
+func SetBaseURL(baseURL string) error {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return fmt.Errorf("invalid base url %q: %w", baseURL, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("invalid base url %q: scheme must be http or https", baseURL)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("invalid base url %q: missing host", baseURL)
+	}
+	if parsed.RawQuery != "" || parsed.Fragment != "" || parsed.User != nil {
+		return fmt.Errorf("invalid base url %q: query, fragment and user info are not allowed", baseURL)
+	}
+
+	commonCrawlURL = strings.TrimSuffix(parsed.String(), "/") + "/"
+	return nil
+}
+
+// FileURL - url of file from Common Crawl data server, path is relative like paths in segments file
+func FileURL(path string) string {
+	return commonCrawlURL + strings.TrimPrefix(path, "/")
+}
+
+// segmentsFileMaxRetries - number of retries of segments file (wat.paths.gz) download
+const segmentsFileMaxRetries = 3
 
 const debugTestMode = false // import only 20 wat files in 2 segments. To verify all mechanisms/
 
-// InitImport - initialize import by downloading segments file and extracting segments into segmentList
-func InitImport(archiveName string) ([]WatSegment, error) {
-	var err error
-	var segmentList []WatSegment
+// InitImport - initialize import by downloading segments file and extracting segments into segmentList.
+// Segments file is cached in data directory and downloaded again only with refresh or when cached file is broken.
+func InitImport(archiveName string, dataDir DataDir, refresh bool) ([]WatSegment, error) {
+	cacheFile := dataDir.SegmentsFile(archiveName)
+
+	if !refresh && fileutils.FileExists(cacheFile) {
+		segmentList, err := readSegmentsFile(cacheFile, archiveName)
+		if err == nil {
+			return segmentList, nil
+		}
+		log.Printf("Cached segments file is broken, downloading it again: %v", err)
+	}
 
 	// download segments file
-	url := "https://data.commoncrawl.org/crawl-data/" + archiveName + "/wat.paths.gz"
+	url := FileURL("crawl-data/" + archiveName + "/wat.paths.gz")
 
-	// download file
-	resp, err := http.Get(url)
+	// download to tmp file first, cache file is replaced only with complete file
+	// transient errors are retried the same way as for WAT files
+	tmpFile := cacheFile + ".tmp"
+	err := fileutils.DownloadFile(url, tmpFile, segmentsFileMaxRetries)
+	if err != nil {
+		_ = os.Remove(tmpFile)
+		return nil, fmt.Errorf("failed to download segments file: %w", err)
+	}
+
+	segmentList, err := readSegmentsFile(tmpFile, archiveName)
+	if err != nil {
+		_ = os.Remove(tmpFile)
+		return nil, err
+	}
+
+	err = os.Rename(tmpFile, cacheFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save segments file: %w", err)
+	}
+
+	return segmentList, nil
+}
+
+// readSegmentsFile - read gzipped segments file, whole file is read so truncated file is reported as error
+func readSegmentsFile(filePath string, archiveName string) ([]WatSegment, error) {
+	var err error
+	var segmentList []WatSegment
+
+	file, err := os.Open(filePath)
 	if err != nil {
 		return segmentList, err
 	}
-	defer resp.Body.Close()
+	defer file.Close()
 
 	// extract gzip
-	gr, err := gzip.NewReader(resp.Body)
+	gr, err := gzip.NewReader(file)
 	if err != nil {
-		return segmentList, err
+		return segmentList, fmt.Errorf("segments file %s is not a valid gzip file: %w", filePath, err)
 	}
 	defer gr.Close()
 
 	scanner := bufio.NewScanner(gr)
 	segments := make(map[string][]string)
+	listed := make(map[string]bool)
 
 	for scanner.Scan() {
 		line := scanner.Text()
+		// WAT file listed twice is imported once
+		if listed[line] {
+			continue
+		}
+		listed[line] = true
 		parts := strings.Split(line, "/")
 		if len(parts) > 4 {
 			segment := parts[3]           // Extracting the segment part
@@ -181,7 +384,10 @@ func InitImport(archiveName string) ([]WatSegment, error) {
 	}
 
 	if err = scanner.Err(); err != nil {
-		return segmentList, err
+		return segmentList, fmt.Errorf("failed to read segments file %s: %w", filePath, err)
+	}
+	if len(segments) == 0 {
+		return segmentList, fmt.Errorf("segments file %s has no segments", filePath)
 	}
 
 	fileNumber := ""
@@ -217,10 +423,15 @@ func InitImport(archiveName string) ([]WatSegment, error) {
 	return segmentList, nil
 }
 
+// NewDataDir - paths of data directory and its tmp, links, pages folders, folders are not created
+func NewDataDir(defaultDir string) DataDir {
+	return DataDir{defaultDir, defaultDir + "/tmp", defaultDir + "/links", defaultDir + "/pages", DefaultFileNaming}
+}
+
 // CreateDataDir - create data directory and tmp, links, pages folders
 func CreateDataDir(defaultDir string) (DataDir, error) {
 	var err error
-	dataDir := DataDir{defaultDir, defaultDir + "/tmp", defaultDir + "/links", defaultDir + "/pages"}
+	dataDir := NewDataDir(defaultDir)
 
 	err = fileutils.CreateDataDirectory(dataDir.DataDir)
 	if err != nil {
@@ -245,156 +456,496 @@ func CreateDataDir(defaultDir string) (DataDir, error) {
 	return dataDir, nil
 }
 
+// Validate - validate if every template is unique per segment and file names are not empty
+func (n FileNaming) Validate() error {
+	templates := map[string]string{"sorted file": n.SortedFile, "compacted file": n.CompactedFile, "segment tmp dir": n.SegmentTmpDir}
+	for name, template := range templates {
+		if strings.TrimSpace(template) == "" {
+			return fmt.Errorf("%s template is empty", name)
+		}
+		if !strings.Contains(template, "{segment_id}") && !strings.Contains(template, "{segment}") {
+			return fmt.Errorf("%s template %q requires {segment_id} or {segment}", name, template)
+		}
+	}
+	if n.SortedFile == n.CompactedFile {
+		return errors.New("sorted and compacted file templates must be different")
+	}
+	return nil
+}
+
+// Name - fill template with segment information
+func (n FileNaming) Name(template string, segment WatSegment) string {
+	replacer := strings.NewReplacer(
+		"{archive}", segment.Archive,
+		"{segment_id}", strconv.Itoa(segment.SegmentID),
+		"{segment}", segment.Segment,
+	)
+	return replacer.Replace(template)
+}
+
+// SegmentsFile - cached wat.paths.gz file with list of segments and WAT files of archive
+func (d DataDir) SegmentsFile(archiveName string) string {
+	return filepath.Join(d.DataDir, archiveName+".wat.paths.gz")
+}
+
+// SortedLinksFile - path to sorted links file of segment
+func (d DataDir) SortedLinksFile(segment WatSegment) string {
+	return d.LinksDir + "/" + d.Naming.Name(d.Naming.SortedFile, segment)
+}
+
+// SortedPagesFile - path to sorted pages file of segment
+func (d DataDir) SortedPagesFile(segment WatSegment) string {
+	return d.PagesDir + "/" + d.Naming.Name(d.Naming.SortedFile, segment)
+}
+
+// CompactedLinksFile - path to compacted links file of segment
+func (d DataDir) CompactedLinksFile(segment WatSegment) string {
+	return d.LinksDir + "/" + d.Naming.Name(d.Naming.CompactedFile, segment)
+}
+
+// SegmentTmpDir - path to tmp directory with files parsed from segment WAT files
+func (d DataDir) SegmentTmpDir(segment WatSegment) string {
+	return d.TmpDir + "/" + d.Naming.Name(d.Naming.SegmentTmpDir, segment)
+}
+
+// WatFileStats - number of pages and links saved from one wat file
+type WatFileStats struct {
+	Pages        int
+	Links        int
+	SkippedLines int // lines longer than scanner buffer
+	Records      int // WAT records read as pages, with or without external links
+	// lookups of host domain of this file found in domain cache and computed from public suffix list, the cache is shared by
+	// parsing threads, so files parsed at the same time fill it for each other
+	DomainCacheHits   int
+	DomainCacheMisses int
+}
+
+// DomainCacheHitRate - share of domain lookups of the file found in domain cache, 0 when no domain was looked up
+func (s WatFileStats) DomainCacheHitRate() float64 {
+	return DomainCacheLookups{Hits: int64(s.DomainCacheHits), Misses: int64(s.DomainCacheMisses)}.HitRate()
+}
+
 // ParseWatByLine - parse wat file line by line and store links in file
 func ParseWatByLine(filePath string, linkFile string, pageFile string, savePage bool) error {
-	// prepare ignore domains and extensions map - load only when empty
-	if len(ignoreDomains) == 0 {
-		ignoreDomainsMutex.Lock()
-		ignoreDomains = createDomainMap(config.IgnoreDomains)
-		ignoreDomainsMutex.Unlock()
+	_, err := ParseWatFile(filePath, linkFile, pageFile, savePage)
+	return err
+}
+
+// ParseWatFile - parse wat file line by line, store links in file and return number of saved pages and links
+func ParseWatFile(filePath string, linkFile string, pageFile string, savePage bool) (WatFileStats, error) {
+	return ParseWatFileWithEmitter(filePath, linkFile, pageFile, savePage, nil)
+}
+
+// ErrLinkEmit - emitter failed after some links of the file were passed to it, parsing the file again would emit them twice
+var ErrLinkEmit = errors.New("error emitting link")
+
+// ParseWatFileWithEmitter - parse wat file like ParseWatFile and pass every saved link to emit too, when emit is not nil.
+// Links are emitted after link file is saved and only when whole file was parsed, error of emit is returned as ErrLinkEmit
+func ParseWatFileWithEmitter(filePath string, linkFile string, pageFile string, savePage bool, emit LinkEmitter) (WatFileStats, error) {
+	return ParseWatFileContext(context.Background(), filePath, linkFile, pageFile, savePage, emit)
+}
+
+// ParseWatFileContext - parse wat file like ParseWatFileWithEmitter and stop when ctx is done. Stopped file is abandoned without
+// emitting links and saving files, ErrWatParseTimeout is returned when ctx deadline is exceeded
+func ParseWatFileContext(ctx context.Context, filePath string, linkFile string, pageFile string, savePage bool, emit LinkEmitter) (WatFileStats, error) {
+	var stats WatFileStats
+
+	prepareIgnoreMaps()
+
+	// reuse maps and scanner buffer from previous files, they are cleared before going back to the pool
+	buffers := watParseBuffersPool.Get().(*watParseBuffers)
+	defer releaseWatParseBuffers(buffers)
+	pageMap := buffers.pageMap
+	linkMap := buffers.linkMap
+	if bufferSize := watScannerBufferSize(); len(buffers.scannerBuf) != bufferSize {
+		// buffer size changed since the buffer was pooled
+		buffers.scannerBuf = make([]byte, bufferSize)
 	}
-	if len(fileExtensions) == 0 {
-		fileExtensionsMutex.Lock()
-		fileExtensions = createFileExtensionMap(config.FileExtensions)
-		fileExtensionsMutex.Unlock()
+
+	file, gzReader, err := openWatFile(filePath)
+	if err != nil {
+		return stats, err
 	}
+	defer file.Close()
+	defer gzReader.Close()
 
-	// clear domain cache
-	domainCacheMutex.Lock()
-	domainCache = map[string]string{}
-	domainCacheMutex.Unlock()
+	// reuse buffers for page and link hashes
+	hasher := newRecordHasher()
 
-	// TODO: I should reserve memory for maps to avoid realocation - just remember to ignore empty maps when saving to file
-	pageMap := make(map[string]FilePage)
-	linkMap := make(map[string]FileLink)
+	scanStats, scanErr := scanWatRecords(newContextReader(ctx, gzReader), buffers.scannerBuf, savePage && config.SavePagesWithoutLinks, func(content *WatPage) error {
+		// lines already read to scanner buffer are parsed without reading, slow records stop the scan here
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pageHash := hasher.hash(content.URLRecord.Host, content.URLRecord.Path, content.URLRecord.RawQuery)
+		pageMap[pageHash] = newFilePage(content)
+		for i := range content.Links {
+			fileLink := newFileLink(&content.Links[i], content, pageHash)
+			linkHash := hasher.hash(fileLink.LinkHost, fileLink.LinkPath, fileLink.LinkRawQuery, content.URLRecord.Host, content.URLRecord.Path, content.URLRecord.RawQuery)
+			// link type is not part of link identity, <a> link wins over head link to the same url
+			if saved, ok := linkMap[linkHash]; ok && saved.LinkType == "" && fileLink.LinkType != "" {
+				continue
+			}
+			linkMap[linkHash] = fileLink
+		}
+		return nil
+	})
 
-	const maxCapacityScanner = 5 * 1024 * 1024 // 5*1MB
+	stats.Links = len(linkMap)
+	stats.Pages = len(pageMap)
+	stats.SkippedLines = scanStats.skippedLines
+	stats.Records = scanStats.records
+	stats.DomainCacheHits = int(scanStats.domainLookups.Hits)
+	stats.DomainCacheMisses = int(scanStats.domainLookups.Misses)
+	logSkippedLines(filePath, stats.SkippedLines, len(buffers.scannerBuf))
 
+	if scanErr != nil && ctx.Err() != nil {
+		return stats, parseStopped(filePath, ctx.Err())
+	}
+
+	if scanErr == nil {
+		err = checkZeroLinks(filePath, stats)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	// saving link file and reseting linkMap
+	err = saveLinkFile(linkFile, linkMap, pageMap)
+	if err != nil {
+		return stats, err
+	}
+
+	if savePage {
+		// saving page file and reseting pageMap
+		err = savePageFile(pageFile, pageMap)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	// Check for errors during scanning
+	if scanErr != nil {
+		return stats, scanErr
+	}
+
+	// links are emitted once, only after whole file is parsed and saved, a retried file does not emit links of a failed attempt
+	if emit != nil {
+		for _, fileLink := range linkMap {
+			err = emit(fileLink, pageMap[fileLink.PageHash])
+			if err != nil {
+				return stats, fmt.Errorf("%w: %w", ErrLinkEmit, err)
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// LinkEmitter - receives every link found by ParseWatStream together with the page it was found on, returned error stops parsing
+type LinkEmitter func(link FileLink, page FilePage) error
+
+// ParseWatStream - parse wat file line by line and pass links to emit as soon as their page is parsed, nothing is saved to files.
+// Only links of one page are kept in memory, link repeated on the page is emitted once with text of its last occurrence like in link file,
+// page repeated in wat file emits its links again
+func ParseWatStream(filePath string, emit LinkEmitter) (WatFileStats, error) {
+	var stats WatFileStats
+
+	prepareIgnoreMaps()
+
+	file, gzReader, err := openWatFile(filePath)
+	if err != nil {
+		return stats, err
+	}
+	defer file.Close()
+	defer gzReader.Close()
+
+	hasher := newRecordHasher()
+	pageLinks := make([]FileLink, 0, 100)
+	pageLinkIndex := make(map[string]int, 100)
+
+	bufferSize := watScannerBufferSize()
+	scanStats, err := scanWatRecords(gzReader, make([]byte, bufferSize), false, func(content *WatPage) error {
+		pageLinks = pageLinks[:0]
+		clear(pageLinkIndex)
+
+		pageHash := hasher.hash(content.URLRecord.Host, content.URLRecord.Path, content.URLRecord.RawQuery)
+		for i := range content.Links {
+			fileLink := newFileLink(&content.Links[i], content, pageHash)
+			linkHash := hasher.hash(fileLink.LinkHost, fileLink.LinkPath, fileLink.LinkRawQuery)
+			if index, ok := pageLinkIndex[linkHash]; ok {
+				pageLinks[index] = fileLink
+				continue
+			}
+			pageLinkIndex[linkHash] = len(pageLinks)
+			pageLinks = append(pageLinks, fileLink)
+		}
+
+		filePage := newFilePage(content)
+		for _, fileLink := range pageLinks {
+			if err := emit(fileLink, filePage); err != nil {
+				return err
+			}
+		}
+
+		stats.Pages++
+		stats.Links += len(pageLinks)
+		return nil
+	})
+	stats.SkippedLines = scanStats.skippedLines
+	stats.Records = scanStats.records
+	stats.DomainCacheHits = int(scanStats.domainLookups.Hits)
+	stats.DomainCacheMisses = int(scanStats.domainLookups.Misses)
+	logSkippedLines(filePath, stats.SkippedLines, bufferSize)
+
+	return stats, err
+}
+
+// openWatFile - open gzipped wat file, caller closes both file and reader
+func openWatFile(filePath string) (*os.File, *gzip.Reader, error) {
 	// Open the .gz file
 	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("error opening file: %w", err)
+		return nil, nil, fmt.Errorf("error opening file: %w", err)
 	}
-	defer file.Close()
 
 	// Create a gzip Reader
 	gzReader, err := gzip.NewReader(file)
 	if err != nil {
-		return fmt.Errorf("error creating gzip reader: %w", err)
+		file.Close()
+		return nil, nil, fmt.Errorf("error creating gzip reader: %w", err)
 	}
-	defer gzReader.Close()
 
-	// Use a bufio.Scanner to read the file line by line
-	scanner := bufio.NewScanner(gzReader)
-	// create buffer to avoid going over token size
-	buf := make([]byte, maxCapacityScanner)
-	scanner.Buffer(buf, maxCapacityScanner)
+	return file, gzReader, nil
+}
 
-	// Read each line and append to the records slice
-	line := ""
+// logSkippedLines - report lines of wat file skipped because they were longer than scanner buffer
+func logSkippedLines(filePath string, skippedLines int, bufferSize int) {
+	if skippedLines > 0 {
+		log.Printf("Skipped %d lines longer than %d bytes in %s", skippedLines, bufferSize, filePath)
+	}
+}
 
-	urlRecord := URLRecord{}
+// ErrNoWatLinks - WAT file has no links and no record could be read as page, the file is probably broken or of unknown schema
+var ErrNoWatLinks = errors.New("no links in WAT file")
+
+// checkZeroLinks - warn about WAT file without links. File with readable pages may have no links to other domains,
+// file without any readable page is returned as ErrNoWatLinks when config.FailZeroLinkWatFiles is enabled
+func checkZeroLinks(filePath string, stats WatFileStats) error {
+	if stats.Links > 0 {
+		return nil
+	}
+	if stats.Records > 0 {
+		log.Printf("WAT file %s has no links, none of its %d pages links to other domains", filePath, stats.Records)
+		return nil
+	}
 
-	validPage := false
+	log.Printf("WAT file %s has no links and no readable pages, it might be broken, truncated or of unknown schema", filePath)
+	if config.FailZeroLinkWatFiles {
+		return fmt.Errorf("%w: %s", ErrNoWatLinks, filePath)
+	}
+	return nil
+}
+
+// watScanStats - lines and records of scanned wat file
+type watScanStats struct {
+	skippedLines int // lines as long as scanner buffer or longer
+	records      int // records read as pages, pages without external links are counted too
+	// domain lookups of hosts of this file only, lookups of other files parsed at the same time are not counted
+	domainLookups DomainCacheLookups
+}
+
+// scanWatRecords - read wat file line by line and call onPage for every accepted page with links, pages without links are passed too
+// when pagesWithoutLinks is set. Lines as long as scanner buffer or longer are skipped
+func scanWatRecords(reader io.Reader, scannerBuf []byte, pagesWithoutLinks bool, onPage func(content *WatPage) error) (watScanStats, error) {
+	var stats watScanStats
+	// read the file line by line, too long lines are skipped instead of stopping the scan
+	scanner := fileutils.NewLineScanner(reader, scannerBuf, len(scannerBuf))
+
+	// header of current record, json content is parsed only when it follows record header
+	targetURILine := ""
 
 	for scanner.Scan() {
-		line = scanner.Text()
-		if strings.HasPrefix(line, "WARC-Target-URI: http") {
-
-			urlRecord = URLRecord{}
-			sourceURL := strings.TrimSpace(line[17:])
-			validRecord := buildURLRecord(sourceURL, &urlRecord)
-			if !validRecord {
-				validPage = false
+		line := scanner.Text()
+		if targetURI, ok := readTargetURIHeader(line); ok {
+			// header of record with other scheme resets previous header so its json is not parsed as page of previous record
+			targetURILine = ""
+			if isHTTPURL(targetURI) {
+				targetURILine = targetURI
+			}
+			continue
+		}
+
+		// read content of record - only when we have proper record header
+		if targetURILine != "" && strings.HasPrefix(line, "{") && (pagesWithoutLinks || strings.Contains(line, "href")) {
+			content, err := parseWatRecord(targetURILine, line, &stats.domainLookups)
+			targetURILine = ""
+			if err != nil {
 				continue
 			}
-			if !verifyRecordQuality(&urlRecord) {
-				validPage = false
+			stats.records++
+			if len(content.Links) == 0 && !pagesWithoutLinks {
 				continue
 			}
 
-			validPage = true
+			err = onPage(content)
+			if err != nil {
+				stats.skippedLines = scanner.SkippedLines()
+				return stats, err
+			}
 		}
+	}
+	stats.skippedLines = scanner.SkippedLines()
 
-		// read content of record - only when we have proper record header - validPage = true
-		if validPage && strings.HasPrefix(line, "{") && strings.Contains(line, "href") {
-			validPage = false
-			content := readPageContent(line, &urlRecord)
-			if content == nil {
-				continue
-			}
+	// Check for errors during scanning
+	if err := scanner.Err(); err != nil {
+		return stats, fmt.Errorf("error scanning the file: %w", err)
+	}
 
-			if len(content.Links) > 0 {
-				// save page info to file
-				filePage := FilePage{
-					Host:          content.URLRecord.Host,
-					Path:          content.URLRecord.Path,
-					RawQuery:      content.URLRecord.RawQuery,
-					Scheme:        content.URLRecord.Scheme,
-					Title:         strings.ReplaceAll(*content.Title, "|", " "),
-					IP:            *content.IP,
-					Imported:      *content.Imported,
-					InternalLinks: content.InternalLinks,
-					ExternalLinks: content.ExternalLinks,
-					NoIndex:       *content.NoIndex,
-				}
-				pageHash := fmt.Sprintf("%x", farm.Hash64([]byte(content.URLRecord.Host+content.URLRecord.Path+content.URLRecord.RawQuery)))
-				pageMap[pageHash] = filePage
-				for _, link := range content.Links {
-					// write to file
-					noFollow := 0
-					if link.NoFollow == 1 {
-						noFollow = 1
-					}
+	return stats, nil
+}
 
-					fileLink := FileLink{
-						LinkHost:      link.Host,
-						LinkPath:      link.Path,
-						LinkRawQuery:  link.RawQuery,
-						LinkScheme:    link.Scheme,
-						LinkText:      strings.ReplaceAll(link.Text, "|", " "),
-						NoFollow:      noFollow,
-						NoIndex:       *content.NoIndex,
-						Imported:      *content.Imported,
-						IP:            *content.IP,
-						PageHash:      pageHash,
-						LinkDomain:    link.Domain,
-						LinkSubDomain: link.SubDomain,
-					}
+// readTargetURIHeader - url from "WARC-Target-URI: <url>" header line, header name is case insensitive and spaces around url are ignored
+func readTargetURIHeader(line string) (string, bool) {
+	if len(line) < len(warcTargetURIHeader) || !strings.EqualFold(line[:len(warcTargetURIHeader)], warcTargetURIHeader) {
+		return "", false
+	}
+	return strings.TrimSpace(line[len(warcTargetURIHeader):]), true
+}
 
-					linkHash := fmt.Sprintf("%x", farm.Hash64([]byte(link.Host+link.Path+link.RawQuery+content.URLRecord.Host+content.URLRecord.Path+content.URLRecord.RawQuery)))
-					linkMap[linkHash] = fileLink
-				}
-			}
-		}
+// isHTTPURL - url has http or https scheme in any case
+func isHTTPURL(rawURL string) bool {
+	scheme, _, found := strings.Cut(rawURL, "://")
+	return found && (strings.EqualFold(scheme, "http") || strings.EqualFold(scheme, "https"))
+}
+
+// newFilePage - page info saved to page file
+func newFilePage(content *WatPage) FilePage {
+	return FilePage{
+		Host:          content.URLRecord.Host,
+		Path:          content.URLRecord.Path,
+		RawQuery:      content.URLRecord.RawQuery,
+		Scheme:        content.URLRecord.Scheme,
+		Title:         *content.Title,
+		IP:            *content.IP,
+		Imported:      *content.Imported,
+		InternalLinks: content.InternalLinks,
+		ExternalLinks: content.ExternalLinks,
+		NoIndex:       *content.NoIndex,
+		Language:      content.Language,
 	}
+}
 
-	// saving link file and reseting linkMap
-	err = saveLinkFile(linkFile, linkMap, pageMap)
-	if err != nil {
-		return err
+// newFileLink - link info saved to link file
+func newFileLink(link *URLRecord, content *WatPage, pageHash string) FileLink {
+	noFollow := 0
+	if link.NoFollow == 1 {
+		noFollow = 1
+	}
+
+	return FileLink{
+		LinkHost:      link.Host,
+		LinkPath:      linkPathWithFragment(link),
+		LinkRawQuery:  link.RawQuery,
+		LinkScheme:    link.Scheme,
+		LinkText:      linkText(link.Text),
+		NoFollow:      noFollow,
+		Imported:      *content.Imported,
+		IP:            *content.IP,
+		PageHash:      pageHash,
+		LinkDomain:    link.Domain,
+		LinkSubDomain: link.SubDomain,
+		LinkType:      link.Type,
+		LinkTitle:     linkText(link.Title),
 	}
+}
 
-	if savePage {
-		// saving page file and reseting pageMap
-		err = savePageFile(pageFile, pageMap)
-		if err != nil {
-			return err
-		}
+// linkText - anchor text saved in link file, whitespace is collapsed when config.NormalizeAnchorText is enabled. Field separator is encoded by EncodeTextField
+func linkText(text string) string {
+	if config.NormalizeAnchorText {
+		text = strings.Join(strings.Fields(text), " ")
 	}
+	return text
+}
+
+// ErrInvalidTargetURI - record url can't be parsed, contains forbidden characters or has no known domain
+var ErrInvalidTargetURI = errors.New("invalid target uri")
+
+// ErrLowQualityTargetURI - record url has quality score below config.RecordQualityThreshold
+var ErrLowQualityTargetURI = errors.New("low quality target uri")
+
+// ErrPageRejected - record has no links or page was rejected by content checks (noindex, canonical to other page)
+var ErrPageRejected = errors.New("page rejected")
+
+// ParseWatRecord - parse one WAT record, targetURILine is "WARC-Target-URI: <url>" header or just url, jsonLine is WAT json of the record.
+// Page and url quality checks are the same as in ParseWatByLine, rejected records return one of ErrInvalidTargetURI, ErrLowQualityTargetURI or ErrPageRejected
+func ParseWatRecord(targetURILine string, jsonLine string) (*WatPage, error) {
+	return parseWatRecord(targetURILine, jsonLine, nil)
+}
+
+// parseWatRecord - parse one WAT record like ParseWatRecord and count domain lookups of its urls in lookups, lookups can be nil
+func parseWatRecord(targetURILine string, jsonLine string, lookups *DomainCacheLookups) (*WatPage, error) {
+	prepareIgnoreMaps()
 
-	// TODO: probably should reset pageMap and linkMap to free memory faster
+	sourceURL := strings.TrimSpace(targetURILine)
+	if targetURI, ok := readTargetURIHeader(targetURILine); ok {
+		sourceURL = targetURI
+	}
+
+	urlRecord := &URLRecord{}
+	if !buildURLRecord(sourceURL, urlRecord, lookups) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTargetURI, sourceURL)
+	}
+	if !verifyRecordQuality(urlRecord) {
+		return nil, fmt.Errorf("%w: %s", ErrLowQualityTargetURI, sourceURL)
+	}
+
+	content := readPageContent(jsonLine, urlRecord, lookups)
+	if content == nil {
+		return nil, fmt.Errorf("%w: %s", ErrPageRejected, sourceURL)
+	}
+
+	return content, nil
+}
+
+// prepareIgnoreMaps - prepare ignore domains and extensions map - load only when empty
+func prepareIgnoreMaps() {
+	if len(ignoreDomains) == 0 {
+		ignoreDomainsMutex.Lock()
+		ignoreDomains = createDomainMap(config.IgnoreDomains)
+		ignoreDomainsMutex.Unlock()
+	}
+	if len(fileExtensions) == 0 {
+		fileExtensionsMutex.Lock()
+		fileExtensions = createFileExtensionMap(config.FileExtensions)
+		fileExtensionsMutex.Unlock()
+	}
+}
+
+// recordHasher - build page and link hashes without concatenating parts into new strings, buffers are reused between calls.
+// Hash is the same as fmt.Sprintf("%x", farm.Hash64([]byte(part1+part2+...))) to keep compatibility with existing data
+type recordHasher struct {
+	buf    []byte
+	hexBuf []byte
+}
+
+// newRecordHasher - create hasher with buffers big enough for most of the urls
+func newRecordHasher() *recordHasher {
+	return &recordHasher{buf: make([]byte, 0, 1024), hexBuf: make([]byte, 0, 16)}
+}
 
-	// Check for errors during scanning
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error scanning the file: %w", err)
+// hash - return hex encoded farm hash of concatenated parts
+func (h *recordHasher) hash(parts ...string) string {
+	h.buf = h.buf[:0]
+	for _, part := range parts {
+		h.buf = append(h.buf, part...)
 	}
-
-	return nil
+	h.hexBuf = strconv.AppendUint(h.hexBuf[:0], farm.Hash64(h.buf), 16)
+	return string(h.hexBuf)
 }
 
-// readPageContent - read page content from json, get IP, noindex, nofollow, title, links, etc.
-func readPageContent(line string, sourceURLRecord *URLRecord) *WatPage {
+// readPageContent - read page content from json, get IP, noindex, nofollow, title, links, etc. Domain lookups of links are counted in lookups
+func readPageContent(line string, sourceURLRecord *URLRecord, lookups *DomainCacheLookups) *WatPage {
 	var err error
 
 	watPage := WatPage{}
@@ -403,16 +954,23 @@ func readPageContent(line string, sourceURLRecord *URLRecord) *WatPage {
 	// parse json and reuse if for Get - 100ms faster per 1M lines
 	parsedJSON := gjson.Parse(line)
 
-	linksData := parsedJSON.Get("Envelope.Payload-Metadata.HTTP-Response-Metadata.HTML-Metadata.Links").String()
-	// check if linksData json is not empty
-	if len(linksData) < 10 {
+	schema := detectWatSchema(&parsedJSON)
+	if schema == nil {
 		return nil
 	}
+	watPage.schema = schema
 
-	ip := parsedJSON.Get("Envelope.WARC-Header-Metadata.WARC-IP-Address").String()
+	linksData := parsedJSON.Get(schema.Links).String()
+	// check if linksData json is not empty, page without links is read only when it is saved to page file
+	hasLinks := len(linksData) >= 10
+	if !hasLinks && !config.SavePagesWithoutLinks {
+		return nil
+	}
+
+	ip := parsedJSON.Get(schema.IP).String()
 	watPage.IP = &ip
 
-	imported := parsedJSON.Get("Envelope.WARC-Header-Metadata.WARC-Date").String()
+	imported := parsedJSON.Get(schema.Date).String()
 	if imported != "" {
 		layout := "2006-01-02T15:04:05Z"
 		t, err := time.Parse(layout, imported)
@@ -422,23 +980,34 @@ func readPageContent(line string, sourceURLRecord *URLRecord) *WatPage {
 		}
 	}
 
-	title := parsedJSON.Get("Envelope.Payload-Metadata.HTTP-Response-Metadata.HTML-Metadata.Head.Title").String()
+	title := parsedJSON.Get(schema.HeadTitle).String()
 	watPage.Title = &title
 
-	metas := parsedJSON.Get("Envelope.Payload-Metadata.HTTP-Response-Metadata.HTML-Metadata.Head.Metas").String()
+	metas := parsedJSON.Get(schema.HeadMetas).String()
 	noindex, nofollow := getNoFollowNoIndex(metas)
 	watPage.NoIndex = &noindex
 	watPage.NoFollow = &nofollow
 
+	watPage.Language = readPageLanguage(&parsedJSON, schema, metas, title)
+
 	// ignore pages with content problems like chinese characters in headers etc., rel canonical problems, etc.
 	if !verifyContentQuality(&parsedJSON, &watPage) {
 		return nil
 	}
 
-	watPage.Links, watPage.InternalLinks, watPage.ExternalLinks, err = parseLinks(linksData, sourceURLRecord, *watPage.NoFollow)
-	if err != nil {
-		// we ignore broken links data in source document
-		return nil
+	if hasLinks {
+		watPage.Links, watPage.InternalLinks, watPage.ExternalLinks, err = parseLinks(linksData, sourceURLRecord, *watPage.NoFollow, lookups)
+		if err != nil {
+			// we ignore broken links data in source document
+			return nil
+		}
+	}
+
+	if len(config.HeadLinkRels) > 0 {
+		headLinks, err := readHeadLinks(&parsedJSON, schema)
+		if err == nil {
+			watPage.Links = append(watPage.Links, parseHeadLinks(headLinks, sourceURLRecord, *watPage.NoFollow, lookups)...)
+		}
 	}
 
 	return &watPage
@@ -463,11 +1032,18 @@ func getNoFollowNoIndex(metas string) (int, int) {
 	}
 
 	for _, metaData := range metaDataArray {
-		if metaData.Name == "robots" {
-			if strings.Contains(metaData.Content, "noindex") {
+		if !strings.EqualFold(strings.TrimSpace(metaData.Name), "robots") {
+			continue
+		}
+		for _, directive := range robotsDirectives(metaData.Content) {
+			switch directive {
+			case "noindex":
+				noindex = 1
+			case "nofollow":
+				nofollow = 1
+			case "none":
+				// none is a shorthand for noindex, nofollow, all means no restrictions and does not change anything
 				noindex = 1
-			}
-			if strings.Contains(metaData.Content, "nofollow") {
 				nofollow = 1
 			}
 		}
@@ -476,8 +1052,15 @@ func getNoFollowNoIndex(metas string) (int, int) {
 	return noindex, nofollow
 }
 
+// robotsDirectives - split robots meta content into lowercase directives, "NoIndex, nofollow" gives ["noindex", "nofollow"]
+func robotsDirectives(content string) []string {
+	return strings.FieldsFunc(strings.ToLower(content), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+}
+
 // parseLinks - parse links from json
-func parseLinks(links string, sourceURLRecord *URLRecord, pageNoFollow int) ([]URLRecord, int, int, error) {
+func parseLinks(links string, sourceURLRecord *URLRecord, pageNoFollow int, lookups *DomainCacheLookups) ([]URLRecord, int, int, error) {
 	var err error
 	internalLinks := 0
 	externalLinks := 0
@@ -485,11 +1068,17 @@ func parseLinks(links string, sourceURLRecord *URLRecord, pageNoFollow int) ([]U
 	urlRecord := URLRecord{}
 	var urlRecords []URLRecord
 
+	// links without anchor are kept apart when anchored links are preferred, they fill up the limit at the end
+	maxLinks := config.MaxLinksPerPage
+	preferAnchored := config.PreferAnchoredLinks && maxLinks > 0
+	var unanchoredRecords []URLRecord
+
 	type LinkInfo struct {
-		Path string `json:"path"`
-		URL  string `json:"url"`
-		Text string `json:"text"`
-		Rel  string `json:"rel"`
+		Path  string `json:"path"`
+		URL   string `json:"url"`
+		Text  string `json:"text"`
+		Title string `json:"title"`
+		Rel   string `json:"rel"`
 	}
 
 	var linksArray []LinkInfo
@@ -498,6 +1087,13 @@ func parseLinks(links string, sourceURLRecord *URLRecord, pageNoFollow int) ([]U
 		return urlRecords, internalLinks, externalLinks, err
 	}
 
+	// anchors of all external links are counted for link farm check, before links are limited by config.MaxLinksPerPage
+	anchors := newLinkAnchors()
+	addExternal := func() {
+		externalLinks++
+		anchors.add(urlRecord.Text)
+	}
+
 	for _, linkData := range linksArray {
 		noFollow := pageNoFollow
 
@@ -516,10 +1112,11 @@ func parseLinks(links string, sourceURLRecord *URLRecord, pageNoFollow int) ([]U
 
 		urlRecord = URLRecord{
 			Text:     linkData.Text,
+			Title:    linkData.Title,
 			NoFollow: noFollow,
 		}
-		validRecord := buildURLRecord(linkData.URL, &urlRecord)
-		if !validRecord {
+		validRecord := buildURLRecord(linkData.URL, &urlRecord, lookups)
+		if !validRecord || !resolveLinkScheme(linkData.URL, &urlRecord, sourceURLRecord) {
 			continue
 		}
 
@@ -531,12 +1128,12 @@ func parseLinks(links string, sourceURLRecord *URLRecord, pageNoFollow int) ([]U
 
 		// ignore the same domains
 		if sourceURLRecord.Domain == urlRecord.Domain {
-			externalLinks++
+			addExternal()
 			continue
 		}
 
 		if !verifyRecordQuality(&urlRecord) {
-			externalLinks++
+			addExternal()
 			continue
 		}
 
@@ -546,49 +1143,260 @@ func parseLinks(links string, sourceURLRecord *URLRecord, pageNoFollow int) ([]U
 		}
 
 		if isIgnoredDomain(urlRecord.Domain) {
-			externalLinks++
+			addExternal()
 			continue
 		}
 
-		externalLinks++
-		urlRecords = append(urlRecords, urlRecord)
+		if config.SkipHomepageLinks && isHomepageLink(&urlRecord) {
+			addExternal()
+			continue
+		}
+
+		addExternal()
+		if preferAnchored && strings.TrimSpace(urlRecord.Text) == "" {
+			if len(unanchoredRecords) < maxLinks {
+				unanchoredRecords = append(unanchoredRecords, urlRecord)
+			}
+			continue
+		}
+		if maxLinks <= 0 || len(urlRecords) < maxLinks {
+			urlRecords = append(urlRecords, urlRecord)
+		}
+
+	}
+	if preferAnchored {
+		urlRecords = append(urlRecords, unanchoredRecords[:min(len(unanchoredRecords), maxLinks-len(urlRecords))]...)
+	}
+
+	// links from link farm are not saved, page still keeps number of its links
+	if isLinkFarm(anchors, externalLinks) {
+		urlRecords = nil
+	}
 
+	// links from pages made mostly of outbound links are not saved either
+	if isOutboundLinksPage(internalLinks, externalLinks) {
+		urlRecords = nil
 	}
 
 	return urlRecords, internalLinks, externalLinks, nil
 }
 
+// linkAnchors - number of empty anchors and of the most common anchor of external links of page, anchors are compared case insensitive.
+// Anchors are counted only when link farm check is enabled
+type linkAnchors struct {
+	empty      int
+	mostCommon int
+	counts     map[string]int
+}
+
+// newLinkAnchors - counter of anchors of one page, nil map when link farm check is disabled
+func newLinkAnchors() linkAnchors {
+	if config.LinkFarmExternalLinks <= 0 {
+		return linkAnchors{}
+	}
+	return linkAnchors{counts: make(map[string]int)}
+}
+
+// add - count anchor of external link
+func (a *linkAnchors) add(text string) {
+	if a.counts == nil {
+		return
+	}
+	anchor := strings.ToLower(strings.TrimSpace(text))
+	if anchor == "" {
+		a.empty++
+		return
+	}
+	a.counts[anchor]++
+	a.mostCommon = max(a.mostCommon, a.counts[anchor])
+}
+
+// isLinkFarm - check if page has more external links than config.LinkFarmExternalLinks and most of them have empty or the same anchor
+func isLinkFarm(anchors linkAnchors, externalLinks int) bool {
+	if config.LinkFarmExternalLinks <= 0 || externalLinks <= config.LinkFarmExternalLinks {
+		return false
+	}
+
+	return float64(anchors.empty+anchors.mostCommon) >= config.LinkFarmAnchorRatio*float64(externalLinks)
+}
+
+// isOutboundLinksPage - check if page has more than config.MaxExternalLinksRatio external links per internal link
+func isOutboundLinksPage(internalLinks int, externalLinks int) bool {
+	if config.MaxExternalLinksRatio <= 0 {
+		return false
+	}
+
+	return float64(externalLinks) > config.MaxExternalLinksRatio*float64(max(internalLinks, 1))
+}
+
+// isHomepageLink - link to homepage of host, path / without query. Fragment kept by config.KeepFragment makes it a different page
+func isHomepageLink(urlRecord *URLRecord) bool {
+	return linkPathWithFragment(urlRecord) == "/" && urlRecord.RawQuery == ""
+}
+
+// parseHeadLinks - parse <link> elements from page head with relation listed in config.HeadLinkRels
+func parseHeadLinks(headLinks []HeadLinkData, sourceURLRecord *URLRecord, pageNoFollow int, lookups *DomainCacheLookups) []URLRecord {
+	var urlRecords []URLRecord
+
+	for _, linkData := range headLinks {
+		rel := headLinkRel(linkData.Rel)
+		if rel == "" {
+			continue
+		}
+		// only absolute links can point to other domains
+		if !strings.HasPrefix(linkData.URL, "http") && !strings.HasPrefix(linkData.URL, "//") {
+			continue
+		}
+
+		urlRecord := URLRecord{
+			NoFollow: pageNoFollow,
+			Type:     rel,
+		}
+		if !buildURLRecord(linkData.URL, &urlRecord, lookups) || !resolveLinkScheme(linkData.URL, &urlRecord, sourceURLRecord) {
+			continue
+		}
+
+		// ignore the same hosts and domains, ignored files and domains
+		if sourceURLRecord.Host == urlRecord.Host || sourceURLRecord.Domain == urlRecord.Domain {
+			continue
+		}
+		if !verifyRecordQuality(&urlRecord) || isIgnoredExtension(urlRecord.Path) || isIgnoredDomain(urlRecord.Domain) {
+			continue
+		}
+		if config.SkipHomepageLinks && isHomepageLink(&urlRecord) {
+			continue
+		}
+
+		urlRecords = append(urlRecords, urlRecord)
+	}
+
+	return urlRecords
+}
+
+// headLinkRel - return first relation from rel attribute listed in config.HeadLinkRels or empty string
+func headLinkRel(rel string) string {
+	for _, relToken := range strings.Fields(strings.ToLower(rel)) {
+		for _, headLinkRel := range config.HeadLinkRels {
+			if relToken == headLinkRel {
+				return relToken
+			}
+		}
+	}
+	return ""
+}
+
 // verifyRecordQuality - verify if record is valid, no blocked TLD, no broken host, no broken query, etc.
 func verifyRecordQuality(record *URLRecord) bool {
+	// path is decoded, so multibyte characters are counted once
+	if config.MaxPathLength > 0 && utf8.RuneCountInString(record.Path) > config.MaxPathLength {
+		return false
+	}
+	score := scoreRecord(record)
+	return score > 0 && score >= config.RecordQualityThreshold
+}
+
+// penalties of url quality heuristics, url starts with maxRecordScore
+const (
+	maxRecordScore          = 100
+	longQueryPenalty        = 60 // query over maxQueryLength is probably garbage
+	hostSymbolsPenalty      = 30 // too many - and _ in host, typical for spam hosts
+	longPathPenalty         = 30 // path over maxPathLength
+	repeatedSegmentsPenalty = 60 // the same path segment repeated, typical for crawler traps like /a/b/a/b/a/b
+
+	maxQueryLength          = 200
+	maxPathLength           = 300
+	maxHostSymbolsRatio     = 0.2
+	maxRepeatedSegments     = 2
+	maxComparedPathSegments = 32
+)
+
+// scoreRecord - score url quality from 0 to maxRecordScore, 0 for urls that can't be saved at all: unknown domain,
+// blocked TLD or broken host. | in query is already encoded by buildURLRecord
+func scoreRecord(record *URLRecord) int {
 	// could not find domain
 	if record.Domain == "" {
-		return false
+		return 0
 	}
 
 	// ignore blocked TLD
 	if ignoreTLD(record.Domain) {
-		return false
+		return 0
 	}
 	// validate problems with host
 	if !validateHost(record.Host) {
-		return false
+		return 0
 	}
 	// validate domain problems
 	if !IsValidDomain(record.Domain) {
-		return false
+		return 0
 	}
 
-	// validate query length. Over 200 is probably garbage
-	if len(record.RawQuery) > 200 {
-		return false
+	score := maxRecordScore
+
+	if len(record.RawQuery) > maxQueryLength {
+		score -= longQueryPenalty
 	}
 
-	// validate if RawQuery contains | char
-	if strings.Contains(record.RawQuery, "|") {
-		return false
+	if hostSymbolsRatio(record.Host) > maxHostSymbolsRatio {
+		score -= hostSymbolsPenalty
 	}
 
-	return true
+	if len(record.Path) > maxPathLength {
+		score -= longPathPenalty
+	}
+
+	if hasRepeatedPathSegments(record.Path) {
+		score -= repeatedSegmentsPenalty
+	}
+
+	return max(score, 0)
+}
+
+// hostSymbolsRatio - ratio of chars other than letters, digits and dots in host
+func hostSymbolsRatio(host string) float64 {
+	if host == "" {
+		return 0
+	}
+
+	symbols := 0
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '.' {
+			symbols++
+		}
+	}
+
+	return float64(symbols) / float64(len(host))
+}
+
+// hasRepeatedPathSegments - check if any path segment is repeated more than maxRepeatedSegments times,
+// only first maxComparedPathSegments segments are compared to keep it fast
+func hasRepeatedPathSegments(path string) bool {
+	var segments [maxComparedPathSegments]string
+	found := 0
+
+	for path != "" && found < maxComparedPathSegments {
+		var segment string
+		segment, path, _ = strings.Cut(strings.TrimPrefix(path, "/"), "/")
+		if segment == "" {
+			continue
+		}
+
+		repeated := 1
+		for _, previous := range segments[:found] {
+			if previous == segment {
+				repeated++
+			}
+		}
+		if repeated > maxRepeatedSegments {
+			return true
+		}
+
+		segments[found] = segment
+		found++
+	}
+
+	return false
 }
 
 // validateHose - validate host for strange characters and no dots
@@ -619,8 +1427,8 @@ func IsValidDomain(domain string) bool {
 	return isValidDomainRegex.MatchString(domain)
 }
 
-// buildURLRecord - build url record from source url, check domain, path, query, etc.
-func buildURLRecord(sourceURL string, urlRecord *URLRecord) bool {
+// buildURLRecord - build url record from source url, check domain, path, query, etc. Domain lookup is counted in lookups of the file, they can be nil
+func buildURLRecord(sourceURL string, urlRecord *URLRecord, lookups *DomainCacheLookups) bool {
 	// ignore url with \n
 	if strings.Contains(sourceURL, "\n") {
 		return false
@@ -646,28 +1454,22 @@ func buildURLRecord(sourceURL string, urlRecord *URLRecord) bool {
 	if parsedURL.Path == "" {
 		parsedURL.Path = "/"
 	}
-	urlRecord.Path = parsedURL.Path
-	urlRecord.RawQuery = parsedURL.RawQuery
+	// encoded # of path stays encoded, # saved in link path starts fragment
+	urlRecord.Path = strings.ReplaceAll(normalizePath(parsedURL.Path), "#", "%23")
+	urlRecord.RawQuery = NormalizeQuery(parsedURL.RawQuery)
 
-	// ignore query starting with
-	if ignoreQuery(urlRecord.RawQuery) {
-		urlRecord.RawQuery = ""
-	}
-
-	urlRecord.Fragment = parsedURL.Fragment
+	urlRecord.Fragment = escapeSeparator(parsedURL.Fragment)
 
 	// ignore records without known domain
-	domainCacheMutex.RLock()
-	domain, exists := domainCache[urlRecord.Host]
-	domainCacheMutex.RUnlock()
+	domain, exists := cachedDomain(urlRecord.Host)
+	lookups.count(exists)
 	if !exists {
-		domain, err = publicsuffix.EffectiveTLDPlusOne(urlRecord.Host)
-		if err != nil {
+		var ok bool
+		domain, ok = registrableDomain(urlRecord.Host)
+		if !ok {
 			return false
 		}
-		domainCacheMutex.Lock()
-		domainCache[urlRecord.Host] = domain
-		domainCacheMutex.Unlock()
+		cacheDomain(urlRecord.Host, domain)
 	}
 	urlRecord.Domain = domain
 
@@ -677,6 +1479,169 @@ func buildURLRecord(sourceURL string, urlRecord *URLRecord) bool {
 	return true
 }
 
+// RegistrableDomain - domain of host the same way as parser saves it: site of platform from config.PlatformSuffixes or eTLD+1.
+// Host which is itself a public suffix of a platform (github.io, blogspot.com) has no eTLD+1, it is its own domain when
+// config.KeepPublicSuffixHosts is enabled. Host has to be in lowercase
+func RegistrableDomain(host string) (string, bool) {
+	domain, _ := lookupDomain(host)
+	return domain, domain != ""
+}
+
+// hostKind - why host has or has no registrable domain
+type hostKind int
+
+const (
+	domainHost       hostKind = iota // host of eTLD+1 or of platform site
+	invalidHost                      // host without dot or with labels which are not a domain
+	publicSuffixHost                 // host which is itself a public suffix, only private suffixes can be kept as domain
+)
+
+// lookupDomain - registrable domain of host and kind of host, domain is empty for hosts without registrable domain
+func lookupDomain(host string) (string, hostKind) {
+	if domain, ok := platformDomain(host); ok {
+		return domain, domainHost
+	}
+
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err == nil {
+		return domain, domainHost
+	}
+
+	suffix, icann := publicsuffix.PublicSuffix(host)
+	if suffix != host || !strings.Contains(host, ".") {
+		return "", invalidHost
+	}
+
+	// ICANN suffixes like co.uk are not sites, only private suffixes are run by platforms hosting sites of their users
+	if icann || !config.KeepPublicSuffixHosts {
+		return "", publicSuffixHost
+	}
+
+	return host, publicSuffixHost
+}
+
+// registrableDomain - RegistrableDomain of parsed host, every host without eTLD+1 is counted in domain failures
+func registrableDomain(host string) (string, bool) {
+	domain, kind := lookupDomain(host)
+	switch kind {
+	case invalidHost:
+		domainFailures.invalidHosts.Add(1)
+	case publicSuffixHost:
+		domainFailures.publicSuffixHosts.Add(1)
+		if domain != "" {
+			domainFailures.keptHosts.Add(1)
+		}
+	}
+
+	return domain, domain != ""
+}
+
+// platformDomain - site of platform from config.PlatformSuffixes, the first label under platform suffix is the site and labels before it are subdomain,
+// www.user.substack.com is subdomain www of user.substack.com. Host of platform itself is its own domain
+func platformDomain(host string) (string, bool) {
+	for _, suffix := range config.PlatformSuffixes {
+		if host == suffix {
+			return host, true
+		}
+		site, found := strings.CutSuffix(host, "."+suffix)
+		if !found {
+			continue
+		}
+		if i := strings.LastIndexByte(site, '.'); i >= 0 {
+			site = site[i+1:]
+		}
+		if site != "" {
+			return site + "." + suffix, true
+		}
+	}
+
+	return "", false
+}
+
+// GetDomainFailures - number of urls with host without eTLD+1 since start of the program
+func GetDomainFailures() DomainFailures {
+	return DomainFailures{
+		PublicSuffixHosts: domainFailures.publicSuffixHosts.Load(),
+		KeptHosts:         domainFailures.keptHosts.Load(),
+		InvalidHosts:      domainFailures.invalidHosts.Load(),
+	}
+}
+
+// GetDomainCacheLookups - domain cache lookups since start of the program. The cache is shared by parsing threads,
+// so lookups are counted for the whole run, not for single files
+func GetDomainCacheLookups() DomainCacheLookups {
+	return DomainCacheLookups{Hits: domainCacheStats.hits.Load(), Misses: domainCacheStats.misses.Load()}
+}
+
+// normalizePath - optionally remove default document and trailing slash from path, root path is always kept as /
+func normalizePath(path string) string {
+	if config.CleanPathSegments {
+		path = cleanPathSegments(path)
+	}
+
+	if config.StripDefaultDocuments {
+		lastSlash := strings.LastIndex(path, "/")
+		for _, document := range config.DefaultDocuments {
+			if strings.EqualFold(path[lastSlash+1:], document) {
+				path = path[:lastSlash+1]
+				break
+			}
+		}
+	}
+
+	if config.FoldTrailingSlash && len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+		if path == "" {
+			path = "/"
+		}
+	}
+
+	return path
+}
+
+// cleanPathSegments - collapse duplicate slashes and resolve . and .. segments, /a//b/../c becomes /a/c.
+// Trailing slash is kept, also for path ending with . or .. segment, so it is removed only by FoldTrailingSlash
+func cleanPathSegments(urlPath string) string {
+	cleaned := path.Clean(urlPath)
+	if cleaned != "/" && (strings.HasSuffix(urlPath, "/") || strings.HasSuffix(urlPath, "/.") || strings.HasSuffix(urlPath, "/..")) {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// NormalizeQuery - query of url the same way as it is saved in link and page files, used to find saved links by url
+func NormalizeQuery(rawQuery string) string {
+	// ignore all queries, query starting with ignored string or only its tracking parameters
+	switch {
+	case config.DropQueryStrings:
+		rawQuery = ""
+	case config.StripIgnoredQueryParams:
+		rawQuery = stripIgnoredQueryParams(rawQuery)
+	case ignoreQuery(rawQuery):
+		rawQuery = ""
+	}
+
+	if config.SortQueryParams {
+		rawQuery = sortQueryParams(rawQuery)
+	}
+
+	// field separator in query is saved percent-encoded, it is the same url
+	return escapeSeparator(rawQuery)
+}
+
+// escapeSeparator - percent-encode field separator in query or fragment of url, encoded url points to the same page
+func escapeSeparator(part string) string {
+	return strings.ReplaceAll(part, "|", "%7C")
+}
+
+// linkPathWithFragment - return link path with fragment when fragment is part of link identity
+func linkPathWithFragment(link *URLRecord) string {
+	if config.KeepFragment && link.Fragment != "" {
+		return link.Path + "#" + link.Fragment
+	}
+	return link.Path
+}
+
 // Function to convert a slice of domains to a map for fast lookup
 func createDomainMap(domains []string) map[string]bool {
 	domainMap := make(map[string]bool, len(domains))
@@ -732,6 +1697,44 @@ func ignoreQuery(query string) bool {
 	return false
 }
 
+// stripIgnoredQueryParams - remove query parameters starting with ignored strings, encode remaining parameters sorted by key
+func stripIgnoredQueryParams(query string) string {
+	if query == "" {
+		return query
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		// broken query can't be encoded again, fall back to ignoring whole query
+		if ignoreQuery(query) {
+			return ""
+		}
+		return query
+	}
+
+	for key := range values {
+		if ignoreQuery(key) {
+			delete(values, key)
+		}
+	}
+
+	return values.Encode()
+}
+
+// sortQueryParams - encode query parameters sorted by key, broken query is returned unchanged
+func sortQueryParams(query string) string {
+	if query == "" {
+		return query
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return query
+	}
+
+	return values.Encode()
+}
+
 // verifyContentQuality - verify if page is valid, noindex, nofollow, canonical, etc.
 func verifyContentQuality(parsedJSON *gjson.Result, watPage *WatPage) bool {
 	/* TODO: I might consider ignoring only noindex nofollow pages
@@ -748,39 +1751,30 @@ func verifyContentQuality(parsedJSON *gjson.Result, watPage *WatPage) bool {
 	}
 
 	// ignore pages with canonical link pointing to other page
-	if !checkPageCanonicalLink(parsedJSON, watPage) {
+	if config.CanonicalFilter != config.CanonicalOff && !checkPageCanonicalLink(parsedJSON, watPage) {
 		return false
 	}
 	return true
 }
 
-// checkPageCanonicalLink - check if page has canonical link and if it is pointing to the same page and for other potential issues connected with it
+// checkPageCanonicalLink - check if page has canonical link and if it is pointing to the same page and for other potential issues connected with it.
+// With lenient config.CanonicalFilter only canonical link to other host rejects the page
 func checkPageCanonicalLink(parsedJSON *gjson.Result, watPage *WatPage) bool {
-	type HeadLinkData struct {
-		Path string `json:"path"`
-		URL  string `json:"url"`
-		Rel  string `json:"rel"`
-		Type string `json:"type"`
-	}
-
-	var links []HeadLinkData
+	lenient := config.CanonicalFilter == config.CanonicalLenient
 
-	headLinksData := parsedJSON.Get("Envelope.Payload-Metadata.HTTP-Response-Metadata.HTML-Metadata.Head.Link").String()
-	if len(headLinksData) > 0 {
-
-		err := jsoniter.Unmarshal([]byte(headLinksData), &links)
-		if err != nil {
-			return false
-		}
+	links, err := readHeadLinks(parsedJSON, watSchemaOrDefault(watPage.schema))
+	if err != nil {
+		return lenient
+	}
 
+	if len(links) > 0 {
 		for _, link := range links {
 			if link.Rel == "canonical" && link.URL != "" {
 				// parse canonical url
 				parsedURL, err := url.Parse(link.URL)
 				if err != nil {
-					// ignore the page if it has broken canonical link
-					// TODO: I might rethink this. Need to check this on more real data
-					return false
+					// ignore the page if it has broken canonical link, lenient mode keeps it because its host is not known
+					return lenient
 				}
 
 				// ignore pages with canonical pointing to other host and then analyze only path
@@ -794,10 +1788,16 @@ func checkPageCanonicalLink(parsedJSON *gjson.Result, watPage *WatPage) bool {
 					link.URL = parsedURL.Path
 				}
 
-				// standardize / path
+				// other path or query of the same host is kept in lenient mode
+				if lenient {
+					continue
+				}
+
+				// standardize / path and normalize it the same way as page path
 				if link.URL == "" {
 					link.URL = "/"
 				}
+				link.URL = normalizePath(link.URL)
 
 				// ignore pages with canonical pointing to other path
 				if link.URL != watPage.URLRecord.Path {
@@ -817,6 +1817,21 @@ func checkPageCanonicalLink(parsedJSON *gjson.Result, watPage *WatPage) bool {
 	return true
 }
 
+// readHeadLinks - read <link> elements from page head
+func readHeadLinks(parsedJSON *gjson.Result, schema *watSchema) ([]HeadLinkData, error) {
+	var links []HeadLinkData
+
+	headLinksData := parsedJSON.Get(schema.HeadLink).String()
+	if len(headLinksData) > 0 {
+		err := jsoniter.Unmarshal([]byte(headLinksData), &links)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return links, nil
+}
+
 // setScheme - set scheme to 0, 1 or 2 depending on http, https or other
 func setScheme(scheme string) string {
 	if scheme == "https" {
@@ -828,6 +1843,19 @@ func setScheme(scheme string) string {
 	return "0"
 }
 
+// resolveLinkScheme - protocol relative link (//host/path) gets scheme of the page, returns false when link with other scheme than http or https
+// should be dropped because of config.DropUnknownSchemeLinks
+func resolveLinkScheme(linkURL string, urlRecord *URLRecord, sourceURLRecord *URLRecord) bool {
+	if urlRecord.Scheme != "0" {
+		return true
+	}
+	if strings.HasPrefix(linkURL, "//") && sourceURLRecord.Scheme != "0" {
+		urlRecord.Scheme = sourceURLRecord.Scheme
+		return true
+	}
+	return !config.DropUnknownSchemeLinks
+}
+
 // ExtractWatFileNumber extracts the number before the .warc.wat.gz extension.
 func ExtractWatFileNumber(filename string) (string, error) {
 	// This regex pattern looks for any digits followed by '.warc.wat.gz' at the end of the string.
@@ -845,7 +1873,7 @@ func ExtractWatFileNumber(filename string) (string, error) {
 	return numberStr, nil
 }
 
-// savePageFile - save pages info to file
+// savePageFile - save pages info to file sorted by host, path and query, so the same pages always give the same file
 func savePageFile(pageFile string, pageMap map[string]FilePage) error {
 	fileOutPage, err := os.OpenFile(pageFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o666)
 	if err != nil {
@@ -855,18 +1883,20 @@ func savePageFile(pageFile string, pageMap map[string]FilePage) error {
 	defer fileOutPage.Close()
 	writerPage := gzip.NewWriter(fileOutPage)
 
-	for _, content := range pageMap {
-		_, err = writerPage.Write([]byte(fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s|%s|%s|%s\n",
+	for _, key := range sortFilePage(pageMap) {
+		content := pageMap[key]
+		_, err = writerPage.Write([]byte(fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s\n",
 			content.Host,
 			content.Path,
 			content.RawQuery,
 			content.Scheme,
-			content.Title,
+			EncodeTextField(content.Title),
 			content.IP,
 			content.Imported,
 			strconv.Itoa(content.InternalLinks),
 			strconv.Itoa(content.ExternalLinks),
 			strconv.Itoa(content.NoIndex),
+			content.Language,
 		)))
 		if err != nil {
 			return err
@@ -883,7 +1913,7 @@ func savePageFile(pageFile string, pageMap map[string]FilePage) error {
 
 // saveLinkFile - save links info to file
 func saveLinkFile(linkFile string, linkMap map[string]FileLink, pageMap map[string]FilePage) error {
-	sortableFileLinkSlice := sortFileLink(linkMap)
+	sortableFileLinkSlice := sortFileLink(linkMap, pageMap)
 
 	// Open the file for writing, create it if not exists, append to it if it does.
 	fileOut, err := os.OpenFile(linkFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o666)
@@ -899,22 +1929,7 @@ func saveLinkFile(linkFile string, linkMap map[string]FileLink, pageMap map[stri
 
 		page := pageMap[content.PageHash]
 
-		_, err = writer.Write([]byte(fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%d|%d|%s|%s\n",
-			content.LinkDomain,
-			content.LinkSubDomain,
-			content.LinkPath,
-			content.LinkRawQuery,
-			content.LinkScheme,
-			page.Host,
-			page.Path,
-			page.RawQuery,
-			page.Scheme,
-			content.LinkText,
-			content.NoFollow,
-			page.NoIndex,
-			page.Imported,
-			page.IP,
-		)))
+		_, err = writer.Write([]byte(EncodeLink(content, page)))
 		if err != nil {
 			return err
 		}
@@ -930,26 +1945,117 @@ func saveLinkFile(linkFile string, linkMap map[string]FileLink, pageMap map[stri
 	return nil
 }
 
-// sortFileLink - sort link map by domain, subdomain and path
-func sortFileLink(linkMap map[string]FileLink) []SortFileLinkByFields {
+// EncodeLink - encode link found on page as line of link file, noindex field is noindex of source page
+func EncodeLink(link FileLink, page FilePage) string {
+	pageTitle := ""
+	if config.SavePageTitle {
+		pageTitle = strings.Join(strings.Fields(page.Title), " ")
+	}
+
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%d|%d|%s|%s|%s|%s%s\n",
+		link.LinkDomain,
+		link.LinkSubDomain,
+		link.LinkPath,
+		link.LinkRawQuery,
+		link.LinkScheme,
+		page.Host,
+		page.Path,
+		page.RawQuery,
+		page.Scheme,
+		EncodeTextField(link.LinkText),
+		link.NoFollow,
+		page.NoIndex,
+		page.Imported,
+		page.IP,
+		link.LinkType,
+		EncodeTextField(link.LinkTitle),
+		pageTitleField(pageTitle),
+	)
+}
+
+// sortFileLink - sort link map by link fields, source page fields and key. Fields are compared the same way as lines of link file,
+// so links are in order of line prefix, the same links give the same file and files can be merged without sorting them again
+func sortFileLink(linkMap map[string]FileLink, pageMap map[string]FilePage) []SortFileLinkByFields {
 	var sortableSlice []SortFileLinkByFields
 	for key, value := range linkMap {
-		sortableSlice = append(sortableSlice, SortFileLinkByFields{Key: key, Domain: value.LinkDomain, Subdomain: value.LinkSubDomain, Path: value.LinkPath})
+		page := pageMap[value.PageHash]
+		sortableSlice = append(sortableSlice, SortFileLinkByFields{
+			Key:       key,
+			Domain:    value.LinkDomain,
+			Subdomain: value.LinkSubDomain,
+			Path:      value.LinkPath,
+			Query:     value.LinkRawQuery,
+			Scheme:    value.LinkScheme,
+			PageHost:  page.Host,
+			PagePath:  page.Path,
+			PageQuery: page.RawQuery,
+		})
 	}
 
 	sort.Slice(sortableSlice, func(i, j int) bool {
-		if sortableSlice[i].Domain == sortableSlice[j].Domain {
-			if sortableSlice[i].Subdomain == sortableSlice[j].Subdomain {
-				return sortableSlice[i].Path < sortableSlice[j].Path
+		a, b := &sortableSlice[i], &sortableSlice[j]
+		for _, fields := range [...][2]string{
+			{a.Domain, b.Domain},
+			{a.Subdomain, b.Subdomain},
+			{a.Path, b.Path},
+			{a.Query, b.Query},
+			{a.Scheme, b.Scheme},
+			{a.PageHost, b.PageHost},
+			{a.PagePath, b.PagePath},
+			{a.PageQuery, b.PageQuery},
+		} {
+			if c := CompareLineField(fields[0], fields[1]); c != 0 {
+				return c < 0
 			}
-			return sortableSlice[i].Subdomain < sortableSlice[j].Subdomain
 		}
-		return sortableSlice[i].Domain < sortableSlice[j].Domain
+		// links with all fields equal are ordered by unique key, so map order does not change the file
+		return a.Key < b.Key
 	})
 
 	return sortableSlice
 }
 
+// CompareLineField - compare fields of link file line the way whole lines are compared, field is followed by |,
+// so "a.com" is sorted after "a.com.au" like "a.com|" after "a.com.au|"
+func CompareLineField(a string, b string) int {
+	n := min(len(a), len(b))
+	if c := strings.Compare(a[:n], b[:n]); c != 0 {
+		return c
+	}
+	switch {
+	case len(a) == len(b):
+		return 0
+	case len(a) < len(b):
+		return cmp.Compare(byte('|'), b[n])
+	default:
+		return cmp.Compare(a[n], byte('|'))
+	}
+}
+
+// sortFilePage - keys of page map sorted by host, path, query and key
+func sortFilePage(pageMap map[string]FilePage) []string {
+	keys := make([]string, 0, len(pageMap))
+	for key := range pageMap {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		pageI, pageJ := pageMap[keys[i]], pageMap[keys[j]]
+		if pageI.Host != pageJ.Host {
+			return pageI.Host < pageJ.Host
+		}
+		if pageI.Path != pageJ.Path {
+			return pageI.Path < pageJ.Path
+		}
+		if pageI.RawQuery != pageJ.RawQuery {
+			return pageI.RawQuery < pageJ.RawQuery
+		}
+		return keys[i] < keys[j]
+	})
+
+	return keys
+}
+
 // genSubdomain - generate subdomain from host and domain
 func genSubdomain(urlRecord *URLRecord) string {
 	var subDomain string
@@ -1050,10 +2156,9 @@ func UpdateSegmentImportEnd(segmentList *[]WatSegment, segmentName string) error
 }
 
 // ValidateSegmentImportEndAtStart - validate segment import status
-func ValidateSegmentImportEndAtStart(segmentList *[]WatSegment, dataDir DataDir, extensionTxtGz string) {
+func ValidateSegmentImportEndAtStart(segmentList *[]WatSegment, dataDir DataDir) {
 	for i, segment := range *segmentList {
-		linkSegmentSorted := dataDir.LinksDir + "/sort_" + strconv.Itoa(segment.SegmentID) + extensionTxtGz
-		if fileutils.FileExists(linkSegmentSorted) {
+		if fileutils.FileExists(dataDir.SortedLinksFile(segment)) {
 			fmt.Println("!!!Segment " + segment.Segment + " already imported!!!")
 			now := time.Now()
 			(*segmentList)[i].ImportEnded = &now
@@ -0,0 +1,170 @@
+package commoncrawl
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/dgryski/go-farm"
+	"github.com/kris-dev-hub/globallinks/pkg/config"
+)
+
+// benchmarkWatPages - build representative pages: external links with and without query, nofollow links, internal links,
+// links to ignored domains and files
+func benchmarkWatPages(pagesQty int) []testWatPage {
+	pages := make([]testWatPage, 0, pagesQty)
+	for i := 0; i < pagesQty; i++ {
+		page := testWatPage{URL: "https://www.site" + strconv.Itoa(i%50) + ".com/articles/" + strconv.Itoa(i) + "/"}
+		for j := 0; j < 40; j++ {
+			number := strconv.Itoa(j)
+			switch j % 8 {
+			case 0:
+				page.Links = append(page.Links, testWatLink{URL: "/internal/" + number, Text: "Internal"})
+			case 1:
+				page.Links = append(page.Links, testWatLink{URL: "https://www.facebook.com/share?u=" + number, Text: "Share"})
+			case 2:
+				page.Links = append(page.Links, testWatLink{URL: "https://cdn.files" + number + ".net/doc.pdf", Text: "Download"})
+			case 3:
+				page.Links = append(page.Links, testWatLink{URL: "https://blog.partner" + number + ".org/post?id=" + number + "&utm_source=site", Text: "Partner post", Rel: "nofollow"})
+			default:
+				page.Links = append(page.Links, testWatLink{URL: "https://shop" + strconv.Itoa(i%200) + ".co.uk/category/item-" + number, Text: "Item " + number})
+			}
+		}
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+func BenchmarkParseWatByLine(b *testing.B) {
+	tempDir := b.TempDir()
+	watFile := filepath.Join(tempDir, "bench.warc.wat.gz")
+	linkFile := filepath.Join(tempDir, "link.txt.gz")
+	pageFile := filepath.Join(tempDir, "page.txt.gz")
+	writeTestWatFile(b, watFile, benchmarkWatPages(2000))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := ParseWatByLine(watFile, linkFile, pageFile, true)
+		if err != nil {
+			b.Fatalf("ParseWatByLine() error = %v", err)
+		}
+
+		b.StopTimer()
+		os.Remove(linkFile)
+		os.Remove(pageFile)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkBuildURLRecord(b *testing.B) {
+	urls := []string{
+		"https://www.example.com/path/to/page?id=5&utm_source=feed",
+		"http://blog.example.co.uk/2023/02/post-title/",
+		"https://shop.example.org/category/item-15#reviews",
+		"//cdn.example.net/assets/main",
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		urlRecord := URLRecord{}
+		buildURLRecord(urls[i%len(urls)], &urlRecord, nil)
+	}
+}
+
+// BenchmarkBuildURLRecordDistinctHosts - every url has new host, like link farm pages, cache size and memory stay bounded
+func BenchmarkBuildURLRecordDistinctHosts(b *testing.B) {
+	defaultSize := config.DomainCacheSize
+	defer func() {
+		config.DomainCacheSize = defaultSize
+		resetDomainCache()
+	}()
+	config.DomainCacheSize = 10000
+	resetDomainCache()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		urlRecord := URLRecord{}
+		buildURLRecord("https://host-"+strconv.Itoa(i)+".example.com/page", &urlRecord, nil)
+	}
+	b.StopTimer()
+
+	cachedHosts := domainCache.Load().len()
+	if cachedHosts > config.DomainCacheSize {
+		b.Fatalf("domain cache has %d hosts, want at most %d", cachedHosts, config.DomainCacheSize)
+	}
+	b.ReportMetric(float64(cachedHosts), "cached_hosts")
+}
+
+func BenchmarkParseLinks(b *testing.B) {
+	page := benchmarkWatPages(1)[0]
+	links := make([]map[string]string, 0, len(page.Links))
+	for _, link := range page.Links {
+		links = append(links, map[string]string{"path": "A@/href", "url": link.URL, "text": link.Text, "rel": link.Rel})
+	}
+	linksData, err := json.Marshal(links)
+	if err != nil {
+		b.Fatalf("Failed to marshal links: %v", err)
+	}
+
+	sourceURLRecord := URLRecord{}
+	buildURLRecord(page.URL, &sourceURLRecord, nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, _, err = parseLinks(string(linksData), &sourceURLRecord, 0, nil)
+		if err != nil {
+			b.Fatalf("parseLinks() error = %v", err)
+		}
+	}
+}
+
+var benchmarkHashParts = []string{"blog.partner.org", "/post/2023/02/title", "id=5", "www.source.com", "/articles/15/", ""}
+
+func BenchmarkRecordHasher(b *testing.B) {
+	hasher := newRecordHasher()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		hasher.hash(benchmarkHashParts...)
+	}
+}
+
+// BenchmarkSprintfHash - previous way of building hashes, kept to compare allocations with BenchmarkRecordHasher
+func BenchmarkSprintfHash(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = fmt.Sprintf("%x", farm.Hash64([]byte(benchmarkHashParts[0]+benchmarkHashParts[1]+benchmarkHashParts[2]+benchmarkHashParts[3]+benchmarkHashParts[4]+benchmarkHashParts[5])))
+	}
+}
+
+// BenchmarkCachedDomainParallel - lookups of cached hosts from many parsing threads at once
+func BenchmarkCachedDomainParallel(b *testing.B) {
+	resetDomainCache()
+	defer resetDomainCache()
+
+	hosts := make([]string, 1000)
+	for i := range hosts {
+		hosts[i] = "www.host-" + strconv.Itoa(i) + ".example.com"
+		cacheDomain(hosts[i], "example.com")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, ok := cachedDomain(hosts[i%len(hosts)]); !ok {
+				b.Errorf("cachedDomain(%s) not found", hosts[i%len(hosts)])
+				return
+			}
+			i++
+		}
+	})
+}
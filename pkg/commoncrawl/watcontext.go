@@ -0,0 +1,45 @@
+package commoncrawl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// ErrWatParseTimeout - parsing of WAT file took longer than its timeout, the file is probably malformed
+var ErrWatParseTimeout = errors.New("WAT file parse timed out")
+
+// contextReader - reader returning error of ctx as soon as ctx is done, so scanning of slow or stuck file stops between reads
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+// newContextReader - wrap reader to stop reading when ctx is done
+func newContextReader(ctx context.Context, reader io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		// context can not be done, e.g. context.Background
+		return reader
+	}
+	return &contextReader{ctx: ctx, reader: reader}
+}
+
+// Read - read from wrapped reader unless ctx is done
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// parseStopped - log WAT file abandoned because ctx is done and return error of it, exceeded deadline is returned as ErrWatParseTimeout
+func parseStopped(filePath string, ctxErr error) error {
+	if errors.Is(ctxErr, context.DeadlineExceeded) {
+		log.Printf("Parsing of WAT file %s timed out, file is abandoned", filePath)
+		return fmt.Errorf("%w: %s", ErrWatParseTimeout, filePath)
+	}
+	log.Printf("Parsing of WAT file %s stopped: %v", filePath, ctxErr)
+	return fmt.Errorf("parsing of %s stopped: %w", filePath, ctxErr)
+}
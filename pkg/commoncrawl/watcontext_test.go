@@ -0,0 +1,108 @@
+package commoncrawl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// slowReader - returns a few bytes per read with delay, like a stuck or pathological WAT file
+type slowReader struct {
+	reader io.Reader
+	delay  time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.reader.Read(p[:min(len(p), 16)])
+}
+
+func TestScanWatRecordsSlowReaderTimeout(t *testing.T) {
+	fixtures := make([]WatFixture, 0, 50)
+	for i := 0; i < 50; i++ {
+		fixtures = append(fixtures, WatFixture{URL: fmt.Sprintf("https://blog.net/post%d", i), IP: "1.2.3.4", Date: testFixtureDate, HTML: `<a href="https://example.com/a">A</a>`})
+	}
+	var wat bytes.Buffer
+	if err := WriteWatRecords(&wat, fixtures); err != nil {
+		t.Fatalf("WriteWatRecords() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	pages := 0
+	reader := newContextReader(ctx, &slowReader{reader: &wat, delay: time.Millisecond})
+	_, err := scanWatRecords(reader, make([]byte, maxCapacityScanner), false, func(content *WatPage) error {
+		pages++
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("scanWatRecords() error = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("scanWatRecords() stopped after %v, want soon after timeout", elapsed)
+	}
+	if pages == len(fixtures) {
+		t.Errorf("scanWatRecords() read all %d pages, want scan stopped by timeout", pages)
+	}
+}
+
+func TestParseWatFileContextTimeout(t *testing.T) {
+	tempDir := t.TempDir()
+	watFile := filepath.Join(tempDir, "slow.warc.wat.gz")
+	err := WriteWatFile(watFile, []WatFixture{{URL: "https://blog.net/", IP: "1.2.3.4", Date: testFixtureDate, HTML: `<a href="https://example.com/a">A</a>`}})
+	if err != nil {
+		t.Fatalf("WriteWatFile() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		ctx     func() (context.Context, context.CancelFunc)
+		wantErr error
+	}{
+		{"no timeout", func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) }, nil},
+		{"timed out", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), -time.Second)
+		}, ErrWatParseTimeout},
+		{"canceled", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx, cancel
+		}, context.Canceled},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			linkFile := filepath.Join(tempDir, fmt.Sprintf("links_%d.txt.gz", i))
+			emitted := 0
+			emit := func(link FileLink, page FilePage) error {
+				emitted++
+				return nil
+			}
+
+			stats, err := ParseWatFileContext(ctx, watFile, linkFile, "", false, emit)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseWatFileContext() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil {
+				if stats.Links != 1 || emitted != 1 {
+					t.Errorf("ParseWatFileContext() = %+v, emitted %d, want 1 link", stats, emitted)
+				}
+				return
+			}
+			// abandoned file does not emit links and save link file
+			if _, err := os.Stat(linkFile); !os.IsNotExist(err) || emitted != 0 {
+				t.Errorf("abandoned file saved link file or emitted %d links", emitted)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package commoncrawl
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/klauspost/compress/gzip"
+	"golang.org/x/net/html"
+)
+
+// WatFixture - small HTML page with crawl metadata, used to build WAT records without real Common Crawl files
+type WatFixture struct {
+	URL  string
+	IP   string
+	Date time.Time
+	HTML string
+}
+
+// watRecord - subset of Common Crawl WAT record used by the parser
+type watRecord struct {
+	Envelope watEnvelope `json:"Envelope"`
+}
+
+type watEnvelope struct {
+	Format             string             `json:"Format"`
+	WARCHeaderMetadata watHeaderMetadata  `json:"WARC-Header-Metadata"`
+	PayloadMetadata    watPayloadMetadata `json:"Payload-Metadata"`
+}
+
+type watHeaderMetadata struct {
+	WARCType      string `json:"WARC-Type"`
+	WARCTargetURI string `json:"WARC-Target-URI"`
+	WARCDate      string `json:"WARC-Date"`
+	WARCIPAddress string `json:"WARC-IP-Address"`
+}
+
+type watPayloadMetadata struct {
+	ActualContentType    string                  `json:"Actual-Content-Type"`
+	HTTPResponseMetadata watHTTPResponseMetadata `json:"HTTP-Response-Metadata"`
+}
+
+type watHTTPResponseMetadata struct {
+	ResponseMessage watResponseMessage `json:"Response-Message"`
+	HTMLMetadata    watHTMLMetadata    `json:"HTML-Metadata"`
+}
+
+type watResponseMessage struct {
+	Version string `json:"Version"`
+	Status  string `json:"Status"`
+	Reason  string `json:"Reason"`
+}
+
+type watHTMLMetadata struct {
+	Head  watHead   `json:"Head"`
+	Links []watLink `json:"Links,omitempty"`
+}
+
+type watHead struct {
+	Lang  string         `json:"Lang,omitempty"`
+	Title string         `json:"Title,omitempty"`
+	Metas []watMeta      `json:"Metas,omitempty"`
+	Link  []HeadLinkData `json:"Link,omitempty"`
+}
+
+type watMeta struct {
+	Name      string `json:"name,omitempty"`
+	Property  string `json:"property,omitempty"`
+	HTTPEquiv string `json:"http-equiv,omitempty"`
+	Content   string `json:"content"`
+}
+
+type watLink struct {
+	Path  string `json:"path"`
+	URL   string `json:"url"`
+	Text  string `json:"text,omitempty"`
+	Title string `json:"title,omitempty"`
+	Rel   string `json:"rel,omitempty"`
+}
+
+// BuildWatRecord - build WAT JSON line for HTML page in the same shape as Common Crawl metadata records
+func BuildWatRecord(fixture WatFixture) (string, error) {
+	doc, err := html.Parse(strings.NewReader(fixture.HTML))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse html of %s: %w", fixture.URL, err)
+	}
+
+	record := watRecord{Envelope: watEnvelope{
+		Format: "WARC",
+		WARCHeaderMetadata: watHeaderMetadata{
+			WARCType:      "response",
+			WARCTargetURI: fixture.URL,
+			WARCDate:      fixture.Date.UTC().Format("2006-01-02T15:04:05Z"),
+			WARCIPAddress: fixture.IP,
+		},
+		PayloadMetadata: watPayloadMetadata{
+			ActualContentType: "application/http; msgtype=response",
+			HTTPResponseMetadata: watHTTPResponseMetadata{
+				ResponseMessage: watResponseMessage{Version: "HTTP/1.1", Status: "200", Reason: "OK"},
+			},
+		},
+	}}
+
+	metadata := &record.Envelope.PayloadMetadata.HTTPResponseMetadata.HTMLMetadata
+	readHTMLNode(doc, metadata)
+
+	jsonRecord, err := jsoniter.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("failed to build WAT record of %s: %w", fixture.URL, err)
+	}
+
+	return string(jsonRecord), nil
+}
+
+// readHTMLNode - collect language, title, meta tags, head links and anchors the way Common Crawl does for WAT files
+func readHTMLNode(node *html.Node, metadata *watHTMLMetadata) {
+	if node.Type == html.ElementNode {
+		switch node.Data {
+		case "html":
+			metadata.Head.Lang = htmlAttr(node, "lang")
+		case "title":
+			metadata.Head.Title = strings.TrimSpace(nodeText(node))
+		case "meta":
+			meta := watMeta{Name: htmlAttr(node, "name"), Property: htmlAttr(node, "property"), HTTPEquiv: htmlAttr(node, "http-equiv"), Content: htmlAttr(node, "content")}
+			if meta.Name != "" || meta.Property != "" || meta.HTTPEquiv != "" {
+				metadata.Head.Metas = append(metadata.Head.Metas, meta)
+			}
+		case "link":
+			if href := htmlAttr(node, "href"); href != "" {
+				metadata.Head.Link = append(metadata.Head.Link, HeadLinkData{Path: "LINK@/href", URL: href, Rel: htmlAttr(node, "rel"), Type: htmlAttr(node, "type")})
+			}
+		case "a":
+			if href := htmlAttr(node, "href"); href != "" {
+				metadata.Links = append(metadata.Links, watLink{Path: "A@/href", URL: href, Text: strings.TrimSpace(nodeText(node)), Title: htmlAttr(node, "title"), Rel: htmlAttr(node, "rel")})
+			}
+		}
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		readHTMLNode(child, metadata)
+	}
+}
+
+// htmlAttr - value of attribute or empty string
+func htmlAttr(node *html.Node, name string) string {
+	for _, attr := range node.Attr {
+		if attr.Key == name {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// nodeText - text of node and all its children
+func nodeText(node *html.Node) string {
+	if node.Type == html.TextNode {
+		return node.Data
+	}
+
+	var text strings.Builder
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		text.WriteString(nodeText(child))
+	}
+	return text.String()
+}
+
+// WriteWatRecords - write WARC metadata record with WAT JSON for every fixture
+func WriteWatRecords(w io.Writer, fixtures []WatFixture) error {
+	for _, fixture := range fixtures {
+		record, err := BuildWatRecord(fixture)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "WARC/1.0\r\nWARC-Type: metadata\r\nWARC-Target-URI: %s\r\nWARC-Date: %s\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s\r\n\r\n",
+			fixture.URL, fixture.Date.UTC().Format("2006-01-02T15:04:05Z"), len(record), record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteWatFile - write gzipped WAT file built from fixtures, file can be parsed with ParseWatByLine
+func WriteWatFile(filePath string, fixtures []WatFixture) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := gzip.NewWriter(file)
+	err = WriteWatRecords(writer, fixtures)
+	if err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
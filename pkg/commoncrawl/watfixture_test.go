@@ -0,0 +1,325 @@
+package commoncrawl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+	"github.com/tidwall/gjson"
+)
+
+var testFixtureDate = time.Date(2023, 2, 4, 10, 0, 0, 0, time.UTC)
+
+func TestBuildWatRecord(t *testing.T) {
+	fixture := WatFixture{
+		URL:  "https://example.com/blog",
+		IP:   "1.2.3.4",
+		Date: testFixtureDate,
+		HTML: `<html><head><title> Blog </title><meta name="robots" content="noindex"><meta property="og:title" content="Blog">` +
+			`<link rel="alternate" type="application/rss+xml" href="https://example.com/feed"></head>` +
+			`<body><a href="https://other.com/page" rel="nofollow">Other <b>page</b></a><a href="#top">Top</a><a>No href</a></body></html>`,
+	}
+
+	record, err := BuildWatRecord(fixture)
+	if err != nil {
+		t.Fatalf("BuildWatRecord() error = %v", err)
+	}
+	if strings.Contains(record, "\n") {
+		t.Errorf("BuildWatRecord() record is not one line: %s", record)
+	}
+
+	parsedJSON := gjson.Parse(record)
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"Envelope.WARC-Header-Metadata.WARC-Target-URI", "https://example.com/blog"},
+		{"Envelope.WARC-Header-Metadata.WARC-IP-Address", "1.2.3.4"},
+		{"Envelope.WARC-Header-Metadata.WARC-Date", "2023-02-04T10:00:00Z"},
+		{"Envelope.Payload-Metadata.HTTP-Response-Metadata.HTML-Metadata.Head.Title", "Blog"},
+		{"Envelope.Payload-Metadata.HTTP-Response-Metadata.HTML-Metadata.Head.Metas.0.name", "robots"},
+		{"Envelope.Payload-Metadata.HTTP-Response-Metadata.HTML-Metadata.Head.Metas.1.property", "og:title"},
+		{"Envelope.Payload-Metadata.HTTP-Response-Metadata.HTML-Metadata.Head.Link.0.path", "LINK@/href"},
+		{"Envelope.Payload-Metadata.HTTP-Response-Metadata.HTML-Metadata.Head.Link.0.rel", "alternate"},
+		{"Envelope.Payload-Metadata.HTTP-Response-Metadata.HTML-Metadata.Links.0.path", "A@/href"},
+		{"Envelope.Payload-Metadata.HTTP-Response-Metadata.HTML-Metadata.Links.0.text", "Other page"},
+		{"Envelope.Payload-Metadata.HTTP-Response-Metadata.HTML-Metadata.Links.0.rel", "nofollow"},
+		{"Envelope.Payload-Metadata.HTTP-Response-Metadata.HTML-Metadata.Links.1.url", "#top"},
+		{"Envelope.Payload-Metadata.HTTP-Response-Metadata.HTML-Metadata.Links.#", "2"},
+	}
+	for _, tt := range tests {
+		if got := parsedJSON.Get(tt.path).String(); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestBuildWatRecordReadPageContent(t *testing.T) {
+	record, err := BuildWatRecord(WatFixture{
+		URL:  "https://example.com/",
+		IP:   "1.2.3.4",
+		Date: testFixtureDate,
+		HTML: `<title>Home</title><meta name="robots" content="nofollow">` +
+			`<a href="/about">About</a><a href="https://www.example.com/contact">Contact</a><a href="https://other.com/">Other</a>`,
+	})
+	if err != nil {
+		t.Fatalf("BuildWatRecord() error = %v", err)
+	}
+
+	sourceURLRecord := URLRecord{}
+	buildURLRecord("https://example.com/", &sourceURLRecord, nil)
+	watPage := readPageContent(record, &sourceURLRecord, nil)
+	if watPage == nil {
+		t.Fatal("readPageContent() returned nil")
+	}
+
+	if *watPage.Title != "Home" || *watPage.IP != "1.2.3.4" || *watPage.Imported != "2023-02-04" || *watPage.NoIndex != 0 || *watPage.NoFollow != 1 {
+		t.Errorf("readPageContent() page = title %q, ip %q, imported %q, noindex %d, nofollow %d",
+			*watPage.Title, *watPage.IP, *watPage.Imported, *watPage.NoIndex, *watPage.NoFollow)
+	}
+	if watPage.InternalLinks != 1 || watPage.ExternalLinks != 2 {
+		t.Errorf("readPageContent() internal = %d, external = %d, want 1 and 2", watPage.InternalLinks, watPage.ExternalLinks)
+	}
+	if len(watPage.Links) != 1 || watPage.Links[0].Host != "other.com" || watPage.Links[0].NoFollow != 1 {
+		t.Errorf("readPageContent() links = %+v, want nofollow link to other.com", watPage.Links)
+	}
+}
+
+func TestWriteWatFile(t *testing.T) {
+	tempDir := t.TempDir()
+	watFile := filepath.Join(tempDir, "fixture.warc.wat.gz")
+	linkFile := filepath.Join(tempDir, "link.txt.gz")
+	pageFile := filepath.Join(tempDir, "page.txt.gz")
+
+	fixtures := []WatFixture{
+		{
+			URL:  "https://example.com/blog?p=1",
+			IP:   "1.2.3.4",
+			Date: testFixtureDate,
+			HTML: `<title>Blog | Example</title><a href="https://other.com/page" title="Other | page">Other page</a><a href="http://news.example.org/">News</a>`,
+		},
+		{
+			URL:  "http://example.net/",
+			IP:   "1.2.3.5",
+			Date: testFixtureDate,
+			HTML: `<title>Net</title><a href="https://other.com/page" rel="nofollow">Other</a>`,
+		},
+	}
+	if err := WriteWatFile(watFile, fixtures); err != nil {
+		t.Fatalf("WriteWatFile() error = %v", err)
+	}
+
+	stats, err := ParseWatFile(watFile, linkFile, pageFile, true)
+	if err != nil {
+		t.Fatalf("ParseWatFile() error = %v", err)
+	}
+	if stats.Pages != 2 || stats.Links != 3 {
+		t.Errorf("ParseWatFile() stats = %+v, want 2 pages and 3 links", stats)
+	}
+
+	links, err := fileutils.ReadGZFileByLine(linkFile)
+	if err != nil {
+		t.Fatalf("Failed to read link file: %v", err)
+	}
+	// links to the same url from different pages are saved in random order
+	slices.Sort(links)
+	wantLinks := []string{
+		"example.org|news|/||1|example.com|/blog|p=1|2|News|0|0|2023-02-04|1.2.3.4||",
+		"other.com||/page||2|example.com|/blog|p=1|2|Other page|0|0|2023-02-04|1.2.3.4||Other %7C page",
+		"other.com||/page||2|example.net|/||1|Other|1|0|2023-02-04|1.2.3.5||",
+	}
+	if !reflect.DeepEqual(links, wantLinks) {
+		t.Errorf("link file = %v, want %v", links, wantLinks)
+	}
+
+	pages, err := fileutils.ReadGZFileByLine(pageFile)
+	if err != nil {
+		t.Fatalf("Failed to read page file: %v", err)
+	}
+	if len(pages) != 2 {
+		t.Fatalf("page file has %d lines, want 2", len(pages))
+	}
+	for _, line := range pages {
+		page, err := DecodePage(line)
+		if err != nil {
+			t.Fatalf("DecodePage(%q) error = %v", line, err)
+		}
+		if page.Host == "example.com" && (page.Title != "Blog | Example" || page.ExternalLinks != 2) {
+			t.Errorf("page = %+v, want decoded title and 2 external links", page)
+		}
+	}
+}
+
+func TestParseWatRecord(t *testing.T) {
+	record := func(html string) string {
+		t.Helper()
+		jsonLine, err := BuildWatRecord(WatFixture{URL: "https://example.com/blog", IP: "1.2.3.4", Date: testFixtureDate, HTML: html})
+		if err != nil {
+			t.Fatalf("BuildWatRecord() error = %v", err)
+		}
+		return jsonLine
+	}
+	validRecord := record(`<title>Blog</title><a href="/about">About</a><a href="https://other.com/page" rel="nofollow">Other</a>`)
+
+	tests := []struct {
+		name          string
+		targetURILine string
+		jsonLine      string
+		wantErr       error
+		wantLinks     []string
+	}{
+		{"record header", "WARC-Target-URI: https://example.com/blog", validRecord, nil, []string{"other.com/page"}},
+		{"bare url", "https://example.com/blog", validRecord, nil, []string{"other.com/page"}},
+		{"invalid url", "WARC-Target-URI: https://localhost/blog", validRecord, ErrInvalidTargetURI, nil},
+		{"low quality url", "WARC-Target-URI: https://example.com/" + strings.Repeat("a/", 160), validRecord, ErrLowQualityTargetURI, nil},
+		{"noindex page", "https://example.com/blog", record(`<meta name="robots" content="noindex"><a href="https://other.com/">Other</a>`), ErrPageRejected, nil},
+		{"no links", "https://example.com/blog", record(`<title>Blog</title>`), ErrPageRejected, nil},
+		{"broken json", "https://example.com/blog", `{"Envelope":`, ErrPageRejected, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			watPage, err := ParseWatRecord(tt.targetURILine, tt.jsonLine)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseWatRecord() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if watPage != nil {
+					t.Errorf("ParseWatRecord() returned page with error")
+				}
+				return
+			}
+
+			if watPage.URLRecord.Host != "example.com" || watPage.URLRecord.Path != "/blog" || *watPage.Title != "Blog" || *watPage.IP != "1.2.3.4" {
+				t.Errorf("ParseWatRecord() page = %+v, title %q", watPage.URLRecord, *watPage.Title)
+			}
+			if watPage.InternalLinks != 1 || watPage.ExternalLinks != 1 {
+				t.Errorf("ParseWatRecord() internal = %d, external = %d, want 1 and 1", watPage.InternalLinks, watPage.ExternalLinks)
+			}
+			var links []string
+			for _, link := range watPage.Links {
+				links = append(links, link.Host+link.Path)
+			}
+			if !reflect.DeepEqual(links, tt.wantLinks) || watPage.Links[0].NoFollow != 1 {
+				t.Errorf("ParseWatRecord() links = %+v, want nofollow %v", watPage.Links, tt.wantLinks)
+			}
+		})
+	}
+}
+
+func TestParseWatStream(t *testing.T) {
+	tempDir := t.TempDir()
+	watFile := filepath.Join(tempDir, "fixture.warc.wat.gz")
+	linkFile := filepath.Join(tempDir, "link.txt.gz")
+
+	fixtures := []WatFixture{
+		{
+			URL:  "https://example.com/blog",
+			IP:   "1.2.3.4",
+			Date: testFixtureDate,
+			HTML: `<a href="https://other.com/page">First</a><a href="https://news.org/" rel="nofollow">News</a><a href="https://other.com/page">Last</a><a href="/about">About</a>`,
+		},
+		{
+			URL:  "http://example.net/",
+			IP:   "1.2.3.5",
+			Date: testFixtureDate,
+			HTML: `<a href="https://other.com/page">Other</a>`,
+		},
+		{
+			URL:  "https://example.org/",
+			IP:   "1.2.3.6",
+			Date: testFixtureDate,
+			HTML: `<a href="/internal">Internal only</a>`,
+		},
+	}
+	if err := WriteWatFile(watFile, fixtures); err != nil {
+		t.Fatalf("WriteWatFile() error = %v", err)
+	}
+
+	var streamed []string
+	stats, err := ParseWatStream(watFile, func(link FileLink, page FilePage) error {
+		streamed = append(streamed, strings.TrimSuffix(EncodeLink(link, page), "\n"))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ParseWatStream() error = %v", err)
+	}
+	if stats.Pages != 2 || stats.Links != 3 {
+		t.Errorf("ParseWatStream() stats = %+v, want 2 pages and 3 links", stats)
+	}
+
+	if _, err = ParseWatFile(watFile, linkFile, "", false); err != nil {
+		t.Fatalf("ParseWatFile() error = %v", err)
+	}
+	saved, err := fileutils.ReadGZFileByLine(linkFile)
+	if err != nil {
+		t.Fatalf("Failed to read link file: %v", err)
+	}
+
+	slices.Sort(streamed)
+	slices.Sort(saved)
+	if !reflect.DeepEqual(streamed, saved) {
+		t.Errorf("ParseWatStream() links =\n%v\nlink file =\n%v", streamed, saved)
+	}
+
+	// error from emitter stops parsing
+	emitted := 0
+	_, err = ParseWatStream(watFile, func(link FileLink, page FilePage) error {
+		emitted++
+		return errors.New("sink is down")
+	})
+	if err == nil || emitted != 1 {
+		t.Errorf("ParseWatStream() error = %v after %d links, want error after first link", err, emitted)
+	}
+}
+
+func TestParseWatFileWithEmitter(t *testing.T) {
+	tempDir := t.TempDir()
+	watFile := filepath.Join(tempDir, "emit.warc.wat.gz")
+	fixtures := make([]WatFixture, 0, 200)
+	for i := 0; i < 200; i++ {
+		fixtures = append(fixtures, WatFixture{URL: fmt.Sprintf("https://blog.net/post%d", i), IP: "1.2.3.4", Date: testFixtureDate, HTML: `<a href="https://example.com/a">A</a>`})
+	}
+	if err := WriteWatFile(watFile, fixtures); err != nil {
+		t.Fatalf("WriteWatFile() error = %v", err)
+	}
+
+	// broken file emits nothing, links of failed attempt are not published before the file is parsed again
+	data, err := os.ReadFile(watFile)
+	if err != nil {
+		t.Fatalf("Failed to read WAT file: %v", err)
+	}
+	brokenFile := filepath.Join(tempDir, "broken.warc.wat.gz")
+	if err = os.WriteFile(brokenFile, data[:len(data)/2], 0o644); err != nil {
+		t.Fatalf("Failed to write broken WAT file: %v", err)
+	}
+	emitted := 0
+	_, err = ParseWatFileWithEmitter(brokenFile, filepath.Join(tempDir, "broken_links.txt.gz"), "", false, func(link FileLink, page FilePage) error {
+		emitted++
+		return nil
+	})
+	if err == nil || emitted != 0 {
+		t.Errorf("ParseWatFileWithEmitter() of broken file error = %v, emitted %d links, want error and no links", err, emitted)
+	}
+
+	// failed emit is returned as ErrLinkEmit, link file is already saved
+	linkFile := filepath.Join(tempDir, "links.txt.gz")
+	emitted = 0
+	_, err = ParseWatFileWithEmitter(watFile, linkFile, "", false, func(link FileLink, page FilePage) error {
+		emitted++
+		return errors.New("sink is down")
+	})
+	if !errors.Is(err, ErrLinkEmit) || emitted != 1 {
+		t.Errorf("ParseWatFileWithEmitter() error = %v after %d links, want ErrLinkEmit after first link", err, emitted)
+	}
+	if lines, err := fileutils.ReadGZFileByLine(linkFile); err != nil || len(lines) != len(fixtures) {
+		t.Errorf("link file has %d lines, error = %v, want %d", len(lines), err, len(fixtures))
+	}
+}
@@ -0,0 +1,87 @@
+package commoncrawl
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+// watSchema - gjson paths of WAT record fields used by the parser. Common Crawl changed names of some keys between crawls,
+// every known variant has own schema and the schema of a record is detected by its envelope key
+type watSchema struct {
+	Name            string
+	Envelope        string
+	IP              string
+	Date            string
+	Links           string
+	HeadTitle       string
+	HeadMetas       string
+	HeadLink        string
+	HeadLang        string
+	ContentLanguage string
+
+	detected sync.Once
+}
+
+// watSchemas - known WAT schemas, the first one is used by current crawls and is checked first
+var watSchemas = []*watSchema{
+	newWatSchema("standard", func(key string) string { return key }),
+	newWatSchema("lowercase keys", strings.ToLower),
+}
+
+// unknownWatSchema - logged once when record does not match any known schema
+var unknownWatSchema sync.Once
+
+// newWatSchema - schema with keys of the standard schema changed by key, for example to lower case
+func newWatSchema(name string, key func(string) string) *watSchema {
+	path := func(keys ...string) string {
+		for i := range keys {
+			keys[i] = key(keys[i])
+		}
+		return strings.Join(keys, ".")
+	}
+	html := []string{"Envelope", "Payload-Metadata", "HTTP-Response-Metadata", "HTML-Metadata"}
+	htmlPath := func(keys ...string) string {
+		return path(append(append([]string{}, html...), keys...)...)
+	}
+
+	return &watSchema{
+		Name:            name,
+		Envelope:        path("Envelope"),
+		IP:              path("Envelope", "WARC-Header-Metadata", "WARC-IP-Address"),
+		Date:            path("Envelope", "WARC-Header-Metadata", "WARC-Date"),
+		Links:           htmlPath("Links"),
+		HeadTitle:       htmlPath("Head", "Title"),
+		HeadMetas:       htmlPath("Head", "Metas"),
+		HeadLink:        htmlPath("Head", "Link"),
+		HeadLang:        htmlPath("Head", "Lang"),
+		ContentLanguage: path("Envelope", "Payload-Metadata", "HTTP-Response-Metadata", "Headers", "Content-Language"),
+	}
+}
+
+// detectWatSchema - schema of parsed WAT record, nil when record has no known envelope. Every schema is logged when it is seen first time
+func detectWatSchema(parsedJSON *gjson.Result) *watSchema {
+	for _, schema := range watSchemas {
+		if parsedJSON.Get(schema.Envelope).Exists() {
+			schema.detected.Do(func() {
+				log.Printf("Detected WAT schema: %s", schema.Name)
+			})
+			return schema
+		}
+	}
+
+	unknownWatSchema.Do(func() {
+		log.Printf("Unknown WAT schema, records without known envelope are skipped")
+	})
+	return nil
+}
+
+// watSchemaOrDefault - schema of page, standard schema when page was not read from WAT record
+func watSchemaOrDefault(schema *watSchema) *watSchema {
+	if schema == nil {
+		return watSchemas[0]
+	}
+	return schema
+}
@@ -0,0 +1,113 @@
+package commoncrawl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/kris-dev-hub/globallinks/pkg/config"
+	"github.com/tidwall/gjson"
+)
+
+// lowercaseKeys - WAT record with all keys in lower case, values are not changed
+func lowercaseKeys(tb testing.TB, record string) string {
+	tb.Helper()
+
+	var lower func(value any) any
+	lower = func(value any) any {
+		switch v := value.(type) {
+		case map[string]any:
+			out := make(map[string]any, len(v))
+			for key, item := range v {
+				out[strings.ToLower(key)] = lower(item)
+			}
+			return out
+		case []any:
+			for i := range v {
+				v[i] = lower(v[i])
+			}
+		}
+		return value
+	}
+
+	var value any
+	if err := jsoniter.UnmarshalFromString(record, &value); err != nil {
+		tb.Fatalf("failed to parse WAT record: %v", err)
+	}
+	out, err := jsoniter.MarshalToString(lower(value))
+	if err != nil {
+		tb.Fatalf("failed to build WAT record: %v", err)
+	}
+
+	return out
+}
+
+func TestDetectWatSchema(t *testing.T) {
+	tests := []struct {
+		name     string
+		jsonData string
+		want     string
+	}{
+		{"standard", `{"Envelope":{"Format":"WARC"}}`, "standard"},
+		{"lowercase keys", `{"envelope":{"format":"WARC"}}`, "lowercase keys"},
+		{"unknown", `{"Record":{"Envelope":{}}}`, ""},
+		{"empty", `{}`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedJSON := gjson.Parse(tt.jsonData)
+			name := ""
+			if schema := detectWatSchema(&parsedJSON); schema != nil {
+				name = schema.Name
+			}
+			if name != tt.want {
+				t.Errorf("detectWatSchema() = %q, want %q", name, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadPageContentWatSchemas(t *testing.T) {
+	record, err := BuildWatRecord(WatFixture{
+		URL:  "https://example.com/post",
+		IP:   "1.2.3.4",
+		Date: testFixtureDate,
+		HTML: `<html lang="de"><head><title>Post</title><meta name="robots" content="nofollow">` +
+			`<link rel="canonical" href="https://example.com/post"><link rel="alternate" href="https://example.de/post"></head>` +
+			`<body><a href="/about">About</a><a href="https://other.com/page" title="Other">Other</a></body></html>`,
+	})
+	if err != nil {
+		t.Fatalf("BuildWatRecord() error = %v", err)
+	}
+
+	config.HeadLinkRels = []string{"alternate"}
+	defer func() { config.HeadLinkRels = []string{} }()
+
+	sourceURLRecord := URLRecord{}
+	buildURLRecord("https://example.com/post", &sourceURLRecord, nil)
+
+	want := readPageContent(record, &sourceURLRecord, nil)
+	if want == nil || len(want.Links) != 2 || want.Language != "de" {
+		t.Fatalf("readPageContent() = %+v, want 2 links with language de", want)
+	}
+
+	got := readPageContent(lowercaseKeys(t, record), &sourceURLRecord, nil)
+	if got == nil {
+		t.Fatal("readPageContent() of lowercase keys record returned nil")
+	}
+	if got.schema.Name != "lowercase keys" {
+		t.Errorf("readPageContent() schema = %q, want lowercase keys", got.schema.Name)
+	}
+
+	got.schema, want.schema = nil, nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readPageContent() of lowercase keys record = %+v, want %+v", got, want)
+	}
+
+	// records of unknown schema are skipped instead of parsed without links
+	if page := readPageContent(`{"Record":`+record+`}`, &sourceURLRecord, nil); page != nil {
+		t.Errorf("readPageContent() of unknown schema = %+v, want nil", page)
+	}
+}
@@ -0,0 +1,328 @@
+package commoncrawl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgryski/go-farm"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// importedWatFilesName - file in data directory with WAT files imported from all archives
+const importedWatFilesName = "imported_wat.json"
+
+// importedWatJournalExt - extension of journal with WAT files imported since imported WAT files were saved, one JSON line per file
+const importedWatJournalExt = ".journal"
+
+// deadLetterWatFilesName - file in data directory with WAT files that could not be downloaded or parsed
+const deadLetterWatFilesName = "dead_letter_wat.json"
+
+// ImportedWatFiles - WAT files imported into data directory, shared by all archives so the same WAT file is downloaded and parsed once.
+// Imported files are appended to journal, it is merged into the file when imported files are loaded. Safe for use from many parsing goroutines
+type ImportedWatFiles struct {
+	filePath string
+	mu       sync.Mutex
+	Files    map[string]time.Time `json:"files"` // WatFileKey -> import time
+}
+
+// ImportedWatFilesFile - path to file with WAT files imported into data directory
+func (d DataDir) ImportedWatFilesFile() string {
+	return filepath.Join(d.DataDir, importedWatFilesName)
+}
+
+// WatFileKey - hash of WAT file name, Common Crawl file names are unique so the same file listed in many segments or archives has the same key
+func WatFileKey(watPath string) string {
+	return strconv.FormatUint(farm.Hash64([]byte(path.Base(watPath))), 16)
+}
+
+// importedWatEntry - journal line, WAT file imported at given time
+type importedWatEntry struct {
+	File     string    `json:"file"`
+	Imported time.Time `json:"imported"`
+}
+
+// LoadImportedWatFiles - load imported WAT files from file and its journal, missing file gives empty list. Journal is merged into
+// the file, so it holds only files imported in the current run
+func LoadImportedWatFiles(filePath string) (*ImportedWatFiles, error) {
+	imported := &ImportedWatFiles{filePath: filePath, Files: make(map[string]time.Time)}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = jsoniter.Unmarshal(data, imported)
+		if err != nil {
+			return nil, fmt.Errorf("imported WAT files %s are broken: %w", filePath, err)
+		}
+		if imported.Files == nil {
+			imported.Files = make(map[string]time.Time)
+		}
+	}
+
+	entries, err := imported.readJournal()
+	if err != nil {
+		return nil, err
+	}
+	if entries > 0 {
+		err = imported.save()
+		if err != nil {
+			return nil, fmt.Errorf("failed to save imported WAT files: %w", err)
+		}
+	}
+
+	return imported, nil
+}
+
+// readJournal - add files from journal to imported files. Last line cut by interrupted write is ignored, its file is imported again
+func (w *ImportedWatFiles) readJournal() (int, error) {
+	data, err := os.ReadFile(w.filePath + importedWatJournalExt)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// every complete line ends with new line, the last part without it was cut by interrupted write
+	lines := bytes.Split(data, []byte("\n"))
+	entries := 0
+	for i, line := range lines[:len(lines)-1] {
+		var entry importedWatEntry
+		err = jsoniter.Unmarshal(line, &entry)
+		if err != nil || entry.File == "" {
+			return 0, fmt.Errorf("imported WAT files journal %s is broken at line %d", w.filePath+importedWatJournalExt, i+1)
+		}
+		w.Files[entry.File] = entry.Imported
+		entries++
+	}
+
+	return entries, nil
+}
+
+// save - replace file with all imported files and remove journal already included in it
+func (w *ImportedWatFiles) save() error {
+	err := saveStateFile(w.filePath, w)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(w.filePath + importedWatJournalExt)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// IsImported - check if WAT file was already imported into data directory
+func (w *ImportedWatFiles) IsImported(watPath string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, ok := w.Files[WatFileKey(watPath)]
+	return ok
+}
+
+// MarkImported - save WAT file as imported, one line is appended to journal instead of saving all imported files
+func (w *ImportedWatFiles) MarkImported(watPath string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entry := importedWatEntry{File: WatFileKey(watPath), Imported: time.Now()}
+	line, err := jsoniter.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to save imported WAT files: %w", err)
+	}
+
+	journal, err := os.OpenFile(w.filePath+importedWatJournalExt, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to save imported WAT files: %w", err)
+	}
+	_, err = journal.Write(append(line, '\n'))
+	if closeErr := journal.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save imported WAT files: %w", err)
+	}
+	w.Files[entry.File] = entry.Imported
+
+	return nil
+}
+
+// Clear - remove WAT files from imported files, so they are downloaded and parsed again. Number of removed files is returned
+func (w *ImportedWatFiles) Clear(watPaths []string) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	cleared := 0
+	for _, watPath := range watPaths {
+		key := WatFileKey(watPath)
+		if _, ok := w.Files[key]; ok {
+			delete(w.Files, key)
+			cleared++
+		}
+	}
+	if cleared == 0 {
+		return 0, nil
+	}
+
+	err := w.save()
+	if err != nil {
+		return 0, fmt.Errorf("failed to save imported WAT files: %w", err)
+	}
+
+	return cleared, nil
+}
+
+// DeadLetterWatFile - WAT file that failed all download or parse attempts
+type DeadLetterWatFile struct {
+	Path     string    `json:"path"`
+	Segment  string    `json:"segment"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Failed   time.Time `json:"failed"`
+}
+
+// DeadLetterWatFiles - WAT files that failed all attempts. They are skipped for the rest of the run, so one broken file does not stop
+// the import, and retried in the next run. Safe for use from many parsing goroutines
+type DeadLetterWatFiles struct {
+	filePath    string
+	mu          sync.Mutex
+	failedInRun map[string]string            // WatFileKey -> segment
+	Files       map[string]DeadLetterWatFile `json:"files"` // WatFileKey -> failed file
+}
+
+// DeadLetterWatFilesFile - path to file with WAT files that failed all attempts
+func (d DataDir) DeadLetterWatFilesFile() string {
+	return filepath.Join(d.DataDir, deadLetterWatFilesName)
+}
+
+// LoadDeadLetterWatFiles - load WAT files failed in previous runs, missing file gives empty list
+func LoadDeadLetterWatFiles(filePath string) (*DeadLetterWatFiles, error) {
+	deadLetter := &DeadLetterWatFiles{filePath: filePath, failedInRun: make(map[string]string), Files: make(map[string]DeadLetterWatFile)}
+
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return deadLetter, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = jsoniter.Unmarshal(data, deadLetter)
+	if err != nil {
+		return nil, fmt.Errorf("dead letter WAT files %s are broken: %w", filePath, err)
+	}
+	if deadLetter.Files == nil {
+		deadLetter.Files = make(map[string]DeadLetterWatFile)
+	}
+
+	return deadLetter, nil
+}
+
+// FailedInRun - check if WAT file failed all attempts in the current run, files failed in previous runs are retried
+func (w *DeadLetterWatFiles) FailedInRun(watPath string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, ok := w.failedInRun[WatFileKey(watPath)]
+	return ok
+}
+
+// SegmentFailedInRun - check if any WAT file of segment failed all attempts in the current run, such segment can't be compacted
+func (w *DeadLetterWatFiles) SegmentFailedInRun(segment string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, failedSegment := range w.failedInRun {
+		if failedSegment == segment {
+			return true
+		}
+	}
+	return false
+}
+
+// Add - save WAT file that failed all attempts
+func (w *DeadLetterWatFiles) Add(segment string, watPath string, attempts int, failure error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key := WatFileKey(watPath)
+	w.failedInRun[key] = segment
+	w.Files[key] = DeadLetterWatFile{Path: watPath, Segment: segment, Attempts: attempts, Error: failure.Error(), Failed: time.Now()}
+
+	err := saveStateFile(w.filePath, w)
+	if err != nil {
+		return fmt.Errorf("failed to save dead letter WAT files: %w", err)
+	}
+
+	return nil
+}
+
+// Remove - remove WAT file imported in retry from the list
+func (w *DeadLetterWatFiles) Remove(watPath string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key := WatFileKey(watPath)
+	if _, ok := w.Files[key]; !ok {
+		return nil
+	}
+	delete(w.Files, key)
+
+	err := saveStateFile(w.filePath, w)
+	if err != nil {
+		return fmt.Errorf("failed to save dead letter WAT files: %w", err)
+	}
+
+	return nil
+}
+
+// ClearSegment - remove WAT files of segment from the list, number of removed files is returned
+func (w *DeadLetterWatFiles) ClearSegment(segment string) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	cleared := 0
+	for key, file := range w.Files {
+		if file.Segment == segment {
+			delete(w.Files, key)
+			cleared++
+		}
+	}
+	if cleared == 0 {
+		return 0, nil
+	}
+
+	err := saveStateFile(w.filePath, w)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save dead letter WAT files: %w", err)
+	}
+
+	return cleared, nil
+}
+
+// saveStateFile - save state as JSON, file is replaced only with complete data
+func saveStateFile(filePath string, state any) error {
+	data, err := jsoniter.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmpFile := filePath + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, filePath)
+}
@@ -0,0 +1,201 @@
+package commoncrawl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+func TestImportedWatFiles(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), importedWatFilesName)
+	watPath := "crawl-data/CC-MAIN-2021-04/segments/1610703495901.0/wat/CC-MAIN-20210115134101-20210115164101-00000.warc.wat.gz"
+
+	imported, err := LoadImportedWatFiles(filePath)
+	if err != nil {
+		t.Fatalf("LoadImportedWatFiles() error = %v", err)
+	}
+	if imported.IsImported(watPath) {
+		t.Fatal("IsImported() = true before file was imported")
+	}
+
+	if err = imported.MarkImported(watPath); err != nil {
+		t.Fatalf("MarkImported() error = %v", err)
+	}
+
+	// other archives sharing data directory load the same state
+	reloaded, err := LoadImportedWatFiles(filePath)
+	if err != nil {
+		t.Fatalf("LoadImportedWatFiles() error = %v", err)
+	}
+	if !reloaded.IsImported(watPath) {
+		t.Error("IsImported() = false after reload")
+	}
+	if !reloaded.IsImported(strings.Replace(watPath, "CC-MAIN-2021-04", "CC-MAIN-2021-10", 1)) {
+		t.Error("IsImported() = false for the same WAT file listed in other archive")
+	}
+	if reloaded.IsImported(strings.Replace(watPath, "00000.warc", "00001.warc", 1)) {
+		t.Error("IsImported() = true for other WAT file")
+	}
+	if _, err = os.Stat(filePath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("MarkImported() left tmp file: %v", err)
+	}
+}
+
+func TestLoadImportedWatFilesBroken(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), importedWatFilesName)
+	if err := os.WriteFile(filePath, []byte(`{"files":{"1a`), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if _, err := LoadImportedWatFiles(filePath); err == nil {
+		t.Error("LoadImportedWatFiles() error = nil for broken file")
+	}
+}
+
+// TestImportedWatFilesJournal - imported files are appended to journal, it is merged into the file on load and cut last line is ignored
+func TestImportedWatFilesJournal(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), importedWatFilesName)
+	watPath := func(number int) string {
+		return fmt.Sprintf("crawl-data/CC-MAIN-2021-04/segments/1610703495901.0/wat/CC-MAIN-20210115134101-20210115164101-%05d.warc.wat.gz", number)
+	}
+
+	imported, err := LoadImportedWatFiles(filePath)
+	if err != nil {
+		t.Fatalf("LoadImportedWatFiles() error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = imported.MarkImported(watPath(i)); err != nil {
+			t.Fatalf("MarkImported() error = %v", err)
+		}
+	}
+	if _, err = os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("MarkImported() saved all imported files, want journal only: %v", err)
+	}
+	journal, err := os.ReadFile(filePath + importedWatJournalExt)
+	if err != nil || strings.Count(string(journal), "\n") != 3 {
+		t.Fatalf("journal = %q, %v, want 3 lines", journal, err)
+	}
+
+	// interrupted write leaves line without new line
+	if err = os.WriteFile(filePath+importedWatJournalExt, append(journal, []byte(`{"file":"`+WatFileKey(watPath(3)))...), 0o644); err != nil {
+		t.Fatalf("Failed to write journal: %v", err)
+	}
+
+	reloaded, err := LoadImportedWatFiles(filePath)
+	if err != nil {
+		t.Fatalf("LoadImportedWatFiles() error = %v", err)
+	}
+	if len(reloaded.Files) != 3 || !reloaded.IsImported(watPath(2)) || reloaded.IsImported(watPath(3)) {
+		t.Errorf("LoadImportedWatFiles() files = %v, want 3 files from journal", reloaded.Files)
+	}
+	if _, err = os.Stat(filePath + importedWatJournalExt); !os.IsNotExist(err) {
+		t.Errorf("LoadImportedWatFiles() kept journal merged into file: %v", err)
+	}
+
+	// cleared files are imported again, clear is saved in the file
+	cleared, err := reloaded.Clear([]string{watPath(0), watPath(3)})
+	if err != nil || cleared != 1 {
+		t.Fatalf("Clear() = %d, %v, want 1 cleared file", cleared, err)
+	}
+	reloaded, err = LoadImportedWatFiles(filePath)
+	if err != nil {
+		t.Fatalf("LoadImportedWatFiles() error = %v", err)
+	}
+	if len(reloaded.Files) != 2 || reloaded.IsImported(watPath(0)) {
+		t.Errorf("LoadImportedWatFiles() files = %v after Clear(), want 2 files", reloaded.Files)
+	}
+
+	// broken line in the middle of journal is not cut by interrupted write
+	if err = os.WriteFile(filePath+importedWatJournalExt, []byte("{\"file\":\n"+`{"file":"1a","imported":"2023-02-04T10:00:00Z"}`+"\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write journal: %v", err)
+	}
+	if _, err = LoadImportedWatFiles(filePath); err == nil {
+		t.Error("LoadImportedWatFiles() error = nil for broken journal")
+	}
+}
+
+func TestDeadLetterWatFiles(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), deadLetterWatFilesName)
+	watPath := "crawl-data/CC-MAIN-2021-04/segments/1610703495901.0/wat/CC-MAIN-20210115134101-20210115164101-00000.warc.wat.gz"
+
+	deadLetter, err := LoadDeadLetterWatFiles(filePath)
+	if err != nil {
+		t.Fatalf("LoadDeadLetterWatFiles() error = %v", err)
+	}
+	if err = deadLetter.Add("1610703495901.0", watPath, 3, errors.New("broken gzip")); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if !deadLetter.FailedInRun(watPath) {
+		t.Error("FailedInRun() = false after Add()")
+	}
+	if !deadLetter.SegmentFailedInRun("1610703495901.0") || deadLetter.SegmentFailedInRun("1610703495901.1") {
+		t.Error("SegmentFailedInRun() does not match segment of failed file")
+	}
+
+	// next run retries the file
+	reloaded, err := LoadDeadLetterWatFiles(filePath)
+	if err != nil {
+		t.Fatalf("LoadDeadLetterWatFiles() error = %v", err)
+	}
+	if reloaded.FailedInRun(watPath) {
+		t.Error("FailedInRun() = true in next run")
+	}
+	want := DeadLetterWatFile{Path: watPath, Segment: "1610703495901.0", Attempts: 3, Error: "broken gzip"}
+	got := reloaded.Files[WatFileKey(watPath)]
+	got.Failed = time.Time{}
+	if got != want {
+		t.Errorf("Files = %+v, want %+v", got, want)
+	}
+
+	if err = reloaded.Remove(watPath); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	reloaded, err = LoadDeadLetterWatFiles(filePath)
+	if err != nil || len(reloaded.Files) != 0 {
+		t.Errorf("LoadDeadLetterWatFiles() after Remove() = %d files, %v, want none", len(reloaded.Files), err)
+	}
+
+	// only files of cleared segment are removed
+	otherPath := strings.Replace(watPath, "00000.warc", "00001.warc", 1)
+	for _, add := range []struct{ segment, path string }{{"1610703495901.0", watPath}, {"1610703495901.1", otherPath}} {
+		if err = reloaded.Add(add.segment, add.path, 3, errors.New("broken gzip")); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	cleared, err := reloaded.ClearSegment("1610703495901.0")
+	if err != nil || cleared != 1 {
+		t.Fatalf("ClearSegment() = %d, %v, want 1 cleared file", cleared, err)
+	}
+	reloaded, err = LoadDeadLetterWatFiles(filePath)
+	if err != nil || len(reloaded.Files) != 1 || reloaded.Files[WatFileKey(otherPath)].Path != otherPath {
+		t.Errorf("LoadDeadLetterWatFiles() after ClearSegment() = %v, %v, want file of other segment", reloaded.Files, err)
+	}
+}
+
+func TestReadSegmentsFileDuplicates(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "CC-MAIN-2021-04.wat.paths.gz")
+	watPath := "crawl-data/CC-MAIN-2021-04/segments/1610703495901.0/wat/CC-MAIN-20210115134101-20210115164101-00000.warc.wat.gz"
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		t.Fatalf("Failed to create segments file: %v", err)
+	}
+	writer := gzip.NewWriter(file)
+	_, _ = writer.Write([]byte(watPath + "\n" + watPath + "\n"))
+	_ = writer.Close()
+	_ = file.Close()
+
+	segmentList, err := readSegmentsFile(filePath, "CC-MAIN-2021-04")
+	if err != nil {
+		t.Fatalf("readSegmentsFile() error = %v", err)
+	}
+	if len(segmentList) != 1 || len(segmentList[0].WatFiles) != 1 {
+		t.Errorf("readSegmentsFile() = %+v, want one segment with one WAT file", segmentList)
+	}
+}
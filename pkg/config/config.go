@@ -195,9 +195,127 @@ var IgnoreDomains = []string{
 	"ziprecruiter.com",
 }
 
+// RecordQualityThreshold - minimal quality score (1-100) of page and link url, see scoreRecord in commoncrawl package,
+// every heuristic lowers the score of url, lower threshold accepts more suspicious urls
+var RecordQualityThreshold = 50
+
+// MaxPathLength - page and link urls with longer path (in characters) are skipped, such paths are usually session ids or attack urls
+// and only bloat storage. Shorter paths over 300 bytes only lower quality score of url, 0 disables the check
+var MaxPathLength = 2048
+
+// FailZeroLinkWatFiles - WAT file without links and without any readable page is returned as error, so importer downloads it again
+// and adds it to dead letter files after all attempts. Files with readable pages and no external links are only logged
+var FailZeroLinkWatFiles = false
+
+// LinkFarmExternalLinks - pages with more external links are checked for link farm pattern and their links are skipped
+// when most anchors are empty or identical, typical for parked domains and link farms, 0 disables the check
+var LinkFarmExternalLinks = 0
+
+// LinkFarmAnchorRatio - share of external links with empty or the most common anchor that marks page as link farm
+var LinkFarmAnchorRatio = 0.8
+
+// MaxExternalLinksRatio - links are skipped from pages with more than MaxExternalLinksRatio external links per internal link,
+// such pages (directories, blogrolls) are low trust, page without internal links is counted as one with a single internal link, 0 disables the check
+var MaxExternalLinksRatio = 0.0
+
+// MaxLinksPerPage - external links saved from one page, pages with tens of thousands of links (sitemaps, spam) would dominate link files
+// and memory of parser. Page keeps number of all its external links, 0 disables the limit
+var MaxLinksPerPage = 10000
+
+// PreferAnchoredLinks - page over MaxLinksPerPage keeps links with anchor text first, links without anchor fill the rest of the limit.
+// Disabled keeps the first MaxLinksPerPage links of the page
+var PreferAnchoredLinks = false
+
+// DropUnknownSchemeLinks - skip links with other scheme than http or https, they are saved with scheme "0" and shown without scheme (//host/path) when kept.
+// Protocol relative links get scheme of the page and are always kept
+var DropUnknownSchemeLinks = false
+
+// DetectTitleLanguage - detect page language from title written in script used by a single language (Japanese, Korean, Greek, ...)
+// when page has no lang attribute, content-language meta tag or header
+var DetectTitleLanguage = false
+
+// NormalizeAnchorText - collapse newlines, tabs and runs of spaces in anchor text to single spaces and trim it,
+// so the same visible anchor is saved as one link text
+var NormalizeAnchorText = false
+
+// SkipHomepageLinks - skip links to homepage of domain (path / without query), they are the most common and the least informative links.
+// Skipped links are still counted as external links of the page
+var SkipHomepageLinks = false
+
+// KeepPublicSuffixHosts - keep urls with host which is itself a public suffix of a platform like github.io or blogspot.com,
+// full host is used as domain. Such hosts have no eTLD+1 and their urls are skipped by default
+var KeepPublicSuffixHosts = false
+
+// PlatformSuffixes - suffixes of platforms hosting sites of their users, for example "substack.com" or "github.io". The first label under the suffix
+// is the domain of the site and labels before it are its subdomain, so links to user.substack.com are not counted as links to substack.com.
+// Suffixes are lowercase without leading dot, empty list splits hosts by public suffix list only
+var PlatformSuffixes = []string{}
+
+// DomainCacheSize - number of hosts with their domain kept in memory by the parser, shared by all parsing threads, around 150 bytes per host.
+// The least recently used hosts are removed from full cache and their domain is computed again from public suffix list
+var DomainCacheSize = 200000
+
+// EncodeLinkText - percent-encode field separator, newlines and percent sign in link text, link title and page title, so any text
+// is saved and read back without changes. Disabled replaces field separator with space like older versions
+var EncodeLinkText = true
+
+// Modes of CanonicalFilter
+const (
+	CanonicalStrict  = "strict"  // skip pages with canonical link to other host, path or query and pages with broken canonical link
+	CanonicalLenient = "lenient" // skip only pages with canonical link to other host, canonical to other path of the same host is often misconfigured
+	CanonicalOff     = "off"     // keep pages with any canonical link
+)
+
+// CanonicalFilter - skip pages with canonical link pointing to other page, their links are saved with the canonical page. Unknown mode is strict
+var CanonicalFilter = CanonicalStrict
+
+// SavePagesWithoutLinks - save pages without external links to page file too, so page data covers all accepted pages of crawled sites.
+// Used only when page data is saved, link files do not change
+var SavePagesWithoutLinks = false
+
+// SavePageTitle - save title of source page with every link, so backlink reports show it without page files.
+// Title is repeated for every link of the page and makes link files much bigger
+var SavePageTitle = false
+
 // IgnoreQuery - ignore query starting with these strings
 var IgnoreQuery = []string{
 	"lang",
 	"utm_",
 	"ref",
 }
+
+// StripIgnoredQueryParams - remove only query parameters starting with IgnoreQuery strings and keep the rest sorted by key,
+// when false whole query starting with IgnoreQuery string is removed
+var StripIgnoredQueryParams = false
+
+// SortQueryParams - encode query parameters sorted by key so links with the same parameters in different order are compacted together,
+// disabled by default because some sites are sensitive to parameters order
+var SortQueryParams = false
+
+// DropQueryStrings - remove whole query of every page and link url, so pages and links differing only in query are the same page and link.
+// Much fewer links are left after compaction, unlike IgnoreQuery it removes all queries, not only those starting with listed strings
+var DropQueryStrings = false
+
+// HeadLinkRels - relations of <link> elements from page head saved as links next to <a> links, for example "alternate" or "me",
+// empty list saves only <a> links
+var HeadLinkRels = []string{}
+
+// KeepFragment - keep link fragment as part of link identity, saved with link path as path#fragment,
+// useful for hash routed sites where /app#/a and /app#/b are different pages
+var KeepFragment = false
+
+// FoldTrailingSlash - remove trailing slash from page and link paths so /page/ and /page are the same page
+var FoldTrailingSlash = false
+
+// CleanPathSegments - collapse duplicate slashes and resolve . and .. segments of page and link paths so /a//b and /a/./c/../b are the same page as /a/b,
+// disabled by default because some servers serve other content for such paths
+var CleanPathSegments = false
+
+// StripDefaultDocuments - remove default document from page and link paths so /page/index.html and /page/ are the same page
+var StripDefaultDocuments = false
+
+// DefaultDocuments - documents removed from the end of the path when StripDefaultDocuments is enabled
+var DefaultDocuments = []string{
+	"index.html",
+	"index.php",
+}
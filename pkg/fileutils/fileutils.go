@@ -5,11 +5,16 @@ package fileutils
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/klauspost/compress/gzip"
@@ -24,6 +29,15 @@ func FileExists(filename string) bool {
 	return !info.IsDir()
 }
 
+// NonEmptyFileExists checks if a file exists and has some data, empty file is left by broken download
+func NonEmptyFileExists(filename string) bool {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+	return !info.IsDir() && info.Size() > 0
+}
+
 // DirExists checks if a directory exists
 func DirExists(filename string) bool {
 	info, err := os.Stat(filename)
@@ -33,52 +47,127 @@ func DirExists(filename string) bool {
 	return info.IsDir()
 }
 
-// DownloadFile downloads a file from a URL and saves it to the specified path, retry if needed
+// RetryDelay is the delay before the first retry of failed download, it is doubled after every next failure
+var RetryDelay = 20 * time.Second
+
+// ErrEmptyDownload is returned when server responds with empty body, it happens on mirror glitches
+var ErrEmptyDownload = errors.New("empty response body")
+
+// StatusError is returned when server responds with unexpected HTTP status, callers check StatusCode to handle 404 and other client errors
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return "unexpected status: " + e.Status
+}
+
+// DownloadFile downloads a file from a URL and saves it to the specified path, retry if needed.
+// Empty response is retried like network errors, 429 and 5xx responses, all of them share maxRetries and back-off of GetWithRetry.
+// File is removed when all attempts return empty body
 func DownloadFile(url, outputPath string, maxRetries int) error {
-	var resp *http.Response
 	var err error
-	retryDelay := 20 * time.Second
-
 	for i := 0; i <= maxRetries; i++ {
-		resp, err = http.Get(url)
-		if err == nil && resp.StatusCode == http.StatusOK {
-			break
+		if i > 0 {
+			waitRetry(url, i, err)
 		}
-		if resp != nil {
-			if resp.StatusCode == http.StatusServiceUnavailable {
-				fmt.Println("503 Service Unavailable error received. Retrying...")
-				time.Sleep(retryDelay)
-				retryDelay *= 2 // Exponential back-off
-			}
-			err = resp.Body.Close()
-			if err != nil {
-				fmt.Printf("Error closing response body: %v\n", err)
-			}
-		} else {
-			fmt.Printf("Error during HTTP GET: %v\n", err)
-			time.Sleep(retryDelay)
+
+		var written int64
+		var retry bool
+		written, retry, err = downloadToFile(url, outputPath)
+		if err == nil && written > 0 {
+			return nil
+		}
+		if err == nil {
+			err = ErrEmptyDownload
+		}
+		if !retry {
+			return fmt.Errorf("failed to download url %s: %w", url, err)
 		}
 	}
 
-	if err != nil || resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download url %s after retries: %v", url, err)
+	if errors.Is(err, ErrEmptyDownload) {
+		removeErr := os.Remove(outputPath)
+		if removeErr != nil {
+			return removeErr
+		}
+	}
+	return fmt.Errorf("failed to download url %s after retries: %w", url, err)
+}
+
+// downloadToFile saves response body of one request to the file and returns number of saved bytes, retry is false for errors which will not change on retry
+func downloadToFile(url, outputPath string) (int64, bool, error) {
+	resp, retry, err := getOnce(url)
+	if err != nil {
+		return 0, retry, err
 	}
 	defer resp.Body.Close()
 
 	// Create the file where the downloaded data will be stored
 	out, err := os.Create(outputPath)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
 	defer out.Close()
 
-	// Use io.Copy to write the response body to file
-	_, err = io.Copy(out, resp.Body)
+	// Use io.Copy to write the response body to file, broken connection is retried
+	written, err := io.Copy(out, resp.Body)
 	if err != nil {
-		return err
+		return written, true, fmt.Errorf("error reading response body: %w", err)
 	}
+	return written, true, nil
+}
 
-	return nil
+// GetWithRetry sends GET request and retries network errors, 429 and 5xx responses with jittered exponential back-off.
+// Response body has to be closed by caller.
+func GetWithRetry(url string, maxRetries int) (*http.Response, error) {
+	var err error
+	for i := 0; i <= maxRetries; i++ {
+		if i > 0 {
+			waitRetry(url, i, err)
+		}
+
+		var resp *http.Response
+		var retry bool
+		resp, retry, err = getOnce(url)
+		if err == nil {
+			return resp, nil
+		}
+		if !retry {
+			return nil, fmt.Errorf("failed to download url %s: %w", url, err)
+		}
+	}
+
+	return nil, fmt.Errorf("failed to download url %s after retries: %w", url, err)
+}
+
+// getOnce sends one GET request, retry is false for client errors like 404 which will not change on retry
+func getOnce(url string) (*http.Response, bool, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, true, fmt.Errorf("error during HTTP GET: %w", err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, false, nil
+	}
+
+	closeErr := resp.Body.Close()
+	if closeErr != nil {
+		fmt.Printf("Error closing response body: %v\n", closeErr)
+	}
+
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+	return nil, retry, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+}
+
+// waitRetry sleeps before retry of failed request, delay starts at RetryDelay and is doubled after every failure.
+// Jitter spreads retries of many threads hitting the same error
+func waitRetry(url string, retry int, err error) {
+	retryDelay := RetryDelay << (retry - 1)
+	delay := retryDelay/2 + time.Duration(rand.Int63n(int64(retryDelay)+1))
+	fmt.Printf("Retrying %s in %s: %v\n", url, delay.Round(time.Millisecond), err)
+	time.Sleep(delay)
 }
 
 // ReadGZFileByLine reads a .gz file line by line and returns a slice of strings
@@ -150,3 +239,82 @@ func DeleteDirectoryIfEmpty(dirPath string) error {
 
 	return nil
 }
+
+// LineScanner reads lines like bufio.Scanner, lines longer than its buffer are skipped and counted instead of stopping the scan
+type LineScanner struct {
+	*bufio.Scanner
+	skippedLines int
+}
+
+// NewLineScanner creates line scanner using buf, lines of maxLineSize bytes or longer are skipped
+func NewLineScanner(reader io.Reader, buf []byte, maxLineSize int) *LineScanner {
+	lineScanner := &LineScanner{Scanner: bufio.NewScanner(reader)}
+	lineScanner.Buffer(buf, maxLineSize)
+
+	skipping := false
+	var split bufio.SplitFunc
+	split = func(data []byte, atEOF bool) (int, []byte, error) {
+		if skipping {
+			// drop rest of too long line up to its end
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				return len(data), nil, nil
+			}
+			skipping = false
+			// next line is returned right away, bufio.Scanner stops at end of file when split gives no token
+			advance, token, err := split(data[i+1:], atEOF)
+			return i + 1 + advance, token, err
+		}
+
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if advance == 0 && token == nil && err == nil && len(data) >= maxLineSize {
+			// buffer is full and has no end of line, bufio.Scanner would stop with bufio.ErrTooLong
+			skipping = true
+			lineScanner.skippedLines++
+			return len(data), nil, nil
+		}
+		return advance, token, err
+	}
+	lineScanner.Split(split)
+
+	return lineScanner
+}
+
+// SkippedLines returns number of lines skipped because they were too long
+func (s *LineScanner) SkippedLines() int {
+	return s.skippedLines
+}
+
+// DefaultScannerBufferSize is the default maximum line length of gzipped files read line by line
+const DefaultScannerBufferSize = 3 * 1024 * 1024 // 3*1MB
+
+// ScannerBufferSize returns scanner buffer size in bytes, GLOBALLINKS_SCANNERBUFFER overrides defaultSize with size in MB.
+// Every scanner allocates whole buffer, so memory used grows with number of threads and files read at once
+func ScannerBufferSize(defaultSize int) int {
+	envVar := "GLOBALLINKS_SCANNERBUFFER"
+	minVal := 1
+	maxVal := 512
+
+	sizeStr := os.Getenv(envVar)
+	if sizeStr == "" {
+		return defaultSize
+	}
+
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil {
+		log.Printf("Invalid number for %s: %v. Using default %d bytes", envVar, err, defaultSize)
+		return defaultSize
+	}
+
+	if size < minVal || size > maxVal {
+		log.Printf("Number for %s must be between %d and %d MB. Using default %d bytes", envVar, minVal, maxVal, defaultSize)
+		return defaultSize
+	}
+
+	return size * 1024 * 1024
+}
+
+// NewGZScanner creates line scanner with new buffer of bufSize bytes, longer lines are skipped and counted
+func NewGZScanner(reader io.Reader, bufSize int) *LineScanner {
+	return NewLineScanner(reader, make([]byte, bufSize), bufSize)
+}
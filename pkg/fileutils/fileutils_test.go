@@ -2,13 +2,25 @@ package fileutils
 
 import (
 	"compress/gzip"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
+func TestMain(m *testing.M) {
+	// retries are tested, not the real delay between them
+	RetryDelay = 10 * time.Millisecond
+	os.Exit(m.Run())
+}
+
 func TestFileExists(t *testing.T) {
 	type args struct {
 		filename string
@@ -93,6 +105,7 @@ func TestDownloadFile_Http503(t *testing.T) {
 		} else {
 			// Return 200 OK on the third attempt
 			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("test data"))
 		}
 	}))
 	defer mockServer.Close()
@@ -116,6 +129,163 @@ func TestDownloadFile_Http503(t *testing.T) {
 	}
 }
 
+func TestDownloadFile_EmptyBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		emptyAttempts int
+		maxRetries    int
+		wantErr       bool
+		wantAttempts  int
+	}{
+		{"empty body retried", 1, 2, false, 2},
+		{"empty body on every attempt", 3, 2, true, 3},
+		{"empty body without retries", 1, 0, true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				if attempts > tt.emptyAttempts {
+					_, _ = w.Write([]byte("test data"))
+				}
+			}))
+			defer server.Close()
+
+			outputPath := filepath.Join(t.TempDir(), "downloadedFile.txt")
+			err := DownloadFile(server.URL, outputPath, tt.maxRetries)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DownloadFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, ErrEmptyDownload) {
+				t.Errorf("DownloadFile() error = %v, want ErrEmptyDownload", err)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("DownloadFile() made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			if FileExists(outputPath) == tt.wantErr {
+				t.Errorf("file exists = %v, want %v", !tt.wantErr, !tt.wantErr)
+			}
+			if !tt.wantErr && !NonEmptyFileExists(outputPath) {
+				t.Error("DownloadFile() saved empty file")
+			}
+		})
+	}
+}
+
+// TestDownloadFileSharedRetries - failed requests and empty responses are retried together at most maxRetries times
+func TestDownloadFileSharedRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		responses    []int // status of every attempt, 0 is empty response
+		wantErr      bool
+		wantAttempts int
+	}{
+		{"error and empty response retried", []int{http.StatusServiceUnavailable, 0, http.StatusOK}, false, 3},
+		{"retries used up", []int{http.StatusServiceUnavailable, 0, http.StatusBadGateway, http.StatusOK}, true, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tt.responses[min(attempts, len(tt.responses)-1)]
+				attempts++
+				if status == 0 {
+					return
+				}
+				w.WriteHeader(status)
+				if status == http.StatusOK {
+					_, _ = w.Write([]byte("test data"))
+				}
+			}))
+			defer server.Close()
+
+			err := DownloadFile(server.URL, filepath.Join(t.TempDir(), "downloadedFile.txt"), 2)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DownloadFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("DownloadFile() made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestNonEmptyFileExists(t *testing.T) {
+	dir := t.TempDir()
+	emptyFile := filepath.Join(dir, "empty.txt")
+	dataFile := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(emptyFile, nil, 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.WriteFile(dataFile, []byte("data"), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{"file with data", dataFile, true},
+		{"empty file", emptyFile, false},
+		{"missing file", filepath.Join(dir, "missing.txt"), false},
+		{"directory", dir, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NonEmptyFileExists(tt.path); got != tt.want {
+				t.Errorf("NonEmptyFileExists(%s) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetWithRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		maxRetries   int
+		wantErr      bool
+		wantAttempts int
+		wantStatus   int // status of returned StatusError
+	}{
+		{"ok", []int{http.StatusOK}, 3, false, 1, 0},
+		{"flaky server", []int{http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusOK}, 3, false, 4, 0},
+		{"too many failures", []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}, 2, true, 3, http.StatusServiceUnavailable},
+		{"not found is not retried", []int{http.StatusNotFound, http.StatusOK}, 3, true, 1, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statuses[min(attempts, len(tt.statuses)-1)])
+				attempts++
+			}))
+			defer server.Close()
+
+			resp, err := GetWithRetry(server.URL, tt.maxRetries)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetWithRetry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("GetWithRetry() attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) != (tt.wantStatus != 0) || (statusErr != nil && statusErr.StatusCode != tt.wantStatus) {
+				t.Errorf("GetWithRetry() error = %v, want status %d", err, tt.wantStatus)
+			}
+		})
+	}
+}
+
 // TestReadGZFileByLine tests reading lines from a gzipped file.
 func TestReadGZFileByLine(t *testing.T) {
 	// Create a temporary gzipped file with test data.
@@ -149,6 +319,100 @@ func TestReadGZFileByLine(t *testing.T) {
 	}
 }
 
+func TestLineScanner(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		wantLines   []string
+		wantSkipped int
+	}{
+		{"short lines", "line 1\nline 2\r\nline 3", []string{"line 1", "line 2", "line 3"}, 0},
+		{"too long line in the middle", "line 1\n" + strings.Repeat("x", 100) + "\nline 2\n", []string{"line 1", "line 2"}, 1},
+		{"too long lines one after another", strings.Repeat("x", 40) + "\n" + strings.Repeat("y", 16) + "\nline 1", []string{"line 1"}, 2},
+		{"too long last line without end of line", "line 1\n" + strings.Repeat("x", 100), []string{"line 1"}, 1},
+		{"line just below limit", strings.Repeat("x", 15) + "\nline 1", []string{strings.Repeat("x", 15), "line 1"}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// gzip reader returns end of file together with last data, lines after skipped one have to be returned too
+			for _, reader := range []io.Reader{strings.NewReader(tt.content), iotest.DataErrReader(strings.NewReader(tt.content))} {
+				scanner := NewLineScanner(reader, make([]byte, 4), 16)
+
+				var lines []string
+				for scanner.Scan() {
+					lines = append(lines, scanner.Text())
+				}
+				if err := scanner.Err(); err != nil {
+					t.Fatalf("LineScanner.Err() = %v", err)
+				}
+				if !reflect.DeepEqual(lines, tt.wantLines) {
+					t.Errorf("LineScanner lines = %q, want %q", lines, tt.wantLines)
+				}
+				if scanner.SkippedLines() != tt.wantSkipped {
+					t.Errorf("LineScanner.SkippedLines() = %d, want %d", scanner.SkippedLines(), tt.wantSkipped)
+				}
+			}
+		})
+	}
+}
+
+func TestScannerBufferSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  int
+	}{
+		{"not set", "", DefaultScannerBufferSize},
+		{"size in MB", "8", 8 * 1024 * 1024},
+		{"not a number", "big", DefaultScannerBufferSize},
+		{"zero", "0", DefaultScannerBufferSize},
+		{"too big", "513", DefaultScannerBufferSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GLOBALLINKS_SCANNERBUFFER", tt.value)
+			if got := ScannerBufferSize(DefaultScannerBufferSize); got != tt.want {
+				t.Errorf("ScannerBufferSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewGZScanner(t *testing.T) {
+	// line over default buffer is read only with raised buffer size
+	longLine := strings.Repeat("x", DefaultScannerBufferSize+1)
+	content := "line 1\n" + longLine + "\nline 2\n"
+
+	tests := []struct {
+		name        string
+		bufSize     int
+		wantLines   int
+		wantSkipped int
+	}{
+		{"default buffer", DefaultScannerBufferSize, 2, 1},
+		{"raised buffer", 2 * DefaultScannerBufferSize, 3, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanner := NewGZScanner(strings.NewReader(content), tt.bufSize)
+
+			lines := 0
+			for scanner.Scan() {
+				lines++
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatalf("NewGZScanner() scan error = %v", err)
+			}
+			if lines != tt.wantLines || scanner.SkippedLines() != tt.wantSkipped {
+				t.Errorf("NewGZScanner() lines = %d, skipped = %d, want %d, %d", lines, scanner.SkippedLines(), tt.wantLines, tt.wantSkipped)
+			}
+		})
+	}
+}
+
 // TestDeleteDirectoryIfEmpty tests the deletion of an empty directory.
 func TestDeleteDirectoryIfEmpty(t *testing.T) {
 	// Create a temporary directory.
@@ -1,18 +1,46 @@
 package healthcheck
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
+// Progress - counters of long-running job, safe to update from many goroutines. Nil progress ignores updates
+type Progress struct {
+	lines   atomic.Int64
+	batches atomic.Int64
+	errors  atomic.Int64
+	updated atomic.Int64 // unix time of last update
+	started time.Time
+}
+
+// ProgressStatus - progress reported by /progress, orchestration can treat job without updates for a long time as stuck
+type ProgressStatus struct {
+	Lines     int64     `json:"lines"`
+	Batches   int64     `json:"batches"`
+	Errors    int64     `json:"errors"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
 func InitRoutes() *mux.Router {
 	router := mux.NewRouter()
 	router.HandleFunc("/health", HealthResponse).Methods(http.MethodGet)
 	return router
 }
 
+// InitRoutesWithProgress - health route and /progress route reporting counters of progress
+func InitRoutesWithProgress(progress *Progress) *mux.Router {
+	router := InitRoutes()
+	router.HandleFunc("/progress", progress.Response).Methods(http.MethodGet)
+	return router
+}
+
 func HealthResponse(w http.ResponseWriter, r *http.Request) {
 	_, err := w.Write([]byte("I am alive!"))
 	if err != nil {
@@ -23,3 +51,59 @@ func HealthResponse(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
 }
+
+// NewProgress - progress started now
+func NewProgress() *Progress {
+	progress := &Progress{started: time.Now().UTC()}
+	progress.updated.Store(progress.started.Unix())
+	return progress
+}
+
+// AddLines - count processed lines
+func (p *Progress) AddLines(n int) {
+	if p == nil {
+		return
+	}
+	p.add(&p.lines, n)
+}
+
+// AddBatches - count written batches
+func (p *Progress) AddBatches(n int) {
+	if p == nil {
+		return
+	}
+	p.add(&p.batches, n)
+}
+
+// AddErrors - count errors
+func (p *Progress) AddErrors(n int) {
+	if p == nil {
+		return
+	}
+	p.add(&p.errors, n)
+}
+
+func (p *Progress) add(counter *atomic.Int64, n int) {
+	counter.Add(int64(n))
+	p.updated.Store(time.Now().Unix())
+}
+
+// Status - current values of counters
+func (p *Progress) Status() ProgressStatus {
+	return ProgressStatus{
+		Lines:     p.lines.Load(),
+		Batches:   p.batches.Load(),
+		Errors:    p.errors.Load(),
+		StartedAt: p.started,
+		UpdatedAt: time.Unix(p.updated.Load(), 0).UTC(),
+	}
+}
+
+// Response - write progress status as json
+func (p *Progress) Response(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(p.Status())
+	if err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package healthcheck
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProgressResponse(t *testing.T) {
+	progress := NewProgress()
+	progress.AddLines(120)
+	progress.AddLines(5)
+	progress.AddBatches(2)
+	progress.AddErrors(1)
+
+	server := httptest.NewServer(InitRoutesWithProgress(progress))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/progress")
+	if err != nil {
+		t.Fatalf("GET /progress error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /progress = %d %q, want 200 application/json", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var status ProgressStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("could not decode progress: %v", err)
+	}
+	if status.Lines != 125 || status.Batches != 2 || status.Errors != 1 {
+		t.Errorf("progress = %+v, want 125 lines, 2 batches, 1 error", status)
+	}
+	if status.StartedAt.IsZero() || status.UpdatedAt.Before(status.StartedAt.Truncate(1e9)) {
+		t.Errorf("progress times = %v, %v", status.StartedAt, status.UpdatedAt)
+	}
+
+	resp, err = http.Get(server.URL + "/health")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /health = %v, %v, want 200", resp, err)
+	}
+	resp.Body.Close()
+}
+
+func TestNilProgressIgnoresUpdates(t *testing.T) {
+	var progress *Progress
+	progress.AddLines(1)
+	progress.AddBatches(1)
+	progress.AddErrors(1)
+}
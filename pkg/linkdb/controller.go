@@ -4,28 +4,38 @@ import (
 	"context"
 	"errors"
 	"log"
+	"net/url"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"golang.org/x/net/publicsuffix"
 )
 
 const (
-	FilterKindExact = "exact"
-	FilterKindAny   = "any"
+	FilterKindExact  = "exact"
+	FilterKindAny    = "any"
+	FilterKindPrefix = "prefix" // anchored case sensitive regex, it can use index instead of scanning all links of domain
+	FilterKindText   = "text"   // value is escaped and matched as plain text anywhere in the field
+
+	maxFilterValueLength = 200  // longer prefix and text filter values are ignored
+	maxSourceURLLength   = 2048 // longer source urls are ignored
+	maxLinkCrawls        = 1000 // rows of one link read for link detail
 )
 
-func (app *App) ControllerGetDomainLinks(apiRequest APIRequest) ([]LinkOut, error) {
+// ControllerGetDomainLinks - get links to domain, hasMore is true when there are more matching links after returned ones
+func (app *App) ControllerGetDomainLinks(apiRequest APIRequest) (outLinks []LinkOut, hasMore bool, err error) {
 	var links []LinkRow
-	var outLinks []LinkOut
 	var limit int64 = 100
 	var page int64 = 1
 
-	domain := *apiRequest.Domain
 	if apiRequest.Limit != nil && *apiRequest.Limit > 0 && *apiRequest.Limit <= 100 {
 		limit = *apiRequest.Limit
 	}
@@ -34,17 +44,17 @@ func (app *App) ControllerGetDomainLinks(apiRequest APIRequest) ([]LinkOut, erro
 	}
 
 	// Get the collection
-	collection := app.DB.Database(app.Dbname).Collection("links")
+	collection := app.DB.Database(app.Dbname).Collection(app.linksCollection())
 
-	domainParsed, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	filter, err := app.domainLinksFilter(&apiRequest)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	filter := generateFilter(domain, domainParsed, &apiRequest)
-
+	// subdomain keeps links to the same path on different subdomains apart, so duplicates are merged correctly
 	sort := bson.D{
 		{Key: "linkdomain", Value: 1},
+		{Key: "linksubdomain", Value: 1},
 		{Key: "linkpath", Value: 1},
 		{Key: "linkrawquery", Value: 1},
 		{Key: "pagehost", Value: 1},
@@ -67,6 +77,7 @@ func (app *App) ControllerGetDomainLinks(apiRequest APIRequest) ([]LinkOut, erro
 		case "linkUrl":
 			sort = bson.D{
 				{Key: "linkdomain", Value: sortValue},
+				{Key: "linksubdomain", Value: sortValue},
 				{Key: "linkpath", Value: sortValue},
 				{Key: "linkrawquery", Value: sortValue},
 			}
@@ -91,8 +102,9 @@ func (app *App) ControllerGetDomainLinks(apiRequest APIRequest) ([]LinkOut, erro
 		}
 	}
 
-	// take more pages since we can have duplicates
-	findOptions := options.Find().SetSort(sort).SetLimit(limit * 3).SetSkip((page - 1) * limit).SetMaxTime(61 * time.Second)
+	// take more pages since we can have duplicates, one more row shows if there is anything after fetched rows
+	fetchLimit := limit * 3
+	findOptions := options.Find().SetSort(sort).SetLimit(fetchLimit + 1).SetSkip((page - 1) * limit).SetMaxTime(61 * time.Second)
 
 	queryTimeout := 60 * time.Second
 	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
@@ -101,7 +113,7 @@ func (app *App) ControllerGetDomainLinks(apiRequest APIRequest) ([]LinkOut, erro
 	cursor, err := collection.Find(ctx, filter, findOptions)
 	if err != nil {
 		if errors.Is(err, context.DeadlineExceeded) {
-			return nil, errors.New("Query timeout")
+			return nil, false, errors.New("Query timeout")
 		} else {
 			log.Fatal(err)
 		}
@@ -112,67 +124,524 @@ func (app *App) ControllerGetDomainLinks(apiRequest APIRequest) ([]LinkOut, erro
 	for cursor.Next(ctx) {
 		var link LinkRow
 		if err := cursor.Decode(&link); err != nil {
-			return nil, err
+			return nil, false, err
 		}
 		links = append(links, link)
 	}
 
 	if err := cursor.Err(); err != nil {
+		return nil, false, err
+	}
+
+	fetchedMore := int64(len(links)) > fetchLimit
+	if fetchedMore {
+		links = links[:fetchLimit]
+	}
+
+	outLinks, hasMore = cleanDomainLinks(&links, limit)
+
+	return outLinks, hasMore || fetchedMore, nil
+}
+
+// errNoRegistrableDomain - requested domain has no registrable domain, for example it is a public suffix
+var errNoRegistrableDomain = errors.New("domain has no registrable domain")
+
+// domainLinksFilter - filter of links to requested domain, options not set in request use defaults of API
+func (app *App) domainLinksFilter(apiRequest *APIRequest) (bson.M, error) {
+	domain := *apiRequest.Domain
+	domainParsed, ok := commoncrawl.RegistrableDomain(domain)
+	if !ok {
+		return nil, errNoRegistrableDomain
+	}
+
+	if apiRequest.IncludeWww == nil {
+		apiRequest.IncludeWww = &app.IncludeWww
+	}
+	if apiRequest.CaseSensitivePaths == nil {
+		apiRequest.CaseSensitivePaths = &app.CaseSensitive
+	}
+
+	return generateFilter(domain, domainParsed, apiRequest), nil
+}
+
+// ControllerGetDomainDateCoverage - number of links to domain first and last seen on every crawl date, links matching filters of request
+// are counted. Link row is counted only on its first and last crawl date, not on crawls between them
+func (app *App) ControllerGetDomainDateCoverage(apiRequest APIRequest) (*DomainDateCoverage, error) {
+	collection := app.DB.Database(app.Dbname).Collection(app.linksCollection())
+
+	filter, err := app.domainLinksFilter(&apiRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	// rows are counted by database, only counts of dates are returned
+	aggregateOptions := options.Aggregate().SetAllowDiskUse(true).SetMaxTime(61 * time.Second)
+	cursor, err := collection.Aggregate(ctx, dateCoveragePipeline(filter), aggregateOptions)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, errors.New("Query timeout")
+		}
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var counts dateCoverageCounts
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&counts); err != nil {
+			return nil, err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts.out(*apiRequest.Domain), nil
+}
+
+// dateCoveragePipeline - count matching link rows, count them by their first and by their last crawl date in date order
+func dateCoveragePipeline(filter bson.M) mongo.Pipeline {
+	countByDate := func(field string) bson.A {
+		return bson.A{
+			bson.D{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$" + field},
+				{Key: "links", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		}
+	}
+
+	return mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$facet", Value: bson.D{
+			{Key: "links", Value: bson.A{bson.D{{Key: "$count", Value: "links"}}}},
+			{Key: "first_seen", Value: countByDate("datefrom")},
+			{Key: "last_seen", Value: countByDate("dateto")},
+		}}},
+	}
+}
+
+// dateCount - number of link rows with crawl date, date is empty in total count
+type dateCount struct {
+	Date  string `bson:"_id"`
+	Links int    `bson:"links"`
+}
+
+// dateCoverageCounts - result of date coverage pipeline, links has one total count or none when nothing matches
+type dateCoverageCounts struct {
+	Links     []dateCount `bson:"links"`
+	FirstSeen []dateCount `bson:"first_seen"`
+	LastSeen  []dateCount `bson:"last_seen"`
+}
+
+// out - coverage output with dates in order, the first and the last date of domain links. Rows without dates are counted only in total
+func (c dateCoverageCounts) out(domain string) *DomainDateCoverage {
+	coverage := &DomainDateCoverage{Domain: domain, Dates: make([]DateLinks, 0, len(c.FirstSeen)+len(c.LastSeen))}
+	if len(c.Links) > 0 {
+		coverage.Links = c.Links[0].Links
+	}
+
+	dates := make(map[string]*DateLinks)
+	dateLinks := func(date string) *DateLinks {
+		if dates[date] == nil {
+			dates[date] = &DateLinks{Date: date}
+		}
+		return dates[date]
+	}
+	for _, count := range c.FirstSeen {
+		if count.Date != "" {
+			dateLinks(count.Date).FirstSeen += count.Links
+		}
+	}
+	for _, count := range c.LastSeen {
+		if count.Date != "" {
+			dateLinks(count.Date).LastSeen += count.Links
+		}
+	}
+
+	for _, date := range dates {
+		coverage.Dates = append(coverage.Dates, *date)
+	}
+	slices.SortFunc(coverage.Dates, func(a, b DateLinks) int {
+		return strings.Compare(a.Date, b.Date)
+	})
+	if len(coverage.Dates) > 0 {
+		coverage.DateFrom = coverage.Dates[0].Date
+		coverage.DateTo = coverage.Dates[len(coverage.Dates)-1].Date
+	}
+
+	return coverage
+}
+
+// ControllerLinksStatus - check if links collection exists and has links, document count is estimated from collection metadata
+func (app *App) ControllerLinksStatus() (LinksStatus, error) {
+	status := LinksStatus{Database: app.Dbname, Collection: app.linksCollection()}
+	database := app.DB.Database(app.Dbname)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	names, err := database.ListCollectionNames(ctx, bson.D{{Key: "name", Value: status.Collection}})
+	if err != nil {
+		return status, err
+	}
+	status.Exists = len(names) > 0
+	if !status.Exists {
+		return status, nil
+	}
+
+	status.Documents, err = database.Collection(status.Collection).EstimatedDocumentCount(ctx)
+	if err != nil {
+		return status, err
+	}
+	status.Ready = status.Documents > 0
+
+	return status, nil
+}
+
+// ControllerGetPage - get stored page info, the newest import is returned when page was loaded from many segments, nil when page is unknown
+func (app *App) ControllerGetPage(pageURL *url.URL) (*PageOut, error) {
+	collection := app.DB.Database(app.Dbname).Collection(app.pagesCollection())
+
+	findOptions := options.FindOne().SetSort(bson.D{{Key: "imported", Value: -1}}).SetMaxTime(11 * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var page PageRow
+	err := collection.FindOne(ctx, generatePageFilter(pageURL), findOptions).Decode(&page)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, errors.New("Query timeout")
+		}
 		return nil, err
 	}
 
-	outLinks = cleanDomainLinks(&links, limit)
+	pageOut := pageRowToOut(page)
+	return &pageOut, nil
+}
+
+// ControllerGetLinkDetail - get all stored rows of one link from one source page merged into link detail, nil when link is unknown
+func (app *App) ControllerGetLinkDetail(filter bson.M) (*LinkDetail, error) {
+	collection := app.DB.Database(app.Dbname).Collection(app.linksCollection())
 
+	findOptions := options.Find().SetSort(bson.D{{Key: "datefrom", Value: 1}, {Key: "dateto", Value: 1}}).SetLimit(maxLinkCrawls).SetMaxTime(11 * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, errors.New("Query timeout")
+		}
+		return nil, err
+	}
 	defer cursor.Close(ctx)
 
-	return outLinks, nil
+	var links []LinkRow
+	for cursor.Next(ctx) {
+		var link LinkRow
+		if err := cursor.Decode(&link); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return linkRowsToDetail(links), nil
+}
+
+// linkRowsToDetail - merge rows of one link sorted by date, nil when there are no rows
+func linkRowsToDetail(links []LinkRow) *LinkDetail {
+	if len(links) == 0 {
+		return nil
+	}
+
+	first := links[0]
+	detail := &LinkDetail{
+		LinkUrl:    showLinkScheme(first.LinkScheme) + showSubDomain(first.LinkSubDomain) + first.LinkDomain + showPathAndQuery(first.LinkPath, first.LinkRawQuery),
+		PageUrl:    showLinkScheme(first.PageScheme) + first.PageHost + showLinkPath(first.PagePath) + showSubQuery(first.PageRawQuery),
+		PageDomain: rowPageDomain(first),
+		DateFrom:   first.DateFrom,
+		DateTo:     first.DateTo,
+		IP:         []string{},
+		Crawls:     make([]LinkCrawl, 0, len(links)),
+	}
+	for _, link := range links {
+		if link.DateFrom < detail.DateFrom {
+			detail.DateFrom = link.DateFrom
+		}
+		if link.DateTo >= detail.DateTo {
+			detail.DateTo = link.DateTo
+			detail.NoFollow = link.NoFollow
+		}
+		if link.PageTitle != "" {
+			detail.PageTitle = link.PageTitle
+		}
+		if link.IP != "" && !slices.Contains(detail.IP, link.IP) {
+			detail.IP = append(detail.IP, link.IP)
+		}
+		detail.Qty += link.Qty
+		detail.Crawls = append(detail.Crawls, LinkCrawl{
+			DateFrom:    link.DateFrom,
+			DateTo:      link.DateTo,
+			IP:          link.IP,
+			LinkText:    link.LinkText,
+			NoFollow:    link.NoFollow,
+			PageNoIndex: link.PageNoIndex,
+			Qty:         link.Qty,
+		})
+	}
+
+	return detail
+}
+
+// linkDetailFilter - match rows of one link from one source page, see sourceURLFilter and linkURLFilter
+func linkDetailFilter(pageURL string, linkURL string) (bson.M, bool) {
+	filter, ok := sourceURLFilter(pageURL)
+	if !ok {
+		return nil, false
+	}
+	linkFilter, ok := linkURLFilter(linkURL)
+	if !ok {
+		return nil, false
+	}
+	for key, value := range linkFilter {
+		filter[key] = value
+	}
+
+	return filter, true
+}
+
+// linkURLFilter - match link by its domain, subdomain, path and query the same way importer saved them, url without scheme matches http and https links.
+// Fragment is ignored
+func linkURLFilter(val string) (bson.M, bool) {
+	val = strings.TrimSpace(val)
+	if val == "" || len(val) > maxSourceURLLength {
+		return nil, false
+	}
+
+	// accepts http://domain.com/page, //domain.com/page and domain.com/page
+	scheme := ""
+	if before, after, found := strings.Cut(val, "://"); found {
+		switch strings.ToLower(before) {
+		case "http":
+			scheme = "1"
+		case "https":
+			scheme = "2"
+		default:
+			return nil, false
+		}
+		val = after
+	}
+	linkURL, err := url.Parse("https://" + strings.TrimPrefix(val, "//"))
+	if err != nil || !commoncrawl.IsValidDomain(linkURL.Hostname()) {
+		return nil, false
+	}
+	host := strings.ToLower(linkURL.Hostname())
+	domain, ok := commoncrawl.RegistrableDomain(host)
+	if !ok {
+		return nil, false
+	}
+
+	filter := bson.M{
+		"linkdomain":    domain,
+		"linksubdomain": strings.TrimSuffix(strings.TrimSuffix(host, domain), "."),
+		"linkpath":      showLinkPath(linkURL.Path),
+		"linkrawquery":  commoncrawl.NormalizeQuery(linkURL.RawQuery),
+	}
+	if scheme != "" {
+		filter["linkscheme"] = scheme
+	}
+
+	return filter, true
+}
+
+// ControllerSearchPages - search pages by title within domain, only the newest import of every page is returned
+func (app *App) ControllerSearchPages(apiRequest APIPageSearchRequest) ([]PageOut, error) {
+	var limit int64 = 100
+	var page int64 = 1
+
+	if apiRequest.Limit != nil && *apiRequest.Limit > 0 && *apiRequest.Limit <= 100 {
+		limit = *apiRequest.Limit
+	}
+	if apiRequest.Page != nil && *apiRequest.Page > 0 {
+		page = *apiRequest.Page
+	}
+
+	collection := app.DB.Database(app.Dbname).Collection(app.pagesCollection())
+
+	domainParsed, ok := commoncrawl.RegistrableDomain(*apiRequest.Domain)
+	if !ok {
+		return nil, errNoRegistrableDomain
+	}
+
+	filter, ok := generatePageSearchFilter(*apiRequest.Domain, domainParsed, *apiRequest.Title)
+	if !ok {
+		return nil, errors.New("invalid title")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	aggregateOptions := options.Aggregate().SetAllowDiskUse(true).SetMaxTime(61 * time.Second)
+	cursor, err := collection.Aggregate(ctx, pageSearchPipeline(filter, limit, page), aggregateOptions)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, errors.New("Query timeout")
+		}
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	outPages := make([]PageOut, 0, limit)
+	for cursor.Next(ctx) {
+		var pageRow PageRow
+		if err := cursor.Decode(&pageRow); err != nil {
+			return nil, err
+		}
+		outPages = append(outPages, pageRowToOut(pageRow))
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return outPages, nil
+}
+
+// pageSearchPipeline - keep the newest import of every page before skip and limit, so every result page is full.
+// Page is identified by host, path and query like in page lookup, scheme is ignored
+func pageSearchPipeline(filter bson.M, limit int64, page int64) mongo.Pipeline {
+	pageKey := bson.D{
+		{Key: "host", Value: 1},
+		{Key: "path", Value: 1},
+		{Key: "rawquery", Value: 1},
+	}
+
+	return mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$sort", Value: append(slices.Clone(pageKey), bson.E{Key: "imported", Value: -1})}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "host", Value: "$host"}, {Key: "path", Value: "$path"}, {Key: "rawquery", Value: "$rawquery"}}},
+			{Key: "page", Value: bson.D{{Key: "$first", Value: "$$ROOT"}}},
+		}}},
+		{{Key: "$replaceRoot", Value: bson.D{{Key: "newRoot", Value: "$page"}}}},
+		{{Key: "$sort", Value: pageKey}},
+		{{Key: "$skip", Value: (page - 1) * limit}},
+		{{Key: "$limit", Value: limit}},
+	}
+}
+
+// generatePageSearchFilter - filter pages from domain or only from subdomain with title containing escaped text
+func generatePageSearchFilter(domain string, domainParsed string, title string) (bson.M, bool) {
+	titleFilter, ok := regexFilter(title, FilterKindText)
+	if !ok {
+		return nil, false
+	}
+
+	filter := bson.M{"domain": domainParsed, "title": titleFilter}
+	if domainParsed != domain {
+		filter["host"] = domain
+	}
+
+	return filter, true
+}
+
+// pageRowToOut - build page output from stored page
+func pageRowToOut(page PageRow) PageOut {
+	return PageOut{
+		PageUrl:       showLinkScheme(page.Scheme) + page.Host + showLinkPath(page.Path) + showSubQuery(page.RawQuery),
+		Title:         page.Title,
+		IP:            page.IP,
+		Imported:      page.Imported,
+		InternalLinks: page.InternalLinks,
+		ExternalLinks: page.ExternalLinks,
+		NoIndex:       page.NoIndex,
+		Language:      page.Language,
+	}
+}
+
+// generatePageFilter - filter page by host, path and query the same way importer saved them, scheme is ignored
+func generatePageFilter(pageURL *url.URL) bson.M {
+	return bson.M{
+		"host":     strings.ToLower(pageURL.Hostname()),
+		"path":     showLinkPath(pageURL.Path),
+		"rawquery": commoncrawl.NormalizeQuery(pageURL.RawQuery),
+	}
 }
 
 // generateFilter creates a MongoDB filter based on the given parameters
 func generateFilter(domain string, domainParsed string, apiRequest *APIRequest) bson.M {
 	// Create a filter for the query
-	filter := bson.M{"linkdomain": domain}
-	if domainParsed != domain {
-		subdomain := domain[:len(domain)-len(domainParsed)-1]
-		filter = bson.M{"linkdomain": domainParsed, "linksubdomain": subdomain}
+	filter := bson.M{"linkdomain": domainParsed}
+	switch {
+	case apiRequest.IncludeSubdomains != nil && *apiRequest.IncludeSubdomains:
+		// all subdomains of registered domain
+	case domainParsed != domain:
+		filter["linksubdomain"] = domain[:len(domain)-len(domainParsed)-1]
+	case apiRequest.IncludeSubdomains != nil && apiRequest.IncludeWww != nil && *apiRequest.IncludeWww:
+		// apex domain and www, usually the same site
+		filter["linksubdomain"] = bson.M{"$in": bson.A{"", "www"}}
+	case apiRequest.IncludeSubdomains != nil:
+		// apex domain only
+		filter["linksubdomain"] = ""
+	}
+	// excluded links are listed in $nor, it keeps pagehost and linkpath free for Source Host, Source URL and Link Path filters
+	var excluded bson.A
+	if apiRequest.ExternalOnly != nil && *apiRequest.ExternalOnly {
+		// links stored before page domain was added are checked by page host
+		excluded = append(excluded,
+			bson.M{"pagedomain": domainParsed},
+			bson.M{"pagedomain": bson.M{"$exists": false}, "pagehost": sameDomainHostRegex(domainParsed)},
+		)
+	}
+	if apiRequest.ExcludeHomepage != nil && *apiRequest.ExcludeHomepage {
+		excluded = append(excluded, bson.M{"linkpath": "/", "linkrawquery": ""})
 	}
+	if len(excluded) > 0 {
+		filter["$nor"] = excluded
+	}
+	// paths are case sensitive on most servers, by default they are still matched case insensitive like other filters
+	caseSensitivePaths := apiRequest.CaseSensitivePaths != nil && *apiRequest.CaseSensitivePaths
 	if apiRequest.Filters != nil {
 		for _, filterData := range *apiRequest.Filters {
 			switch filterData.Name {
 			case "No Follow":
 				val, err := strconv.Atoi(filterData.Val)
 				if err == nil {
-					filter["nofollow"] = val
+					addFieldFilter(filter, "nofollow", val)
 				}
 			case "Link Path":
-				if filterData.Kind == FilterKindExact {
-					filter["linkpath"] = bson.M{"$regex": primitive.Regex{Pattern: "^" + filterData.Val + "$", Options: "i"}}
-				}
-				if filterData.Kind == FilterKindAny {
-					filter["linkpath"] = bson.M{"$regex": primitive.Regex{Pattern: filterData.Val, Options: "i"}}
+				if regex, ok := pathRegexFilter(filterData.Val, filterData.Kind, caseSensitivePaths); ok {
+					addFieldFilter(filter, "linkpath", regex)
 				}
 			case "Source Host":
-				if filterData.Kind == FilterKindExact {
-					filter["pagehost"] = bson.M{"$regex": primitive.Regex{Pattern: "^" + filterData.Val + "$", Options: "i"}}
-				}
-				if filterData.Kind == FilterKindAny {
-					filter["pagehost"] = bson.M{"$regex": primitive.Regex{Pattern: filterData.Val, Options: "i"}}
+				if regex, ok := hostRegexFilter(filterData.Val, filterData.Kind); ok {
+					addFieldFilter(filter, "pagehost", regex)
 				}
 			case "Source Path":
-				if filterData.Kind == FilterKindExact {
-					filter["pagepath"] = bson.M{"$regex": primitive.Regex{Pattern: "^" + filterData.Val + "$", Options: "i"}}
-				}
-				if filterData.Kind == FilterKindAny {
-					filter["pagepath"] = bson.M{"$regex": primitive.Regex{Pattern: filterData.Val, Options: "i"}}
+				if regex, ok := pathRegexFilter(filterData.Val, filterData.Kind, caseSensitivePaths); ok {
+					addFieldFilter(filter, "pagepath", regex)
 				}
 			case "Anchor":
-				if filterData.Kind == FilterKindExact {
-					filter["linktext"] = bson.M{"$regex": primitive.Regex{Pattern: "^" + filterData.Val + "$", Options: "i"}}
+				if regex, ok := regexFilter(filterData.Val, filterData.Kind); ok {
+					addFieldFilter(filter, "linktext", regex)
 				}
-				if filterData.Kind == FilterKindAny {
-					filter["linktext"] = bson.M{"$regex": primitive.Regex{Pattern: filterData.Val, Options: "i"}}
+			case "Source URL":
+				if pageFilter, ok := sourceURLFilter(filterData.Val); ok {
+					for key, val := range pageFilter {
+						addFieldFilter(filter, key, val)
+					}
 				}
-
 			}
 		}
 	}
@@ -180,27 +649,153 @@ func generateFilter(domain string, domainParsed string, apiRequest *APIRequest)
 	return filter
 }
 
-func cleanDomainLinks(links *[]LinkRow, limit int64) []LinkOut {
+// addFieldFilter - add condition of field to filter, condition of field that is already filtered (like page host of Source Host
+// and Source URL) is added to $and, so both have to match instead of the later one replacing the other
+func addFieldFilter(filter bson.M, field string, condition any) {
+	if _, exists := filter[field]; !exists {
+		filter[field] = condition
+		return
+	}
+	and, _ := filter["$and"].(bson.A)
+	filter["$and"] = append(and, bson.M{field: condition})
+}
+
+// rowPageDomain - registered domain of page with the link, derived from page host for links stored before page domain was added
+func rowPageDomain(link LinkRow) string {
+	if link.PageDomain != "" {
+		return link.PageDomain
+	}
+	pageDomain, ok := commoncrawl.RegistrableDomain(strings.ToLower(link.PageHost))
+	if !ok {
+		return strings.ToLower(link.PageHost)
+	}
+	return pageDomain
+}
+
+// sameDomainHostRegex - match host of registered domain and all its subdomains
+func sameDomainHostRegex(domainParsed string) bson.M {
+	return bson.M{"$regex": primitive.Regex{Pattern: `^(.+\.)?` + regexp.QuoteMeta(domainParsed) + "$", Options: "i"}}
+}
+
+// regexFilter - case insensitive regex filter, values of exact and any kinds are regular expressions, values of prefix and
+// text kinds are escaped and matched as plain text
+func regexFilter(val string, kind string) (bson.M, bool) {
+	return caseRegexFilter(val, kind, false)
+}
+
+// caseRegexFilter - regex filter like regexFilter, matched case sensitive when caseSensitive is set
+func caseRegexFilter(val string, kind string, caseSensitive bool) (bson.M, bool) {
+	if val == "" {
+		return nil, false
+	}
+
+	var pattern string
+	switch kind {
+	case FilterKindExact:
+		pattern = "^" + val + "$"
+	case FilterKindAny:
+		pattern = val
+	case FilterKindPrefix, FilterKindText:
+		if len(val) > maxFilterValueLength {
+			return nil, false
+		}
+		pattern = regexp.QuoteMeta(val)
+		if kind == FilterKindPrefix {
+			pattern = "^" + pattern
+		}
+	default:
+		return nil, false
+	}
+
+	options := "i"
+	if caseSensitive {
+		options = ""
+	}
+
+	return bson.M{"$regex": primitive.Regex{Pattern: pattern, Options: options}}, true
+}
+
+// pathRegexFilter - regex filter of link or page path, prefix is always matched case sensitive, so it is resolved from index
+// instead of scanning all links of domain. Other kinds are case sensitive only when caseSensitive is set
+func pathRegexFilter(val string, kind string, caseSensitive bool) (bson.M, bool) {
+	return caseRegexFilter(val, kind, caseSensitive || kind == FilterKindPrefix)
+}
+
+// hostRegexFilter - regex filter of page host, hosts are saved in lowercase, so prefix is matched case sensitive with lowercase value
+// and can use index
+func hostRegexFilter(val string, kind string) (bson.M, bool) {
+	if kind == FilterKindPrefix {
+		return caseRegexFilter(strings.ToLower(val), kind, true)
+	}
+	return regexFilter(val, kind)
+}
+
+// sourceURLFilter - match links from one source page by its host, path and query, url without scheme matches http and https pages.
+// Source URL is always matched exactly, fragment is ignored
+func sourceURLFilter(val string) (bson.M, bool) {
+	val = strings.TrimSpace(val)
+	if val == "" || len(val) > maxSourceURLLength {
+		return nil, false
+	}
+
+	// accepts http://domain.com/page, //domain.com/page and domain.com/page
+	scheme := ""
+	if before, after, found := strings.Cut(val, "://"); found {
+		switch strings.ToLower(before) {
+		case "http":
+			scheme = "1"
+		case "https":
+			scheme = "2"
+		default:
+			return nil, false
+		}
+		val = after
+	}
+	sourceURL, err := url.Parse("https://" + strings.TrimPrefix(val, "//"))
+	if err != nil || !commoncrawl.IsValidDomain(sourceURL.Hostname()) {
+		return nil, false
+	}
+
+	filter := bson.M{
+		"pagehost":     strings.ToLower(sourceURL.Hostname()),
+		"pagepath":     showLinkPath(sourceURL.Path),
+		"pagerawquery": commoncrawl.NormalizeQuery(sourceURL.RawQuery),
+	}
+	if scheme != "" {
+		filter["pagescheme"] = scheme
+	}
+
+	return filter, true
+}
+
+// cleanDomainLinks - merge duplicated links, hasMore is true when limit was reached before all rows were used
+func cleanDomainLinks(links *[]LinkRow, limit int64) (outLinks []LinkOut, hasMore bool) {
 	lastLink := LinkOut{}
 	curLink := LinkOut{}
-	outLinks := make([]LinkOut, 0, len(*links))
+	outLinks = make([]LinkOut, 0, len(*links))
 	i := 0
 	for _, link := range *links {
 
 		if i >= int(limit) {
+			hasMore = true
 			break
 		}
 
 		curLink = LinkOut{
-			LinkUrl:  showLinkScheme(link.LinkScheme) + "://" + showSubDomain(link.LinkSubDomain) + link.LinkDomain + showLinkPath(link.LinkPath) + showSubQuery(link.LinkRawQuery),
-			PageUrl:  showLinkScheme(link.PageScheme) + "://" + link.PageHost + showLinkPath(link.PagePath) + showSubQuery(link.PageRawQuery),
-			LinkText: link.LinkText,
-			NoFollow: link.NoFollow,
-			NoIndex:  link.NoIndex,
-			DateFrom: link.DateFrom,
-			DateTo:   link.DateTo,
-			IP:       []string{link.IP},
-			Qty:      link.Qty,
+			LinkUrl:     showLinkScheme(link.LinkScheme) + showSubDomain(link.LinkSubDomain) + link.LinkDomain + showPathAndQuery(link.LinkPath, link.LinkRawQuery),
+			PageUrl:     showLinkScheme(link.PageScheme) + link.PageHost + showLinkPath(link.PagePath) + showSubQuery(link.PageRawQuery),
+			PageDomain:  rowPageDomain(link),
+			LinkText:    link.LinkText,
+			NoFollow:    link.NoFollow,
+			PageNoIndex: link.PageNoIndex,
+			NoIndex:     link.PageNoIndex,
+			DateFrom:    link.DateFrom,
+			DateTo:      link.DateTo,
+			IP:          []string{link.IP},
+			Qty:         link.Qty,
+			LinkType:    link.LinkType,
+			LinkTitle:   link.LinkTitle,
+			PageTitle:   link.PageTitle,
 		}
 
 		if lastLink.LinkUrl != curLink.LinkUrl || lastLink.PageUrl != curLink.PageUrl || lastLink.LinkText != curLink.LinkText || lastLink.NoFollow != curLink.NoFollow {
@@ -212,11 +807,12 @@ func cleanDomainLinks(links *[]LinkRow, limit int64) []LinkOut {
 			continue
 		}
 
-		if lastLink.DateFrom < curLink.DateFrom {
+		// merged link is seen from the earliest to the latest crawl of its rows
+		if curLink.DateFrom < lastLink.DateFrom {
 			lastLink.DateFrom = curLink.DateFrom
 		}
 
-		if lastLink.DateTo > curLink.DateTo {
+		if curLink.DateTo > lastLink.DateTo {
 			lastLink.DateTo = curLink.DateTo
 		}
 
@@ -226,14 +822,44 @@ func cleanDomainLinks(links *[]LinkRow, limit int64) []LinkOut {
 
 	}
 
-	return outLinks
+	// last merged link is not followed by a different one
+	if lastLink.LinkUrl != "" && !hasMore {
+		if i < int(limit) {
+			outLinks = append(outLinks, lastLink)
+		} else {
+			hasMore = true
+		}
+	}
+
+	return outLinks, hasMore
 }
 
+// linksToEdges - edges from source pages to link urls, links of the same page and url with other text or nofollow are one edge with sum of their qty
+func linksToEdges(links []LinkOut) []LinkEdge {
+	edges := make([]LinkEdge, 0, len(links))
+	edgeIndex := make(map[[2]string]int, len(links))
+	for _, link := range links {
+		key := [2]string{link.PageUrl, link.LinkUrl}
+		if i, ok := edgeIndex[key]; ok {
+			edges[i].Weight += link.Qty
+			continue
+		}
+		edgeIndex[key] = len(edges)
+		edges = append(edges, LinkEdge{Source: link.PageUrl, Target: link.LinkUrl, Weight: link.Qty})
+	}
+
+	return edges
+}
+
+// showLinkScheme - beginning of url for scheme saved by importer, links with other scheme than http or https are shown as protocol relative
 func showLinkScheme(scheme string) string {
-	if scheme == "1" {
-		return "http"
+	switch scheme {
+	case "1":
+		return "http://"
+	case "0":
+		return "//"
 	}
-	return "https"
+	return "https://"
 }
 
 func showSubDomain(subDomain string) string {
@@ -250,11 +876,21 @@ func showSubQuery(rawQuery string) string {
 	return "?" + rawQuery
 }
 
+// showLinkPath - path of url, # of path is encoded, it would start fragment of shown url
 func showLinkPath(linkPath string) string {
 	if linkPath == "" {
 		return "/"
 	}
-	return linkPath
+	return strings.ReplaceAll(linkPath, "#", "%23")
+}
+
+// showPathAndQuery - build path with query, fragment saved with link path is moved behind the query
+func showPathAndQuery(linkPath string, rawQuery string) string {
+	fragment := ""
+	if i := strings.Index(linkPath, "#"); i >= 0 {
+		linkPath, fragment = linkPath[:i], linkPath[i:]
+	}
+	return showLinkPath(linkPath) + showSubQuery(rawQuery) + fragment
 }
 
 func addIPsToLink(lastLink *LinkOut, curLink *LinkOut) {
@@ -0,0 +1,1066 @@
+package linkdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/kris-dev-hub/globallinks/pkg/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestShowPathAndQuery(t *testing.T) {
+	tests := []struct {
+		path     string
+		rawQuery string
+		want     string
+	}{
+		{"/page", "", "/page"},
+		{"", "", "/"},
+		{"/page", "a=1", "/page?a=1"},
+		{"/app#/first", "", "/app#/first"},
+		{"/app#/first", "a=1", "/app?a=1#/first"},
+		{"/c%23/intro", "", "/c%23/intro"},
+		{"/c%23/intro#part", "a=1", "/c%23/intro?a=1#part"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path+"?"+tt.rawQuery, func(t *testing.T) {
+			if got := showPathAndQuery(tt.path, tt.rawQuery); got != tt.want {
+				t.Errorf("showPathAndQuery(%q, %q) = %q, want %q", tt.path, tt.rawQuery, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShowLinkPath(t *testing.T) {
+	// path decoded by url parser, like source url of filter, is shown with # encoded
+	parsed, err := url.Parse("https://example.com/c%23/intro")
+	if err != nil {
+		t.Fatalf("url.Parse() error = %v", err)
+	}
+	if got := showLinkPath(parsed.Path); got != "/c%23/intro" {
+		t.Errorf("showLinkPath(%q) = %q, want %q", parsed.Path, got, "/c%23/intro")
+	}
+}
+
+func TestCleanDomainLinksLastLink(t *testing.T) {
+	link := func(path string, qty int) LinkRow {
+		return LinkRow{LinkDomain: "example.com", LinkPath: path, LinkScheme: "2", PageHost: "source.com", PagePath: "/", PageScheme: "2", LinkText: "text", IP: "1.1.1.1", Qty: qty}
+	}
+
+	tests := []struct {
+		name     string
+		links    []LinkRow
+		limit    int64
+		wantUrls []string
+		wantQty  int
+	}{
+		{"single link", []LinkRow{link("/a", 1)}, 100, []string{"https://example.com/a"}, 1},
+		{"last links merged", []LinkRow{link("/a", 1), link("/b", 1), link("/b", 2)}, 100, []string{"https://example.com/a", "https://example.com/b"}, 3},
+		{"limit reached before last link", []LinkRow{link("/a", 1), link("/b", 1)}, 1, []string{"https://example.com/a"}, 1},
+		{"no links", nil, 100, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outLinks, _ := cleanDomainLinks(&tt.links, tt.limit)
+
+			if len(outLinks) != len(tt.wantUrls) {
+				t.Fatalf("cleanDomainLinks() = %+v, want urls %v", outLinks, tt.wantUrls)
+			}
+			for i, link := range outLinks {
+				if link.LinkUrl != tt.wantUrls[i] {
+					t.Errorf("link %d url = %s, want %s", i, link.LinkUrl, tt.wantUrls[i])
+				}
+			}
+			if len(outLinks) > 0 && outLinks[len(outLinks)-1].Qty != tt.wantQty {
+				t.Errorf("last link qty = %d, want %d", outLinks[len(outLinks)-1].Qty, tt.wantQty)
+			}
+		})
+	}
+}
+
+func TestCleanDomainLinksDates(t *testing.T) {
+	link := func(dateFrom string, dateTo string) LinkRow {
+		return LinkRow{LinkDomain: "example.com", LinkPath: "/a", LinkScheme: "2", PageHost: "source.com", PagePath: "/", PageScheme: "2", LinkText: "text", DateFrom: dateFrom, DateTo: dateTo, IP: "1.1.1.1", Qty: 1}
+	}
+
+	tests := []struct {
+		name         string
+		links        []LinkRow
+		wantDateFrom string
+		wantDateTo   string
+	}{
+		{"later rows", []LinkRow{link("2023-01-28", "2023-02-04"), link("2023-05-30", "2023-06-01")}, "2023-01-28", "2023-06-01"},
+		{"earlier rows", []LinkRow{link("2023-05-30", "2023-06-01"), link("2023-01-28", "2023-02-04")}, "2023-01-28", "2023-06-01"},
+		{"row within range", []LinkRow{link("2023-01-28", "2023-06-01"), link("2023-02-04", "2023-02-09")}, "2023-01-28", "2023-06-01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outLinks, _ := cleanDomainLinks(&tt.links, 100)
+
+			if len(outLinks) != 1 {
+				t.Fatalf("cleanDomainLinks() = %+v, want one merged link", outLinks)
+			}
+			if outLinks[0].DateFrom != tt.wantDateFrom || outLinks[0].DateTo != tt.wantDateTo {
+				t.Errorf("merged link dates = %s - %s, want %s - %s", outLinks[0].DateFrom, outLinks[0].DateTo, tt.wantDateFrom, tt.wantDateTo)
+			}
+		})
+	}
+}
+
+func TestRegexFilter(t *testing.T) {
+	tests := []struct {
+		name        string
+		val         string
+		kind        string
+		wantPattern string
+		wantOk      bool
+	}{
+		{"exact", "/blog", FilterKindExact, "^/blog$", true},
+		{"any", "news", FilterKindAny, "news", true},
+		{"any is regex", "^/blog/.*-[0-9]+$", FilterKindAny, "^/blog/.*-[0-9]+$", true},
+		{"exact is regex", "/(en|de)/", FilterKindExact, "^/(en|de)/$", true},
+		{"long regex", "/" + strings.Repeat("a", maxFilterValueLength), FilterKindAny, "/" + strings.Repeat("a", maxFilterValueLength), true},
+		{"text is escaped", ".*(a+)+$", FilterKindText, `\.\*\(a\+\)\+\$`, true},
+		{"prefix is escaped", "/c++/", FilterKindPrefix, `^/c\+\+/`, true},
+		{"unknown kind", "news", "regex", "", false},
+		{"empty value", "", FilterKindAny, "", false},
+		{"too long text", string(make([]byte, maxFilterValueLength+1)), FilterKindText, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := regexFilter(tt.val, tt.kind)
+			if ok != tt.wantOk {
+				t.Fatalf("regexFilter() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			regex := got["$regex"].(primitive.Regex)
+			if regex.Pattern != tt.wantPattern || regex.Options != "i" {
+				t.Errorf("regexFilter() = %v, want pattern %q", regex, tt.wantPattern)
+			}
+		})
+	}
+}
+
+func TestGenerateFilterValues(t *testing.T) {
+	filters := []ApiRequestFilter{
+		{Name: "Anchor", Val: "(.*)", Kind: FilterKindText},
+		{Name: "Source Host", Val: "(www|blog).example.com", Kind: FilterKindExact},
+		{Name: "Source Path", Val: "/news/.*", Kind: FilterKindAny},
+		{Name: "Link Path", Val: "/path", Kind: "regex"},
+	}
+	filter := generateFilter("example.com", "example.com", &APIRequest{Filters: &filters})
+
+	want := bson.M{
+		"linkdomain": "example.com",
+		"linktext":   bson.M{"$regex": primitive.Regex{Pattern: `\(\.\*\)`, Options: "i"}},
+		"pagehost":   bson.M{"$regex": primitive.Regex{Pattern: `^(www|blog).example.com$`, Options: "i"}},
+		"pagepath":   bson.M{"$regex": primitive.Regex{Pattern: `/news/.*`, Options: "i"}},
+	}
+	if !reflect.DeepEqual(filter, want) {
+		t.Errorf("generateFilter() = %v, want %v", filter, want)
+	}
+}
+
+func TestSourceURLFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		val  string
+		want bson.M
+	}{
+		{"https url", "https://blog.source.com/post?id=1", bson.M{"pagehost": "blog.source.com", "pagepath": "/post", "pagerawquery": "id=1", "pagescheme": "2"}},
+		{"http url", "http://source.com/post", bson.M{"pagehost": "source.com", "pagepath": "/post", "pagerawquery": "", "pagescheme": "1"}},
+		{"uppercase scheme and host", "HTTPS://Source.COM/Post", bson.M{"pagehost": "source.com", "pagepath": "/Post", "pagerawquery": "", "pagescheme": "2"}},
+		{"without scheme matches any scheme", "source.com/post", bson.M{"pagehost": "source.com", "pagepath": "/post", "pagerawquery": ""}},
+		{"protocol relative", "//source.com/post", bson.M{"pagehost": "source.com", "pagepath": "/post", "pagerawquery": ""}},
+		{"root page", "https://source.com", bson.M{"pagehost": "source.com", "pagepath": "/", "pagerawquery": "", "pagescheme": "2"}},
+		{"fragment is ignored", " https://source.com/post#comments ", bson.M{"pagehost": "source.com", "pagepath": "/post", "pagerawquery": "", "pagescheme": "2"}},
+		{"port is ignored", "https://source.com:443/post", bson.M{"pagehost": "source.com", "pagepath": "/post", "pagerawquery": "", "pagescheme": "2"}},
+		{"separator in query is encoded", "https://source.com/post?a=1|2", bson.M{"pagehost": "source.com", "pagepath": "/post", "pagerawquery": "a=1%7C2", "pagescheme": "2"}},
+		{"ignored query is removed", "https://source.com/post?utm_source=news", bson.M{"pagehost": "source.com", "pagepath": "/post", "pagerawquery": "", "pagescheme": "2"}},
+		{"other scheme", "ftp://source.com/post", nil},
+		{"invalid host", "https://localhost/post", nil},
+		{"empty", "", nil},
+		{"too long", "https://source.com/" + strings.Repeat("a", maxSourceURLLength), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := sourceURLFilter(tt.val)
+			if ok != (tt.want != nil) {
+				t.Fatalf("sourceURLFilter(%q) ok = %v, want %v", tt.val, ok, tt.want != nil)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sourceURLFilter(%q) = %v, want %v", tt.val, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinkURLFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		val  string
+		want bson.M
+	}{
+		{"https url", "https://blog.example.com/post?id=1", bson.M{"linkdomain": "example.com", "linksubdomain": "blog", "linkpath": "/post", "linkrawquery": "id=1", "linkscheme": "2"}},
+		{"apex domain", "http://Example.COM", bson.M{"linkdomain": "example.com", "linksubdomain": "", "linkpath": "/", "linkrawquery": "", "linkscheme": "1"}},
+		{"public suffix with two labels", "www.example.co.uk/a", bson.M{"linkdomain": "example.co.uk", "linksubdomain": "www", "linkpath": "/a", "linkrawquery": ""}},
+		{"port and fragment are ignored", "https://a.b.example.com:8080/p#top", bson.M{"linkdomain": "example.com", "linksubdomain": "a.b", "linkpath": "/p", "linkrawquery": "", "linkscheme": "2"}},
+		{"separator in query is encoded", "https://example.com/p?a=1|2", bson.M{"linkdomain": "example.com", "linksubdomain": "", "linkpath": "/p", "linkrawquery": "a=1%7C2", "linkscheme": "2"}},
+		{"ignored query is removed", "https://example.com/p?ref=home", bson.M{"linkdomain": "example.com", "linksubdomain": "", "linkpath": "/p", "linkrawquery": "", "linkscheme": "2"}},
+		{"other scheme", "ftp://example.com/", nil},
+		{"invalid host", "localhost/post", nil},
+		{"empty", " ", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := linkURLFilter(tt.val)
+			if ok != (tt.want != nil) {
+				t.Fatalf("linkURLFilter(%q) ok = %v, want %v", tt.val, ok, tt.want != nil)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("linkURLFilter(%q) = %v, want %v", tt.val, got, tt.want)
+			}
+		})
+	}
+
+	if _, ok := linkDetailFilter("https://localhost/", "https://example.com/"); ok {
+		t.Errorf("linkDetailFilter() accepted invalid page url")
+	}
+}
+
+// TestURLFilterQueryOptions - url filters find links saved with query normalized by parser options
+func TestURLFilterQueryOptions(t *testing.T) {
+	defer func() {
+		config.SortQueryParams = false
+		config.StripIgnoredQueryParams = false
+		config.DropQueryStrings = false
+	}()
+
+	tests := []struct {
+		name  string
+		set   func()
+		query string
+		want  string
+	}{
+		{"sorted params", func() { config.SortQueryParams = true }, "b=2&a=1", "a=1&b=2"},
+		{"stripped ignored params", func() { config.StripIgnoredQueryParams = true }, "id=1&utm_source=news", "id=1"},
+		{"dropped query", func() { config.DropQueryStrings = true }, "id=1", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.SortQueryParams, config.StripIgnoredQueryParams, config.DropQueryStrings = false, false, false
+			tt.set()
+
+			linkFilter, ok := linkURLFilter("https://example.com/p?" + tt.query)
+			if !ok || linkFilter["linkrawquery"] != tt.want {
+				t.Errorf("linkURLFilter() = %v, want link query %q", linkFilter, tt.want)
+			}
+			sourceFilter, ok := sourceURLFilter("https://source.com/p?" + tt.query)
+			if !ok || sourceFilter["pagerawquery"] != tt.want {
+				t.Errorf("sourceURLFilter() = %v, want page query %q", sourceFilter, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinkRowsToDetail(t *testing.T) {
+	links := []LinkRow{
+		{LinkDomain: "example.com", LinkPath: "/a", LinkScheme: "2", PageHost: "www.source.com", PagePath: "/post", PageScheme: "2", LinkText: "A", NoFollow: 0, DateFrom: "2023-01-02", DateTo: "2023-01-05", IP: "1.1.1.1", Qty: 2},
+		{LinkDomain: "example.com", LinkPath: "/a", LinkScheme: "2", PageHost: "www.source.com", PagePath: "/post", PageScheme: "2", LinkText: "A", NoFollow: 0, DateFrom: "2023-03-01", DateTo: "2023-03-01", IP: "1.1.1.1", Qty: 1},
+		{LinkDomain: "example.com", LinkPath: "/a", LinkScheme: "2", PageHost: "www.source.com", PagePath: "/post", PageScheme: "2", LinkText: "A link", NoFollow: 1, PageNoIndex: 1, DateFrom: "2023-06-10", DateTo: "2023-06-12", IP: "2.2.2.2", Qty: 3},
+	}
+
+	detail := linkRowsToDetail(links)
+	if detail == nil {
+		t.Fatalf("linkRowsToDetail() = nil")
+	}
+	if detail.LinkUrl != "https://example.com/a" || detail.PageUrl != "https://www.source.com/post" || detail.PageDomain != "source.com" {
+		t.Errorf("linkRowsToDetail() urls = %s from %s (%s)", detail.LinkUrl, detail.PageUrl, detail.PageDomain)
+	}
+	if detail.DateFrom != "2023-01-02" || detail.DateTo != "2023-06-12" || detail.Qty != 6 || detail.NoFollow != 1 {
+		t.Errorf("linkRowsToDetail() = %s - %s, qty %d, nofollow %d, want 2023-01-02 - 2023-06-12, qty 6, nofollow 1", detail.DateFrom, detail.DateTo, detail.Qty, detail.NoFollow)
+	}
+	if !reflect.DeepEqual(detail.IP, []string{"1.1.1.1", "2.2.2.2"}) {
+		t.Errorf("linkRowsToDetail() IP = %v, want [1.1.1.1 2.2.2.2]", detail.IP)
+	}
+	wantLast := LinkCrawl{DateFrom: "2023-06-10", DateTo: "2023-06-12", IP: "2.2.2.2", LinkText: "A link", NoFollow: 1, PageNoIndex: 1, Qty: 3}
+	if len(detail.Crawls) != 3 || detail.Crawls[2] != wantLast {
+		t.Errorf("linkRowsToDetail() crawls = %+v, want 3 crawls ending with %+v", detail.Crawls, wantLast)
+	}
+
+	if linkRowsToDetail(nil) != nil {
+		t.Errorf("linkRowsToDetail(nil) != nil")
+	}
+}
+
+func TestDateCoverageCounts(t *testing.T) {
+	// links of three crawls, no link was first or last seen in 2023-03 crawl, one row is stored without dates
+	counts := dateCoverageCounts{
+		Links:     []dateCount{{Links: 6}},
+		FirstSeen: []dateCount{{Date: "", Links: 1}, {Date: "2023-01-28", Links: 2}, {Date: "2023-02-04", Links: 1}, {Date: "2023-05-30", Links: 2}},
+		LastSeen:  []dateCount{{Date: "", Links: 1}, {Date: "2023-01-28", Links: 1}, {Date: "2023-02-09", Links: 1}, {Date: "2023-05-30", Links: 2}, {Date: "2023-06-01", Links: 1}},
+	}
+	got := counts.out("example.com")
+
+	want := &DomainDateCoverage{
+		Domain:   "example.com",
+		DateFrom: "2023-01-28",
+		DateTo:   "2023-06-01",
+		Links:    6,
+		Dates: []DateLinks{
+			{Date: "2023-01-28", FirstSeen: 2, LastSeen: 1},
+			{Date: "2023-02-04", FirstSeen: 1},
+			{Date: "2023-02-09", LastSeen: 1},
+			{Date: "2023-05-30", FirstSeen: 2, LastSeen: 2},
+			{Date: "2023-06-01", LastSeen: 1},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dateCoverageCounts.out() = %+v, want %+v", got, want)
+	}
+
+	if empty := (dateCoverageCounts{}).out("example.com"); empty.Links != 0 || empty.DateFrom != "" || empty.Dates == nil {
+		t.Errorf("dateCoverageCounts.out() without links = %+v, want empty dates list", empty)
+	}
+}
+
+func TestControllerGetDomainDateCoverage(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("filtered links", func(mt *mtest.T) {
+		counts := bson.D{
+			{Key: "links", Value: bson.A{bson.D{{Key: "links", Value: 3}}}},
+			{Key: "first_seen", Value: bson.A{
+				bson.D{{Key: "_id", Value: "2023-01-28"}, {Key: "links", Value: 1}},
+				bson.D{{Key: "_id", Value: "2023-02-04"}, {Key: "links", Value: 1}},
+				bson.D{{Key: "_id", Value: "2023-06-01"}, {Key: "links", Value: 1}},
+			}},
+			{Key: "last_seen", Value: bson.A{
+				bson.D{{Key: "_id", Value: "2023-02-04"}, {Key: "links", Value: 2}},
+				bson.D{{Key: "_id", Value: "2023-06-01"}, {Key: "links", Value: 1}},
+			}},
+		}
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+".links", mtest.FirstBatch, counts))
+
+		app := &App{DB: mt.Client, Dbname: mt.DB.Name()}
+		domain := "blog.example.com"
+		filters := []ApiRequestFilter{{Name: "No Follow", Val: "0"}}
+		coverage, err := app.ControllerGetDomainDateCoverage(APIRequest{Domain: &domain, Filters: &filters})
+		if err != nil {
+			mt.Fatalf("ControllerGetDomainDateCoverage() error = %v", err)
+		}
+
+		wantDates := []DateLinks{{Date: "2023-01-28", FirstSeen: 1}, {Date: "2023-02-04", FirstSeen: 1, LastSeen: 2}, {Date: "2023-06-01", FirstSeen: 1, LastSeen: 1}}
+		if coverage.Domain != domain || coverage.Links != 3 || coverage.DateFrom != "2023-01-28" || coverage.DateTo != "2023-06-01" || !reflect.DeepEqual(coverage.Dates, wantDates) {
+			mt.Errorf("ControllerGetDomainDateCoverage() = %+v, want dates %+v", coverage, wantDates)
+		}
+
+		// rows are counted by aggregation, not read one by one
+		command := mt.GetStartedEvent().Command
+		stages, err := command.Lookup("pipeline").Array().Values()
+		if err != nil || len(stages) != 2 {
+			mt.Fatalf("pipeline = %v, want $match and $facet stages", command.Lookup("pipeline"))
+		}
+		match := stages[0].Document().Lookup("$match")
+		if got := match.Document().Lookup("linksubdomain").StringValue(); got != "blog" {
+			mt.Errorf("linksubdomain filter = %q, want blog", got)
+		}
+		if got := match.Document().Lookup("nofollow").AsInt64(); got != 0 {
+			mt.Errorf("nofollow filter = %d, want 0", got)
+		}
+		facet := stages[1].Document().Lookup("$facet").Document()
+		for field, date := range map[string]string{"first_seen": "$datefrom", "last_seen": "$dateto"} {
+			group := facet.Lookup(field, "0", "$group", "_id")
+			if got := group.StringValue(); got != date {
+				mt.Errorf("%s grouped by %q, want %q", field, got, date)
+			}
+		}
+	})
+
+	mt.Run("no links", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+".links", mtest.FirstBatch))
+
+		app := &App{DB: mt.Client, Dbname: mt.DB.Name()}
+		domain := "example.com"
+		coverage, err := app.ControllerGetDomainDateCoverage(APIRequest{Domain: &domain})
+		if err != nil || coverage.Links != 0 || len(coverage.Dates) != 0 {
+			mt.Errorf("ControllerGetDomainDateCoverage() = %+v, %v, want no links", coverage, err)
+		}
+	})
+}
+
+func TestGenerateFilterSourceURL(t *testing.T) {
+	filters := []ApiRequestFilter{
+		{Name: "No Follow", Val: "0"},
+		{Name: "Source URL", Val: "https://source.com/post?id=1"},
+	}
+	filter := generateFilter("example.com", "example.com", &APIRequest{Filters: &filters})
+
+	want := bson.M{
+		"linkdomain":   "example.com",
+		"nofollow":     0,
+		"pagehost":     "source.com",
+		"pagepath":     "/post",
+		"pagerawquery": "id=1",
+		"pagescheme":   "2",
+	}
+	if !reflect.DeepEqual(filter, want) {
+		t.Errorf("generateFilter() = %v, want %v", filter, want)
+	}
+}
+
+func TestGenerateFilterSameField(t *testing.T) {
+	hostRegex := bson.M{"$regex": primitive.Regex{Pattern: `^blog.source.com$`, Options: "i"}}
+	pathRegex := bson.M{"$regex": primitive.Regex{Pattern: "post", Options: "i"}}
+
+	tests := []struct {
+		name    string
+		filters []ApiRequestFilter
+		want    bson.M
+	}{
+		{
+			name:    "source host before source url",
+			filters: []ApiRequestFilter{{Name: "Source Host", Val: "blog.source.com", Kind: FilterKindExact}, {Name: "Source URL", Val: "source.com/"}},
+			want: bson.M{
+				"linkdomain": "example.com", "pagehost": hostRegex, "pagepath": "/", "pagerawquery": "",
+				"$and": bson.A{bson.M{"pagehost": "source.com"}},
+			},
+		},
+		{
+			name:    "source url before source path",
+			filters: []ApiRequestFilter{{Name: "Source URL", Val: "source.com/"}, {Name: "Source Path", Val: "post", Kind: FilterKindAny}},
+			want: bson.M{
+				"linkdomain": "example.com", "pagehost": "source.com", "pagepath": "/", "pagerawquery": "",
+				"$and": bson.A{bson.M{"pagepath": pathRegex}},
+			},
+		},
+		{
+			name:    "two anchors",
+			filters: []ApiRequestFilter{{Name: "Anchor", Val: "a", Kind: FilterKindAny}, {Name: "Anchor", Val: "b", Kind: FilterKindAny}},
+			want: bson.M{
+				"linkdomain": "example.com", "linktext": bson.M{"$regex": primitive.Regex{Pattern: "a", Options: "i"}},
+				"$and": bson.A{bson.M{"linktext": bson.M{"$regex": primitive.Regex{Pattern: "b", Options: "i"}}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := generateFilter("example.com", "example.com", &APIRequest{Filters: &tt.filters})
+			if !reflect.DeepEqual(filter, tt.want) {
+				t.Errorf("generateFilter() = %v, want %v", filter, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateFilterExternalOnly(t *testing.T) {
+	externalOnly, all := true, false
+
+	// rows from pages of the same registered domain and of other domains with similar names, page domain is missing in rows stored before it was added
+	rows := []LinkRow{
+		{PageHost: "example.com", PageDomain: "example.com"},
+		{PageHost: "Blog.Example.com"},
+		{PageHost: "source.com", PageDomain: "source.com"},
+		{PageHost: "example.com.au"},
+		{PageHost: "myexample.com", PageDomain: "myexample.com"},
+		{PageHost: "example.co.uk", PageDomain: "example.co.uk"},
+		{PageHost: "www.example.co.uk"},
+	}
+	allHosts := []string{"example.com", "Blog.Example.com", "source.com", "example.com.au", "myexample.com", "example.co.uk", "www.example.co.uk"}
+
+	tests := []struct {
+		name         string
+		domain       string
+		externalOnly *bool
+		wantHosts    []string
+	}{
+		{"not set keeps internal links", "example.com", nil, allHosts},
+		{"false keeps internal links", "example.com", &all, allHosts},
+		{"external only", "example.com", &externalOnly, []string{"source.com", "example.com.au", "myexample.com", "example.co.uk", "www.example.co.uk"}},
+		{"external only for multi-label TLD", "example.co.uk", &externalOnly, []string{"example.com", "Blog.Example.com", "source.com", "example.com.au", "myexample.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := generateFilter(tt.domain, tt.domain, &APIRequest{ExternalOnly: tt.externalOnly})
+			if got := matchNor(filter, rows); !reflect.DeepEqual(got, tt.wantHosts) {
+				t.Errorf("generateFilter() matches pages %v, want %v", got, tt.wantHosts)
+			}
+		})
+	}
+}
+
+func TestGenerateFilterExcludeHomepage(t *testing.T) {
+	exclude, keep, externalOnly := true, false, true
+
+	// page host is used as label of the row
+	rows := []LinkRow{
+		{PageHost: "home.com", LinkPath: "/"},
+		{PageHost: "home-query.com", LinkPath: "/", LinkRawQuery: "id=1"},
+		{PageHost: "deep.com", LinkPath: "/blog/post"},
+		{PageHost: "deep-slash.com", LinkPath: "/blog/"},
+		{PageHost: "www.example.com", PageDomain: "example.com", LinkPath: "/about"},
+	}
+
+	tests := []struct {
+		name         string
+		exclude      *bool
+		externalOnly *bool
+		wantHosts    []string
+	}{
+		{"not set keeps homepage links", nil, nil, []string{"home.com", "home-query.com", "deep.com", "deep-slash.com", "www.example.com"}},
+		{"false keeps homepage links", &keep, nil, []string{"home.com", "home-query.com", "deep.com", "deep-slash.com", "www.example.com"}},
+		{"homepage without query excluded", &exclude, nil, []string{"home-query.com", "deep.com", "deep-slash.com", "www.example.com"}},
+		{"combined with external only", &exclude, &externalOnly, []string{"home-query.com", "deep.com", "deep-slash.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := generateFilter("example.com", "example.com", &APIRequest{ExcludeHomepage: tt.exclude, ExternalOnly: tt.externalOnly, Filters: &[]ApiRequestFilter{{Name: "Link Path", Val: "/", Kind: FilterKindAny}}})
+			if got := matchNor(filter, rows); !reflect.DeepEqual(got, tt.wantHosts) {
+				t.Errorf("generateFilter() matches pages %v, want %v", got, tt.wantHosts)
+			}
+			if _, ok := filter["linkpath"]; !ok {
+				t.Error("generateFilter() dropped Link Path filter")
+			}
+		})
+	}
+}
+
+// matchNor - page hosts of rows not excluded by $nor part of the filter, conditions are evaluated the same way as in MongoDB
+func matchNor(filter bson.M, rows []LinkRow) []string {
+	var matched []string
+	for _, row := range rows {
+		excluded := false
+		nor, _ := filter["$nor"].(bson.A)
+		for _, condition := range nor {
+			conditionMatched := true
+			for key, val := range condition.(bson.M) {
+				switch key {
+				case "pagedomain":
+					if domain, ok := val.(string); ok {
+						conditionMatched = conditionMatched && row.PageDomain == domain
+					} else {
+						// {"$exists": false}
+						conditionMatched = conditionMatched && row.PageDomain == ""
+					}
+				case "pagehost":
+					regex := val.(bson.M)["$regex"].(primitive.Regex)
+					conditionMatched = conditionMatched && regexp.MustCompile("(?"+regex.Options+")"+regex.Pattern).MatchString(row.PageHost)
+				case "linkpath":
+					conditionMatched = conditionMatched && row.LinkPath == val.(string)
+				case "linkrawquery":
+					conditionMatched = conditionMatched && row.LinkRawQuery == val.(string)
+				}
+			}
+			excluded = excluded || conditionMatched
+		}
+		if !excluded {
+			matched = append(matched, row.PageHost)
+		}
+	}
+	return matched
+}
+
+func TestRowPageDomain(t *testing.T) {
+	tests := []struct {
+		name string
+		row  LinkRow
+		want string
+	}{
+		{"stored page domain", LinkRow{PageHost: "blog.source.com", PageDomain: "source.com"}, "source.com"},
+		{"derived from host", LinkRow{PageHost: "blog.source.com"}, "source.com"},
+		{"multi-label TLD", LinkRow{PageHost: "www.Source.co.uk"}, "source.co.uk"},
+		{"platform suffix", LinkRow{PageHost: "user.github.io"}, "user.github.io"},
+		{"host without registered domain", LinkRow{PageHost: "co.uk"}, "co.uk"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rowPageDomain(tt.row); got != tt.want {
+				t.Errorf("rowPageDomain() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// site of platform is its own domain like in parser
+	config.PlatformSuffixes = []string{"substack.com"}
+	defer func() { config.PlatformSuffixes = []string{} }()
+	if got := rowPageDomain(LinkRow{PageHost: "www.user.substack.com"}); got != "user.substack.com" {
+		t.Errorf("rowPageDomain() of platform site = %q, want user.substack.com", got)
+	}
+}
+
+func TestGenerateFilterSubdomains(t *testing.T) {
+	includeAll, apexOnly := true, false
+
+	tests := []struct {
+		name              string
+		domain            string
+		includeSubdomains *bool
+		wantSubDomain     any
+	}{
+		{"apex domain default returns all subdomains", "example.com", nil, nil},
+		{"apex domain with all subdomains", "example.com", &includeAll, nil},
+		{"apex domain only", "example.com", &apexOnly, ""},
+		{"subdomain default", "blog.example.com", nil, "blog"},
+		{"subdomain with all subdomains", "blog.example.com", &includeAll, nil},
+		{"subdomain only", "shop.blog.example.com", &apexOnly, "shop.blog"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := generateFilter(tt.domain, "example.com", &APIRequest{IncludeSubdomains: tt.includeSubdomains})
+
+			if filter["linkdomain"] != "example.com" {
+				t.Errorf("linkdomain filter = %v, want example.com", filter["linkdomain"])
+			}
+			if filter["linksubdomain"] != tt.wantSubDomain {
+				t.Errorf("linksubdomain filter = %v, want %v", filter["linksubdomain"], tt.wantSubDomain)
+			}
+		})
+	}
+}
+
+func TestGenerateFilterIncludeWww(t *testing.T) {
+	includeAll, apexOnly, includeWww, excludeWww := true, false, true, false
+
+	tests := []struct {
+		name              string
+		domain            string
+		includeSubdomains *bool
+		includeWww        *bool
+		wantSubDomain     any
+	}{
+		{"apex domain only with www", "example.com", &apexOnly, &includeWww, bson.M{"$in": bson.A{"", "www"}}},
+		{"apex domain only without www", "example.com", &apexOnly, &excludeWww, ""},
+		{"apex domain default returns all subdomains", "example.com", nil, &includeWww, nil},
+		{"apex domain with all subdomains", "example.com", &includeAll, &includeWww, nil},
+		{"www subdomain stays exact", "www.example.com", &apexOnly, &includeWww, "www"},
+		{"subdomain stays exact", "blog.example.com", nil, &includeWww, "blog"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := generateFilter(tt.domain, "example.com", &APIRequest{IncludeSubdomains: tt.includeSubdomains, IncludeWww: tt.includeWww})
+
+			if !reflect.DeepEqual(filter["linksubdomain"], tt.wantSubDomain) {
+				t.Errorf("linksubdomain filter = %v, want %v", filter["linksubdomain"], tt.wantSubDomain)
+			}
+		})
+	}
+}
+
+// matchRegex - value is matched by $regex filter
+func matchRegex(filter any, value string) bool {
+	regex := filter.(bson.M)["$regex"].(primitive.Regex)
+	pattern := regex.Pattern
+	if regex.Options != "" {
+		pattern = "(?" + regex.Options + ")" + pattern
+	}
+	return regexp.MustCompile(pattern).MatchString(value)
+}
+
+func TestGenerateFilterCaseSensitivePaths(t *testing.T) {
+	caseSensitive, caseInsensitive := true, false
+	filters := []ApiRequestFilter{
+		{Name: "Link Path", Val: "/Docs/API", Kind: FilterKindExact},
+		{Name: "Source Path", Val: "/Wiki", Kind: FilterKindAny},
+		{Name: "Anchor", Val: "Docs", Kind: FilterKindAny},
+	}
+
+	tests := []struct {
+		name               string
+		caseSensitivePaths *bool
+		wantLinkPaths      []string
+		wantSourcePaths    []string
+	}{
+		{"default is case insensitive", nil, []string{"/Docs/API", "/docs/api"}, []string{"/Wiki/Main", "/wiki/main"}},
+		{"case insensitive", &caseInsensitive, []string{"/Docs/API", "/docs/api"}, []string{"/Wiki/Main", "/wiki/main"}},
+		{"case sensitive", &caseSensitive, []string{"/Docs/API"}, []string{"/Wiki/Main"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := generateFilter("example.com", "example.com", &APIRequest{Filters: &filters, CaseSensitivePaths: tt.caseSensitivePaths})
+
+			var linkPaths, sourcePaths []string
+			for _, path := range []string{"/Docs/API", "/docs/api"} {
+				if matchRegex(filter["linkpath"], path) {
+					linkPaths = append(linkPaths, path)
+				}
+			}
+			for _, path := range []string{"/Wiki/Main", "/wiki/main"} {
+				if matchRegex(filter["pagepath"], path) {
+					sourcePaths = append(sourcePaths, path)
+				}
+			}
+			if !reflect.DeepEqual(linkPaths, tt.wantLinkPaths) || !reflect.DeepEqual(sourcePaths, tt.wantSourcePaths) {
+				t.Errorf("generateFilter() matches link paths %v and source paths %v, want %v and %v", linkPaths, sourcePaths, tt.wantLinkPaths, tt.wantSourcePaths)
+			}
+
+			// anchor text is not a path and stays case insensitive
+			if !matchRegex(filter["linktext"], "docs") {
+				t.Errorf("generateFilter() anchor filter = %v, want case insensitive", filter["linktext"])
+			}
+		})
+	}
+}
+
+func TestGenerateFilterPrefix(t *testing.T) {
+	caseSensitive := true
+	tests := []struct {
+		name               string
+		filter             ApiRequestFilter
+		field              string
+		caseSensitivePaths *bool
+		values             []string
+		want               []string
+	}{
+		{
+			name:   "link path is case sensitive by default",
+			filter: ApiRequestFilter{Name: "Link Path", Val: "/blog/", Kind: FilterKindPrefix},
+			field:  "linkpath",
+			values: []string{"/blog/", "/blog/post", "/Blog/Post", "/old/blog/post", "/blog", "/blogroll"},
+			want:   []string{"/blog/", "/blog/post"},
+		},
+		{
+			name:               "link path with case sensitive paths",
+			filter:             ApiRequestFilter{Name: "Link Path", Val: "/blog/", Kind: FilterKindPrefix},
+			field:              "linkpath",
+			caseSensitivePaths: &caseSensitive,
+			values:             []string{"/blog/", "/blog/post", "/Blog/Post", "/old/blog/post"},
+			want:               []string{"/blog/", "/blog/post"},
+		},
+		{
+			name:   "page path with regex characters",
+			filter: ApiRequestFilter{Name: "Source Path", Val: "/c++/", Kind: FilterKindPrefix},
+			field:  "pagepath",
+			values: []string{"/c++/intro", "/cc/intro", "/c/intro", "/docs/c++/intro"},
+			want:   []string{"/c++/intro"},
+		},
+		{
+			name:   "page host",
+			filter: ApiRequestFilter{Name: "Source Host", Val: "Blog.", Kind: FilterKindPrefix},
+			field:  "pagehost",
+			values: []string{"blog.example.com", "blog.other.org", "myblog.example.com", "www.blog.com"},
+			want:   []string{"blog.example.com", "blog.other.org"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filters := []ApiRequestFilter{tt.filter}
+			filter := generateFilter("example.com", "example.com", &APIRequest{Filters: &filters, CaseSensitivePaths: tt.caseSensitivePaths})
+
+			regex, ok := filter[tt.field].(bson.M)["$regex"].(primitive.Regex)
+			if !ok || !strings.HasPrefix(regex.Pattern, "^") || strings.HasSuffix(regex.Pattern, "$") || regex.Options != "" {
+				t.Fatalf("generateFilter() %s = %v, want anchored case sensitive prefix regex", tt.field, filter[tt.field])
+			}
+			var got []string
+			for _, value := range tt.values {
+				if matchRegex(filter[tt.field], value) {
+					got = append(got, value)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("generateFilter() %s matches %v, want %v", tt.field, got, tt.want)
+			}
+		})
+	}
+
+	// lowercase host prefix is case sensitive, so it can use index
+	filters := []ApiRequestFilter{{Name: "Source Host", Val: "Blog.", Kind: FilterKindPrefix}}
+	filter := generateFilter("example.com", "example.com", &APIRequest{Filters: &filters})
+	if regex := filter["pagehost"].(bson.M)["$regex"].(primitive.Regex); regex.Pattern != `^blog\.` || regex.Options != "" {
+		t.Errorf("generateFilter() pagehost = %+v, want case sensitive lowercase prefix", regex)
+	}
+}
+
+func TestControllerGetDomainLinksCaseSensitivePaths(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	tests := []struct {
+		name               string
+		appDefault         bool
+		caseSensitivePaths *bool
+		wantOptions        string
+	}{
+		{name: "api default is case insensitive", wantOptions: "i"},
+		{name: "api default case sensitive", appDefault: true},
+		{name: "request overrides api default", appDefault: true, caseSensitivePaths: new(bool), wantOptions: "i"},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+".links", mtest.FirstBatch))
+
+			app := &App{DB: mt.Client, Dbname: mt.DB.Name(), CaseSensitive: tt.appDefault}
+			domain := "example.com"
+			filters := []ApiRequestFilter{{Name: "Link Path", Val: "/Docs", Kind: FilterKindAny}}
+			_, _, err := app.ControllerGetDomainLinks(APIRequest{Domain: &domain, Filters: &filters, CaseSensitivePaths: tt.caseSensitivePaths})
+			if err != nil {
+				mt.Fatalf("ControllerGetDomainLinks() error = %v", err)
+			}
+
+			_, options := mt.GetStartedEvent().Command.Lookup("filter", "linkpath", "$regex").Regex()
+			if options != tt.wantOptions {
+				mt.Errorf("linkpath regex options = %q, want %q", options, tt.wantOptions)
+			}
+		})
+	}
+}
+
+func TestControllerGetDomainLinksIncludeWww(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	tests := []struct {
+		name       string
+		appDefault bool
+		includeWww *bool
+		wantWww    bool
+	}{
+		{name: "api default includes www", appDefault: true, wantWww: true},
+		{name: "api default excludes www"},
+		{name: "request overrides api default", appDefault: true, includeWww: new(bool)},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			rows := []bson.D{
+				{{Key: "linkdomain", Value: "example.com"}, {Key: "linkpath", Value: "/"}, {Key: "linkscheme", Value: "2"}, {Key: "pagehost", Value: "a.com"}, {Key: "pagepath", Value: "/"}, {Key: "qty", Value: 1}},
+			}
+			if tt.wantWww {
+				rows = append(rows, bson.D{{Key: "linkdomain", Value: "example.com"}, {Key: "linksubdomain", Value: "www"}, {Key: "linkpath", Value: "/"}, {Key: "linkscheme", Value: "2"}, {Key: "pagehost", Value: "b.com"}, {Key: "pagepath", Value: "/"}, {Key: "qty", Value: 1}})
+			}
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+".links", mtest.FirstBatch, rows...))
+
+			app := &App{DB: mt.Client, Dbname: mt.DB.Name(), IncludeWww: tt.appDefault}
+			domain := "example.com"
+			apexOnly := false
+			outLinks, _, err := app.ControllerGetDomainLinks(APIRequest{Domain: &domain, IncludeSubdomains: &apexOnly, IncludeWww: tt.includeWww})
+			if err != nil {
+				mt.Fatalf("ControllerGetDomainLinks() error = %v", err)
+			}
+			if len(outLinks) != len(rows) {
+				mt.Errorf("ControllerGetDomainLinks() returned %d links, want %d", len(outLinks), len(rows))
+			}
+			if tt.wantWww && outLinks[len(outLinks)-1].LinkUrl != "https://www.example.com/" {
+				mt.Errorf("ControllerGetDomainLinks() last link = %s, want https://www.example.com/", outLinks[len(outLinks)-1].LinkUrl)
+			}
+
+			filter := mt.GetStartedEvent().Command.Lookup("filter", "linksubdomain")
+			if got := filter.Type == bson.TypeEmbeddedDocument; got != tt.wantWww {
+				mt.Errorf("linksubdomain filter = %s, want www included %v", filter, tt.wantWww)
+			}
+		})
+	}
+}
+
+func TestControllerCollections(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	tests := []struct {
+		name      string
+		app       App
+		wantLinks string
+		wantPages string
+	}{
+		{name: "default collections", wantLinks: "links", wantPages: "pages"},
+		{name: "collections of one archive", app: App{LinksCollection: "links_cc2021", PagesCollection: "pages_cc2021"}, wantLinks: "links_cc2021", wantPages: "pages_cc2021"},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			app := tt.app
+			app.DB, app.Dbname = mt.Client, mt.DB.Name()
+
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+"."+tt.wantLinks, mtest.FirstBatch))
+			domain := "example.com"
+			if _, _, err := app.ControllerGetDomainLinks(APIRequest{Domain: &domain}); err != nil {
+				mt.Fatalf("ControllerGetDomainLinks() error = %v", err)
+			}
+			if got := mt.GetStartedEvent().Command.Lookup("find").StringValue(); got != tt.wantLinks {
+				mt.Errorf("ControllerGetDomainLinks() collection = %q, want %q", got, tt.wantLinks)
+			}
+
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+"."+tt.wantPages, mtest.FirstBatch))
+			pageURL, _ := url.Parse("https://example.com/")
+			if _, err := app.ControllerGetPage(pageURL); err != nil {
+				mt.Fatalf("ControllerGetPage() error = %v", err)
+			}
+			if got := mt.GetStartedEvent().Command.Lookup("find").StringValue(); got != tt.wantPages {
+				mt.Errorf("ControllerGetPage() collection = %q, want %q", got, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestCleanDomainLinksSchemes(t *testing.T) {
+	links := []LinkRow{
+		{LinkDomain: "example.com", LinkPath: "/a", LinkScheme: "0", PageHost: "source.com", PagePath: "/", PageScheme: "1", DateFrom: "2023-02-01", DateTo: "2023-02-01", IP: "1.1.1.1", Qty: 1},
+		{LinkDomain: "example.com", LinkPath: "/b", LinkRawQuery: "q=1", LinkScheme: "1", PageHost: "source.com", PagePath: "/post", PageRawQuery: "p=2", PageScheme: "0", DateFrom: "2023-02-01", DateTo: "2023-02-01", IP: "1.1.1.1", Qty: 1},
+		{LinkDomain: "example.com", LinkPath: "/c", LinkScheme: "2", PageHost: "source.com", PagePath: "/", PageScheme: "2", DateFrom: "2023-02-01", DateTo: "2023-02-01", IP: "1.1.1.1", Qty: 1},
+	}
+
+	outLinks, _ := cleanDomainLinks(&links, 100)
+
+	want := [][2]string{
+		{"//example.com/a", "http://source.com/"},
+		{"http://example.com/b?q=1", "//source.com/post?p=2"},
+		{"https://example.com/c", "https://source.com/"},
+	}
+	if len(outLinks) != len(want) {
+		t.Fatalf("cleanDomainLinks() returned %d links, want %d: %+v", len(outLinks), len(want), outLinks)
+	}
+	for i, link := range outLinks {
+		if link.LinkUrl != want[i][0] || link.PageUrl != want[i][1] {
+			t.Errorf("link %d = %s from %s, want %s from %s", i, link.LinkUrl, link.PageUrl, want[i][0], want[i][1])
+		}
+	}
+}
+
+func TestCleanDomainLinksPageTitle(t *testing.T) {
+	links := []LinkRow{
+		{LinkDomain: "example.com", LinkPath: "/a", LinkScheme: "2", PageHost: "source.com", PagePath: "/", PageScheme: "2", DateFrom: "2023-02-01", DateTo: "2023-02-01", IP: "1.1.1.1", Qty: 1, PageTitle: "Source post"},
+		{LinkDomain: "example.com", LinkPath: "/b", LinkScheme: "2", PageHost: "source.com", PagePath: "/", PageScheme: "2", DateFrom: "2023-02-01", DateTo: "2023-02-01", IP: "1.1.1.1", Qty: 1},
+	}
+
+	outLinks, _ := cleanDomainLinks(&links, 10)
+	if len(outLinks) != 2 || outLinks[0].PageTitle != "Source post" || outLinks[1].PageTitle != "" {
+		t.Fatalf("cleanDomainLinks() = %+v, want page title of the first link only", outLinks)
+	}
+
+	// links without saved title have no page_title field
+	out, err := json.Marshal(outLinks[1])
+	if err != nil || strings.Contains(string(out), "page_title") {
+		t.Errorf("json.Marshal() = %s, %v, want no page_title", out, err)
+	}
+}
+
+func TestCleanDomainLinksPageNoIndex(t *testing.T) {
+	links := []LinkRow{
+		{LinkDomain: "example.com", LinkPath: "/a", LinkScheme: "2", PageHost: "source.com", PagePath: "/", PageScheme: "2", PageNoIndex: 1, DateFrom: "2023-02-01", DateTo: "2023-02-01", IP: "1.1.1.1", Qty: 1},
+	}
+
+	outLinks, _ := cleanDomainLinks(&links, 100)
+	if len(outLinks) != 1 || outLinks[0].PageNoIndex != 1 || outLinks[0].NoIndex != 1 || outLinks[0].NoFollow != 0 {
+		t.Errorf("cleanDomainLinks() = %+v, want link from noindex page", outLinks)
+	}
+}
+
+func TestCleanDomainLinksSubdomains(t *testing.T) {
+	// rows sorted the same way as in ControllerGetDomainLinks
+	links := []LinkRow{
+		{LinkDomain: "example.com", LinkSubDomain: "", LinkPath: "/", LinkScheme: "2", PageHost: "source.com", PagePath: "/", PageScheme: "2", LinkText: "home", DateFrom: "2023-02-01", DateTo: "2023-02-01", IP: "1.1.1.1", Qty: 1},
+		{LinkDomain: "example.com", LinkSubDomain: "blog", LinkPath: "/", LinkScheme: "2", PageHost: "source.com", PagePath: "/", PageScheme: "2", LinkText: "home", DateFrom: "2023-02-01", DateTo: "2023-02-01", IP: "1.1.1.1", Qty: 1},
+		{LinkDomain: "example.com", LinkSubDomain: "blog", LinkPath: "/", LinkScheme: "2", PageHost: "source.com", PagePath: "/", PageScheme: "2", LinkText: "home", DateFrom: "2023-03-01", DateTo: "2023-03-01", IP: "1.1.1.2", Qty: 2},
+		{LinkDomain: "example.com", LinkSubDomain: "shop", LinkPath: "/", LinkScheme: "2", PageHost: "source.com", PagePath: "/", PageScheme: "2", LinkText: "home", DateFrom: "2023-02-01", DateTo: "2023-02-01", IP: "1.1.1.1", Qty: 1},
+		{LinkDomain: "example.com", LinkSubDomain: "www", LinkPath: "/", LinkScheme: "2", PageHost: "source.com", PagePath: "/", PageScheme: "2", LinkText: "home", DateFrom: "2023-02-01", DateTo: "2023-02-01", IP: "1.1.1.1", Qty: 1},
+		{LinkDomain: "example.com", LinkSubDomain: "www", LinkPath: "/", LinkScheme: "2", PageHost: "source.com", PagePath: "/", PageScheme: "2", LinkText: "home", DateFrom: "2023-02-01", DateTo: "2023-02-01", IP: "1.1.1.1", Qty: 1},
+	}
+
+	outLinks, _ := cleanDomainLinks(&links, 100)
+
+	wantUrls := []string{"https://example.com/", "https://blog.example.com/", "https://shop.example.com/", "https://www.example.com/"}
+	if len(outLinks) != len(wantUrls) {
+		t.Fatalf("cleanDomainLinks() returned %d links, want %d: %+v", len(outLinks), len(wantUrls), outLinks)
+	}
+	for i, link := range outLinks {
+		if link.LinkUrl != wantUrls[i] {
+			t.Errorf("link %d url = %s, want %s", i, link.LinkUrl, wantUrls[i])
+		}
+	}
+	if outLinks[1].Qty != 3 || len(outLinks[1].IP) != 2 {
+		t.Errorf("links to blog subdomain not merged: %+v", outLinks[1])
+	}
+	if outLinks[3].Qty != 2 {
+		t.Errorf("links to www subdomain not merged: %+v", outLinks[3])
+	}
+
+	if limited, _ := cleanDomainLinks(&links, 2); len(limited) != 2 {
+		t.Errorf("cleanDomainLinks() with limit 2 returned %d links", len(limited))
+	}
+}
+
+// testLinkRows - rows of distinct links, every link is repeated in copies rows as after import from many segments
+func testLinkRows(distinct int, copies int) []LinkRow {
+	rows := make([]LinkRow, 0, distinct*copies)
+	for i := 0; i < distinct; i++ {
+		for j := 0; j < copies; j++ {
+			rows = append(rows, LinkRow{LinkDomain: "example.com", LinkPath: fmt.Sprintf("/page%03d", i), LinkScheme: "2", PageHost: "source.com", PagePath: "/", PageScheme: "2", LinkText: "text", DateFrom: "2023-02-01", DateTo: "2023-02-01", IP: "1.1.1.1", Qty: 1})
+		}
+	}
+	return rows
+}
+
+func TestCleanDomainLinksHasMore(t *testing.T) {
+	tests := []struct {
+		name        string
+		distinct    int
+		copies      int
+		limit       int64
+		wantLinks   int
+		wantHasMore bool
+	}{
+		{"under limit", 3, 2, 5, 3, false},
+		{"exactly limit", 5, 2, 5, 5, false},
+		{"exactly limit single rows", 5, 1, 5, 5, false},
+		{"over limit", 6, 2, 5, 5, true},
+		{"over limit by last row", 6, 1, 5, 5, true},
+		{"empty", 0, 1, 5, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows := testLinkRows(tt.distinct, tt.copies)
+			outLinks, hasMore := cleanDomainLinks(&rows, tt.limit)
+			if len(outLinks) != tt.wantLinks || hasMore != tt.wantHasMore {
+				t.Errorf("cleanDomainLinks() = %d links, hasMore %v, want %d links, hasMore %v", len(outLinks), hasMore, tt.wantLinks, tt.wantHasMore)
+			}
+			for _, link := range outLinks {
+				if link.Qty != tt.copies {
+					t.Errorf("link %s qty = %d, want %d", link.LinkUrl, link.Qty, tt.copies)
+				}
+			}
+		})
+	}
+}
+
+func TestLinksToEdges(t *testing.T) {
+	links := []LinkOut{
+		{LinkUrl: "https://example.com/a", PageUrl: "https://blog.net/post", LinkText: "A", Qty: 2},
+		{LinkUrl: "https://example.com/a", PageUrl: "https://blog.net/post", LinkText: "Other text", NoFollow: 1, Qty: 3},
+		{LinkUrl: "https://example.com/b", PageUrl: "https://blog.net/post", Qty: 1},
+		{LinkUrl: "https://example.com/a", PageUrl: "https://news.org/", Qty: 4},
+	}
+	want := []LinkEdge{
+		{Source: "https://blog.net/post", Target: "https://example.com/a", Weight: 5},
+		{Source: "https://blog.net/post", Target: "https://example.com/b", Weight: 1},
+		{Source: "https://news.org/", Target: "https://example.com/a", Weight: 4},
+	}
+
+	if got := linksToEdges(links); !reflect.DeepEqual(got, want) {
+		t.Errorf("linksToEdges() = %+v, want %+v", got, want)
+	}
+	if got := linksToEdges(nil); got == nil || len(got) != 0 {
+		t.Errorf("linksToEdges(nil) = %#v, want empty list", got)
+	}
+}
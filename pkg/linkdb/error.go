@@ -1,6 +1,106 @@
 package linkdb
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// ErrorCode - error code returned in API error response, it selects HTTP status of the response
+type ErrorCode string
+
+const (
+	ErrorParsing          ErrorCode = "ErrorParsing"
+	ErrorRequestTooLarge  ErrorCode = "ErrorRequestTooLarge"
+	ErrorTooManyRequests  ErrorCode = "ErrorTooManyRequests"
+	ErrorNoDomain         ErrorCode = "ErrorNoDomain"
+	ErrorInvalidDomain    ErrorCode = "ErrorInvalidDomain"
+	ErrorNoURL            ErrorCode = "ErrorNoURL"
+	ErrorInvalidURL       ErrorCode = "ErrorInvalidURL"
+	ErrorInvalidTitle     ErrorCode = "ErrorInvalidTitle"
+	ErrorInvalidFormat    ErrorCode = "ErrorInvalidFormat"
+	ErrorNotFound         ErrorCode = "ErrorNotFound"
+	ErrorPageNotFound     ErrorCode = "ErrorPageNotFound"
+	ErrorLinkNotFound     ErrorCode = "ErrorLinkNotFound"
+	ErrorMethodNotAllowed ErrorCode = "ErrorMethodNotAllowed"
+	ErrorFailedLinks      ErrorCode = "ErrorFailedLinks"
+	ErrorFailedPage       ErrorCode = "ErrorFailedPage"
+	ErrorFailedLink       ErrorCode = "ErrorFailedLink"
+	ErrorFailedPages      ErrorCode = "ErrorFailedPages"
+	ErrorFailedStatus     ErrorCode = "ErrorFailedStatus"
+	ErrorJson             ErrorCode = "ErrorJson"
+	ErrorInternal         ErrorCode = "ErrorInternal"
+)
+
+// errorStatus - HTTP status of every error code, codes missing here are sent with 500
+var errorStatus = map[ErrorCode]int{
+	ErrorParsing:          http.StatusBadRequest,
+	ErrorRequestTooLarge:  http.StatusRequestEntityTooLarge,
+	ErrorTooManyRequests:  http.StatusTooManyRequests,
+	ErrorNoDomain:         http.StatusBadRequest,
+	ErrorInvalidDomain:    http.StatusBadRequest,
+	ErrorNoURL:            http.StatusBadRequest,
+	ErrorInvalidURL:       http.StatusBadRequest,
+	ErrorInvalidTitle:     http.StatusBadRequest,
+	ErrorInvalidFormat:    http.StatusBadRequest,
+	ErrorNotFound:         http.StatusNotFound,
+	ErrorPageNotFound:     http.StatusNotFound,
+	ErrorLinkNotFound:     http.StatusNotFound,
+	ErrorMethodNotAllowed: http.StatusMethodNotAllowed,
+	ErrorFailedLinks:      http.StatusInternalServerError,
+	ErrorFailedPage:       http.StatusInternalServerError,
+	ErrorFailedLink:       http.StatusInternalServerError,
+	ErrorFailedPages:      http.StatusInternalServerError,
+	ErrorFailedStatus:     http.StatusServiceUnavailable,
+	ErrorJson:             http.StatusInternalServerError,
+	ErrorInternal:         http.StatusInternalServerError,
+}
+
+// HTTPStatus - HTTP status of response with this error code
+func (c ErrorCode) HTTPStatus() int {
+	if status, ok := errorStatus[c]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// HandlerError - error returned to API client, Code selects HTTP status, Function is the handler that failed
+type HandlerError struct {
+	Code     ErrorCode
+	Function string
+	Message  string
+}
+
+// Error - message of the error
+func (e *HandlerError) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+// NewHandlerError - create error returned to API client
+func NewHandlerError(code ErrorCode, function string, message string) *HandlerError {
+	return &HandlerError{Code: code, Function: function, Message: message}
+}
+
+// respondError - send error response with status of its code and request ID, other errors than HandlerError are logged and sent as ErrorInternal
+func respondError(w http.ResponseWriter, r *http.Request, err error) {
+	requestID := RequestIDFromContext(r.Context())
+
+	var handlerErr *HandlerError
+	if !errors.As(err, &handlerErr) {
+		log.Printf("unexpected API error, request_id=%s: %v", requestID, err)
+		handlerErr = NewHandlerError(ErrorInternal, "", "Internal error")
+	}
+
+	errorData := ApiError{
+		ErrorCode: string(handlerErr.Code),
+		Function:  handlerErr.Function,
+		Error:     handlerErr.Message,
+		RequestID: requestID,
+	}
+	jsonError, _ := json.Marshal(errorData)
+	SendResponse(w, handlerErr.Code.HTTPStatus(), jsonError)
+}
 
 // GenerateError - generate error response
 func GenerateError(errorCode string, errorFunction string, errorInfo string) []byte {
@@ -0,0 +1,86 @@
+package linkdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorCodeHTTPStatus(t *testing.T) {
+	tests := []struct {
+		code ErrorCode
+		want int
+	}{
+		{ErrorParsing, http.StatusBadRequest},
+		{ErrorRequestTooLarge, http.StatusRequestEntityTooLarge},
+		{ErrorTooManyRequests, http.StatusTooManyRequests},
+		{ErrorNoDomain, http.StatusBadRequest},
+		{ErrorInvalidDomain, http.StatusBadRequest},
+		{ErrorNoURL, http.StatusBadRequest},
+		{ErrorInvalidURL, http.StatusBadRequest},
+		{ErrorInvalidTitle, http.StatusBadRequest},
+		{ErrorInvalidFormat, http.StatusBadRequest},
+		{ErrorNotFound, http.StatusNotFound},
+		{ErrorPageNotFound, http.StatusNotFound},
+		{ErrorLinkNotFound, http.StatusNotFound},
+		{ErrorMethodNotAllowed, http.StatusMethodNotAllowed},
+		{ErrorFailedLinks, http.StatusInternalServerError},
+		{ErrorFailedPage, http.StatusInternalServerError},
+		{ErrorFailedLink, http.StatusInternalServerError},
+		{ErrorFailedPages, http.StatusInternalServerError},
+		{ErrorFailedStatus, http.StatusServiceUnavailable},
+		{ErrorJson, http.StatusInternalServerError},
+		{ErrorInternal, http.StatusInternalServerError},
+		{ErrorCode("ErrorUnknown"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.code), func(t *testing.T) {
+			if got := tt.code.HTTPStatus(); got != tt.want {
+				t.Errorf("HTTPStatus() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// every code with status is tested
+	if len(tests)-1 != len(errorStatus) {
+		t.Errorf("tested %d error codes, errorStatus has %d", len(tests)-1, len(errorStatus))
+	}
+}
+
+func TestRespondError(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		wantStatus   int
+		wantCode     ErrorCode
+		wantFunction string
+	}{
+		{"handler error", NewHandlerError(ErrorInvalidDomain, "HandlerGetDomainLinks", "Invalid domain"), http.StatusBadRequest, ErrorInvalidDomain, "HandlerGetDomainLinks"},
+		{"wrapped handler error", fmt.Errorf("request: %w", NewHandlerError(ErrorPageNotFound, "HandlerGetPage", "Page not found")), http.StatusNotFound, ErrorPageNotFound, "HandlerGetPage"},
+		{"body too large", decodeError(&http.MaxBytesError{Limit: 1024}, "HandlerGetPage"), http.StatusRequestEntityTooLarge, ErrorRequestTooLarge, "HandlerGetPage"},
+		{"broken body", decodeError(errors.New("unexpected EOF"), "HandlerSearchPages"), http.StatusBadRequest, ErrorParsing, "HandlerSearchPages"},
+		{"other error", errors.New("connection refused"), http.StatusInternalServerError, ErrorInternal, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			respondError(recorder, httptest.NewRequest(http.MethodGet, "/api/links", nil), tt.err)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("respondError() status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			var apiError ApiError
+			if err := json.Unmarshal(recorder.Body.Bytes(), &apiError); err != nil {
+				t.Fatalf("Failed to decode error response: %v", err)
+			}
+			if apiError.ErrorCode != string(tt.wantCode) || apiError.Function != tt.wantFunction {
+				t.Errorf("respondError() = %+v, want code %s from %q", apiError, tt.wantCode, tt.wantFunction)
+			}
+		})
+	}
+}
@@ -2,15 +2,27 @@ package linkdb
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
 )
 
+// Output formats of links request
+const (
+	formatLinks = "links" // link objects with all fields
+	formatEdges = "edges" // source page to link url edges
+)
+
+// hasMoreHeader - response header set to true when there are more links after returned ones
+const hasMoreHeader = "X-Has-More"
+
 // SendResponse - send http response
 func SendResponse(w http.ResponseWriter, status int, data []byte) {
 	w.Header().Set("Content-Type", "application/json")
@@ -20,54 +32,305 @@ func SendResponse(w http.ResponseWriter, status int, data []byte) {
 	}
 }
 
+// decodeError - error for request body that could not be decoded, ErrorRequestTooLarge when body is over size limit
+func decodeError(err error, errorFunction string) error {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		return NewHandlerError(ErrorRequestTooLarge, errorFunction, fmt.Sprintf("Request body is larger than %d bytes", maxBytesError.Limit))
+	}
+
+	return NewHandlerError(ErrorParsing, errorFunction, fmt.Sprintf("Error parsing request: %s", err))
+}
+
+// normalizeDomain - lowercase domain and remove whitespace, scheme, port and trailing dot, accepts http://domain.com and domain.com
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+
+	if strings.Contains(domain, "://") {
+		parsedUrl, err := url.Parse(domain)
+		if err != nil {
+			return "", err
+		}
+		domain = parsedUrl.Host
+	}
+
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+
+	return strings.TrimSuffix(domain, "."), nil
+}
+
 // HandlerGetDomainLinks - get domain links
 func (app *App) HandlerGetDomainLinks(w http.ResponseWriter, r *http.Request) {
 	if app.isRateLimited(r.RemoteAddr) {
-		SendResponse(w, http.StatusTooManyRequests, GenerateError("ErrorTooManyRequests", "HandlerGetDomainLinks", "Too Many Requests"))
+		respondError(w, r, NewHandlerError(ErrorTooManyRequests, "HandlerGetDomainLinks", "Too Many Requests"))
 		return
 	}
 
+	apiRequest, err := readDomainRequest(r, "HandlerGetDomainLinks")
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+
+	format := formatLinks
+	if apiRequest.Format != nil && *apiRequest.Format != "" {
+		format = *apiRequest.Format
+	}
+	if format != formatLinks && format != formatEdges {
+		respondError(w, r, NewHandlerError(ErrorInvalidFormat, "HandlerGetDomainLinks", "Format must be links or edges"))
+		return
+	}
+
+	links, hasMore, err := app.ControllerGetDomainLinks(apiRequest)
+	if err != nil {
+		respondError(w, r, NewHandlerError(ErrorFailedLinks, "HandlerGetDomainLinks", "Error getting links"))
+		return
+	}
+
+	var response []byte
+	if format == formatEdges {
+		response, err = json.Marshal(linksToEdges(links))
+	} else {
+		response, err = json.Marshal(links)
+	}
+	if err != nil {
+		respondError(w, r, NewHandlerError(ErrorJson, "HandlerGetDomainLinks", "Error marshalling links"))
+		return
+	}
+
+	// response stays a list of links, header tells if next page has any links
+	w.Header().Set(hasMoreHeader, strconv.FormatBool(hasMore))
+
+	SendResponse(w, http.StatusOK, response)
+}
+
+// HandlerGetDomainDateCoverage - get number of links to domain by crawl date
+func (app *App) HandlerGetDomainDateCoverage(w http.ResponseWriter, r *http.Request) {
+	if app.isRateLimited(r.RemoteAddr) {
+		respondError(w, r, NewHandlerError(ErrorTooManyRequests, "HandlerGetDomainDateCoverage", "Too Many Requests"))
+		return
+	}
+
+	apiRequest, err := readDomainRequest(r, "HandlerGetDomainDateCoverage")
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+
+	coverage, err := app.ControllerGetDomainDateCoverage(apiRequest)
+	if err != nil {
+		respondError(w, r, NewHandlerError(ErrorFailedLinks, "HandlerGetDomainDateCoverage", "Error getting date coverage"))
+		return
+	}
+
+	response, err := json.Marshal(coverage)
+	if err != nil {
+		respondError(w, r, NewHandlerError(ErrorJson, "HandlerGetDomainDateCoverage", "Error marshalling date coverage"))
+		return
+	}
+
+	SendResponse(w, http.StatusOK, response)
+}
+
+// readDomainRequest - decode links request with required valid domain, domain is normalized
+func readDomainRequest(r *http.Request, errorFunction string) (APIRequest, error) {
 	var apiRequest APIRequest
 	decoder := json.NewDecoder(r.Body)
 	defer r.Body.Close()
 	err := decoder.Decode(&apiRequest)
 	if err != nil {
-		errorMsg := fmt.Sprintf("Error parsing request: %s", err)
-		SendResponse(w, http.StatusBadRequest, GenerateError("ErrorParsing", "HandlerGetDomainLinks", errorMsg))
-		return
+		return apiRequest, decodeError(err, errorFunction)
 	}
 
 	if apiRequest.Domain == nil || *apiRequest.Domain == "" {
-		SendResponse(w, http.StatusBadRequest, GenerateError("ErrorNoDomain", "HandlerGetDomainLinks", "Domain is required"))
+		return apiRequest, NewHandlerError(ErrorNoDomain, errorFunction, "Domain is required")
+	}
+
+	*apiRequest.Domain, err = normalizeDomain(*apiRequest.Domain)
+	if err != nil {
+		return apiRequest, NewHandlerError(ErrorParsing, errorFunction, "Error parsing domain")
+	}
+
+	if !commoncrawl.IsValidDomain(*apiRequest.Domain) {
+		return apiRequest, NewHandlerError(ErrorInvalidDomain, errorFunction, "Invalid domain")
+	}
+
+	return apiRequest, nil
+}
+
+// HandlerGetPage - get page info, GET with url query parameter or POST with json body
+func (app *App) HandlerGetPage(w http.ResponseWriter, r *http.Request) {
+	if app.isRateLimited(r.RemoteAddr) {
+		respondError(w, r, NewHandlerError(ErrorTooManyRequests, "HandlerGetPage", "Too Many Requests"))
 		return
 	}
 
-	// accepts http://domain.com and domain.com
-	if strings.HasPrefix(*apiRequest.Domain, "http") {
-		parsedUrl, err := url.Parse(*apiRequest.Domain)
+	var apiRequest APIPageRequest
+	if r.Method == http.MethodPost {
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := decoder.Decode(&apiRequest)
 		if err != nil {
-			SendResponse(w, http.StatusBadRequest, GenerateError("ErrorParsing", "HandlerGetDomainLinks", "Error parsing domain"))
+			respondError(w, r, decodeError(err, "HandlerGetPage"))
 			return
 		}
-		*apiRequest.Domain = parsedUrl.Host
+	} else if pageURL := r.URL.Query().Get("url"); pageURL != "" {
+		apiRequest.URL = &pageURL
 	}
 
-	if !commoncrawl.IsValidDomain(*apiRequest.Domain) {
-		SendResponse(w, http.StatusBadRequest, GenerateError("ErrorInvalidDomain", "HandlerGetDomainLinks", "Invalid domain"))
+	if apiRequest.URL == nil || *apiRequest.URL == "" {
+		respondError(w, r, NewHandlerError(ErrorNoURL, "HandlerGetPage", "URL is required"))
+		return
+	}
+
+	// accepts http://domain.com/page and domain.com/page
+	pageURL := *apiRequest.URL
+	if !strings.HasPrefix(pageURL, "http") {
+		pageURL = "https://" + pageURL
+	}
+	parsedUrl, err := url.Parse(pageURL)
+	if err != nil || !commoncrawl.IsValidDomain(parsedUrl.Hostname()) {
+		respondError(w, r, NewHandlerError(ErrorInvalidURL, "HandlerGetPage", "Invalid URL"))
 		return
 	}
 
-	links, err := app.ControllerGetDomainLinks(apiRequest)
+	page, err := app.ControllerGetPage(parsedUrl)
 	if err != nil {
-		SendResponse(w, http.StatusInternalServerError, GenerateError("ErrorFailedLinks", "HandlerGetDomainLinks", "Error getting links"))
+		respondError(w, r, NewHandlerError(ErrorFailedPage, "HandlerGetPage", "Error getting page"))
+		return
+	}
+	if page == nil {
+		respondError(w, r, NewHandlerError(ErrorPageNotFound, "HandlerGetPage", "Page not found"))
+		return
+	}
+
+	response, err := json.Marshal(page)
+	if err != nil {
+		respondError(w, r, NewHandlerError(ErrorJson, "HandlerGetPage", "Error marshalling page"))
+		return
+	}
+
+	SendResponse(w, http.StatusOK, response)
+}
+
+// HandlerGetLink - get link from source page with all its crawls, GET with page_url and link_url query parameters or POST with json body
+func (app *App) HandlerGetLink(w http.ResponseWriter, r *http.Request) {
+	if app.isRateLimited(r.RemoteAddr) {
+		respondError(w, r, NewHandlerError(ErrorTooManyRequests, "HandlerGetLink", "Too Many Requests"))
+		return
+	}
+
+	var apiRequest APILinkRequest
+	if r.Method == http.MethodPost {
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := decoder.Decode(&apiRequest)
+		if err != nil {
+			respondError(w, r, decodeError(err, "HandlerGetLink"))
+			return
+		}
+	} else {
+		if pageURL := r.URL.Query().Get("page_url"); pageURL != "" {
+			apiRequest.PageURL = &pageURL
+		}
+		if linkURL := r.URL.Query().Get("link_url"); linkURL != "" {
+			apiRequest.LinkURL = &linkURL
+		}
+	}
+
+	if apiRequest.PageURL == nil || *apiRequest.PageURL == "" || apiRequest.LinkURL == nil || *apiRequest.LinkURL == "" {
+		respondError(w, r, NewHandlerError(ErrorNoURL, "HandlerGetLink", "Page URL and link URL are required"))
+		return
+	}
+
+	filter, ok := linkDetailFilter(*apiRequest.PageURL, *apiRequest.LinkURL)
+	if !ok {
+		respondError(w, r, NewHandlerError(ErrorInvalidURL, "HandlerGetLink", "Invalid URL"))
+		return
+	}
+
+	link, err := app.ControllerGetLinkDetail(filter)
+	if err != nil {
+		respondError(w, r, NewHandlerError(ErrorFailedLink, "HandlerGetLink", "Error getting link"))
+		return
+	}
+	if link == nil {
+		respondError(w, r, NewHandlerError(ErrorLinkNotFound, "HandlerGetLink", "Link not found"))
+		return
+	}
+
+	response, err := json.Marshal(link)
+	if err != nil {
+		respondError(w, r, NewHandlerError(ErrorJson, "HandlerGetLink", "Error marshalling link"))
 		return
 	}
 
-	response, err := json.Marshal(links)
+	SendResponse(w, http.StatusOK, response)
+}
+
+// HandlerSearchPages - search pages by title within domain
+func (app *App) HandlerSearchPages(w http.ResponseWriter, r *http.Request) {
+	if app.isRateLimited(r.RemoteAddr) {
+		respondError(w, r, NewHandlerError(ErrorTooManyRequests, "HandlerSearchPages", "Too Many Requests"))
+		return
+	}
+
+	var apiRequest APIPageSearchRequest
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	err := decoder.Decode(&apiRequest)
+	if err != nil {
+		respondError(w, r, decodeError(err, "HandlerSearchPages"))
+		return
+	}
+
+	if apiRequest.Domain != nil {
+		*apiRequest.Domain, err = normalizeDomain(*apiRequest.Domain)
+	}
+	if apiRequest.Domain == nil || err != nil || !commoncrawl.IsValidDomain(*apiRequest.Domain) {
+		respondError(w, r, NewHandlerError(ErrorInvalidDomain, "HandlerSearchPages", "Invalid domain"))
+		return
+	}
+
+	if apiRequest.Title == nil || *apiRequest.Title == "" || len(*apiRequest.Title) > maxFilterValueLength {
+		respondError(w, r, NewHandlerError(ErrorInvalidTitle, "HandlerSearchPages", "Invalid title"))
+		return
+	}
+
+	pages, err := app.ControllerSearchPages(apiRequest)
 	if err != nil {
-		SendResponse(w, http.StatusInternalServerError, GenerateError("ErrorJson", "HandlerGetDomainLinks", "Error marshalling links"))
+		respondError(w, r, NewHandlerError(ErrorFailedPages, "HandlerSearchPages", "Error searching pages"))
+		return
+	}
+
+	response, err := json.Marshal(pages)
+	if err != nil {
+		respondError(w, r, NewHandlerError(ErrorJson, "HandlerSearchPages", "Error marshalling pages"))
 		return
 	}
 
 	SendResponse(w, http.StatusOK, response)
 }
+
+// HandlerReady - 200 when links collection has links, 503 when it is missing or empty, so load balancer does not send traffic to API with wrong database
+func (app *App) HandlerReady(w http.ResponseWriter, r *http.Request) {
+	status, err := app.ControllerLinksStatus()
+	if err != nil {
+		log.Printf("error checking links collection: %v", err)
+		respondError(w, r, NewHandlerError(ErrorFailedStatus, "HandlerReady", "Error checking links collection"))
+		return
+	}
+
+	jsonResponse, err := json.Marshal(status)
+	if err != nil {
+		respondError(w, r, NewHandlerError(ErrorJson, "HandlerReady", "Error marshalling status"))
+		return
+	}
+	if !status.Ready {
+		SendResponse(w, http.StatusServiceUnavailable, jsonResponse)
+		return
+	}
+	SendResponse(w, http.StatusOK, jsonResponse)
+}
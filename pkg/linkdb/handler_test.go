@@ -0,0 +1,579 @@
+package linkdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestHandlerGetPage(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	storedPage := bson.D{
+		{Key: "host", Value: "www.example.com"},
+		{Key: "path", Value: "/blog"},
+		{Key: "rawquery", Value: "p=1"},
+		{Key: "scheme", Value: "2"},
+		{Key: "title", Value: "Blog title"},
+		{Key: "ip", Value: "1.2.3.4"},
+		{Key: "imported", Value: "2023-02-04"},
+		{Key: "internallinks", Value: 12},
+		{Key: "externallinks", Value: 3},
+		{Key: "noindex", Value: 0},
+		{Key: "language", Value: "en"},
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		found    bool
+		wantCode int
+	}{
+		{"get by query parameter", http.MethodGet, "/api/page?url=" + "https%3A%2F%2FWWW.example.com%2Fblog%3Fp%3D1", "", true, http.StatusOK},
+		{"post url without scheme", http.MethodPost, "/api/page", `{"url":"www.example.com/blog?p=1"}`, true, http.StatusOK},
+		{"url with port", http.MethodPost, "/api/page", `{"url":"https://www.example.com:443/blog?p=1"}`, true, http.StatusOK},
+		{"unknown page", http.MethodGet, "/api/page?url=www.example.com/blog?p=1", "", false, http.StatusNotFound},
+		{"missing url", http.MethodGet, "/api/page", "", false, http.StatusBadRequest},
+		{"invalid url", http.MethodPost, "/api/page", `{"url":"http://localhost/blog"}`, false, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			app := &App{DB: mt.Client, Dbname: mt.DB.Name(), requestRecords: make(map[string]*RequestInfo)}
+			if tt.found {
+				mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+".pages", mtest.FirstBatch, storedPage))
+			} else {
+				mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+".pages", mtest.FirstBatch))
+			}
+
+			recorder := httptest.NewRecorder()
+			InitRoutes(app).ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+
+			if recorder.Code != tt.wantCode {
+				t.Fatalf("HandlerGetPage() status = %d, want %d, body %s", recorder.Code, tt.wantCode, recorder.Body.String())
+			}
+			if tt.wantCode == http.StatusBadRequest {
+				return
+			}
+
+			filter := mt.GetStartedEvent().Command.Lookup("filter").Document()
+			if filter.Lookup("host").StringValue() != "www.example.com" || filter.Lookup("path").StringValue() != "/blog" || filter.Lookup("rawquery").StringValue() != "p=1" {
+				t.Errorf("page filter = %v", filter)
+			}
+
+			if !tt.found {
+				return
+			}
+			var page PageOut
+			if err := json.Unmarshal(recorder.Body.Bytes(), &page); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			want := PageOut{PageUrl: "https://www.example.com/blog?p=1", Title: "Blog title", IP: "1.2.3.4", Imported: "2023-02-04", InternalLinks: 12, ExternalLinks: 3, Language: "en"}
+			if page != want {
+				t.Errorf("HandlerGetPage() = %+v, want %+v", page, want)
+			}
+		})
+	}
+}
+
+func TestHandlerGetLink(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	crawl := func(dateFrom string, dateTo string, ip string, noFollow int) bson.D {
+		return bson.D{
+			{Key: "linkdomain", Value: "example.com"},
+			{Key: "linksubdomain", Value: "www"},
+			{Key: "linkpath", Value: "/a"},
+			{Key: "linkscheme", Value: "2"},
+			{Key: "pagehost", Value: "blog.source.com"},
+			{Key: "pagepath", Value: "/post"},
+			{Key: "pagescheme", Value: "2"},
+			{Key: "linktext", Value: "A"},
+			{Key: "nofollow", Value: noFollow},
+			{Key: "datefrom", Value: dateFrom},
+			{Key: "dateto", Value: dateTo},
+			{Key: "ip", Value: ip},
+			{Key: "qty", Value: 1},
+		}
+	}
+	crawls := []bson.D{crawl("2023-01-02", "2023-01-02", "1.1.1.1", 0), crawl("2023-02-04", "2023-02-06", "2.2.2.2", 1)}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		found    bool
+		wantCode int
+	}{
+		{"get by query parameters", http.MethodGet, "/api/link?page_url=https%3A%2F%2Fblog.source.com%2Fpost&link_url=https%3A%2F%2Fwww.example.com%2Fa", "", true, http.StatusOK},
+		{"post urls", http.MethodPost, "/api/link", `{"page_url":"https://blog.source.com/post","link_url":"https://www.example.com/a"}`, true, http.StatusOK},
+		{"unknown link", http.MethodPost, "/api/link", `{"page_url":"https://blog.source.com/post","link_url":"https://www.example.com/a"}`, false, http.StatusNotFound},
+		{"missing link url", http.MethodGet, "/api/link?page_url=blog.source.com/post", "", false, http.StatusBadRequest},
+		{"invalid link url", http.MethodPost, "/api/link", `{"page_url":"https://blog.source.com/post","link_url":"http://localhost/a"}`, false, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			app := &App{DB: mt.Client, Dbname: mt.DB.Name(), requestRecords: make(map[string]*RequestInfo)}
+			if tt.found {
+				mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+".links", mtest.FirstBatch, crawls...))
+			} else {
+				mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+".links", mtest.FirstBatch))
+			}
+
+			recorder := httptest.NewRecorder()
+			InitRoutes(app).ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+
+			if recorder.Code != tt.wantCode {
+				mt.Fatalf("HandlerGetLink() status = %d, want %d, body %s", recorder.Code, tt.wantCode, recorder.Body.String())
+			}
+			if tt.wantCode == http.StatusBadRequest {
+				return
+			}
+
+			filter := mt.GetStartedEvent().Command.Lookup("filter").Document()
+			if filter.Lookup("linkdomain").StringValue() != "example.com" || filter.Lookup("linksubdomain").StringValue() != "www" || filter.Lookup("linkpath").StringValue() != "/a" ||
+				filter.Lookup("pagehost").StringValue() != "blog.source.com" || filter.Lookup("pagepath").StringValue() != "/post" {
+				mt.Errorf("link filter = %v", filter)
+			}
+
+			if !tt.found {
+				return
+			}
+			var link LinkDetail
+			if err := json.Unmarshal(recorder.Body.Bytes(), &link); err != nil {
+				mt.Fatalf("Failed to decode response: %v", err)
+			}
+			if link.LinkUrl != "https://www.example.com/a" || link.DateFrom != "2023-01-02" || link.DateTo != "2023-02-06" || link.Qty != 2 || link.NoFollow != 1 ||
+				len(link.IP) != 2 || len(link.Crawls) != 2 {
+				mt.Errorf("HandlerGetLink() = %+v", link)
+			}
+		})
+	}
+}
+
+func TestHandlerSearchPages(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	storedPage := func(host string, path string, title string, imported string, internalLinks int) bson.D {
+		return bson.D{
+			{Key: "host", Value: host},
+			{Key: "domain", Value: "example.com"},
+			{Key: "path", Value: path},
+			{Key: "rawquery", Value: ""},
+			{Key: "scheme", Value: "2"},
+			{Key: "title", Value: title},
+			{Key: "imported", Value: imported},
+			{Key: "internallinks", Value: internalLinks},
+			{Key: "externallinks", Value: 1},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		body        string
+		pages       []bson.D
+		wantCode    int
+		wantFilter  bson.M
+		wantSkip    int64
+		wantLimit   int64
+		wantPageUrl []string
+	}{
+		{
+			name: "domain with all subdomains",
+			body: `{"domain":"Example.com","title":"Go (news)"}`,
+			pages: []bson.D{
+				storedPage("blog.example.com", "/go", "Go (news) weekly", "2023-03-01", 5),
+				storedPage("www.example.com", "/", "Latest go (NEWS)", "2023-02-01", 20),
+			},
+			wantCode:    http.StatusOK,
+			wantFilter:  bson.M{"domain": "example.com", "title": `Go \(news\)`},
+			wantLimit:   100,
+			wantPageUrl: []string{"https://blog.example.com/go", "https://www.example.com/"},
+		},
+		{
+			name:        "subdomain only",
+			body:        `{"domain":"blog.example.com","title":"weekly"}`,
+			pages:       []bson.D{storedPage("blog.example.com", "/go", "Go (news) weekly", "2023-03-01", 5)},
+			wantCode:    http.StatusOK,
+			wantFilter:  bson.M{"domain": "example.com", "host": "blog.example.com", "title": "weekly"},
+			wantLimit:   100,
+			wantPageUrl: []string{"https://blog.example.com/go"},
+		},
+		{
+			name:        "second page skips deduplicated pages",
+			body:        `{"domain":"example.com","title":"weekly","limit":10,"page":2}`,
+			pages:       []bson.D{storedPage("blog.example.com", "/go", "Go (news) weekly", "2023-03-01", 5)},
+			wantCode:    http.StatusOK,
+			wantFilter:  bson.M{"domain": "example.com", "title": "weekly"},
+			wantSkip:    10,
+			wantLimit:   10,
+			wantPageUrl: []string{"https://blog.example.com/go"},
+		},
+		{name: "missing title", body: `{"domain":"example.com"}`, wantCode: http.StatusBadRequest},
+		{name: "invalid domain", body: `{"domain":"example","title":"news"}`, wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			app := &App{DB: mt.Client, Dbname: mt.DB.Name(), requestRecords: make(map[string]*RequestInfo)}
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+".pages", mtest.FirstBatch, tt.pages...))
+
+			recorder := httptest.NewRecorder()
+			InitRoutes(app).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/pages/search", strings.NewReader(tt.body)))
+
+			if recorder.Code != tt.wantCode {
+				t.Fatalf("HandlerSearchPages() status = %d, want %d, body %s", recorder.Code, tt.wantCode, recorder.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			// pages are deduplicated by $group before $skip and $limit
+			stages, _ := mt.GetStartedEvent().Command.Lookup("pipeline").Array().Values()
+			var stageNames []string
+			for _, stage := range stages {
+				elements, _ := stage.Document().Elements()
+				stageNames = append(stageNames, elements[0].Key())
+			}
+			wantStages := []string{"$match", "$sort", "$group", "$replaceRoot", "$sort", "$skip", "$limit"}
+			if !slices.Equal(stageNames, wantStages) {
+				t.Fatalf("search pipeline stages = %v, want %v", stageNames, wantStages)
+			}
+			if skip := stages[5].Document().Lookup("$skip").Int64(); skip != tt.wantSkip {
+				t.Errorf("search skip = %d, want %d", skip, tt.wantSkip)
+			}
+			if limit := stages[6].Document().Lookup("$limit").Int64(); limit != tt.wantLimit {
+				t.Errorf("search limit = %d, want %d", limit, tt.wantLimit)
+			}
+
+			filter := stages[0].Document().Lookup("$match").Document()
+			elements, _ := filter.Elements()
+			if len(elements) != len(tt.wantFilter) {
+				t.Errorf("search filter = %v, want %v", filter, tt.wantFilter)
+			}
+			for key, val := range tt.wantFilter {
+				value := filter.Lookup(key)
+				if key == "title" {
+					pattern, options := value.Document().Lookup("$regex").Regex()
+					if pattern != val || options != "i" {
+						t.Errorf("title filter = %s/%s, want %s/i", pattern, options, val)
+					}
+					continue
+				}
+				if value.StringValue() != val {
+					t.Errorf("%s filter = %v, want %v", key, value, val)
+				}
+			}
+
+			var pages []PageOut
+			if err := json.Unmarshal(recorder.Body.Bytes(), &pages); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if len(pages) != len(tt.wantPageUrl) {
+				t.Fatalf("HandlerSearchPages() = %+v, want urls %v", pages, tt.wantPageUrl)
+			}
+			for i, page := range pages {
+				if page.PageUrl != tt.wantPageUrl[i] {
+					t.Errorf("page %d url = %s, want %s", i, page.PageUrl, tt.wantPageUrl[i])
+				}
+			}
+			if pages[0].Imported != "2023-03-01" {
+				t.Errorf("expected newest import first, got %s", pages[0].Imported)
+			}
+		})
+	}
+}
+
+func TestRequestBodySizeLimit(t *testing.T) {
+	oversized := `{"domain":"example.com","title":"` + strings.Repeat("a", 2048) + `"}`
+
+	tests := []struct {
+		name        string
+		maxBodySize int64
+		target      string
+		body        string
+		wantCode    int
+	}{
+		{"links body over limit", 1024, "/api/links", oversized, http.StatusRequestEntityTooLarge},
+		{"search body over limit", 1024, "/api/pages/search", oversized, http.StatusRequestEntityTooLarge},
+		{"page body over default limit", 0, "/api/page", `{"url":"` + strings.Repeat("a", defaultMaxBodySize) + `"}`, http.StatusRequestEntityTooLarge},
+		{"body under limit", 1024, "/api/links", `{"domain":""}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &App{MaxBodySize: tt.maxBodySize, requestRecords: make(map[string]*RequestInfo)}
+
+			recorder := httptest.NewRecorder()
+			InitRoutes(app).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body)))
+
+			if recorder.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d, body %s", recorder.Code, tt.wantCode, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandlerGetDomainLinksNormalizesDomain(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	tests := []struct {
+		name          string
+		domain        string
+		wantDomain    string
+		wantSubDomain string
+	}{
+		{"uppercase", "Example.COM", "example.com", ""},
+		{"trailing dot", "example.com.", "example.com", ""},
+		{"port", "example.com:8080", "example.com", ""},
+		{"whitespace", "  example.com ", "example.com", ""},
+		{"url with port", "HTTPS://Blog.Example.com:443/path", "example.com", "blog"},
+		{"uppercase subdomain with trailing dot", "Blog.Example.COM.", "example.com", "blog"},
+		{"domain starting with http", "httpexample.com", "httpexample.com", ""},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			app := &App{DB: mt.Client, Dbname: mt.DB.Name(), requestRecords: make(map[string]*RequestInfo)}
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+".links", mtest.FirstBatch))
+
+			body, _ := json.Marshal(APIRequest{Domain: &tt.domain})
+			recorder := httptest.NewRecorder()
+			InitRoutes(app).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/links", strings.NewReader(string(body))))
+
+			if recorder.Code != http.StatusOK {
+				mt.Fatalf("HandlerGetDomainLinks() status = %d, body %s", recorder.Code, recorder.Body.String())
+			}
+
+			filter := mt.GetStartedEvent().Command.Lookup("filter").Document()
+			if got := filter.Lookup("linkdomain").StringValue(); got != tt.wantDomain {
+				mt.Errorf("linkdomain filter = %q, want %q", got, tt.wantDomain)
+			}
+			subDomain, _ := filter.Lookup("linksubdomain").StringValueOK()
+			if subDomain != tt.wantSubDomain {
+				mt.Errorf("linksubdomain filter = %q, want %q", subDomain, tt.wantSubDomain)
+			}
+		})
+	}
+}
+
+func TestHandlerGetDomainLinksHasMore(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	tests := []struct {
+		name        string
+		rows        int
+		limit       int64
+		wantLinks   int
+		wantHasMore string
+	}{
+		{"under limit", 2, 3, 2, "false"},
+		{"exactly limit", 3, 3, 3, "false"},
+		{"over limit", 4, 3, 3, "true"},
+		{"more rows than fetched", 10, 3, 3, "true"},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			app := &App{DB: mt.Client, Dbname: mt.DB.Name(), requestRecords: make(map[string]*RequestInfo)}
+
+			rows := make([]bson.D, 0, tt.rows)
+			for _, row := range testLinkRows(tt.rows, 1) {
+				rows = append(rows, bson.D{
+					{Key: "linkdomain", Value: row.LinkDomain},
+					{Key: "linkpath", Value: row.LinkPath},
+					{Key: "linkscheme", Value: row.LinkScheme},
+					{Key: "pagehost", Value: row.PageHost},
+					{Key: "pagepath", Value: row.PagePath},
+					{Key: "qty", Value: row.Qty},
+				})
+			}
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+".links", mtest.FirstBatch, rows...))
+
+			domain := "example.com"
+			body, _ := json.Marshal(APIRequest{Domain: &domain, Limit: &tt.limit})
+			recorder := httptest.NewRecorder()
+			InitRoutes(app).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/links", strings.NewReader(string(body))))
+
+			var links []LinkOut
+			if err := json.Unmarshal(recorder.Body.Bytes(), &links); err != nil {
+				mt.Fatalf("Failed to decode response: %v", err)
+			}
+			if len(links) != tt.wantLinks {
+				mt.Errorf("HandlerGetDomainLinks() returned %d links, want %d", len(links), tt.wantLinks)
+			}
+			if got := recorder.Header().Get(hasMoreHeader); got != tt.wantHasMore {
+				mt.Errorf("%s = %q, want %q", hasMoreHeader, got, tt.wantHasMore)
+			}
+		})
+	}
+}
+
+func TestHandlerGetDomainLinksEdges(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"edges", `{"domain":"example.com","format":"edges"}`, http.StatusOK, `[{"source":"https://blog.net/post","target":"https://example.com/a","weight":5},{"source":"https://news.org/","target":"https://example.com/a","weight":1}]`},
+		{"default links", `{"domain":"example.com","format":""}`, http.StatusOK, ""},
+		{"unknown format", `{"domain":"example.com","format":"graphml"}`, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			app := &App{DB: mt.Client, Dbname: mt.DB.Name(), requestRecords: make(map[string]*RequestInfo)}
+			// the same link from blog.net with two anchors is one edge
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+".links", mtest.FirstBatch,
+				bson.D{{Key: "linkdomain", Value: "example.com"}, {Key: "linkpath", Value: "/a"}, {Key: "linkscheme", Value: "2"}, {Key: "pagehost", Value: "blog.net"}, {Key: "pagepath", Value: "/post"}, {Key: "pagescheme", Value: "2"}, {Key: "linktext", Value: "A"}, {Key: "qty", Value: 2}},
+				bson.D{{Key: "linkdomain", Value: "example.com"}, {Key: "linkpath", Value: "/a"}, {Key: "linkscheme", Value: "2"}, {Key: "pagehost", Value: "blog.net"}, {Key: "pagepath", Value: "/post"}, {Key: "pagescheme", Value: "2"}, {Key: "linktext", Value: "Read A"}, {Key: "qty", Value: 3}},
+				bson.D{{Key: "linkdomain", Value: "example.com"}, {Key: "linkpath", Value: "/a"}, {Key: "linkscheme", Value: "2"}, {Key: "pagehost", Value: "news.org"}, {Key: "pagepath", Value: "/"}, {Key: "pagescheme", Value: "2"}, {Key: "qty", Value: 1}},
+			))
+
+			recorder := httptest.NewRecorder()
+			InitRoutes(app).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/links", strings.NewReader(tt.body)))
+
+			if recorder.Code != tt.wantStatus {
+				mt.Fatalf("HandlerGetDomainLinks() status = %d, want %d, body %s", recorder.Code, tt.wantStatus, recorder.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if tt.wantBody != "" {
+				if got := recorder.Body.String(); got != tt.wantBody {
+					mt.Errorf("HandlerGetDomainLinks() = %s, want %s", got, tt.wantBody)
+				}
+				return
+			}
+			var links []LinkOut
+			if err := json.Unmarshal(recorder.Body.Bytes(), &links); err != nil || len(links) != 3 {
+				mt.Errorf("HandlerGetDomainLinks() = %s, %v, want 3 link objects", recorder.Body.String(), err)
+			}
+		})
+	}
+}
+
+func TestHandlerGetDomainDateCoverage(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantDates  []DateLinks
+	}{
+		{"coverage", `{"domain":"Example.com"}`, http.StatusOK, []DateLinks{{Date: "2023-01-28", FirstSeen: 2, LastSeen: 1}, {Date: "2023-05-30", LastSeen: 1}}},
+		{"no domain", `{}`, http.StatusBadRequest, nil},
+		{"invalid domain", `{"domain":"not a domain"}`, http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			app := &App{DB: mt.Client, Dbname: mt.DB.Name(), requestRecords: make(map[string]*RequestInfo)}
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+".links", mtest.FirstBatch, bson.D{
+				{Key: "links", Value: bson.A{bson.D{{Key: "links", Value: 2}}}},
+				{Key: "first_seen", Value: bson.A{bson.D{{Key: "_id", Value: "2023-01-28"}, {Key: "links", Value: 2}}}},
+				{Key: "last_seen", Value: bson.A{
+					bson.D{{Key: "_id", Value: "2023-01-28"}, {Key: "links", Value: 1}},
+					bson.D{{Key: "_id", Value: "2023-05-30"}, {Key: "links", Value: 1}},
+				}},
+			}))
+
+			recorder := httptest.NewRecorder()
+			InitRoutes(app).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/links/coverage", strings.NewReader(tt.body)))
+
+			if recorder.Code != tt.wantStatus {
+				mt.Fatalf("HandlerGetDomainDateCoverage() status = %d, want %d, body %s", recorder.Code, tt.wantStatus, recorder.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var coverage DomainDateCoverage
+			if err := json.Unmarshal(recorder.Body.Bytes(), &coverage); err != nil {
+				mt.Fatalf("Failed to decode response: %v", err)
+			}
+			if coverage.Domain != "example.com" || coverage.Links != 2 || len(coverage.Dates) != len(tt.wantDates) {
+				mt.Fatalf("HandlerGetDomainDateCoverage() = %+v, want %+v", coverage, tt.wantDates)
+			}
+			for i, date := range tt.wantDates {
+				if coverage.Dates[i] != date {
+					mt.Errorf("date %d = %+v, want %+v", i, coverage.Dates[i], date)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerReady(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	tests := []struct {
+		name       string
+		collection string
+		exists     bool
+		documents  int64
+		failed     bool
+		wantCode   int
+	}{
+		{name: "populated collection", exists: true, documents: 42, wantCode: http.StatusOK},
+		{name: "populated custom collection", collection: "links_cc2021", exists: true, documents: 7, wantCode: http.StatusOK},
+		{name: "empty collection", exists: true, wantCode: http.StatusServiceUnavailable},
+		{name: "missing collection", wantCode: http.StatusServiceUnavailable},
+		{name: "database error", failed: true, wantCode: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			app := &App{DB: mt.Client, Dbname: mt.DB.Name(), LinksCollection: tt.collection, requestRecords: make(map[string]*RequestInfo)}
+			wantCollection := tt.collection
+			if wantCollection == "" {
+				wantCollection = DefaultLinksCollection
+			}
+			switch {
+			case tt.failed:
+				mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 13, Message: "Unauthorized"}))
+			case tt.exists:
+				mt.AddMockResponses(
+					mtest.CreateCursorResponse(0, mt.DB.Name()+".$cmd.listCollections", mtest.FirstBatch, bson.D{{Key: "name", Value: wantCollection}}),
+					mtest.CreateSuccessResponse(bson.E{Key: "n", Value: tt.documents}),
+				)
+			default:
+				mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+".$cmd.listCollections", mtest.FirstBatch))
+			}
+
+			recorder := httptest.NewRecorder()
+			InitRoutes(app).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/ready", nil))
+
+			if recorder.Code != tt.wantCode {
+				mt.Fatalf("HandlerReady() status = %d, want %d, body %s", recorder.Code, tt.wantCode, recorder.Body.String())
+			}
+			if got := mt.GetStartedEvent().Command.Lookup("filter", "name").StringValue(); got != wantCollection {
+				mt.Errorf("listCollections name = %q, want %q", got, wantCollection)
+			}
+			if tt.failed {
+				return
+			}
+			var status LinksStatus
+			if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+				mt.Fatalf("Failed to decode response: %v", err)
+			}
+			want := LinksStatus{Database: mt.DB.Name(), Collection: wantCollection, Exists: tt.exists, Documents: tt.documents, Ready: tt.documents > 0}
+			if status != want {
+				mt.Errorf("HandlerReady() = %+v, want %+v", status, want)
+			}
+		})
+	}
+}
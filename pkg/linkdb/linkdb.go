@@ -6,31 +6,81 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
+// defaultMaxBodySize - request body limit used when App.MaxBodySize is not set
+const defaultMaxBodySize = 64 * 1024
+
+// maxCollectionNameLength - longer names are rejected, MongoDB limits namespace (database and collection) to 255 bytes
+const maxCollectionNameLength = 120
+
+// DefaultLinksCollection and DefaultPagesCollection - collections used when GLOBALLINKS_LINKSCOLLECTION and GLOBALLINKS_PAGESCOLLECTION are not set
+const (
+	DefaultLinksCollection = "links"
+	DefaultPagesCollection = "pages"
+)
+
+// DBConfig - database client timeouts and connection attempts at startup
+type DBConfig struct {
+	Timeout       time.Duration      // connect, server selection and single ping timeout
+	SocketTimeout time.Duration      // read and write timeout, longer than max query time
+	Attempts      int                // number of connection attempts at startup
+	RetryDelay    time.Duration      // delay after first failed attempt, doubled after every next one
+	ReadPref      *readpref.ReadPref // members of replica set used for queries, nil uses driver default (primary)
+}
+
+// DefaultDBConfig - database config used by linksapi
+var DefaultDBConfig = DBConfig{
+	Timeout:       5 * time.Second,
+	SocketTimeout: 70 * time.Second,
+	Attempts:      5,
+	RetryDelay:    time.Second,
+}
+
 type App struct {
-	DB             *mongo.Client
-	Dbname         string
-	requestRecords map[string]*RequestInfo
+	DB              *mongo.Client
+	Dbname          string
+	MaxBodySize     int64  // maximum size of request body in bytes, larger requests get 413
+	IncludeWww      bool   // default of APIRequest.IncludeWww
+	CaseSensitive   bool   // default of APIRequest.CaseSensitivePaths
+	LinksCollection string // collection with links, DefaultLinksCollection when empty
+	PagesCollection string // collection with pages, DefaultPagesCollection when empty
+	requestRecords  map[string]*RequestInfo
 }
 
 func InitServer(host string, port string, dbname string) {
-	db, err := InitDB("mongodb://" + host + ":" + port)
+	db, err := InitDB("mongodb://"+host+":"+port, setDBConfig())
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	requestRecords := make(map[string]*RequestInfo)
 
-	app := &App{DB: db, Dbname: dbname, requestRecords: requestRecords}
+	app := &App{
+		DB:              db,
+		Dbname:          dbname,
+		MaxBodySize:     setMaxBodySize(),
+		IncludeWww:      setIncludeWww(),
+		CaseSensitive:   setCaseSensitivePaths(),
+		LinksCollection: CollectionName("GLOBALLINKS_LINKSCOLLECTION", DefaultLinksCollection),
+		PagesCollection: CollectionName("GLOBALLINKS_PAGESCOLLECTION", DefaultPagesCollection),
+		requestRecords:  requestRecords,
+	}
+
+	// API started with wrong database name returns empty results for every domain, so it is reported at startup
+	logLinksStatus(app)
 
 	router := InitRoutes(app)
 
-	handlerWithCORS := enableCORS(router)
+	handlerWithCORS := serverHandler(router)
 
 	// start http server
 	if os.Getenv("GO_ENV") == "production" {
@@ -46,37 +96,201 @@ func InitServer(host string, port string, dbname string) {
 	}
 }
 
-func InitDB(connectionString string) (*mongo.Client, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// logLinksStatus - log number of links in database, missing or empty links collection is logged as warning
+func logLinksStatus(app *App) {
+	status, err := app.ControllerLinksStatus()
+	switch {
+	case err != nil:
+		log.Printf("WARNING: could not check links collection %s in database %s: %v", status.Collection, app.Dbname, err)
+	case !status.Exists:
+		log.Printf("WARNING: database %s has no links collection %s, API returns no links. Check database and collection name", app.Dbname, status.Collection)
+	case !status.Ready:
+		log.Printf("WARNING: links collection %s in database %s is empty, API returns no links until links are stored", status.Collection, app.Dbname)
+	default:
+		log.Printf("Database %s has about %d links in collection %s", app.Dbname, status.Documents, status.Collection)
+	}
+}
+
+// linksCollection - name of collection with links
+func (app *App) linksCollection() string {
+	if app.LinksCollection == "" {
+		return DefaultLinksCollection
+	}
+	return app.LinksCollection
+}
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(connectionString))
+// pagesCollection - name of collection with pages
+func (app *App) pagesCollection() string {
+	if app.PagesCollection == "" {
+		return DefaultPagesCollection
+	}
+	return app.PagesCollection
+}
+
+// CollectionName - collection name from envVar, defaultName when it is not set or is not a valid MongoDB collection name.
+// Used by API and storelinks, so both use the same collections
+func CollectionName(envVar string, defaultName string) string {
+	name := os.Getenv(envVar)
+	if name == "" {
+		return defaultName
+	}
+
+	if len(name) > maxCollectionNameLength || strings.ContainsAny(name, "$\x00") || strings.HasPrefix(name, "system.") {
+		log.Printf("Invalid collection name for %s: %q. Using default %s", envVar, name, defaultName)
+		return defaultName
+	}
+
+	return name
+}
+
+// setMaxBodySize sets the maximum size of request body in bytes
+func setMaxBodySize() int64 {
+	return envInt64("GLOBALLINKS_API_MAXBODYSIZE", defaultMaxBodySize, 1024, 10*1024*1024)
+}
+
+// setIncludeWww - GLOBALLINKS_API_INCLUDEWWW=true returns links to www subdomain for apex domain queries limited to exact host
+func setIncludeWww() bool {
+	return os.Getenv("GLOBALLINKS_API_INCLUDEWWW") == "true"
+}
+
+// setCaseSensitivePaths - GLOBALLINKS_API_CASESENSITIVEPATHS=true matches Link Path and Source Path filters case sensitive
+func setCaseSensitivePaths() bool {
+	return os.Getenv("GLOBALLINKS_API_CASESENSITIVEPATHS") == "true"
+}
+
+// setDBConfig sets database timeouts and number of connection attempts at startup
+func setDBConfig() DBConfig {
+	dbConfig := DefaultDBConfig
+	dbConfig.Timeout = time.Duration(envInt64("GLOBALLINKS_API_DBTIMEOUT", int64(DefaultDBConfig.Timeout/time.Second), 1, 60)) * time.Second
+	dbConfig.Attempts = int(envInt64("GLOBALLINKS_API_DBATTEMPTS", int64(DefaultDBConfig.Attempts), 1, 20))
+	dbConfig.ReadPref = setReadPreference()
+	return dbConfig
+}
+
+// setReadPreference sets replica set members used for queries: primary, primaryPreferred, secondary, secondaryPreferred or nearest
+func setReadPreference() *readpref.ReadPref {
+	envVar := "GLOBALLINKS_API_READPREFERENCE"
+	valStr := os.Getenv(envVar)
+	if valStr == "" {
+		return nil
+	}
+
+	mode, err := readpref.ModeFromString(valStr)
+	if err != nil {
+		log.Printf("Invalid read preference for %s: %v. Using default primary", envVar, err)
+		return nil
+	}
+
+	readPref, err := readpref.New(mode)
+	if err != nil {
+		log.Printf("Invalid read preference for %s: %v. Using default primary", envVar, err)
+		return nil
+	}
+
+	return readPref
+}
+
+// envInt64 - read number from environment variable, default value is used when it is not set or out of range
+func envInt64(envVar string, defaultVal int64, minVal int64, maxVal int64) int64 {
+	valStr := os.Getenv(envVar)
+	if valStr == "" {
+		return defaultVal
+	}
+
+	val, err := strconv.ParseInt(valStr, 10, 64)
+	if err != nil {
+		log.Printf("Invalid number for %s: %v. Using default %d", envVar, err, defaultVal)
+		return defaultVal
+	}
+
+	if val < minVal || val > maxVal {
+		log.Printf("Number for %s must be between %d and %d. Using default %d", envVar, minVal, maxVal, defaultVal)
+		return defaultVal
+	}
+
+	return val
+}
+
+// InitDB - connect to database, ping is retried with backoff so short database unavailability at startup is not fatal
+func InitDB(connectionString string, dbConfig DBConfig) (*mongo.Client, error) {
+	// connect does not wait for the server, it is checked with ping
+	client, err := mongo.Connect(context.Background(), newClientOptions(connectionString, dbConfig))
 	if err != nil {
 		return nil, err
 	}
 
-	// Pinging the database to check the connection can be done here
-	if err := client.Ping(ctx, nil); err != nil {
-		panic(err)
+	err = retryWithBackoff(dbConfig.Attempts, dbConfig.RetryDelay, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), dbConfig.Timeout)
+		defer cancel()
+		return client.Ping(ctx, nil)
+	})
+	if err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, fmt.Errorf("database is not available after %d attempts: %w", dbConfig.Attempts, err)
 	}
 
 	return client, nil
 }
 
-func enableCORS(next http.Handler) http.Handler {
+// newClientOptions - client options with timeouts and read preference from config
+func newClientOptions(connectionString string, dbConfig DBConfig) *options.ClientOptions {
+	clientOptions := options.Client().ApplyURI(connectionString).
+		SetConnectTimeout(dbConfig.Timeout).
+		SetServerSelectionTimeout(dbConfig.Timeout).
+		SetSocketTimeout(dbConfig.SocketTimeout)
+
+	if dbConfig.ReadPref != nil {
+		clientOptions.SetReadPreference(dbConfig.ReadPref)
+	}
+
+	return clientOptions
+}
+
+// retryWithBackoff - run fn until it succeeds, delay is doubled after every failed attempt
+func retryWithBackoff(attempts int, delay time.Duration, fn func() error) error {
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if attempt < attempts {
+			log.Printf("Attempt %d of %d failed: %v. Retrying in %s", attempt, attempts, err, delay)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return err
+}
+
+// serverHandler - router with CORS headers, request log and request ID, which is set first so every response and log line has it
+func serverHandler(router *mux.Router) http.Handler {
+	return withRequestID(logRequests(enableCORS(router)))
+}
+
+// enableCORS - set CORS headers, preflight request reports methods registered for the requested route
+func enableCORS(router *mux.Router) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Set CORS headers
 		w.Header().Set("Access-Control-Allow-Origin", "*") // allow any origin
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, "+requestIDHeader)
+		w.Header().Set("Access-Control-Expose-Headers", hasMoreHeader+", "+requestIDHeader)
 
 		// Check if the request is for CORS options
-		if r.Method == "OPTIONS" {
+		if r.Method == http.MethodOptions {
+			methods := allowedMethods(router, r)
+			if len(methods) == 0 {
+				respondError(w, r, NewHandlerError(ErrorNotFound, "Options", "Not found"))
+				return
+			}
+			allow := strings.Join(append(methods, http.MethodOptions), ", ")
+			w.Header().Set("Access-Control-Allow-Methods", allow)
+			w.Header().Set("Allow", allow)
 			// Just return with the headers, don't pass the request along
 			return
 		}
 
 		// Pass down the request to the next handler (or middleware)
-		next.ServeHTTP(w, r)
+		router.ServeHTTP(w, r)
 	})
 }
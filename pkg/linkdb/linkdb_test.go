@@ -0,0 +1,114 @@
+package linkdb
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+func TestRetryWithBackoff(t *testing.T) {
+	errDown := errors.New("database is down")
+
+	tests := []struct {
+		name         string
+		attempts     int
+		failures     int
+		wantErr      error
+		wantAttempts int
+	}{
+		{"available at once", 3, 0, nil, 1},
+		{"available after delay", 4, 2, nil, 3},
+		{"permanently down", 3, 10, errDown, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retryWithBackoff(tt.attempts, time.Millisecond, func() error {
+				calls++
+				if calls <= tt.failures {
+					return errDown
+				}
+				return nil
+			})
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("retryWithBackoff() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantAttempts {
+				t.Errorf("retryWithBackoff() attempts = %d, want %d", calls, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestInitDBUnavailable(t *testing.T) {
+	dbConfig := DBConfig{
+		Timeout:       100 * time.Millisecond,
+		SocketTimeout: 100 * time.Millisecond,
+		Attempts:      2,
+		RetryDelay:    10 * time.Millisecond,
+	}
+
+	client, err := InitDB("mongodb://127.0.0.1:1", dbConfig)
+	if err == nil {
+		t.Fatal("InitDB() expected error for unavailable database")
+	}
+	if client != nil {
+		t.Errorf("InitDB() client = %v, want nil", client)
+	}
+}
+
+func TestSetDBConfigReadPreference(t *testing.T) {
+	tests := []struct {
+		value string
+		want  readpref.Mode
+	}{
+		{"", readpref.PrimaryMode},
+		{"primary", readpref.PrimaryMode},
+		{"secondaryPreferred", readpref.SecondaryPreferredMode},
+		{"nearest", readpref.NearestMode},
+		{"fastest", readpref.PrimaryMode},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("GLOBALLINKS_API_READPREFERENCE", tt.value)
+
+			clientOptions := newClientOptions("mongodb://localhost:27017", setDBConfig())
+			mode := readpref.PrimaryMode
+			if clientOptions.ReadPreference != nil {
+				mode = clientOptions.ReadPreference.Mode()
+			}
+			if mode != tt.want {
+				t.Errorf("ReadPreference = %v, want %v", mode, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectionName(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"not set", "", DefaultLinksCollection},
+		{"archive collection", "links_CC-MAIN-2021-04", "links_CC-MAIN-2021-04"},
+		{"dollar sign", "links$", DefaultLinksCollection},
+		{"system collection", "system.users", DefaultLinksCollection},
+		{"too long", strings.Repeat("l", maxCollectionNameLength+1), DefaultLinksCollection},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GLOBALLINKS_LINKSCOLLECTION", tt.value)
+			if got := CollectionName("GLOBALLINKS_LINKSCOLLECTION", DefaultLinksCollection); got != tt.want {
+				t.Errorf("CollectionName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -15,26 +15,110 @@ type LinkRow struct {
 	PagePath      string `json:"page_path"`
 	PageRawQuery  string `json:"page_raw_query"`
 	PageScheme    string `json:"page_scheme"`
+	PageDomain    string `json:"page_domain"` // registered domain of page host, empty for links stored before it was added
 	LinkText      string `json:"link_text"`
 	NoFollow      int    `json:"no_follow"`
-	NoIndex       int    `json:"no_index"`
+	PageNoIndex   int    `json:"page_no_index" bson:"noindex"` // noindex of source page
 	DateFrom      string `json:"date_from"`
 	DateTo        string `json:"date_to"`
 	IP            string `json:"ip"`
 	Qty           int    `json:"qty"`
+	LinkType      string `json:"link_type"`
+	LinkTitle     string `json:"link_title"`
+	PageTitle     string `json:"page_title"`
 }
 
 // LinkOut - link output
 type LinkOut struct {
-	LinkUrl  string   `json:"link_url"`
-	PageUrl  string   `json:"page_url"`
-	LinkText string   `json:"link_text"`
-	NoFollow int      `json:"no_follow"`
-	NoIndex  int      `json:"no_index"`
-	DateFrom string   `json:"date_from"`
-	DateTo   string   `json:"date_to"`
-	IP       []string `json:"ip"`
-	Qty      int      `json:"qty"`
+	LinkUrl     string   `json:"link_url"`
+	PageUrl     string   `json:"page_url"`
+	PageDomain  string   `json:"page_domain"`
+	LinkText    string   `json:"link_text"`
+	NoFollow    int      `json:"no_follow"`     // rel nofollow of the link or robots nofollow of source page
+	PageNoIndex int      `json:"page_no_index"` // robots noindex of source page, links have no noindex of their own
+	NoIndex     int      `json:"no_index"`      // Deprecated: the same as page_no_index, kept for existing clients
+	DateFrom    string   `json:"date_from"`
+	DateTo      string   `json:"date_to"`
+	IP          []string `json:"ip"`
+	Qty         int      `json:"qty"`
+	LinkType    string   `json:"link_type,omitempty"`  // empty for <a> links, rel of <link> element for links from page head
+	LinkTitle   string   `json:"link_title,omitempty"` // title attribute of link, empty when link has no title
+	PageTitle   string   `json:"page_title,omitempty"` // title of source page, empty when importer did not save it
+}
+
+// LinkEdge - edge of link graph from source page to link url, weight is qty of all merged links between them
+type LinkEdge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Weight int    `json:"weight"`
+}
+
+// LinkDetail - one link from one source page with all its crawls, sum of qty, all ips and the widest date span
+type LinkDetail struct {
+	LinkUrl    string      `json:"link_url"`
+	PageUrl    string      `json:"page_url"`
+	PageDomain string      `json:"page_domain"`
+	PageTitle  string      `json:"page_title,omitempty"` // title of source page from the latest crawl which saved it
+	NoFollow   int         `json:"no_follow"`            // nofollow of the latest crawl
+	DateFrom   string      `json:"date_from"`            // the first crawl
+	DateTo     string      `json:"date_to"`              // the latest crawl
+	IP         []string    `json:"ip"`
+	Qty        int         `json:"qty"`
+	Crawls     []LinkCrawl `json:"crawls"` // stored rows of the link ordered by date
+}
+
+// LinkCrawl - link seen in one imported segment
+type LinkCrawl struct {
+	DateFrom    string `json:"date_from"`
+	DateTo      string `json:"date_to"`
+	IP          string `json:"ip"`
+	LinkText    string `json:"link_text"`
+	NoFollow    int    `json:"no_follow"`
+	PageNoIndex int    `json:"page_no_index"`
+	Qty         int    `json:"qty"`
+}
+
+// DomainDateCoverage - links to domain by crawl date, shows which crawls contributed links and gaps between them
+type DomainDateCoverage struct {
+	Domain   string      `json:"domain"`
+	DateFrom string      `json:"date_from"` // the first crawl with links to domain
+	DateTo   string      `json:"date_to"`   // the latest crawl with links to domain
+	Links    int         `json:"links"`     // stored link rows matching the request
+	Dates    []DateLinks `json:"dates"`     // crawl dates where links were first or last seen ordered by date
+}
+
+// DateLinks - number of link rows first and last seen on crawl date, rows seen before and after it are not counted
+type DateLinks struct {
+	Date      string `json:"date"`
+	FirstSeen int    `json:"first_seen"` // link rows with date_from on crawl date
+	LastSeen  int    `json:"last_seen"`  // link rows with date_to on crawl date
+}
+
+// PageRow - page row loaded from page file
+type PageRow struct {
+	Host          string `json:"host"`
+	Path          string `json:"path"`
+	RawQuery      string `json:"raw_query"`
+	Scheme        string `json:"scheme"`
+	Title         string `json:"title"`
+	IP            string `json:"ip"`
+	Imported      string `json:"imported"`
+	InternalLinks int    `json:"internal_links"`
+	ExternalLinks int    `json:"external_links"`
+	NoIndex       int    `json:"no_index"`
+	Language      string `json:"language"`
+}
+
+// PageOut - page output
+type PageOut struct {
+	PageUrl       string `json:"page_url"`
+	Title         string `json:"title"`
+	IP            string `json:"ip"`
+	Imported      string `json:"imported"`
+	InternalLinks int    `json:"internal_links"`
+	ExternalLinks int    `json:"external_links"`
+	NoIndex       int    `json:"no_index"`
+	Language      string `json:"language"`
 }
 
 type ApiRequestFilter struct {
@@ -50,6 +134,19 @@ type APIRequest struct {
 	Order   *string             `json:"order,omitempty"`
 	Page    *int64              `json:"page,omitempty"`
 	Filters *[]ApiRequestFilter `json:"filters,omitempty"`
+	// IncludeSubdomains - not set: apex domain returns links to all subdomains, subdomain returns only its links
+	// true: links to all subdomains of registered domain, false: links only to the exact host, also for apex domain
+	IncludeSubdomains *bool `json:"include_subdomains,omitempty"`
+	// IncludeWww - links only to apex domain (include_subdomains false) include links to www subdomain, not set uses default of API
+	IncludeWww *bool `json:"include_www,omitempty"`
+	// CaseSensitivePaths - Link Path and Source Path filters match /Page and /page as different paths, not set uses default of API
+	CaseSensitivePaths *bool `json:"case_sensitive_paths,omitempty"`
+	// ExternalOnly - skip links from pages of the same registered domain, kept when parser saved them or archives were merged
+	ExternalOnly *bool `json:"external_only,omitempty"`
+	// ExcludeHomepage - skip links to homepage (path / without query), they are the most common and the least informative links
+	ExcludeHomepage *bool `json:"exclude_homepage,omitempty"`
+	// Format - "links" (default) returns link objects, "edges" returns source page to link edges for graph tools
+	Format *string `json:"format,omitempty"`
 	/*
 		NoFollow  *int    `json:"no_follow,omitempty"`
 		TextExact *string `json:"text_exact,omitempty"`
@@ -57,10 +154,30 @@ type APIRequest struct {
 	*/
 }
 
+// APIPageRequest - page request, url can be sent in json body or as url query parameter
+type APIPageRequest struct {
+	URL *string `json:"url,omitempty"`
+}
+
+// APILinkRequest - link request, urls can be sent in json body or as url query parameters
+type APILinkRequest struct {
+	PageURL *string `json:"page_url,omitempty"`
+	LinkURL *string `json:"link_url,omitempty"`
+}
+
+// APIPageSearchRequest - search pages by title within domain
+type APIPageSearchRequest struct {
+	Domain *string `json:"domain,omitempty"`
+	Title  *string `json:"title,omitempty"`
+	Limit  *int64  `json:"limit,omitempty"`
+	Page   *int64  `json:"page,omitempty"`
+}
+
 type ApiError struct {
 	ErrorCode string `json:"errorCode"`
 	Function  string `json:"function"`
 	Error     string `json:"error"`
+	RequestID string `json:"requestId,omitempty"` // X-Request-ID of the request, the same as in response header and logs
 }
 
 // RequestInfo - request info used to count requests in a period of time
@@ -68,3 +185,12 @@ type RequestInfo struct {
 	FirstRequestTime time.Time
 	RequestCount     int
 }
+
+// LinksStatus - links collection of API database, missing or empty collection usually means API is pointed at wrong database
+type LinksStatus struct {
+	Database   string `json:"database"`
+	Collection string `json:"collection"`
+	Exists     bool   `json:"exists"`
+	Documents  int64  `json:"documents"` // estimated number of links
+	Ready      bool   `json:"ready"`     // collection has links
+}
@@ -1,7 +1,16 @@
 package linkdb
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
 	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/kris-dev-hub/globallinks/pkg/healthcheck"
@@ -9,7 +18,9 @@ import (
 
 func InitRoutes(app *App) *mux.Router {
 	router := mux.NewRouter()
+	router.Use(app.limitBodySize)
 	router = app.LinkdbApiRoutes(router)
+	router.MethodNotAllowedHandler = methodNotAllowedHandler(router)
 	return router
 }
 
@@ -20,6 +31,12 @@ func (app *App) LinkdbApiRoutes(router *mux.Router) *mux.Router {
 	//   200:
 	//   500:
 	router.HandleFunc("/api/health", healthcheck.HealthResponse).Methods(http.MethodGet)
+	// swagger:route GET /api/ready health Ready
+	// Returns status of links collection
+	// responses:
+	//   200: Links collection has links
+	//   503: Links collection is missing or empty
+	router.HandleFunc("/api/ready", app.HandlerReady).Methods(http.MethodGet)
 	// swagger:route POST /api/transaction transactions AddTransaction
 	// Adds a transaction
 	// responses:
@@ -27,5 +44,155 @@ func (app *App) LinkdbApiRoutes(router *mux.Router) *mux.Router {
 	//   400: Bad Request
 	//   500:
 	router.HandleFunc("/api/links", app.HandlerGetDomainLinks).Methods(http.MethodPost)
+	// swagger:route POST /api/links/coverage links GetDomainDateCoverage
+	// Returns number of links to domain first and last seen on every crawl date, request takes the same domain options and filters as /api/links
+	// responses:
+	//   200: Date Coverage Response on success
+	//   400: Bad Request
+	//   500:
+	router.HandleFunc("/api/links/coverage", app.HandlerGetDomainDateCoverage).Methods(http.MethodPost)
+	// swagger:route GET /api/page pages GetPage
+	// Returns page info loaded from page files, url is sent as query parameter or in POST body
+	// responses:
+	//   200: Page Response on success
+	//   400: Bad Request
+	//   404: Page Not Found
+	//   500:
+	router.HandleFunc("/api/page", app.HandlerGetPage).Methods(http.MethodGet, http.MethodPost)
+	// swagger:route GET /api/link links GetLink
+	// Returns one link from source page with all its crawls, urls are sent as query parameters or in POST body
+	// responses:
+	//   200: Link Detail Response on success
+	//   400: Bad Request
+	//   404: Link Not Found
+	//   500:
+	router.HandleFunc("/api/link", app.HandlerGetLink).Methods(http.MethodGet, http.MethodPost)
+	// swagger:route POST /api/pages/search pages SearchPages
+	// Returns pages from domain with title containing given text
+	// responses:
+	//   200: Pages Response on success
+	//   400: Bad Request
+	//   500:
+	router.HandleFunc("/api/pages/search", app.HandlerSearchPages).Methods(http.MethodPost)
 	return router
 }
+
+// allowedMethods - methods registered for routes matching request path, empty when path is unknown
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+	var methods []string
+	_ = router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		pathRegexp, err := route.GetPathRegexp()
+		if err != nil {
+			return nil
+		}
+		pathMatch, err := regexp.MatchString(pathRegexp, r.URL.Path)
+		if err != nil || !pathMatch {
+			return nil
+		}
+		routeMethods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range routeMethods {
+			if !slices.Contains(methods, method) {
+				methods = append(methods, method)
+			}
+		}
+		return nil
+	})
+	return methods
+}
+
+// methodNotAllowedHandler - return 405 with Allow header listing methods registered for the path
+func methodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", strings.Join(append(allowedMethods(router, r), http.MethodOptions), ", "))
+		respondError(w, r, NewHandlerError(ErrorMethodNotAllowed, "MethodNotAllowed", "Method not allowed"))
+	})
+}
+
+// limitBodySize - limit size of request body for all routes, handlers return 413 when the limit is reached
+func (app *App) limitBodySize(next http.Handler) http.Handler {
+	maxBodySize := app.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMaxBodySize
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestIDHeader - header with correlation ID of request, sent back in response and written to logs
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength - longer request IDs sent by clients are replaced with generated ones
+const maxRequestIDLength = 128
+
+// requestIDKey - context key of request ID
+type requestIDKey struct{}
+
+// withRequestID - use X-Request-ID of the request or generate new one, save it in request context and response header
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !isValidRequestID(requestID) {
+			requestID = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID)))
+	})
+}
+
+// RequestIDFromContext - request ID saved by request ID middleware, empty when there is none
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// isValidRequestID - not empty, not too long and only printable ASCII, so it is safe to write it to logs and headers
+func isValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] < '!' || requestID[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID - random 128 bit ID in hex
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		// crypto/rand does not fail on supported platforms, time keeps IDs unique enough for logs
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// statusRecorder - response writer remembering status of response for request log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader - remember status and send it
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// logRequests - log method, path, status, duration and request ID of every request
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		log.Printf("%s %s %d %s request_id=%s", r.Method, r.URL.Path, recorder.status, time.Since(start).Round(time.Microsecond), RequestIDFromContext(r.Context()))
+	})
+}
@@ -0,0 +1,102 @@
+package linkdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouteMethods(t *testing.T) {
+	app := &App{requestRecords: make(map[string]*RequestInfo)}
+	handler := enableCORS(InitRoutes(app))
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		wantCode    int
+		wantMethods string
+		wantAllow   string
+	}{
+		{"preflight links", http.MethodOptions, "/api/links", http.StatusOK, "POST, OPTIONS", "POST, OPTIONS"},
+		{"preflight page", http.MethodOptions, "/api/page?url=example.com", http.StatusOK, "GET, POST, OPTIONS", "GET, POST, OPTIONS"},
+		{"preflight health", http.MethodOptions, "/api/health", http.StatusOK, "GET, OPTIONS", "GET, OPTIONS"},
+		{"preflight unknown route", http.MethodOptions, "/api/unknown", http.StatusNotFound, "", ""},
+		{"get links not allowed", http.MethodGet, "/api/links", http.StatusMethodNotAllowed, "", "POST, OPTIONS"},
+		{"delete page not allowed", http.MethodDelete, "/api/page", http.StatusMethodNotAllowed, "", "GET, POST, OPTIONS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.target, nil))
+
+			if recorder.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.wantCode)
+			}
+			if got := recorder.Header().Get("Access-Control-Allow-Methods"); got != tt.wantMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, tt.wantMethods)
+			}
+			if got := recorder.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			if got := recorder.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+				t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	app := &App{requestRecords: make(map[string]*RequestInfo)}
+	handler := serverHandler(InitRoutes(app))
+
+	tests := []struct {
+		name      string
+		requestID string
+		wantSame  bool
+	}{
+		{"generated when missing", "", false},
+		{"provided one is echoed", "lb-7f3a9c", true},
+		{"invalid one is replaced", "bad id\n", false},
+		{"too long one is replaced", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 404 error response of unknown route has the ID in header and body
+			request := httptest.NewRequest(http.MethodOptions, "/api/unknown", nil)
+			if tt.requestID != "" {
+				request.Header.Set(requestIDHeader, tt.requestID)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			requestID := recorder.Header().Get(requestIDHeader)
+			if !isValidRequestID(requestID) {
+				t.Fatalf("%s = %q, want valid request ID", requestIDHeader, requestID)
+			}
+			if (requestID == tt.requestID) != tt.wantSame {
+				t.Errorf("%s = %q, sent %q, want echoed %v", requestIDHeader, requestID, tt.requestID, tt.wantSame)
+			}
+
+			var apiError ApiError
+			if err := json.Unmarshal(recorder.Body.Bytes(), &apiError); err != nil {
+				t.Fatalf("Failed to decode error response: %v", err)
+			}
+			if apiError.RequestID != requestID {
+				t.Errorf("ApiError.RequestID = %q, want %q", apiError.RequestID, requestID)
+			}
+		})
+	}
+
+	// every request gets its own ID
+	first, second := httptest.NewRecorder(), httptest.NewRecorder()
+	handler.ServeHTTP(first, httptest.NewRequest(http.MethodGet, "/api/links", nil))
+	handler.ServeHTTP(second, httptest.NewRequest(http.MethodGet, "/api/links", nil))
+	if first.Header().Get(requestIDHeader) == second.Header().Get(requestIDHeader) {
+		t.Errorf("generated request IDs are the same: %q", first.Header().Get(requestIDHeader))
+	}
+}
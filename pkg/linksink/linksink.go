@@ -0,0 +1,152 @@
+/*
+Package linksink - publish links found by the importer to message broker, next to link files
+*/
+package linksink
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+)
+
+// Publisher - message broker client used by BrokerSink
+type Publisher interface {
+	// Publish - send message to subject, message can be buffered by client
+	Publish(subject string, data []byte) error
+	// Flush - wait until broker received all buffered messages
+	Flush() error
+	Close() error
+}
+
+// Config - broker sink settings
+type Config struct {
+	Subject    string        // subject or topic links are published to
+	BatchSize  int           // number of links buffered before they are published
+	MaxRetries int           // number of retries of failed publish or flush
+	RetryDelay time.Duration // delay before first retry, doubled with every next retry
+}
+
+// DefaultConfig - default broker sink settings
+var DefaultConfig = Config{
+	Subject:    "globallinks.links",
+	BatchSize:  1000,
+	MaxRetries: 3,
+	RetryDelay: time.Second,
+}
+
+// BrokerSink - publish links in batches, every message is one line of link file without new line.
+// Safe for use from many parsing goroutines
+type BrokerSink struct {
+	publisher Publisher
+	config    Config
+	mu        sync.Mutex // guards batch and published, it is not held while batch is published
+	publishMu sync.Mutex // one batch is published at a time, parsers add links to the next batch meanwhile
+	batch     [][]byte
+	published int
+}
+
+// NewBrokerSink - create sink publishing to publisher
+func NewBrokerSink(publisher Publisher, config Config) *BrokerSink {
+	config.BatchSize = max(config.BatchSize, 1)
+	config.MaxRetries = max(config.MaxRetries, 0)
+
+	return &BrokerSink{
+		publisher: publisher,
+		config:    config,
+		batch:     make([][]byte, 0, config.BatchSize),
+	}
+}
+
+// Emit - add link to batch and publish the batch when it is full, can be used as commoncrawl.LinkEmitter
+func (s *BrokerSink) Emit(link commoncrawl.FileLink, page commoncrawl.FilePage) error {
+	s.mu.Lock()
+	s.batch = append(s.batch, []byte(strings.TrimSuffix(commoncrawl.EncodeLink(link, page), "\n")))
+	full := len(s.batch) >= s.config.BatchSize
+	s.mu.Unlock()
+
+	if !full {
+		return nil
+	}
+
+	return s.publishBatch()
+}
+
+// Flush - publish buffered links and wait until broker received them, including links of batch published by other goroutine
+func (s *BrokerSink) Flush() error {
+	return s.publishBatch()
+}
+
+// Close - flush buffered links and close publisher
+func (s *BrokerSink) Close() error {
+	err := s.Flush()
+	if err != nil {
+		_ = s.publisher.Close()
+		return err
+	}
+
+	return s.publisher.Close()
+}
+
+// Published - number of links received by broker
+func (s *BrokerSink) Published() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.published
+}
+
+// publishBatch - publish all links from batch and flush publisher, waiting for flush keeps parser from running ahead of slow broker.
+// Links already accepted by publisher are not sent again on retry, links of failed batch are kept for next publish
+func (s *BrokerSink) publishBatch() error {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+
+	s.mu.Lock()
+	batch := s.batch
+	s.batch = make([][]byte, 0, s.config.BatchSize)
+	s.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	sent := 0
+	err := s.retry(func() error {
+		for sent < len(batch) {
+			if err := s.publisher.Publish(s.config.Subject, batch[sent]); err != nil {
+				return err
+			}
+			sent++
+		}
+		return s.publisher.Flush()
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.batch = append(batch, s.batch...)
+		return fmt.Errorf("failed to publish %d links: %w", len(batch)-sent, err)
+	}
+	s.published += len(batch)
+
+	return nil
+}
+
+// retry - run fn until it succeeds or MaxRetries is reached, delay is doubled after every failed attempt. It sleeps without
+// holding mu, so parsers are not blocked by slow broker until their batch is full
+func (s *BrokerSink) retry(fn func() error) error {
+	delay := s.config.RetryDelay
+
+	err := fn()
+	for attempt := 0; err != nil && attempt < s.config.MaxRetries; attempt++ {
+		time.Sleep(delay)
+		delay *= 2
+		err = fn()
+	}
+
+	return err
+}
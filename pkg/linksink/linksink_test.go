@@ -0,0 +1,254 @@
+package linksink
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/kris-dev-hub/globallinks/pkg/commoncrawl"
+	"github.com/kris-dev-hub/globallinks/pkg/fileutils"
+)
+
+// memoryPublisher - in memory broker, fails first failPublish publishes
+type memoryPublisher struct {
+	failPublish int
+	messages    []string
+	subjects    map[string]int
+	flushes     int
+	closed      bool
+}
+
+func newMemoryPublisher(failPublish int) *memoryPublisher {
+	return &memoryPublisher{failPublish: failPublish, subjects: map[string]int{}}
+}
+
+func (p *memoryPublisher) Publish(subject string, data []byte) error {
+	if p.failPublish > 0 {
+		p.failPublish--
+		return errors.New("broker unavailable")
+	}
+	p.messages = append(p.messages, string(data))
+	p.subjects[subject]++
+	return nil
+}
+
+func (p *memoryPublisher) Flush() error {
+	p.flushes++
+	return nil
+}
+
+func (p *memoryPublisher) Close() error {
+	p.closed = true
+	return nil
+}
+
+func testConfig(batchSize int, maxRetries int) Config {
+	return Config{Subject: "test.links", BatchSize: batchSize, MaxRetries: maxRetries, RetryDelay: time.Millisecond}
+}
+
+func testLink(path string) (commoncrawl.FileLink, commoncrawl.FilePage) {
+	link := commoncrawl.FileLink{
+		LinkHost:   "example.com",
+		LinkPath:   path,
+		LinkScheme: "2",
+		LinkText:   "Example",
+		Imported:   "2023-02-04",
+		IP:         "1.2.3.4",
+		LinkDomain: "example.com",
+		LinkType:   "A",
+	}
+	page := commoncrawl.FilePage{Host: "blog.net", Path: "/post", Scheme: "2", IP: "1.2.3.4", Imported: "2023-02-04"}
+	return link, page
+}
+
+func TestBrokerSink(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        Config
+		failPublish   int
+		links         int
+		flush         bool
+		wantPublished int
+		wantFlushes   int
+		wantErr       bool
+	}{
+		{name: "flush publishes all links", config: testConfig(10, 0), links: 3, flush: true, wantPublished: 3, wantFlushes: 1},
+		{name: "full batch is published without flush", config: testConfig(2, 0), links: 5, wantPublished: 4, wantFlushes: 2},
+		{name: "retry after transient failures", config: testConfig(10, 3), failPublish: 2, links: 3, flush: true, wantPublished: 3, wantFlushes: 1},
+		{name: "error after max retries", config: testConfig(10, 2), failPublish: 3, links: 3, flush: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := newMemoryPublisher(tt.failPublish)
+			sink := NewBrokerSink(publisher, tt.config)
+
+			var err error
+			for i := 0; i < tt.links && err == nil; i++ {
+				err = sink.Emit(testLink("/" + string(rune('a'+i))))
+			}
+			if err == nil && tt.flush {
+				err = sink.Flush()
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BrokerSink error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if sink.Published() != tt.wantPublished || len(publisher.messages) != tt.wantPublished {
+				t.Errorf("Published() = %d, messages = %d, want %d", sink.Published(), len(publisher.messages), tt.wantPublished)
+			}
+			if publisher.flushes != tt.wantFlushes {
+				t.Errorf("flushes = %d, want %d", publisher.flushes, tt.wantFlushes)
+			}
+			if publisher.subjects[tt.config.Subject] != tt.wantPublished {
+				t.Errorf("messages on %s = %d, want %d", tt.config.Subject, publisher.subjects[tt.config.Subject], tt.wantPublished)
+			}
+		})
+	}
+}
+
+func TestBrokerSinkClose(t *testing.T) {
+	publisher := newMemoryPublisher(0)
+	sink := NewBrokerSink(publisher, testConfig(10, 0))
+
+	if err := sink.Emit(testLink("/a")); err != nil {
+		t.Fatalf("Emit() error = %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if len(publisher.messages) != 1 || !publisher.closed {
+		t.Errorf("Close() messages = %d, closed = %v, want 1 message and closed publisher", len(publisher.messages), publisher.closed)
+	}
+}
+
+// blockingPublisher - broker which accepts messages only after release is closed
+type blockingPublisher struct {
+	memoryPublisher
+	publishing chan struct{}
+	release    chan struct{}
+}
+
+func (p *blockingPublisher) Publish(subject string, data []byte) error {
+	select {
+	case p.publishing <- struct{}{}:
+	default:
+	}
+	<-p.release
+	return p.memoryPublisher.Publish(subject, data)
+}
+
+// TestBrokerSinkEmitWhilePublishing - links are added to the next batch while slow broker receives the previous one
+func TestBrokerSinkEmitWhilePublishing(t *testing.T) {
+	publisher := &blockingPublisher{memoryPublisher: *newMemoryPublisher(0), publishing: make(chan struct{}), release: make(chan struct{})}
+	sink := NewBrokerSink(publisher, testConfig(10, 0))
+
+	if err := sink.Emit(testLink("/a")); err != nil {
+		t.Fatalf("Emit() error = %v", err)
+	}
+	flushed := make(chan error)
+	go func() {
+		flushed <- sink.Flush()
+	}()
+	<-publisher.publishing
+
+	emitted := make(chan error)
+	go func() {
+		emitted <- sink.Emit(testLink("/b"))
+	}()
+	select {
+	case err := <-emitted:
+		if err != nil {
+			t.Fatalf("Emit() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Emit() blocked while batch was published")
+	}
+
+	close(publisher.release)
+	if err := <-flushed; err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if sink.Published() != 2 || len(publisher.messages) != 2 {
+		t.Errorf("Published() = %d, messages = %d, want 2", sink.Published(), len(publisher.messages))
+	}
+}
+
+// TestBrokerSinkFailedBatchKept - links of batch which failed all retries are published with the next flush
+func TestBrokerSinkFailedBatchKept(t *testing.T) {
+	publisher := newMemoryPublisher(2)
+	sink := NewBrokerSink(publisher, testConfig(10, 1))
+
+	for _, path := range []string{"/a", "/b"} {
+		if err := sink.Emit(testLink(path)); err != nil {
+			t.Fatalf("Emit() error = %v", err)
+		}
+	}
+	if err := sink.Flush(); err == nil {
+		t.Fatal("Flush() error = nil, want error after max retries")
+	}
+	if err := sink.Emit(testLink("/c")); err != nil {
+		t.Fatalf("Emit() error = %v", err)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if sink.Published() != 3 || len(publisher.messages) != 3 {
+		t.Errorf("Published() = %d, messages = %d, want 3", sink.Published(), len(publisher.messages))
+	}
+}
+
+// TestBrokerSinkWatFile - links published while parsing WAT file are the same as lines of link file
+func TestBrokerSinkWatFile(t *testing.T) {
+	tempDir := t.TempDir()
+	watFile := filepath.Join(tempDir, "test.warc.wat.gz")
+	linkFile := filepath.Join(tempDir, "test.txt.gz")
+
+	fixtures := []commoncrawl.WatFixture{
+		{
+			URL:  "https://blog.net/post",
+			IP:   "1.2.3.4",
+			Date: time.Date(2023, 2, 4, 10, 0, 0, 0, time.UTC),
+			HTML: `<title>Post</title><a href="https://example.com/a">Example A</a><a href="https://www.example.com/b" rel="nofollow">B</a>`,
+		},
+		{
+			URL:  "https://news.org/list",
+			IP:   "1.2.3.5",
+			Date: time.Date(2023, 2, 4, 11, 0, 0, 0, time.UTC),
+			HTML: `<title>News</title><a href="https://other.org/">Other</a>`,
+		},
+	}
+	if err := commoncrawl.WriteWatFile(watFile, fixtures); err != nil {
+		t.Fatalf("WriteWatFile() error = %v", err)
+	}
+
+	publisher := newMemoryPublisher(0)
+	sink := NewBrokerSink(publisher, testConfig(2, 0))
+	if _, err := commoncrawl.ParseWatFileWithEmitter(watFile, linkFile, "", false, sink.Emit); err != nil {
+		t.Fatalf("ParseWatFileWithEmitter() error = %v", err)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	lines, err := fileutils.ReadGZFileByLine(linkFile)
+	if err != nil {
+		t.Fatalf("ReadGZFileByLine() error = %v", err)
+	}
+	slices.Sort(lines)
+	messages := slices.Clone(publisher.messages)
+	slices.Sort(messages)
+
+	if len(lines) != 3 || !reflect.DeepEqual(messages, lines) {
+		t.Errorf("published messages =\n%v\nwant link file lines\n%v", messages, lines)
+	}
+}
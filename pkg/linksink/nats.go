@@ -0,0 +1,43 @@
+package linksink
+
+import (
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsFlushTimeout - maximum time of waiting for NATS server to confirm published batch
+const natsFlushTimeout = 30 * time.Second
+
+// natsPublisher - Publisher sending links to NATS server
+type natsPublisher struct {
+	conn *nats.Conn
+}
+
+// NewNATSPublisher - connect to NATS server, url can list many servers separated by comma
+func NewNATSPublisher(url string) (Publisher, error) {
+	conn, err := nats.Connect(url, nats.Name("globallinks importer"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+
+	return &natsPublisher{conn: conn}, nil
+}
+
+func (p *natsPublisher) Publish(subject string, data []byte) error {
+	return p.conn.Publish(subject, data)
+}
+
+func (p *natsPublisher) Flush() error {
+	return p.conn.FlushTimeout(natsFlushTimeout)
+}
+
+func (p *natsPublisher) Close() error {
+	err := p.conn.Drain()
+	if err != nil {
+		p.conn.Close()
+		return err
+	}
+
+	return nil
+}